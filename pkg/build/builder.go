@@ -1,22 +1,27 @@
 package build
 
 import (
-	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"fmt"
-	"html/template"
 	"io"
 	"io/ioutil"
 	"os"
 	"strings"
 	"time"
 
-	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/build/package/formats"
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/codec"
+	"github.com/tinyzimmer/k3p/pkg/crypt"
+	"github.com/tinyzimmer/k3p/pkg/delta"
 	"github.com/tinyzimmer/k3p/pkg/images"
 	"github.com/tinyzimmer/k3p/pkg/log"
 	"github.com/tinyzimmer/k3p/pkg/parser"
+	"github.com/tinyzimmer/k3p/pkg/requirements"
+	"github.com/tinyzimmer/k3p/pkg/sbom"
+	"github.com/tinyzimmer/k3p/pkg/split"
 	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/unpack"
 	"github.com/tinyzimmer/k3p/pkg/util"
 )
 
@@ -29,18 +34,44 @@ func NewBuilder() (types.Builder, error) {
 		return nil, err
 	}
 	log.Debug("Using temporary build directory:", tmpDir)
-	return &builder{writer: v1.New(tmpDir)}, nil
+	return &builder{workDir: tmpDir}, nil
 }
 
 // builder implements the Builder interface.
 type builder struct {
 	// the directory for storing temporary assets during the build
+	workDir string
+	// the package being built, created in workDir when the build starts
 	writer types.Package
 }
 
+// newPackage returns a package writer in the given directory, producing a reproducible archive
+// when the options ask for one.
+func newPackage(dir string, opts *types.BuildOptions) types.Package {
+	if opts.SourceDate != nil {
+		return v2.NewReproducible(dir, *opts.SourceDate)
+	}
+	return v2.New(dir)
+}
+
 func (b *builder) Build(opts *types.BuildOptions) error {
+	b.writer = newPackage(b.workDir, opts)
 	defer b.writer.Close()
 
+	if opts.SourceDate != nil {
+		log.Infof("Building a reproducible package with entries dated %s\n", opts.SourceDate.UTC().Format(time.RFC3339))
+		if opts.K3sVersion == types.VersionLatest {
+			log.Warning("The k3s version is resolved from the release channel, pin it with --k3s-version to reproduce the build later")
+		}
+	}
+
+	if opts.FromDir != "" {
+		if err := b.repack(opts); err != nil {
+			return err
+		}
+		return b.finalize(opts)
+	}
+
 	if opts.Name == "" {
 		opts.Name = util.GetRandomName()
 		log.Infof("Generated name for package %q\n", opts.Name)
@@ -48,6 +79,7 @@ func (b *builder) Build(opts *types.BuildOptions) error {
 		log.Infof("Building package %q\n", opts.Name)
 	}
 
+	var resolvedChannel string
 	if opts.K3sVersion == types.VersionLatest {
 		log.Info("Detecting latest k3s version for channel", opts.K3sChannel)
 		latest, err := getLatestK3sForChannel(opts.K3sChannel)
@@ -55,20 +87,28 @@ func (b *builder) Build(opts *types.BuildOptions) error {
 			return err
 		}
 		opts.K3sVersion = latest
+		resolvedChannel = opts.K3sChannel
 		log.Info("Latest k3s version is", opts.K3sVersion)
 	}
 
+	provenance, err := newProvenance(opts, resolvedChannel)
+	if err != nil {
+		return err
+	}
+
 	imageFormat := types.ImageBundleTar
 	if opts.CreateRegistry {
 		imageFormat = types.ImageBundleRegistry
 	}
 	packageMeta := types.PackageMeta{
-		MetaVersion:       "v1",
+		MetaVersion:       v2.MetaVersion,
 		Name:              opts.Name,
 		Version:           opts.BuildVersion,
+		Description:       opts.Description,
 		K3sVersion:        opts.K3sVersion,
-		Arch:              opts.Arch,
+		Arch:              strings.Join(opts.Archs, ","),
 		ImageBundleFormat: imageFormat,
+		Provenance:        provenance,
 	}
 
 	if opts.ConfigFile != "" {
@@ -79,9 +119,34 @@ func (b *builder) Build(opts *types.BuildOptions) error {
 		}
 		packageMeta.PackageConfig = conf
 		log.Debugf("Unmarshaled config: %+v\n", *packageMeta.PackageConfig)
+		if err := checkRequirements(conf, opts.K3sVersion); err != nil {
+			return err
+		}
+	}
+
+	// The EULA is written first so it can be reviewed before anything else is installed
+	// when the package is streamed.
+	if opts.EULAFile != "" {
+		log.Infof("Adding EULA from %q\n", opts.EULAFile)
+		stat, err := os.Stat(opts.EULAFile)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(opts.EULAFile)
+		if err != nil {
+			return err
+		}
+		if err := b.writer.Put(&types.Artifact{
+			Type: types.ArtifactEULA,
+			Name: types.ManifestEULAFile,
+			Body: f,
+			Size: stat.Size(),
+		}); err != nil {
+			return err
+		}
 	}
 
-	log.Infof("Packaging distribution for version %q using %q architecture\n", opts.K3sVersion, opts.Arch)
+	log.Infof("Packaging distribution for version %q using %q architecture\n", opts.K3sVersion, strings.Join(opts.Archs, ","))
 
 	log.Info("Downloading core k3s components")
 	// need to implement cache layer
@@ -89,6 +154,14 @@ func (b *builder) Build(opts *types.BuildOptions) error {
 		return err
 	}
 
+	if err := b.bundleFiles(opts, packageMeta.GetPackageConfig()); err != nil {
+		return err
+	}
+
+	if err := b.bundleHooks(opts, packageMeta.GetPackageConfig()); err != nil {
+		return err
+	}
+
 	for _, dir := range opts.ManifestDirs {
 
 		parser := parser.NewManifestParser(dir, opts.Excludes, packageMeta.GetPackageConfig())
@@ -114,39 +187,43 @@ func (b *builder) Build(opts *types.BuildOptions) error {
 		}
 	}
 
-	if opts.EULAFile != "" {
-		log.Infof("Adding EULA from %q\n", opts.EULAFile)
-		stat, err := os.Stat(opts.EULAFile)
-		if err != nil {
-			return err
-		}
-		f, err := os.Open(opts.EULAFile)
-		if err != nil {
-			return err
-		}
-		if err := b.writer.Put(&types.Artifact{
-			Type: types.ArtifactEULA,
-			Name: types.ManifestEULAFile,
-			Body: f,
-			Size: stat.Size(),
-		}); err != nil {
-			return err
-		}
-	}
-
 	log.Info("Writing package metadata")
 	log.Debugf("Appending meta: %+v\n", packageMeta)
 	if err := b.writer.PutMeta(&packageMeta); err != nil {
 		return err
 	}
+	return b.finalize(opts)
+}
+
+// finalize adds the generated artifacts to the package once its contents and metadata are
+// written, and writes it to the output in the format asked for in the options.
+func (b *builder) finalize(opts *types.BuildOptions) error {
+	if opts.SBOM != "" {
+		if err := b.writeSBOM(opts); err != nil {
+			return err
+		}
+	}
+	if err := b.recordSubjects(); err != nil {
+		return err
+	}
 	log.Debugf("Complete package meta: %+v\n", b.writer.GetMeta())
 	log.Debugf("Complete package manifest: %+v\n", *b.writer.GetMeta().GetManifest())
 	if cfg := b.writer.GetMeta().GetPackageConfig(); cfg != nil {
 		log.Debugf("Complete package config: %+v\n", *cfg)
 	}
 
+	pkg := b.writer
+	if opts.BasePackage != "" {
+		deltaPkg, err := b.buildDelta(opts)
+		if err != nil {
+			return err
+		}
+		defer deltaPkg.Close()
+		pkg = deltaPkg
+	}
+
 	log.Info("Finalizing archive")
-	archive, err := b.writer.Archive()
+	archive, err := pkg.Archive()
 	if err != nil {
 		return err
 	}
@@ -155,248 +232,268 @@ func (b *builder) Build(opts *types.BuildOptions) error {
 		return makeRunFile(opts, archive)
 	}
 
-	if opts.Compress {
-		compName := fmt.Sprintf("%s.zst", opts.Output)
-		log.Infof("Writing version %q of %q to %q\n", opts.BuildVersion, opts.Name, compName)
-		return archive.CompressTo(compName)
+	if opts.SplitSize > 0 || opts.Encrypt != nil {
+		return writeArchiveStream(opts, archive)
+	}
+
+	if compressed(opts) {
+		compName := opts.Output + codec.Extension(opts.Compression)
+		log.Infof("Writing version %q of %q to %q (%s)\n", opts.BuildVersion, opts.Name, compName, opts.Compression)
+		return archive.CompressTo(compName, opts.Compression)
 	}
 
 	log.Infof("Writing version %q of %q to %q\n", opts.BuildVersion, opts.Name, opts.Output)
 	return archive.WriteTo(opts.Output)
 }
 
-func (b *builder) bundleImages(opts *types.BuildOptions, parser types.ManifestParser) error {
-	imageNames, err := parser.ParseImages()
+// repack writes the contents of a package unpacked with "k3p unpack" to the package. The metadata
+// is taken from the directory, with the name, version, description, and configuration overridden
+// when they are given in the options.
+func (b *builder) repack(opts *types.BuildOptions) error {
+	log.Infof("Packing the contents of %q\n", opts.FromDir)
+	meta, sboms, err := unpack.Repack(opts.FromDir, b.writer)
 	if err != nil {
 		return err
 	}
-
-	if opts.ImageFile != "" {
-		log.Infof("Reading container images from %q\n", opts.ImageFile)
-		body, err := ioutil.ReadFile(opts.ImageFile)
-		if err != nil {
+	if opts.Name != "" {
+		meta.Name = opts.Name
+	}
+	if opts.BuildVersion != "" {
+		meta.Version = opts.BuildVersion
+	}
+	if opts.Description != "" {
+		meta.Description = opts.Description
+	}
+	opts.Name, opts.BuildVersion, opts.K3sVersion = meta.Name, meta.Version, meta.K3sVersion
+	opts.Archs = meta.GetArchs()
+	if opts.ConfigFile != "" {
+		log.Debugf("Reading configuration file at %q\n", opts.ConfigFile)
+		if meta.PackageConfig, err = types.PackageConfigFromFile(opts.ConfigFile); err != nil {
 			return err
 		}
-		for _, img := range strings.Split(string(body), "\n") {
-			if img != "" && !strings.HasPrefix(img, "#") {
-				imageNames = append(imageNames, img)
+	}
+	if meta.PackageConfig != nil {
+		if err := checkRequirements(meta.PackageConfig, meta.K3sVersion); err != nil {
+			return err
+		}
+		// the declared files and hooks are already in the directory, but are installed and
+		// run as declared
+		for _, file := range meta.PackageConfig.Files {
+			if err := file.Validate(); err != nil {
+				return err
+			}
+		}
+		if meta.PackageConfig.Hooks != nil {
+			if err := meta.PackageConfig.Hooks.Validate(); err != nil {
+				return err
 			}
 		}
 	}
-
-	if len(opts.Images) > 0 {
-		log.Infof("Got the following images on the command line: %+v\n", opts.Images)
-		imageNames = append(imageNames, opts.Images...)
+	if opts.SBOM == "" && len(sboms) > 0 {
+		// the bills of materials in the directory no longer describe the package
+		opts.SBOM = sboms[0]
 	}
-
-	log.Info("Detected the following images to bundle with the package:", imageNames)
-
-	downloader := images.NewImageDownloader()
-
-	var imgRdr io.ReadCloser
-	if opts.CreateRegistry {
-		log.Info("Building private image registry to bundle with the package")
-		imgRdr, err = downloader.BuildRegistry(&types.BuildRegistryOptions{
-			Name:       opts.Name,
-			AppVersion: opts.BuildVersion,
-			Arch:       opts.Arch,
-			Images:     imageNames,
-			PullPolicy: opts.PullPolicy,
-		})
-	} else {
-		log.Info("Exporting images to tar archives to bundle with the package")
-		// TODO: Switch to opts here as well
-		imgRdr, err = downloader.SaveImages(imageNames, opts.Arch, opts.PullPolicy)
-	}
-	if err != nil {
+	if meta.Provenance, err = newProvenance(opts, ""); err != nil {
 		return err
 	}
+	meta.MetaVersion = v2.MetaVersion
+	log.Info("Writing package metadata")
+	return b.writer.PutMeta(meta)
+}
 
-	log.Info("Adding container images to package")
-	images, err := util.ArtifactFromReader(types.ArtifactImages, types.ManifestUserImagesFile, imgRdr)
-	if err != nil {
+// checkRequirements makes sure the requirements in the package configuration can be parsed, and
+// that they allow the k3s version bundled with the package.
+func checkRequirements(cfg *types.PackageConfig, k3sVersion string) error {
+	if cfg.Requires == nil {
+		return nil
+	}
+	if err := cfg.Requires.Validate(); err != nil {
 		return err
 	}
-	return b.writer.Put(images)
+	if problems := requirements.CheckK3sVersion(cfg.Requires, k3sVersion); len(problems) > 0 {
+		return fmt.Errorf("The package requirements do not allow the bundled k3s version: %s", strings.Join(problems, ", "))
+	}
+	return nil
 }
 
-var runFilePreSeed = template.Must(template.New("").Parse(`#!/bin/sh
-
-cleanup() { 
-	rm -rf {{ .DirName }} 
+// compressed returns true if the options call for compressing the archive
+func compressed(opts *types.BuildOptions) bool {
+	return opts.Compression != "" && opts.Compression != types.CompressionNone
 }
 
-cleanup
-trap cleanup EXIT
-
-mkdir -p {{ .DirName }}
-tail -n +30 $0 | tar xzf -
-
-if [ -z ${1} ] || [ "${1}" == "install" ] || [ {{ .Backtick }}echo ${1} | cut -c1-1{{ .Backtick }} = "-" ] ; then
-	if [ "${1}" == "install" ] ; then shift ; fi
-	cmd="./{{ .DirName }}/{{ .K3pBin }} install {{ .DirName }}/{{ .PackageFile }}"
-elif [ "${1}" == "inspect" ] ; then
-	shift
-	cmd="./{{ .DirName }}/{{ .K3pBin }} inspect {{ .DirName }}/{{ .PackageFile }}"
-else
-	cmd="./{{ .DirName }}/{{ .K3pBin }}"
-fi
-
-${cmd} ${@}
-
-exit $?
-
-
-
-#payload
-`))
-
-var (
-	runDirName = ".k3p-run"
-	runK3pBin  = "k3p"
-)
-
-func tmplSeed(pkgFile string) ([]byte, error) {
-	var out bytes.Buffer
-	if err := runFilePreSeed.Execute(&out, map[string]string{
-		"DirName":     runDirName,
-		"K3pBin":      runK3pBin,
-		"PackageFile": pkgFile,
-		"Backtick":    "`",
-	}); err != nil {
+// archiveReader returns a reader over the final contents of the archive, compressed and
+// encrypted as requested in the options.
+func archiveReader(opts *types.BuildOptions, archive types.Archive) (io.ReadCloser, error) {
+	rdr, err := archive.CompressReader(opts.Compression)
+	if err != nil {
 		return nil, err
 	}
-	return out.Bytes(), nil
-}
-
-func makeRunFile(opts *types.BuildOptions, archive types.Archive) error {
-	if strings.HasSuffix(opts.Output, "tar") {
-		opts.Output = strings.Replace(opts.Output, ".tar", ".run", 1)
+	if opts.Encrypt == nil {
+		return rdr, nil
 	}
-
-	pkgFile := "package.tar"
-	if opts.Compress {
-		pkgFile = "package.tar.zst"
+	recipients, err := crypt.LoadPublicKeys(opts.Encrypt.Recipients)
+	if err != nil {
+		rdr.Close()
+		return nil, err
 	}
+	if opts.Encrypt.Passphrase != "" {
+		log.Infof("Encrypting the archive for %d recipient(s) and a passphrase\n", len(recipients))
+	} else {
+		log.Infof("Encrypting the archive for %d recipient(s)\n", len(recipients))
+	}
+	return crypt.EncryptReader(rdr, recipients, []byte(opts.Encrypt.Passphrase))
+}
 
-	log.Infof("Writing k3p executable and package contents to run file %q\n", opts.Output)
-
-	runFile, err := os.OpenFile(opts.Output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+// writeArchiveStream writes the final contents of the archive to the output, in parts of at
+// most opts.SplitSize bytes if requested.
+func writeArchiveStream(opts *types.BuildOptions, archive types.Archive) error {
+	output := opts.Output + codec.Extension(opts.Compression)
+	rdr, err := archiveReader(opts, archive)
 	if err != nil {
 		return err
 	}
+	defer rdr.Close()
+
+	if opts.SplitSize > 0 {
+		log.Infof("Writing version %q of %q to %q in parts of %d bytes\n", opts.BuildVersion, opts.Name, output, opts.SplitSize)
+		manifest, err := split.Write(rdr, output, opts.SplitSize)
+		if err != nil {
+			return err
+		}
+		log.Infof("Wrote %d bytes in %d parts\n", manifest.Size, len(manifest.Parts))
+		return nil
+	}
 
-	runFileSeed, err := tmplSeed(pkgFile)
+	log.Infof("Writing version %q of %q to %q\n", opts.BuildVersion, opts.Name, output)
+	f, err := os.Create(output)
 	if err != nil {
 		return err
 	}
-	if _, err := runFile.Write(runFileSeed); err != nil {
+	defer f.Close()
+	if _, err := io.Copy(f, rdr); err != nil {
 		return err
 	}
+	return f.Close()
+}
 
-	// wrap the rest of the content in gzip
-	gzw := gzip.NewWriter(runFile)
-
-	// Create a new tar writer around the gzip writer
-	tw := tar.NewWriter(gzw)
-
-	// get the time
-	now := time.Now()
-
-	// downloadURL := fmt.Sprintf("https://github.com/tinyzimmer/k3p/releases/download/%s/k3p_linux_%s", version.K3pVersion, opts.Arch)
-	// bin, err := cache.DefaultCache.Get(downloadURL)
-	// until i open the repo - the releases can't be downloaded - just use the current executable
-	// (which obviously will not always be linux, and it has to be for installations besides docker)
-	ex, err := os.Executable()
+// writeSBOM generates a software bill of materials for the contents written so far and adds it
+// to the package.
+func (b *builder) writeSBOM(opts *types.BuildOptions) error {
+	log.Infof("Generating a software bill of materials (%s)\n", opts.SBOM)
+	created := time.Now()
+	if opts.SourceDate != nil {
+		created = *opts.SourceDate
+	}
+	raw, err := sbom.GenerateAt(b.writer, opts.SBOM, created)
 	if err != nil {
 		return err
 	}
-	bin, err := os.Open(ex)
+	return b.writer.Put(&types.Artifact{
+		Type: types.ArtifactSBOM,
+		Name: sbom.FileName(opts.SBOM),
+		Body: ioutil.NopCloser(bytes.NewReader(raw)),
+		Size: int64(len(raw)),
+	})
+}
+
+// buildDelta writes a delta of the package against the base package in the options and
+// returns it.
+func (b *builder) buildDelta(opts *types.BuildOptions) (types.Package, error) {
+	log.Infof("Building delta against %q\n", opts.BasePackage)
+	f, err := os.Open(opts.BasePackage)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	binStat, err := os.Stat(ex)
+	defer f.Close()
+	rdr, err := codec.Decompress(f)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// Write the k3p binary to the tar ball
-	if err := tw.WriteHeader(&tar.Header{
-		Typeflag: tar.TypeReg,
-		Name:     fmt.Sprintf("%s/%s", runDirName, runK3pBin), // must ensure its a linux path separator
-		Size:     binStat.Size(),
-		Mode:     0755,
-		Uid:      0, Gid: 0,
-		Uname: "root", Gname: "root",
-		ModTime: now, AccessTime: now, ChangeTime: now,
-	}); err != nil {
-		return err
+	base, err := formats.Load(rdr)
+	if err != nil {
+		return nil, err
 	}
+	defer base.Close()
 
-	if _, err := io.Copy(tw, bin); err != nil {
-		return err
+	tmpDir, err := util.GetTempDir()
+	if err != nil {
+		return nil, err
 	}
-	if err := bin.Close(); err != nil {
+	out := newPackage(tmpDir, opts)
+	if err := delta.Build(b.writer, base, out); err != nil {
+		out.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+func (b *builder) bundleImages(opts *types.BuildOptions, parser types.ManifestParser) error {
+	imageNames, err := parser.ParseImages()
+	if err != nil {
 		return err
 	}
 
-	// Write the archive to the tar ball
-	rdr := archive.Reader()
-	size := archive.Size()
-	if opts.Compress {
-		// need to compress to a tempfile first
-		tmpFile, err := ioutil.TempFile(util.TempDir, "")
-		if err != nil {
-			return err
-		}
-		defer os.Remove(tmpFile.Name())
-		compressedReader, err := archive.CompressReader()
+	if opts.ImageFile != "" {
+		log.Infof("Reading container images from %q\n", opts.ImageFile)
+		body, err := ioutil.ReadFile(opts.ImageFile)
 		if err != nil {
 			return err
 		}
-		if _, err := io.Copy(tmpFile, compressedReader); err != nil {
-			return err
+		for _, img := range strings.Split(string(body), "\n") {
+			if img != "" && !strings.HasPrefix(img, "#") {
+				imageNames = append(imageNames, img)
+			}
 		}
-		if err := tmpFile.Close(); err != nil {
+	}
+
+	if len(opts.Images) > 0 {
+		log.Infof("Got the following images on the command line: %+v\n", opts.Images)
+		imageNames = append(imageNames, opts.Images...)
+	}
+
+	log.Info("Detected the following images to bundle with the package:", imageNames)
+
+	downloader := images.NewImageDownloader()
+
+	if opts.CreateRegistry {
+		log.Info("Building private image registry to bundle with the package")
+		imgRdr, err := downloader.BuildRegistry(&types.BuildRegistryOptions{
+			Name:        opts.Name,
+			AppVersion:  opts.BuildVersion,
+			Arch:        opts.Archs[0],
+			Images:      imageNames,
+			PullPolicy:  opts.PullPolicy,
+			Parallelism: opts.Parallelism,
+		})
+		if err != nil {
 			return err
 		}
-		stat, err := os.Stat(tmpFile.Name())
+		return b.putImages(types.ManifestUserImagesFile, imgRdr)
+	}
+
+	for _, arch := range opts.Archs {
+		log.Infof("Exporting %q images to tar archives to bundle with the package\n", arch)
+		imgRdr, err := downloader.SaveImages(&types.SaveImagesOptions{
+			Images:      imageNames,
+			Arch:        arch,
+			PullPolicy:  opts.PullPolicy,
+			Parallelism: opts.Parallelism,
+		})
 		if err != nil {
 			return err
 		}
-		// Overwrite the size and the reader
-		size = stat.Size()
-		rdr, err = os.Open(tmpFile.Name())
-		if err != nil {
+		if err := b.putImages(archArtifactName(opts, arch, types.ManifestUserImagesFile), imgRdr); err != nil {
 			return err
 		}
 	}
-	if err := tw.WriteHeader(&tar.Header{
-		Typeflag: tar.TypeReg,
-		Name:     fmt.Sprintf("%s/%s", runDirName, pkgFile), // must ensure its a linux path separator
-		Size:     size,
-		Mode:     0644,
-		Uid:      0, Gid: 0,
-		Uname: "root", Gname: "root",
-		ModTime: now, AccessTime: now, ChangeTime: now,
-	}); err != nil {
-		return err
-	}
-
-	if _, err := io.Copy(tw, rdr); err != nil {
-		return err
-	}
-
-	// Close the tar writer
-	if err := tw.Close(); err != nil {
-		return err
-	}
+	return nil
+}
 
-	// Close the gzip writer
-	if err := gzw.Close(); err != nil {
+func (b *builder) putImages(name string, imgRdr io.ReadCloser) error {
+	log.Info("Adding container images to package")
+	images, err := util.ArtifactFromReader(types.ArtifactImages, name, imgRdr)
+	if err != nil {
 		return err
 	}
-
-	// Close the runfile
-	return runFile.Close()
+	return b.writer.Put(images)
 }
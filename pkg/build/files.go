@@ -0,0 +1,114 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// bundleFiles adds the files declared in the package configuration to the package. Paths are
+// relative to the directory of the configuration file.
+func (b *builder) bundleFiles(opts *types.BuildOptions, cfg *types.PackageConfig) error {
+	if cfg == nil || len(cfg.Files) == 0 {
+		return nil
+	}
+	// the files installed by k3s itself and the hooks cannot be replaced
+	installed := map[string][]string{
+		fileKey(types.ArtifactBin, "k3s"):           {""},
+		fileKey(types.ArtifactScript, "install.sh"): {""},
+	}
+	for _, phase := range types.HookPhases {
+		if cfg.Hooks.Get(phase) != nil {
+			installed[fileKey(types.ArtifactScript, types.HookScriptName(phase))] = []string{""}
+		}
+	}
+	for _, file := range cfg.Files {
+		if err := file.Validate(); err != nil {
+			return err
+		}
+		if file.Arch != "" && !hasArch(opts.Archs, file.Arch) {
+			log.Infof("Skipping %q, the package is not built for %q\n", file.Path, file.Arch)
+			continue
+		}
+		name := file.GetName(len(opts.Archs) > 1)
+		key := fileKey(file.Type, name)
+		for _, arch := range installed[key] {
+			if arch == "" || file.Arch == "" || arch == file.Arch {
+				return fmt.Errorf("%s: another %s file is already installed as %q", file.Path, file.Type, path.Base(name))
+			}
+		}
+		installed[key] = append(installed[key], file.Arch)
+
+		if err := b.putFile(opts, file.Path, file.Type, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleHooks adds the scripts of the hooks declared in the package configuration to the package.
+func (b *builder) bundleHooks(opts *types.BuildOptions, cfg *types.PackageConfig) error {
+	if cfg == nil || cfg.Hooks == nil {
+		return nil
+	}
+	if err := cfg.Hooks.Validate(); err != nil {
+		return err
+	}
+	for _, phase := range types.HookPhases {
+		if hook := cfg.Hooks.Get(phase); hook != nil {
+			if err := b.putFile(opts, hook.Script, types.ArtifactScript, types.HookScriptName(phase)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// putFile adds the file at the given path, relative to the directory of the configuration file,
+// to the package as an artifact with the given type and name.
+func (b *builder) putFile(opts *types.BuildOptions, src string, t types.ArtifactType, name string) error {
+	if !filepath.IsAbs(src) && opts.ConfigFile != "" {
+		src = filepath.Join(filepath.Dir(opts.ConfigFile), src)
+	}
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("%s: only regular files can be bundled with a package", src)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	log.Infof("Adding %s file %q from %q\n", t, name, src)
+	return b.writer.Put(&types.Artifact{
+		Type: t,
+		Name: name,
+		Body: f,
+		Size: stat.Size(),
+	})
+}
+
+// fileKey returns a key identifying where a file with the given type and name is installed. Binaries
+// and scripts are installed to flat directories.
+func fileKey(t types.ArtifactType, name string) string {
+	switch t {
+	case types.ArtifactBin, types.ArtifactScript:
+		name = path.Base(name)
+	}
+	return path.Join(string(t), name)
+}
+
+func hasArch(archs []string, arch string) bool {
+	for _, a := range archs {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
@@ -22,92 +22,118 @@ const (
 )
 
 func (b *builder) downloadCoreK3sComponents(opts *types.BuildOptions) error {
-	log.Info("Fetching checksums...")
-	if err := b.downloadK3sChecksums(opts.K3sVersion, opts.Arch); err != nil {
-		return err
+	downloads := []*k3sDownload{{
+		name:         "the k3s install script",
+		url:          k3sScriptURL,
+		artifactType: types.ArtifactScript,
+		artifactName: "install.sh",
+	}}
+
+	if opts.ExcludeImages {
+		log.Info("Skipping bundling k3s airgap images with the package")
+	}
+	for _, arch := range opts.Archs {
+		suffix := ""
+		if len(opts.Archs) > 1 {
+			suffix = fmt.Sprintf(" for %s", arch)
+		}
+		downloads = append(downloads,
+			&k3sDownload{
+				name:         "the k3s checksums" + suffix,
+				url:          getDownloadURL(opts.K3sVersion, getDownloadChecksumsName(arch)),
+				artifactType: types.ArtifactType("misc"),
+				artifactName: archArtifactName(opts, arch, "k3s-sha256sums.txt"),
+			},
+			&k3sDownload{
+				name:         "the k3s binary" + suffix,
+				url:          getDownloadURL(opts.K3sVersion, getDownloadK3sBinName(arch)),
+				artifactType: types.ArtifactBin,
+				artifactName: archArtifactName(opts, arch, "k3s"),
+			},
+		)
+		if opts.ExcludeImages {
+			continue
+		}
+		downloads = append(downloads, &k3sDownload{
+			name:         "the k3s airgap images" + suffix,
+			url:          getDownloadURL(opts.K3sVersion, getDownloadAirgapImagesName(arch)),
+			artifactType: types.ArtifactImages,
+			artifactName: archArtifactName(opts, arch, "k3s-airgap-images.tar"),
+		})
 	}
 
-	log.Info("Fetching k3s install script...")
-	if err := b.downloadK3sInstallScript(); err != nil {
-		return err
+	log.Infof("Fetching %d k3s components...\n", len(downloads))
+	tasks := make([]util.Task, len(downloads))
+	for i, download := range downloads {
+		tasks[i] = util.Task{Name: "fetching " + download.name, Run: download.fetch}
 	}
+	err := util.RunTasks(opts.Parallelism, tasks)
 
-	log.Info("Fetching k3s binary...")
-	if err := b.downloadK3sBinary(opts.K3sVersion, opts.Arch); err != nil {
+	// the package writer is not safe for concurrent use, and artifacts are added in a fixed
+	// order so reproducible builds do not depend on which download finished first
+	for _, download := range downloads {
+		if download.artifact == nil {
+			continue
+		}
+		if err != nil {
+			// release the temporary files of the components that were fetched
+			download.artifact.Body.Close()
+			continue
+		}
+		err = b.writer.Put(download.artifact)
+	}
+	if err != nil {
 		return err
 	}
 
-	if !opts.ExcludeImages {
-		log.Info("Fetching k3s airgap images...")
-		if err := b.downloadK3sAirgapImages(opts.K3sVersion, opts.Arch); err != nil {
+	for _, arch := range opts.Archs {
+		if len(opts.Archs) > 1 {
+			log.Infof("Validating checksums for %q architecture\n", arch)
+		} else {
+			log.Info("Validating checksums...")
+		}
+		if err := b.validateCheckSums(opts, arch); err != nil {
 			return err
 		}
-	} else {
-		log.Info("Skipping bundling k3s airgap images with the package")
-	}
-
-	log.Info("Validating checksums...")
-	if err := b.validateCheckSums(opts); err != nil {
-		return err
 	}
 
 	return nil
 }
 
-func (b *builder) downloadK3sChecksums(version, arch string) error {
-	rdr, err := cache.DefaultCache.Get(getDownloadURL(version, getDownloadChecksumsName(arch)))
-	if err != nil {
-		return err
-	}
-	artifact, err := util.ArtifactFromReader(types.ArtifactType("misc"), "k3s-sha256sums.txt", rdr)
-	if err != nil {
-		return err
-	}
-	return b.writer.Put(artifact)
-}
-
-func (b *builder) downloadK3sInstallScript() error {
-	rdr, err := cache.DefaultCache.Get(k3sScriptURL)
-	if err != nil {
-		return err
-	}
-	artifact, err := util.ArtifactFromReader(types.ArtifactScript, "install.sh", rdr)
-	if err != nil {
-		return err
-	}
-	return b.writer.Put(artifact)
+// k3sDownload is a k3s component fetched from the internet and added to the package.
+type k3sDownload struct {
+	name         string
+	url          string
+	artifactType types.ArtifactType
+	artifactName string
+	// populated once the component is fetched
+	artifact *types.Artifact
 }
 
-func (b *builder) downloadK3sAirgapImages(version, arch string) error {
-	rdr, err := cache.DefaultCache.Get(getDownloadURL(version, getDownloadAirgapImagesName(arch)))
-	if err != nil {
-		return err
-	}
-	artifact, err := util.ArtifactFromReader(types.ArtifactImages, "k3s-airgap-images.tar", rdr)
+func (d *k3sDownload) fetch() error {
+	rdr, err := cache.DefaultCache.Get(d.url)
 	if err != nil {
 		return err
 	}
-	return b.writer.Put(artifact)
+	d.artifact, err = util.ArtifactFromReader(d.artifactType, d.artifactName, rdr)
+	return err
 }
 
-func (b *builder) downloadK3sBinary(version, arch string) error {
-	rdr, err := cache.DefaultCache.Get(getDownloadURL(version, getDownloadK3sBinName(arch)))
-	if err != nil {
-		return err
-	}
-	artifact, err := util.ArtifactFromReader(types.ArtifactBin, "k3s", rdr)
-	if err != nil {
-		return err
+// archArtifactName returns the name to use for an architecture specific artifact. Packages
+// built for multiple architectures keep these in a directory named after the architecture.
+func archArtifactName(opts *types.BuildOptions, arch, name string) string {
+	if len(opts.Archs) > 1 {
+		return path.Join(arch, name)
 	}
-	return b.writer.Put(artifact)
+	return name
 }
 
-func (b *builder) validateCheckSums(opts *types.BuildOptions) error {
+func (b *builder) validateCheckSums(opts *types.BuildOptions, arch string) error {
 	// Queue up extra check to make sure we visited each
 	var binValid, imagesValid bool
 
 	// retrieve the downloaded checksums from the bundle
-	checksums := &types.Artifact{Name: "k3s-sha256sums.txt"}
+	checksums := &types.Artifact{Name: archArtifactName(opts, arch, "k3s-sha256sums.txt")}
 	if err := b.writer.Get(checksums); err != nil {
 		return err
 	}
@@ -129,14 +155,14 @@ func (b *builder) validateCheckSums(opts *types.BuildOptions) error {
 
 		// verify the checksums
 		switch fname {
-		case getDownloadAirgapImagesName(opts.Arch):
+		case getDownloadAirgapImagesName(arch):
 			if opts.ExcludeImages {
 				imagesValid = true
 				continue
 			}
 			images := &types.Artifact{
 				Type: types.ArtifactImages,
-				Name: "k3s-airgap-images.tar",
+				Name: archArtifactName(opts, arch, "k3s-airgap-images.tar"),
 			}
 			if err := b.writer.Get(images); err != nil {
 				return err
@@ -146,10 +172,10 @@ func (b *builder) validateCheckSums(opts *types.BuildOptions) error {
 				return err
 			}
 			imagesValid = true
-		case getDownloadK3sBinName(opts.Arch):
+		case getDownloadK3sBinName(arch):
 			k3sbin := &types.Artifact{
 				Type: types.ArtifactBin,
-				Name: "k3s",
+				Name: archArtifactName(opts, arch, "k3s"),
 			}
 			if err := b.writer.Get(k3sbin); err != nil {
 				return err
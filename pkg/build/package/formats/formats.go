@@ -0,0 +1,256 @@
+package formats
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+// Format is a version of the package archive format, identified by the apiVersion it writes
+// to the metadata of the packages it produces.
+type Format struct {
+	// The apiVersion of packages written in this format
+	Version string
+	// A short description of the format
+	Description string
+	// New returns a writer for the format that works in the given directory
+	New func(dir string) types.Package
+	// Open loads a package.tar written in the format from the given directory
+	Open func(workDir string) (types.Package, error)
+	// OpenFile loads a package file written in the format in place, it is nil for formats that
+	// can only be read from a package.tar in a work directory
+	OpenFile func(tarPath string) (types.Package, error)
+}
+
+var registry = make(map[string]*Format)
+
+func init() {
+	Register(&Format{
+		Version:     v1.MetaVersion,
+		Description: "A tar archive with the metadata as the last entry, read by scanning the archive",
+		New:         v1.New,
+		Open:        v1.Open,
+	})
+	Register(&Format{
+		Version:     v2.MetaVersion,
+		Description: "A tar archive with the metadata first and an index at the end, read without scanning and installable as a stream",
+		New:         v2.New,
+		Open:        v2.Open,
+		OpenFile:    v2.OpenFile,
+	})
+}
+
+// Register adds a format to the registry, replacing any format with the same version.
+func Register(format *Format) { registry[format.Version] = format }
+
+// Versions returns the versions of every registered format, oldest first.
+func Versions() []string {
+	versions := make([]string, 0, len(registry))
+	for version := range registry {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versionNumber(versions[i]) < versionNumber(versions[j]) })
+	return versions
+}
+
+// Latest returns the newest registered format.
+func Latest() *Format {
+	versions := Versions()
+	return registry[versions[len(versions)-1]]
+}
+
+// Get returns the format with the given version. Packages from before the version was
+// recorded in the metadata are in the v1 format.
+func Get(version string) (*Format, error) {
+	if version == "" {
+		version = v1.MetaVersion
+	}
+	format, ok := registry[version]
+	if !ok {
+		return nil, fmt.Errorf("The package format %q is not supported by this release of k3p (supported formats are %s), a newer release may be required",
+			version, strings.Join(Versions(), ","))
+	}
+	return format, nil
+}
+
+// versionNumber returns the number in a version like v2, or -1 if it is not one.
+func versionNumber(version string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(version, "v"))
+	if err != nil || !strings.HasPrefix(version, "v") {
+		return -1
+	}
+	return n
+}
+
+// Load loads the given readcloser into a Package interface, using the format matching the
+// apiVersion in its metadata.
+func Load(rdr io.ReadCloser) (types.Package, error) {
+	defer rdr.Close()
+	workDir, err := util.GetTempDir()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path.Join(workDir, "package.tar"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, rdr); err != nil {
+		return nil, err
+	}
+	return Open(workDir)
+}
+
+// Open loads a package that was already written to a package.tar inside the given directory,
+// using the format matching the apiVersion in its metadata. The directory is removed when the
+// package is closed.
+func Open(workDir string) (types.Package, error) {
+	version, err := DetectVersion(path.Join(workDir, "package.tar"))
+	if err != nil {
+		return nil, err
+	}
+	format, err := Get(version)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Loading package in the %s format\n", format.Version)
+	return format.Open(workDir)
+}
+
+// OpenFile loads the package file at the given path, using the format matching the apiVersion
+// in its metadata. Formats that support it read the file in place, otherwise it is copied to a
+// temporary directory first. The file itself is never removed or modified.
+func OpenFile(tarPath string) (types.Package, error) {
+	version, err := DetectVersion(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	format, err := Get(version)
+	if err != nil {
+		return nil, err
+	}
+	if format.OpenFile == nil {
+		f, err := os.Open(tarPath)
+		if err != nil {
+			return nil, err
+		}
+		return Load(f)
+	}
+	log.Debugf("Opening package in the %s format in place\n", format.Version)
+	return format.OpenFile(tarPath)
+}
+
+// DetectVersion returns the apiVersion recorded in the metadata of the package archive at the
+// given path. Only the headers of the archive are read until the metadata is found.
+func DetectVersion(tarPath string) (string, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	rdr := tar.NewReader(f)
+	for {
+		header, err := rdr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return "", errors.New("The archive does not contain any package metadata")
+			}
+			return "", err
+		}
+		if header.Name != types.ManifestMetaFile {
+			continue
+		}
+		body, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			return "", err
+		}
+		var meta struct {
+			MetaVersion string `json:"apiVersion"`
+		}
+		if err := json.Unmarshal(body, &meta); err != nil {
+			return "", err
+		}
+		return meta.MetaVersion, nil
+	}
+}
+
+// Convert writes the contents and metadata of the package to a new package in the given format,
+// working in the given directory. Packages can only be converted to newer formats. Delta packages
+// do not contain everything they install and cannot be converted.
+func Convert(pkg types.Package, format *Format, dir string) (types.Package, error) {
+	meta := pkg.GetMeta()
+	if meta.IsDelta() {
+		return nil, errors.New("Delta packages cannot be converted, convert the complete release and build the delta again")
+	}
+	from, err := Get(meta.MetaVersion)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case from.Version == format.Version:
+		return nil, fmt.Errorf("The package is already in the %s format", format.Version)
+	case versionNumber(format.Version) < versionNumber(from.Version):
+		return nil, fmt.Errorf("Packages can only be converted to newer formats, %s is older than %s", format.Version, from.Version)
+	}
+
+	out := format.New(dir)
+	manifest := meta.GetManifest()
+	// the EULA is kept first so it can still be reviewed before anything is installed
+	if manifest.HasEULA() {
+		if err := copyArtifact(pkg, out, &types.Artifact{Type: types.ArtifactEULA, Name: types.ManifestEULAFile}); err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+	listings := []struct {
+		t     types.ArtifactType
+		names []string
+	}{
+		{types.ArtifactBin, manifest.Bins},
+		{types.ArtifactScript, manifest.Scripts},
+		{types.ArtifactImages, manifest.Images},
+		{types.ArtifactManifest, manifest.K8sManifests},
+		{types.ArtifactStatic, manifest.Static},
+		{types.ArtifactEtc, manifest.Etc},
+		{types.ArtifactSBOM, manifest.SBOM},
+	}
+	for _, listing := range listings {
+		for _, name := range listing.names {
+			if err := copyArtifact(pkg, out, &types.Artifact{Type: listing.t, Name: name}); err != nil {
+				out.Close()
+				return nil, err
+			}
+		}
+	}
+
+	outMeta := meta.DeepCopy()
+	outMeta.MetaVersion = format.Version
+	outMeta.Manifest = nil
+	if err := out.PutMeta(outMeta); err != nil {
+		out.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+func copyArtifact(from, to types.Package, artifact *types.Artifact) error {
+	log.Debugf("Copying %s %q\n", artifact.Type, artifact.Name)
+	if err := from.Get(artifact); err != nil {
+		return err
+	}
+	return to.Put(artifact)
+}
@@ -0,0 +1,112 @@
+package formats
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestFormats(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Formats Suite")
+}
+
+func archiveBytes(pkg types.Package) []byte {
+	archive, err := pkg.Archive()
+	Expect(err).ToNot(HaveOccurred())
+	rdr := archive.Reader()
+	defer rdr.Close()
+	body, err := ioutil.ReadAll(rdr)
+	Expect(err).ToNot(HaveOccurred())
+	return body
+}
+
+func load(raw []byte) (types.Package, error) {
+	return Load(ioutil.NopCloser(bytes.NewReader(raw)))
+}
+
+func mockPackage(mock types.Package) []byte {
+	defer mock.Close()
+	Expect(mock.PutMeta(&types.PackageMeta{Name: "test", Version: "v1"})).To(Succeed())
+	return archiveBytes(mock)
+}
+
+func readArtifact(pkg types.Package, t types.ArtifactType, name string) string {
+	artifact := &types.Artifact{Type: t, Name: name}
+	Expect(pkg.Get(artifact)).To(Succeed())
+	defer artifact.Body.Close()
+	body, err := ioutil.ReadAll(artifact.Body)
+	Expect(err).ToNot(HaveOccurred())
+	return string(body)
+}
+
+var _ = Describe("Package formats", func() {
+	It("Should order the registered formats", func() {
+		Expect(Versions()).To(Equal([]string{"v1", "v2"}))
+		Expect(Latest().Version).To(Equal(v2.MetaVersion))
+		format, err := Get("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(format.Version).To(Equal(v1.MetaVersion))
+		_, err = Get("v9")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should load packages with the format in their metadata", func() {
+		for _, mock := range []types.Package{v1.Mock(), v2.Mock()} {
+			pkg, err := load(mockPackage(mock))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pkg.GetMeta().GetName()).To(Equal("test"))
+			Expect(readArtifact(pkg, types.ArtifactBin, "k3s")).To(Equal("test"))
+			pkg.Close()
+		}
+	})
+
+	It("Should refuse packages in an unknown format", func() {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		meta := []byte(`{"apiVersion": "v9", "name": "test"}`)
+		Expect(tw.WriteHeader(&tar.Header{Name: types.ManifestMetaFile, Size: int64(len(meta)), Mode: 0644})).To(Succeed())
+		_, err := tw.Write(meta)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tw.Close()).To(Succeed())
+		_, err = load(buf.Bytes())
+		Expect(err).To(MatchError(ContainSubstring(`"v9" is not supported`)))
+	})
+
+	It("Should convert packages to newer formats", func() {
+		pkg, err := load(mockPackage(v1.Mock()))
+		Expect(err).ToNot(HaveOccurred())
+		defer pkg.Close()
+
+		tmpDir, err := ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		out, err := Convert(pkg, Latest(), tmpDir)
+		Expect(err).ToNot(HaveOccurred())
+		converted, err := load(archiveBytes(out))
+		out.Close()
+		Expect(err).ToNot(HaveOccurred())
+		defer converted.Close()
+
+		Expect(converted.GetMeta().MetaVersion).To(Equal(v2.MetaVersion))
+		Expect(converted.GetMeta().GetName()).To(Equal("test"))
+		Expect(converted.GetMeta().GetManifest().Bins).To(Equal(pkg.GetMeta().GetManifest().Bins))
+		Expect(readArtifact(converted, types.ArtifactManifest, "manifest.yaml")).To(Equal(readArtifact(pkg, types.ArtifactManifest, "manifest.yaml")))
+
+		format, err := Get(v1.MetaVersion)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = Convert(converted, format, tmpDir)
+		Expect(err).To(MatchError(ContainSubstring("only be converted to newer formats")))
+		_, err = Convert(converted, Latest(), tmpDir)
+		Expect(err).To(MatchError(ContainSubstring("already in the v2 format")))
+	})
+})
@@ -0,0 +1,21 @@
+package v1
+
+import (
+	"io"
+
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+// newDigestReader wraps the contents of an artifact inside the archive and verifies them
+// against the digest recorded in the package metadata once the end of the stream is
+// reached. If there is no digest for the artifact, the contents are passed through as is.
+func (rw *readWriter) newDigestReader(name string, rdr io.Reader, closer io.Closer) io.ReadCloser {
+	// the metadata is not populated yet when it is first read during a load
+	if rw.meta == nil || rw.meta.Manifest == nil {
+		return util.NewDigestReader(name, rdr, closer, nil)
+	}
+	if digest, ok := rw.meta.Manifest.Digests[name]; ok {
+		return util.NewDigestReader(name, rdr, closer, &digest)
+	}
+	return util.NewDigestReader(name, rdr, closer, nil)
+}
@@ -7,31 +7,34 @@ import (
 	"github.com/tinyzimmer/k3p/pkg/types"
 )
 
-var mockArtifacts = []*types.Artifact{
-	{
-		Type: types.ArtifactBin,
-		Name: "k3s",
-		Body: ioutil.NopCloser(strings.NewReader("test")),
-		Size: 4,
-	},
-	{
-		Type: types.ArtifactImages,
-		Name: "k3s-airgap-images.tar",
-		Body: ioutil.NopCloser(strings.NewReader("test")),
-		Size: 4,
-	},
-	{
-		Type: types.ArtifactScript,
-		Name: "install.sh",
-		Body: ioutil.NopCloser(strings.NewReader("test")),
-		Size: 4,
-	},
-	{
-		Type: types.ArtifactManifest,
-		Name: "manifest.yaml",
-		Body: ioutil.NopCloser(strings.NewReader("test")),
-		Size: 4,
-	},
+// mockArtifacts returns a fresh set of artifacts for populating a mock package.
+func mockArtifacts() []*types.Artifact {
+	return []*types.Artifact{
+		{
+			Type: types.ArtifactBin,
+			Name: "k3s",
+			Body: ioutil.NopCloser(strings.NewReader("test")),
+			Size: 4,
+		},
+		{
+			Type: types.ArtifactImages,
+			Name: "k3s-airgap-images.tar",
+			Body: ioutil.NopCloser(strings.NewReader("test")),
+			Size: 4,
+		},
+		{
+			Type: types.ArtifactScript,
+			Name: "install.sh",
+			Body: ioutil.NopCloser(strings.NewReader("test")),
+			Size: 4,
+		},
+		{
+			Type: types.ArtifactManifest,
+			Name: "manifest.yaml",
+			Body: ioutil.NopCloser(strings.NewReader("test")),
+			Size: 4,
+		},
+	}
 }
 
 // Mock returns a fake package.
@@ -41,7 +44,7 @@ func Mock() types.Package {
 		panic(err)
 	}
 	writer := New(tmpDir)
-	for _, artifact := range mockArtifacts {
+	for _, artifact := range mockArtifacts() {
 		if err := writer.Put(artifact); err != nil {
 			panic(err)
 		}
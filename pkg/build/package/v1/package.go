@@ -3,6 +3,7 @@ package v1
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -19,6 +20,9 @@ import (
 	"github.com/tinyzimmer/k3p/pkg/util"
 )
 
+// MetaVersion is the metadata version written by this package format.
+const MetaVersion = "v1"
+
 const (
 	// binDir is the directory for storing binary artifacts inside a package
 	binDir = "bin"
@@ -32,15 +36,19 @@ const (
 	staticDir = "static"
 	// etcDir is where etc artifacts are stored inside the package
 	etcDir = "etc"
+	// sbomDir is where software bills of materials are stored inside the package
+	sbomDir = "sbom"
 	// the tar file we use inside the workdir
 	tarFile = "package.tar"
 )
 
 // New returns a new v1 package writer.
 func New(dir string) types.Package {
+	meta := types.NewEmptyMeta()
+	meta.MetaVersion = MetaVersion
 	return &readWriter{
 		workDir: dir,
-		meta:    types.NewEmptyMeta(),
+		meta:    meta,
 	}
 }
 
@@ -51,8 +59,7 @@ func Load(rdr io.ReadCloser) (types.Package, error) {
 	if err != nil {
 		return nil, err
 	}
-	pkg := &readWriter{workDir: workDir}
-	f, err := os.Create(pkg.tarFile())
+	f, err := os.Create(path.Join(workDir, tarFile))
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +67,13 @@ func Load(rdr io.ReadCloser) (types.Package, error) {
 	if _, err := io.Copy(f, rdr); err != nil {
 		return nil, err
 	}
+	return Open(workDir)
+}
 
+// Open loads a package that was already written to a package.tar inside the given directory.
+// The directory is removed when the package is closed.
+func Open(workDir string) (types.Package, error) {
+	pkg := &readWriter{workDir: workDir}
 	artifact := &types.Artifact{Name: types.ManifestMetaFile}
 	if err := pkg.Get(artifact); err != nil {
 		return nil, err
@@ -74,12 +87,21 @@ func Load(rdr io.ReadCloser) (types.Package, error) {
 		return nil, err
 	}
 	pkg.meta = &meta
+	if pkg.meta.Manifest == nil {
+		pkg.meta.Manifest = types.NewEmptyManifest()
+	}
+	if err := pkg.Verify(); err != nil {
+		return nil, err
+	}
 	return pkg, nil
 }
 
 type readWriter struct {
 	workDir string
 	meta    *types.PackageMeta
+	// verified is set once the contents of the tar file have been checked
+	// against the digests in the metadata.
+	verified bool
 }
 
 func (rw *readWriter) tarFile() string {
@@ -111,14 +133,22 @@ func (rw *readWriter) Put(artifact *types.Artifact) error {
 		return err
 	}
 	defer tarWriter.Close()
-	header := genArtifactHeader(artifact)
+	header := ArtifactHeader(artifact)
 	log.Debug("Generated header for artifact", header)
 	if err := tarWriter.WriteHeader(header); err != nil {
 		return err
 	}
-	_, err = io.Copy(tarWriter, artifact.Body)
-	rw.appendMeta(artifact.Type, header.Name)
-	return err
+	h := sha256.New()
+	written, err := io.Copy(tarWriter, io.TeeReader(artifact.Body, h))
+	if err != nil {
+		return err
+	}
+	AppendMeta(rw.meta, artifact.Type, header.Name)
+	// The metadata can't contain a digest of itself
+	if header.Name != types.ManifestMetaFile {
+		rw.appendDigest(header.Name, fmt.Sprintf("%x", h.Sum(nil)), written)
+	}
+	return nil
 }
 
 func (rw *readWriter) PutMeta(meta *types.PackageMeta) error {
@@ -131,14 +161,11 @@ func (rw *readWriter) PutMeta(meta *types.PackageMeta) error {
 }
 
 func (rw *readWriter) GetMeta() *types.PackageMeta {
-	return rw.sanitizeMeta()
+	return SanitizeMeta(rw.meta)
 }
 
 func (rw *readWriter) Get(artifact *types.Artifact) error {
-	searchName := artifact.Name
-	if !rw.hasDirPrefix(artifact) {
-		searchName = path.Join(dirFromType(artifact.Type), artifact.Name)
-	}
+	searchName := ArtifactPath(artifact)
 	f, err := os.Open(rw.tarFile())
 	if err != nil {
 		return err
@@ -162,13 +189,63 @@ func (rw *readWriter) Get(artifact *types.Artifact) error {
 			continue
 		}
 		// We have the right artifact - populate the provided object and return
-		artifact.Body = ioutil.NopCloser(rdr)
+		artifact.Body = rw.newDigestReader(header.Name, rdr, f)
 		artifact.Size = header.Size
 
 		return nil
 	}
 }
 
+func (rw *readWriter) Verify() error {
+	if rw.verified {
+		return nil
+	}
+	digests := rw.meta.Manifest.Digests
+	if len(digests) == 0 {
+		log.Warning("The package does not contain any artifact digests, its contents cannot be verified")
+		rw.verified = true
+		return nil
+	}
+	log.Debugf("Verifying %d artifacts against the package metadata\n", len(digests))
+	f, err := os.Open(rw.tarFile())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	seen := make(map[string]struct{})
+	rdr := tar.NewReader(f)
+	for {
+		header, err := rdr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Get always returns the first match for a name, so only the first is checked
+		if _, ok := seen[header.Name]; ok {
+			continue
+		}
+		if _, ok := digests[header.Name]; !ok {
+			continue
+		}
+		seen[header.Name] = struct{}{}
+		if _, err := io.Copy(ioutil.Discard, rw.newDigestReader(header.Name, rdr, nil)); err != nil {
+			return err
+		}
+	}
+	for name, digest := range digests {
+		if _, ok := seen[name]; !ok && !digest.Base {
+			return fmt.Errorf("artifact %q is listed in the package metadata but missing from the archive", name)
+		}
+	}
+	rw.verified = true
+	return nil
+}
+
 func (rw *readWriter) Archive() (types.Archive, error) {
 	rawMeta, err := json.MarshalIndent(rw.meta, "", "  ")
 	if err != nil {
@@ -182,81 +259,85 @@ func (rw *readWriter) Archive() (types.Archive, error) {
 	if err := rw.Put(artifact); err != nil {
 		return nil, err
 	}
-	stat, err := os.Stat(rw.tarFile())
-	if err != nil {
-		return nil, err
-	}
-	f, err := os.Open(rw.tarFile())
-	if err != nil {
-		return nil, err
-	}
-	out := &archive{stat: stat, f: f}
-	return out, nil
+	return OpenArchive(rw.tarFile())
 }
 
 func (rw *readWriter) Close() error {
 	return os.RemoveAll(rw.workDir)
 }
 
-func (rw *readWriter) sanitizeMeta() *types.PackageMeta {
-	outMeta := rw.meta.DeepCopy()
+// SanitizeMeta returns a copy of the given metadata with the directory prefixes used inside
+// the archive stripped from the manifest listings.
+func SanitizeMeta(meta *types.PackageMeta) *types.PackageMeta {
+	outMeta := meta.DeepCopy()
 	outMeta.Manifest = types.NewEmptyManifest()
-	for _, bin := range rw.meta.Manifest.Bins {
+	for _, bin := range meta.Manifest.Bins {
 		outMeta.Manifest.Bins = append(outMeta.Manifest.Bins, strings.TrimPrefix(bin, binDir+"/"))
 	}
-	for _, img := range rw.meta.Manifest.Images {
+	for _, img := range meta.Manifest.Images {
 		outMeta.Manifest.Images = append(outMeta.Manifest.Images, strings.TrimPrefix(img, imageDir+"/"))
 	}
-	for _, script := range rw.meta.Manifest.Scripts {
+	for _, script := range meta.Manifest.Scripts {
 		outMeta.Manifest.Scripts = append(outMeta.Manifest.Scripts, strings.TrimPrefix(script, scriptsDir+"/"))
 	}
-	for _, mani := range rw.meta.Manifest.K8sManifests {
+	for _, mani := range meta.Manifest.K8sManifests {
 		outMeta.Manifest.K8sManifests = append(outMeta.Manifest.K8sManifests, strings.TrimPrefix(mani, manifestDir+"/"))
 	}
-	for _, static := range rw.meta.Manifest.Static {
+	for _, static := range meta.Manifest.Static {
 		outMeta.Manifest.Static = append(outMeta.Manifest.Static, strings.TrimPrefix(static, staticDir+"/"))
 	}
-	for _, etc := range rw.meta.Manifest.Etc {
+	for _, etc := range meta.Manifest.Etc {
 		outMeta.Manifest.Etc = append(outMeta.Manifest.Etc, strings.TrimPrefix(etc, etcDir+"/"))
 	}
+	for _, sbom := range meta.Manifest.SBOM {
+		outMeta.Manifest.SBOM = append(outMeta.Manifest.SBOM, strings.TrimPrefix(sbom, sbomDir+"/"))
+	}
+	outMeta.Manifest.EULA = meta.Manifest.EULA
+	outMeta.Manifest.Digests = meta.Manifest.DeepCopy().Digests
+	outMeta.Manifest.ArchiveSize = meta.Manifest.ArchiveSize
 	return outMeta
 }
 
-func (rw *readWriter) appendMeta(t types.ArtifactType, tarPath string) {
+// AppendMeta appends the given archive path to the manifest listing for the artifact type.
+func AppendMeta(meta *types.PackageMeta, t types.ArtifactType, tarPath string) {
 	switch t {
 	case types.ArtifactBin:
-		rw.meta.Manifest.Bins = append(rw.meta.Manifest.Bins, tarPath)
+		meta.Manifest.Bins = append(meta.Manifest.Bins, tarPath)
 	case types.ArtifactImages:
-		rw.meta.Manifest.Images = append(rw.meta.Manifest.Images, tarPath)
+		meta.Manifest.Images = append(meta.Manifest.Images, tarPath)
 	case types.ArtifactScript:
-		rw.meta.Manifest.Scripts = append(rw.meta.Manifest.Scripts, tarPath)
+		meta.Manifest.Scripts = append(meta.Manifest.Scripts, tarPath)
 	case types.ArtifactManifest:
-		rw.meta.Manifest.K8sManifests = append(rw.meta.Manifest.K8sManifests, tarPath)
+		meta.Manifest.K8sManifests = append(meta.Manifest.K8sManifests, tarPath)
 	case types.ArtifactStatic:
-		rw.meta.Manifest.Static = append(rw.meta.Manifest.Static, tarPath)
+		meta.Manifest.Static = append(meta.Manifest.Static, tarPath)
 	case types.ArtifactEtc:
-		rw.meta.Manifest.Etc = append(rw.meta.Manifest.Etc, tarPath)
+		meta.Manifest.Etc = append(meta.Manifest.Etc, tarPath)
+	case types.ArtifactSBOM:
+		meta.Manifest.SBOM = append(meta.Manifest.SBOM, tarPath)
 	case types.ArtifactEULA:
-		rw.meta.Manifest.EULA = tarPath
+		meta.Manifest.EULA = tarPath
 	}
 }
 
-func (rw *readWriter) hasDirPrefix(artifact *types.Artifact) bool {
-	switch artifact.Type {
-	case types.ArtifactBin:
-		return strings.HasPrefix(artifact.Name, binDir)
-	case types.ArtifactImages:
-		return strings.HasPrefix(artifact.Name, imageDir)
-	case types.ArtifactScript:
-		return strings.HasPrefix(artifact.Name, scriptsDir)
-	case types.ArtifactManifest:
-		return strings.HasPrefix(artifact.Name, manifestDir)
-	case types.ArtifactStatic:
-		return strings.HasPrefix(artifact.Name, staticDir)
-	case types.ArtifactEtc:
-		return strings.HasPrefix(artifact.Name, etcDir)
+func (rw *readWriter) appendDigest(tarPath, sha256sum string, size int64) {
+	if rw.meta.Manifest.Digests == nil {
+		rw.meta.Manifest.Digests = make(map[string]types.ArtifactDigest)
 	}
-	return false
+	rw.meta.Manifest.Digests[tarPath] = types.ArtifactDigest{SHA256: sha256sum, Size: size}
+}
+
+// ArtifactPath returns the path of the given artifact inside the archive.
+func ArtifactPath(artifact *types.Artifact) string {
+	if hasDirPrefix(artifact) {
+		return artifact.Name
+	}
+	return path.Join(dirFromType(artifact.Type), artifact.Name)
+}
+
+func hasDirPrefix(artifact *types.Artifact) bool {
+	dir := dirFromType(artifact.Type)
+	return dir != "" && strings.HasPrefix(artifact.Name, dir+"/")
 }
 
 func dirFromType(t types.ArtifactType) string {
@@ -273,10 +354,33 @@ func dirFromType(t types.ArtifactType) string {
 		return staticDir
 	case types.ArtifactEtc:
 		return etcDir
+	case types.ArtifactSBOM:
+		return sbomDir
 	}
 	return ""
 }
 
+// ArtifactFromPath returns the type of the artifact at the given path inside the archive,
+// along with its name relative to the directory for that type.
+func ArtifactFromPath(tarPath string) (types.ArtifactType, string) {
+	if tarPath == types.ManifestEULAFile {
+		return types.ArtifactEULA, tarPath
+	}
+	spl := strings.SplitN(tarPath, "/", 2)
+	if len(spl) != 2 {
+		return "", tarPath
+	}
+	for _, t := range []types.ArtifactType{
+		types.ArtifactBin, types.ArtifactImages, types.ArtifactScript,
+		types.ArtifactManifest, types.ArtifactStatic, types.ArtifactEtc, types.ArtifactSBOM,
+	} {
+		if dirFromType(t) == spl[0] {
+			return t, spl[1]
+		}
+	}
+	return "", tarPath
+}
+
 func fileExists(path string) bool {
 	stat, err := os.Stat(path)
 	if err != nil {
@@ -285,7 +389,8 @@ func fileExists(path string) bool {
 	return !stat.IsDir()
 }
 
-func genArtifactHeader(artifact *types.Artifact) *tar.Header {
+// ArtifactHeader generates the tar header for writing the given artifact to an archive.
+func ArtifactHeader(artifact *types.Artifact) *tar.Header {
 	uid := 0
 	uname := "root"
 	if u, err := user.Current(); err == nil {
@@ -305,3 +410,17 @@ func genArtifactHeader(artifact *types.Artifact) *tar.Header {
 		ModTime: now, AccessTime: now, ChangeTime: now,
 	}
 }
+
+// ReproducibleHeader generates the tar header for writing the given artifact to a reproducible
+// archive. The entry is owned by root and stamped with the given time instead of the current one.
+func ReproducibleHeader(artifact *types.Artifact, modTime time.Time) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(dirFromType(artifact.Type), artifact.Name),
+		Size:     artifact.Size,
+		Mode:     0644,
+		Uid:      0, Gid: 0,
+		Uname: "root", Gname: "root",
+		ModTime: modTime.UTC(),
+	}
+}
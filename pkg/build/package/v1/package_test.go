@@ -0,0 +1,166 @@
+package v1
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestPackage(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "V1 Package Suite")
+}
+
+// archiveBytes finalizes the given package and returns the raw contents of the tarball.
+func archiveBytes(pkg types.Package) []byte {
+	archive, err := pkg.Archive()
+	Expect(err).ToNot(HaveOccurred())
+	body, err := ioutil.ReadAll(archive.Reader())
+	Expect(err).ToNot(HaveOccurred())
+	return body
+}
+
+// tamper rewrites the tarball replacing the contents of the named entry.
+func tamper(raw []byte, name, contents string) []byte {
+	var out bytes.Buffer
+	rdr := tar.NewReader(bytes.NewReader(raw))
+	tw := tar.NewWriter(&out)
+	for {
+		header, err := rdr.Next()
+		if err == io.EOF {
+			break
+		}
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(rdr)
+		Expect(err).ToNot(HaveOccurred())
+		if header.Name == name {
+			body = []byte(contents)
+			header.Size = int64(len(body))
+		}
+		Expect(tw.WriteHeader(header)).To(Succeed())
+		_, err = tw.Write(body)
+		Expect(err).ToNot(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	return out.Bytes()
+}
+
+var _ = Describe("V1 Package", func() {
+
+	Describe("Writing artifacts", func() {
+		var pkg types.Package
+
+		BeforeEach(func() { pkg = Mock() })
+		AfterEach(func() { pkg.Close() })
+
+		It("Should record a digest for every artifact", func() {
+			digests := pkg.GetMeta().GetManifest().Digests
+			Expect(len(digests)).To(Equal(len(mockArtifacts())))
+			// sha256sum of "test"
+			Expect(digests["bin/k3s"].SHA256).To(Equal("9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"))
+			Expect(digests["bin/k3s"].Size).To(Equal(int64(4)))
+		})
+
+		It("Should verify its own contents", func() {
+			Expect(pkg.Verify()).To(Succeed())
+		})
+	})
+
+	Describe("Loading packages", func() {
+		var (
+			raw []byte
+			pkg types.Package
+			err error
+		)
+
+		JustBeforeEach(func() {
+			pkg, err = Load(ioutil.NopCloser(bytes.NewReader(raw)))
+		})
+
+		AfterEach(func() {
+			if pkg != nil {
+				pkg.Close()
+			}
+		})
+
+		Context("When the package is intact", func() {
+			BeforeEach(func() {
+				mock := Mock()
+				defer mock.Close()
+				raw = archiveBytes(mock)
+			})
+			It("Should load and stream verified artifacts", func() {
+				Expect(err).ToNot(HaveOccurred())
+				artifact := &types.Artifact{Type: types.ArtifactBin, Name: "k3s"}
+				Expect(pkg.Get(artifact)).To(Succeed())
+				body, err := ioutil.ReadAll(artifact.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal("test"))
+			})
+		})
+
+		Context("When an artifact has been modified", func() {
+			BeforeEach(func() {
+				mock := Mock()
+				defer mock.Close()
+				raw = tamper(archiveBytes(mock), "bin/k3s", "evil")
+			})
+			It("Should fail to load", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("sha256 mismatch in bin/k3s"))
+			})
+		})
+
+		Context("When an artifact has been truncated", func() {
+			BeforeEach(func() {
+				mock := Mock()
+				defer mock.Close()
+				raw = tamper(archiveBytes(mock), "images/k3s-airgap-images.tar", "te")
+			})
+			It("Should fail to load", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("size mismatch in images/k3s-airgap-images.tar"))
+			})
+		})
+
+		Context("When the package was built without digests", func() {
+			BeforeEach(func() {
+				mock := Mock()
+				defer mock.Close()
+				mock.(*readWriter).meta.Manifest.Digests = nil
+				raw = archiveBytes(mock)
+			})
+			It("Should still load", func() {
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("Reading tampered artifacts from a loaded package", func() {
+		It("Should return an error at the end of the stream", func() {
+			mock := Mock()
+			defer mock.Close()
+			raw := archiveBytes(mock)
+			pkg, err := Load(ioutil.NopCloser(bytes.NewReader(raw)))
+			Expect(err).ToNot(HaveOccurred())
+			defer pkg.Close()
+			// corrupt the file on disk after the initial verification
+			rw := pkg.(*readWriter)
+			Expect(ioutil.WriteFile(rw.tarFile(), tamper(raw, "manifests/manifest.yaml", "nope"), 0644)).To(Succeed())
+			artifact := &types.Artifact{Type: types.ArtifactManifest, Name: "manifest.yaml"}
+			Expect(pkg.Get(artifact)).To(Succeed())
+			_, err = ioutil.ReadAll(artifact.Body)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("mismatch"))
+		})
+	})
+})
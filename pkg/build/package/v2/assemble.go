@@ -0,0 +1,116 @@
+package v2
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// ArtifactOpener returns the contents of the artifact at the given path in the archive.
+type ArtifactOpener func(name string, digest types.ArtifactDigest) (io.ReadCloser, error)
+
+// Assemble writes an archive to w from the raw metadata of a package and the contents of each
+// artifact it lists, as returned by open. The metadata is written exactly as given, so any
+// signatures over it remain valid, and every artifact is placed at the offset recorded for it.
+// The contents returned by open are copied as they are, callers are expected to verify them.
+func Assemble(w io.Writer, rawMeta []byte, open ArtifactOpener) error {
+	var meta types.PackageMeta
+	if err := json.Unmarshal(rawMeta, &meta); err != nil {
+		return err
+	}
+	if meta.MetaVersion != MetaVersion || meta.Manifest == nil || len(meta.Manifest.Digests) == 0 {
+		return errors.New("The package metadata does not record the layout of the archive")
+	}
+	names := make([]string, 0, len(meta.Manifest.Digests))
+	for name, digest := range meta.Manifest.Digests {
+		if !digest.Base {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return meta.Manifest.Digests[names[i]].Offset < meta.Manifest.Digests[names[j]].Offset
+	})
+
+	cw := &countingWriter{w: w}
+	tarWriter := tar.NewWriter(cw)
+	if err := tarWriter.WriteHeader(blockHeader(types.ManifestMetaFile, int64(len(rawMeta)), time.Now())); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(rawMeta); err != nil {
+		return err
+	}
+	for _, name := range names {
+		digest := meta.Manifest.Digests[name]
+		header := v1.ArtifactHeader(&types.Artifact{Size: digest.Size})
+		header.Name = name
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		// the writer does not buffer, the contents start at the current position
+		if cw.n != digest.Offset {
+			return fmt.Errorf("%s would be written at offset %d instead of %d recorded in the package metadata", name, cw.n, digest.Offset)
+		}
+		if err := copyArtifact(tarWriter, name, digest, open); err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Flush(); err != nil {
+		return err
+	}
+
+	idx := &packageIndex{MetaOffset: blockSize, MetaSize: int64(len(rawMeta))}
+	rawIdx, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	rawIdx = append(rawIdx, []byte(strings.Repeat(" ", blockSize-len(rawIdx)))...)
+	if err := tarWriter.WriteHeader(blockHeader(indexFile, blockSize, time.Now())); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(rawIdx); err != nil {
+		return err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if cw.n != meta.Manifest.ArchiveSize {
+		return fmt.Errorf("The assembled archive is %d bytes instead of %d recorded in the package metadata", cw.n, meta.Manifest.ArchiveSize)
+	}
+	return nil
+}
+
+func copyArtifact(w io.Writer, name string, digest types.ArtifactDigest, open ArtifactOpener) error {
+	body, err := open(name, digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return err
+	}
+	if n != digest.Size {
+		return fmt.Errorf("size mismatch in %s: expected %d bytes, got %d", name, digest.Size, n)
+	}
+	return nil
+}
+
+// countingWriter records the number of bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,615 @@
+package v2
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+// MetaVersion is the metadata version written by this package format.
+const MetaVersion = "v2"
+
+const (
+	// the tar file we use inside the workdir
+	tarFile = "package.tar"
+	// indexFile is the name of the entry at the end of the archive pointing to the metadata
+	indexFile = ".k3p-index"
+	// blockSize is the size of a tar block, the index is always written as a single block
+	blockSize = 512
+)
+
+// packageIndex is written as the last entry of the archive. It records the location of the
+// metadata, which in turn records the location of every artifact in the archive.
+type packageIndex struct {
+	// The offset of the metadata contents in the archive
+	MetaOffset int64 `json:"metaOffset"`
+	// The size of the metadata
+	MetaSize int64 `json:"metaSize"`
+	// the offset of the index entry itself
+	indexOffset int64
+}
+
+// padded returns the given size rounded up to a full tar block.
+func padded(size int64) int64 {
+	return (size + blockSize - 1) / blockSize * blockSize
+}
+
+// blockHeader returns a header that fits in a single tar block, so that the position
+// of the entry contents are known ahead of time.
+func blockHeader(name string, size int64, modTime time.Time) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime.Truncate(time.Second),
+		Format:   tar.FormatUSTAR,
+	}
+}
+
+// New returns a new v2 package writer. The v2 format uses the same layout as v1, but
+// the metadata is always the first entry in the archive and records the offset of every
+// artifact. An index at the end of the archive records the location of the metadata. This
+// allows artifacts to be read without scanning the archive, and packages to be streamed
+// in a single pass.
+func New(dir string) types.Package {
+	meta := types.NewEmptyMeta()
+	meta.MetaVersion = MetaVersion
+	return &readWriter{
+		workDir: dir,
+		meta:    meta,
+		dirty:   true,
+	}
+}
+
+// NewReproducible returns a new v2 package writer that produces the same archive for the same
+// contents. Every entry is owned by root and stamped with the given time, and the artifacts are
+// written in order of their paths, with the EULA first, regardless of the order they were added in.
+func NewReproducible(dir string, sourceDate time.Time) types.Package {
+	rw := New(dir).(*readWriter)
+	rw.sourceDate = &sourceDate
+	return rw
+}
+
+// Load loads the given readcloser into a Package interface. Packages produced by the v1
+// format are detected and loaded with the v1 implementation.
+func Load(rdr io.ReadCloser) (types.Package, error) {
+	defer rdr.Close()
+	workDir, err := util.GetTempDir()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path.Join(workDir, tarFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, rdr); err != nil {
+		return nil, err
+	}
+	return Open(workDir)
+}
+
+// Open loads a package that was already written to a package.tar inside the given directory.
+// The directory is removed when the package is closed.
+func Open(workDir string) (types.Package, error) {
+	pkg := &readWriter{workDir: workDir}
+	if err := pkg.readMeta(); err != nil {
+		if err == errNoIndex {
+			return v1.Open(workDir)
+		}
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// OpenFile loads the package at the given path in place. Only the index and the metadata are
+// read up front, and artifacts are read from the file as they are requested. The file itself is
+// never modified, it is copied to a temporary directory before any changes are made. Packages
+// produced by the v1 format are copied and loaded with the v1 implementation.
+func OpenFile(tarPath string) (types.Package, error) {
+	pkg := &readWriter{path: tarPath}
+	if err := pkg.readMeta(); err != nil {
+		if err == errNoIndex {
+			f, err := os.Open(tarPath)
+			if err != nil {
+				return nil, err
+			}
+			return Load(f)
+		}
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// errNoIndex is returned by readMeta when the archive does not end with a package index.
+var errNoIndex = errors.New("archive does not contain a package index")
+
+// readMeta reads the index and the metadata from the archive. The artifacts are not read,
+// each of them is verified as it is retrieved with Get.
+func (rw *readWriter) readMeta() error {
+	idx, err := rw.readIndex()
+	if err != nil {
+		log.Debug("Could not read package index:", err.Error())
+		return errNoIndex
+	}
+	rw.index = idx
+	rw.dataStart = idx.MetaOffset + padded(idx.MetaSize)
+	rw.dataEnd = idx.indexOffset
+	artifact := &types.Artifact{Name: types.ManifestMetaFile}
+	if err := rw.Get(artifact); err != nil {
+		return err
+	}
+	defer artifact.Body.Close()
+	rawMeta, err := ioutil.ReadAll(artifact.Body)
+	if err != nil {
+		return err
+	}
+	var meta types.PackageMeta
+	if err := json.Unmarshal(rawMeta, &meta); err != nil {
+		return err
+	}
+	rw.meta = &meta
+	if rw.meta.Manifest == nil {
+		rw.meta.Manifest = types.NewEmptyManifest()
+	}
+	return nil
+}
+
+type readWriter struct {
+	workDir string
+	// path is set when the package was opened in place from a file outside the work directory
+	path string
+	meta *types.PackageMeta
+	// index is populated once the metadata has been written to or read from the archive
+	index *packageIndex
+	// the artifacts in the tar file occupy the range between dataStart and dataEnd
+	dataStart, dataEnd int64
+	// dirty is set when the archive has changes that are not reflected in the written metadata
+	dirty bool
+	// verified is set once the contents of the tar file have been checked
+	// against the digests in the metadata.
+	verified bool
+	// sourceDate is set for reproducible archives and replaces the current time in every entry
+	sourceDate *time.Time
+}
+
+// modTime returns the time to stamp on new entries in the archive.
+func (rw *readWriter) modTime() time.Time {
+	if rw.sourceDate != nil {
+		return *rw.sourceDate
+	}
+	return time.Now()
+}
+
+func (rw *readWriter) tarFile() string {
+	if rw.path != "" {
+		return rw.path
+	}
+	return path.Join(rw.workDir, tarFile)
+}
+
+// copyToWorkDir copies a package that was opened in place to a new work directory, so that
+// changes to the package are never written to the original file.
+func (rw *readWriter) copyToWorkDir() error {
+	if rw.path == "" {
+		return nil
+	}
+	workDir, err := util.GetTempDir()
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(rw.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path.Join(workDir, tarFile))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	rw.workDir, rw.path = workDir, ""
+	return nil
+}
+
+// openForAppend opens the tar file positioned so that new entries are written directly
+// after the last artifact.
+func (rw *readWriter) openForAppend() (*os.File, error) {
+	if err := rw.copyToWorkDir(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(rw.tarFile(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(rw.dataEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(rw.dataEnd, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// put writes the given artifact to the archive and returns the offset and size of its contents.
+func (rw *readWriter) put(header *tar.Header, body io.Reader) (offset int64, digest string, size int64, err error) {
+	f, err := rw.openForAppend()
+	if err != nil {
+		return 0, "", 0, err
+	}
+	defer f.Close()
+	tarWriter := tar.NewWriter(f)
+	log.Debug("Generated header for artifact", header)
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return 0, "", 0, err
+	}
+	// the tar writer does not buffer, so the contents start at the current position
+	if offset, err = f.Seek(0, io.SeekCurrent); err != nil {
+		return 0, "", 0, err
+	}
+	h := sha256.New()
+	if size, err = io.Copy(tarWriter, io.TeeReader(body, h)); err != nil {
+		return 0, "", 0, err
+	}
+	if err := tarWriter.Flush(); err != nil {
+		return 0, "", 0, err
+	}
+	if rw.dataEnd, err = f.Seek(0, io.SeekCurrent); err != nil {
+		return 0, "", 0, err
+	}
+	rw.index = nil
+	if err := tarWriter.Close(); err != nil {
+		return 0, "", 0, err
+	}
+	return offset, fmt.Sprintf("%x", h.Sum(nil)), size, nil
+}
+
+func (rw *readWriter) Put(artifact *types.Artifact) error {
+	defer artifact.Body.Close()
+	header := v1.ArtifactHeader(artifact)
+	if header.Name == types.ManifestMetaFile {
+		return errors.New("the package metadata can only be written with PutMeta")
+	}
+	offset, sum, size, err := rw.put(header, artifact.Body)
+	if err != nil {
+		return err
+	}
+	v1.AppendMeta(rw.meta, artifact.Type, header.Name)
+	if rw.meta.Manifest.Digests == nil {
+		rw.meta.Manifest.Digests = make(map[string]types.ArtifactDigest)
+	}
+	rw.meta.Manifest.Digests[header.Name] = types.ArtifactDigest{SHA256: sum, Size: size, Offset: offset}
+	rw.dirty = true
+	return nil
+}
+
+func (rw *readWriter) PutMeta(meta *types.PackageMeta) error {
+	meta.Sanitize()
+	out, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(out, rw.meta); err != nil {
+		return err
+	}
+	rw.meta.MetaVersion = MetaVersion
+	rw.dirty = true
+	return nil
+}
+
+func (rw *readWriter) GetMeta() *types.PackageMeta {
+	return v1.SanitizeMeta(rw.meta)
+}
+
+func (rw *readWriter) Get(artifact *types.Artifact) error {
+	searchName := v1.ArtifactPath(artifact)
+	var offset, size int64
+	var digest *types.ArtifactDigest
+	if searchName == types.ManifestMetaFile {
+		if rw.index == nil {
+			return fmt.Errorf("%s artifact %q not found", artifact.Type, artifact.Name)
+		}
+		offset, size = rw.index.MetaOffset, rw.index.MetaSize
+	} else {
+		d, ok := rw.meta.Manifest.Digests[searchName]
+		if !ok {
+			return fmt.Errorf("%s artifact %q not found", artifact.Type, artifact.Name)
+		}
+		if d.Base {
+			return fmt.Errorf("%s artifact %q is not included in this delta package", artifact.Type, artifact.Name)
+		}
+		offset, size, digest = d.Offset, d.Size, &d
+	}
+	f, err := os.Open(rw.tarFile())
+	if err != nil {
+		return err
+	}
+	artifact.Body = util.NewDigestReader(searchName, io.NewSectionReader(f, offset, size), f, digest)
+	artifact.Size = size
+	return nil
+}
+
+func (rw *readWriter) Verify() error {
+	if rw.verified {
+		return nil
+	}
+	log.Debugf("Verifying %d artifacts against the package metadata\n", len(rw.meta.Manifest.Digests))
+	f, err := os.Open(rw.tarFile())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for name, digest := range rw.meta.Manifest.Digests {
+		if digest.Base {
+			continue
+		}
+		d := digest
+		rdr := util.NewDigestReader(name, io.NewSectionReader(f, d.Offset, d.Size), nil, &d)
+		if _, err := io.Copy(ioutil.Discard, rdr); err != nil {
+			return err
+		}
+	}
+	rw.verified = true
+	return nil
+}
+
+func (rw *readWriter) Archive() (types.Archive, error) {
+	if rw.dirty {
+		if err := rw.writeArchive(); err != nil {
+			return nil, err
+		}
+	}
+	return v1.OpenArchive(rw.tarFile())
+}
+
+func (rw *readWriter) Close() error {
+	if rw.workDir == "" {
+		return nil
+	}
+	return os.RemoveAll(rw.workDir)
+}
+
+// layoutMeta serializes the metadata for an archive that starts with the metadata. Since the
+// metadata records the offsets of the artifacts that follow it, along with the size of the
+// whole archive, serialization is repeated until the number of blocks it occupies is stable.
+func (rw *readWriter) layoutMeta() (meta *types.PackageMeta, rawMeta []byte, dataStart int64, err error) {
+	meta = rw.meta.DeepCopy()
+	dataLen := rw.dataEnd - rw.dataStart
+	dataStart = blockSize
+	for {
+		for name, digest := range rw.meta.Manifest.Digests {
+			if digest.Base {
+				continue
+			}
+			digest.Offset += dataStart - rw.dataStart
+			meta.Manifest.Digests[name] = digest
+		}
+		// metadata, artifacts, the index entry, and the two blocks terminating the archive
+		meta.Manifest.ArchiveSize = dataStart + dataLen + 4*blockSize
+		rawMeta, err = json.MarshalIndent(meta, "", "  ")
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		next := blockSize + padded(int64(len(rawMeta)))
+		if next == dataStart {
+			return meta, rawMeta, dataStart, nil
+		}
+		dataStart = next
+	}
+}
+
+// writeArchive rewrites the tar file with the current metadata as the first entry, followed
+// by the artifacts, and an index pointing to the metadata as the last entry.
+func (rw *readWriter) writeArchive() error {
+	if err := rw.copyToWorkDir(); err != nil {
+		return err
+	}
+	if rw.sourceDate != nil {
+		if err := rw.sortArtifacts(); err != nil {
+			return err
+		}
+	}
+	meta, rawMeta, dataStart, err := rw.layoutMeta()
+	if err != nil {
+		return err
+	}
+
+	src, err := os.OpenFile(rw.tarFile(), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpFile := rw.tarFile() + ".tmp"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	tarWriter := tar.NewWriter(out)
+	if err := tarWriter.WriteHeader(blockHeader(types.ManifestMetaFile, int64(len(rawMeta)), rw.modTime())); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(rawMeta); err != nil {
+		return err
+	}
+	if err := tarWriter.Flush(); err != nil {
+		return err
+	}
+	dataLen := rw.dataEnd - rw.dataStart
+	if _, err := io.Copy(out, io.NewSectionReader(src, rw.dataStart, dataLen)); err != nil {
+		return err
+	}
+
+	idx := &packageIndex{MetaOffset: blockSize, MetaSize: int64(len(rawMeta)), indexOffset: dataStart + dataLen}
+	rawIdx, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if len(rawIdx) > blockSize {
+		return errors.New("package index does not fit in a single tar block")
+	}
+	// pad the index to exactly one block so it can be found from the end of the archive
+	rawIdx = append(rawIdx, []byte(strings.Repeat(" ", blockSize-len(rawIdx)))...)
+	tarWriter = tar.NewWriter(out)
+	if err := tarWriter.WriteHeader(blockHeader(indexFile, blockSize, rw.modTime())); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(rawIdx); err != nil {
+		return err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, rw.tarFile()); err != nil {
+		return err
+	}
+
+	rw.meta = meta
+	rw.index = idx
+	rw.dataStart, rw.dataEnd = dataStart, dataStart+dataLen
+	rw.dirty = false
+	return nil
+}
+
+// sortArtifacts rewrites the artifacts in the tar file in order of their paths, with the EULA
+// first, so the layout of the archive does not depend on the order they were added in. The
+// entries are given reproducible headers, and the listings in the manifest are rebuilt in the
+// same order.
+func (rw *readWriter) sortArtifacts() error {
+	digests := rw.meta.Manifest.Digests
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if isEULA := names[i] == types.ManifestEULAFile; isEULA != (names[j] == types.ManifestEULAFile) {
+			return isEULA
+		}
+		return names[i] < names[j]
+	})
+
+	src, err := os.OpenFile(rw.tarFile(), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpFile := rw.tarFile() + ".tmp"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	listing := &types.PackageMeta{Manifest: types.NewEmptyManifest()}
+	listing.Manifest.Digests = make(map[string]types.ArtifactDigest, len(digests))
+	listing.Manifest.ArchiveSize = rw.meta.Manifest.ArchiveSize
+	tarWriter := tar.NewWriter(out)
+	for _, name := range names {
+		digest := digests[name]
+		t, _ := v1.ArtifactFromPath(name)
+		v1.AppendMeta(listing, t, name)
+		if digest.Base {
+			listing.Manifest.Digests[name] = digest
+			continue
+		}
+		if err := tarWriter.WriteHeader(v1.ReproducibleHeader(&types.Artifact{Name: name, Size: digest.Size}, *rw.sourceDate)); err != nil {
+			return err
+		}
+		// the tar writer does not buffer, so the contents start at the current position
+		offset, err := out.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(tarWriter, io.NewSectionReader(src, digest.Offset, digest.Size)); err != nil {
+			return err
+		}
+		digest.Offset = offset
+		listing.Manifest.Digests[name] = digest
+	}
+	if err := tarWriter.Flush(); err != nil {
+		return err
+	}
+	dataEnd, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, rw.tarFile()); err != nil {
+		return err
+	}
+
+	rw.meta.Manifest = listing.Manifest
+	rw.index = nil
+	rw.dataStart, rw.dataEnd = 0, dataEnd
+	return nil
+}
+
+// readIndex reads the package index from the end of the archive. The last entry of a v2
+// archive is a single block header followed by a single block of index data, and then
+// the two zero blocks terminating the archive. The index must point to the metadata at
+// the start of the archive.
+func (rw *readWriter) readIndex() (*packageIndex, error) {
+	f, err := os.Open(rw.tarFile())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < 4*blockSize {
+		return nil, errors.New("archive is too small to contain an index")
+	}
+	indexOffset := stat.Size() - 4*blockSize
+	rdr := tar.NewReader(io.NewSectionReader(f, indexOffset, 2*blockSize))
+	header, err := rdr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if header.Name != indexFile {
+		return nil, fmt.Errorf("last entry in archive is %q, not %q", header.Name, indexFile)
+	}
+	body, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	idx := packageIndex{indexOffset: indexOffset}
+	if err := json.Unmarshal(bytes.TrimSpace(body), &idx); err != nil {
+		return nil, err
+	}
+	if idx.MetaOffset != blockSize {
+		return nil, fmt.Errorf("package metadata is at offset %d instead of the start of the archive", idx.MetaOffset)
+	}
+	return &idx, nil
+}
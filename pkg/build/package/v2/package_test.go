@@ -0,0 +1,333 @@
+package v2
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestPackage(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "V2 Package Suite")
+}
+
+// archiveBytes finalizes the given package and returns the raw contents of the tarball.
+func archiveBytes(pkg types.Package) []byte {
+	archive, err := pkg.Archive()
+	Expect(err).ToNot(HaveOccurred())
+	body, err := ioutil.ReadAll(archive.Reader())
+	Expect(err).ToNot(HaveOccurred())
+	return body
+}
+
+func load(raw []byte) (types.Package, error) {
+	return Load(ioutil.NopCloser(bytes.NewReader(raw)))
+}
+
+var _ = Describe("V2 Package", func() {
+
+	Describe("Writing artifacts", func() {
+		var pkg types.Package
+
+		BeforeEach(func() { pkg = Mock() })
+		AfterEach(func() { pkg.Close() })
+
+		It("Should record the location of every artifact", func() {
+			raw := archiveBytes(pkg)
+			for name, digest := range pkg.GetMeta().GetManifest().Digests {
+				Expect(digest.Offset).ToNot(BeZero())
+				Expect(string(raw[digest.Offset:digest.Offset+digest.Size])).To(Equal("test"), name)
+			}
+		})
+
+		It("Should write the index as the last entry", func() {
+			Expect(pkg.GetMeta().MetaVersion).To(Equal(MetaVersion))
+			archiveBytes(pkg)
+			idx, err := pkg.(*readWriter).readIndex()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(idx.MetaSize).ToNot(BeZero())
+		})
+	})
+
+	Describe("Reproducible packages", func() {
+		build := func(artifacts []*types.Artifact) []byte {
+			tmpDir, err := ioutil.TempDir("", "")
+			Expect(err).ToNot(HaveOccurred())
+			pkg := NewReproducible(tmpDir, time.Unix(1600000000, 0))
+			defer pkg.Close()
+			for _, artifact := range artifacts {
+				Expect(pkg.Put(artifact)).To(Succeed())
+			}
+			Expect(pkg.PutMeta(&types.PackageMeta{Name: "test", Version: "v1"})).To(Succeed())
+			return archiveBytes(pkg)
+		}
+
+		It("Should produce the same archive regardless of the order artifacts are added in", func() {
+			artifacts := append(mockArtifacts(), &types.Artifact{
+				Type: types.ArtifactEULA,
+				Name: types.ManifestEULAFile,
+				Body: ioutil.NopCloser(strings.NewReader("eula")),
+				Size: 4,
+			})
+			first := build(artifacts)
+
+			reversed := append(mockArtifacts(), &types.Artifact{
+				Type: types.ArtifactEULA,
+				Name: types.ManifestEULAFile,
+				Body: ioutil.NopCloser(strings.NewReader("eula")),
+				Size: 4,
+			})
+			for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+				reversed[i], reversed[j] = reversed[j], reversed[i]
+			}
+			Expect(build(reversed)).To(Equal(first))
+
+			pkg, err := load(first)
+			Expect(err).ToNot(HaveOccurred())
+			defer pkg.Close()
+			manifest := pkg.GetMeta().GetManifest()
+			Expect(manifest.Digests[types.ManifestEULAFile].Offset).To(BeNumerically("<", manifest.Digests["bin/k3s"].Offset))
+			Expect(manifest.Digests["bin/k3s"].Offset).To(BeNumerically("<", manifest.Digests["images/k3s-airgap-images.tar"].Offset))
+
+			rdr := tar.NewReader(bytes.NewReader(first))
+			for {
+				header, err := rdr.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+				Expect(header.ModTime.Unix()).To(BeEquivalentTo(1600000000), header.Name)
+				Expect(header.Uid).To(BeZero(), header.Name)
+			}
+		})
+	})
+
+	Describe("Loading packages", func() {
+		It("Should read artifacts in any order", func() {
+			mock := Mock()
+			defer mock.Close()
+			pkg, err := load(archiveBytes(mock))
+			Expect(err).ToNot(HaveOccurred())
+			defer pkg.Close()
+			for _, name := range []string{"manifest.yaml", "install.sh"} {
+				typ := types.ArtifactManifest
+				if name == "install.sh" {
+					typ = types.ArtifactScript
+				}
+				artifact := &types.Artifact{Type: typ, Name: name}
+				Expect(pkg.Get(artifact)).To(Succeed())
+				body, err := ioutil.ReadAll(artifact.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(artifact.Body.Close()).To(Succeed())
+				Expect(string(body)).To(Equal("test"))
+			}
+		})
+
+		It("Should read artifacts whose names start with the name of their directory", func() {
+			mock := Mock()
+			defer mock.Close()
+			artifacts := []*types.Artifact{
+				{Type: types.ArtifactEtc, Name: "etcd.yaml"},
+				{Type: types.ArtifactBin, Name: "binwalk"},
+				{Type: types.ArtifactScript, Name: "scripts-setup.sh"},
+			}
+			for _, artifact := range artifacts {
+				Expect(mock.Put(&types.Artifact{Type: artifact.Type, Name: artifact.Name, Body: ioutil.NopCloser(strings.NewReader(artifact.Name)), Size: int64(len(artifact.Name))})).To(Succeed())
+			}
+			pkg, err := load(archiveBytes(mock))
+			Expect(err).ToNot(HaveOccurred())
+			defer pkg.Close()
+			for _, artifact := range artifacts {
+				Expect(pkg.Get(artifact)).To(Succeed(), artifact.Name)
+				body, err := ioutil.ReadAll(artifact.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(artifact.Body.Close()).To(Succeed())
+				Expect(string(body)).To(Equal(artifact.Name))
+			}
+			Expect(pkg.GetMeta().GetManifest().Digests).To(HaveKey("etc/etcd.yaml"))
+		})
+
+		It("Should fail to read or verify a modified artifact", func() {
+			mock := Mock()
+			defer mock.Close()
+			raw := archiveBytes(mock)
+			digest := mock.GetMeta().GetManifest().Digests["bin/k3s"]
+			copy(raw[digest.Offset:], "evil")
+			pkg, err := load(raw)
+			Expect(err).ToNot(HaveOccurred())
+			defer pkg.Close()
+			artifact := &types.Artifact{Type: types.ArtifactBin, Name: "k3s"}
+			Expect(pkg.Get(artifact)).To(Succeed())
+			_, err = ioutil.ReadAll(artifact.Body)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("sha256 mismatch in bin/k3s"))
+			err = pkg.Verify()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("sha256 mismatch in bin/k3s"))
+		})
+
+		It("Should read a single artifact from a file in place without reading the others", func() {
+			mock := Mock()
+			defer mock.Close()
+			raw := archiveBytes(mock)
+			// corrupt every artifact except the one being read
+			for name, digest := range mock.GetMeta().GetManifest().Digests {
+				if name != "manifests/manifest.yaml" {
+					copy(raw[digest.Offset:], "evil")
+				}
+			}
+			tmpFile, err := ioutil.TempFile("", "")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.Remove(tmpFile.Name())
+			_, err = tmpFile.Write(raw)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tmpFile.Close()).To(Succeed())
+
+			pkg, err := OpenFile(tmpFile.Name())
+			Expect(err).ToNot(HaveOccurred())
+			defer pkg.Close()
+			Expect(pkg.(*readWriter).workDir).To(BeEmpty())
+			artifact := &types.Artifact{Type: types.ArtifactManifest, Name: "manifest.yaml"}
+			Expect(pkg.Get(artifact)).To(Succeed())
+			body, err := ioutil.ReadAll(artifact.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(artifact.Body.Close()).To(Succeed())
+			Expect(string(body)).To(Equal("test"))
+			Expect(pkg.Verify()).ToNot(Succeed())
+		})
+
+		It("Should not modify a file opened in place when the package is changed", func() {
+			mock := Mock()
+			defer mock.Close()
+			raw := archiveBytes(mock)
+			tmpFile, err := ioutil.TempFile("", "")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.Remove(tmpFile.Name())
+			_, err = tmpFile.Write(raw)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tmpFile.Close()).To(Succeed())
+
+			pkg, err := OpenFile(tmpFile.Name())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pkg.Put(&types.Artifact{
+				Type: types.ArtifactStatic,
+				Name: "extra",
+				Body: ioutil.NopCloser(strings.NewReader("extra")),
+				Size: 5,
+			})).To(Succeed())
+			archiveBytes(pkg)
+			Expect(pkg.Close()).To(Succeed())
+			onDisk, err := ioutil.ReadFile(tmpFile.Name())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(onDisk).To(Equal(raw))
+		})
+
+		It("Should preserve the original metadata when archived again", func() {
+			mock := Mock()
+			defer mock.Close()
+			raw := archiveBytes(mock)
+			pkg, err := load(raw)
+			Expect(err).ToNot(HaveOccurred())
+			defer pkg.Close()
+			Expect(archiveBytes(pkg)).To(Equal(raw))
+		})
+
+		It("Should assemble an archive from its metadata and artifacts", func() {
+			mock := Mock()
+			defer mock.Close()
+			raw := archiveBytes(mock)
+			rawMeta := raw[blockSize : blockSize+mock.(*readWriter).index.MetaSize]
+			var out bytes.Buffer
+			Expect(Assemble(&out, rawMeta, func(name string, digest types.ArtifactDigest) (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(raw[digest.Offset : digest.Offset+digest.Size])), nil
+			})).To(Succeed())
+			Expect(out.Len()).To(Equal(len(raw)))
+			pkg, err := load(out.Bytes())
+			Expect(err).ToNot(HaveOccurred())
+			defer pkg.Close()
+			Expect(string(archiveBytes(pkg)[blockSize:])).To(HavePrefix(string(rawMeta)))
+		})
+
+		It("Should load packages produced by the v1 format", func() {
+			mock := v1.Mock()
+			defer mock.Close()
+			pkg, err := load(archiveBytes(mock))
+			Expect(err).ToNot(HaveOccurred())
+			defer pkg.Close()
+			Expect(pkg.GetMeta().GetManifest().Digests).To(HaveLen(4))
+			artifact := &types.Artifact{Type: types.ArtifactBin, Name: "k3s"}
+			Expect(pkg.Get(artifact)).To(Succeed())
+			body, err := ioutil.ReadAll(artifact.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("test"))
+		})
+	})
+
+	Describe("Streaming packages", func() {
+		It("Should read every artifact in a single pass", func() {
+			mock := Mock()
+			defer mock.Close()
+			raw := archiveBytes(mock)
+			Expect(mock.GetMeta().GetManifest().ArchiveSize).To(Equal(int64(len(raw))))
+
+			stream, err := Stream(ioutil.NopCloser(bytes.NewReader(raw)))
+			Expect(err).ToNot(HaveOccurred())
+			defer stream.Close()
+			var teed bytes.Buffer
+			Expect(stream.Tee(&teed)).To(Succeed())
+			var count int
+			for {
+				artifact, err := stream.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+				body, err := ioutil.ReadAll(artifact.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal("test"))
+				count++
+			}
+			Expect(count).To(Equal(len(mockArtifacts())))
+			Expect(teed.Bytes()).To(Equal(raw))
+		})
+
+		It("Should fail on a modified artifact", func() {
+			mock := Mock()
+			defer mock.Close()
+			raw := archiveBytes(mock)
+			digest := mock.GetMeta().GetManifest().Digests["scripts/install.sh"]
+			copy(raw[digest.Offset:], "evil")
+			stream, err := Stream(ioutil.NopCloser(bytes.NewReader(raw)))
+			Expect(err).ToNot(HaveOccurred())
+			defer stream.Close()
+			for {
+				artifact, err := stream.Next()
+				Expect(err).ToNot(HaveOccurred())
+				if _, err = ioutil.ReadAll(artifact.Body); err != nil {
+					Expect(err.Error()).To(ContainSubstring("sha256 mismatch in scripts/install.sh"))
+					return
+				}
+			}
+		})
+
+		It("Should refuse packages produced by the v1 format", func() {
+			mock := v1.Mock()
+			defer mock.Close()
+			_, err := Stream(ioutil.NopCloser(bytes.NewReader(archiveBytes(mock))))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
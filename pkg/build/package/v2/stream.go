@@ -0,0 +1,148 @@
+package v2
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+// Stream reads a package in a single pass from the given reader. The metadata is parsed
+// from the first entry in the archive, and artifacts are verified against it as they are
+// read. Nothing is written to disk.
+func Stream(rdr io.ReadCloser) (types.PackageStream, error) {
+	buf := &bytes.Buffer{}
+	rec := &recorder{rdr: rdr, w: buf}
+	s := &stream{src: rdr, buf: buf, rec: rec, tarReader: tar.NewReader(rec), seen: make(map[string]struct{})}
+	header, err := s.tarReader.Next()
+	if err != nil {
+		rdr.Close()
+		return nil, err
+	}
+	if header.Name != types.ManifestMetaFile {
+		rdr.Close()
+		return nil, errors.New("The package does not start with its metadata and cannot be streamed, it must be rebuilt with a newer k3p")
+	}
+	if s.rawMeta, err = ioutil.ReadAll(s.tarReader); err != nil {
+		rdr.Close()
+		return nil, err
+	}
+	var meta types.PackageMeta
+	if err := json.Unmarshal(s.rawMeta, &meta); err != nil {
+		rdr.Close()
+		return nil, err
+	}
+	if meta.Manifest == nil || len(meta.Manifest.Digests) == 0 {
+		rdr.Close()
+		return nil, errors.New("The package does not contain artifact digests and cannot be streamed")
+	}
+	s.meta = &meta
+	return s, nil
+}
+
+type stream struct {
+	src io.ReadCloser
+	// buf holds what was read from src until a tee is provided
+	buf       *bytes.Buffer
+	rec       *recorder
+	tarReader *tar.Reader
+	rawMeta   []byte
+	meta      *types.PackageMeta
+	seen      map[string]struct{}
+	started   bool
+	closed    bool
+}
+
+func (s *stream) GetMeta() *types.PackageMeta { return v1.SanitizeMeta(s.meta) }
+
+func (s *stream) RawMeta() []byte { return s.rawMeta }
+
+func (s *stream) Tee(w io.Writer) error {
+	if s.started {
+		return errors.New("Tee must be called before reading any artifacts from the stream")
+	}
+	if _, err := io.Copy(w, s.buf); err != nil {
+		return err
+	}
+	s.rec.w = w
+	return nil
+}
+
+func (s *stream) Next() (*types.Artifact, error) {
+	if !s.started {
+		s.started = true
+		// stop buffering what was read if nobody asked for it
+		if s.rec.w == s.buf {
+			s.rec.w = ioutil.Discard
+		}
+	}
+	for {
+		header, err := s.tarReader.Next()
+		if err == io.EOF {
+			return nil, s.finish()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || header.Name == indexFile || header.Name == types.ManifestMetaFile {
+			continue
+		}
+		digest, ok := s.meta.Manifest.Digests[header.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s is not listed in the package metadata", header.Name)
+		}
+		s.seen[header.Name] = struct{}{}
+		t, name := v1.ArtifactFromPath(header.Name)
+		return &types.Artifact{
+			Type: t,
+			Name: name,
+			Body: util.NewDigestReader(header.Name, s.tarReader, nil, &digest),
+			Size: header.Size,
+		}, nil
+	}
+}
+
+// finish makes sure every artifact in the metadata was read and passes the remainder
+// of the stream to any tee.
+func (s *stream) finish() error {
+	for name, digest := range s.meta.Manifest.Digests {
+		if _, ok := s.seen[name]; !ok && !digest.Base {
+			return fmt.Errorf("%s is listed in the package metadata but was not found in the stream", name)
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, s.rec); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (s *stream) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.src.Close()
+}
+
+// recorder writes everything read from the underlying reader to w.
+type recorder struct {
+	rdr io.Reader
+	w   io.Writer
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.rdr.Read(p)
+	if n > 0 {
+		if _, werr := r.w.Write(p[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
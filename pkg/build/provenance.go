@@ -0,0 +1,211 @@
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/version"
+)
+
+// newProvenance records how the package is being built with the given options. The channel is
+// the one the k3s version was resolved from, if any. The sources are the manifest directories, or
+// the unpacked package being packed again. Reproducible builds leave out everything that depends
+// on the machine or the pipeline run, so they are the same wherever they are built.
+func newProvenance(opts *types.BuildOptions, channel string) (*types.Provenance, error) {
+	prov := &types.Provenance{
+		K3pVersion: version.K3pVersion,
+		K3pCommit:  version.K3pCommit,
+		BuildTime:  time.Now().UTC().Truncate(time.Second),
+		K3sChannel: channel,
+	}
+	if opts.SourceDate != nil {
+		prov.BuildTime = opts.SourceDate.UTC()
+	} else {
+		if host, err := os.Hostname(); err == nil {
+			prov.BuildHost = host
+		}
+		prov.BuildURL = pipelineURL()
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	rel := func(p string) string { return relativePath(cwd, p) }
+
+	dirs := opts.ManifestDirs
+	if opts.FromDir != "" {
+		dirs = []string{opts.FromDir}
+	}
+	for _, dir := range dirs {
+		log.Debugf("Hashing the contents of %q for the package provenance\n", dir)
+		sum, err := hashDir(dir, opts.Excludes)
+		if err != nil {
+			return nil, err
+		}
+		source := types.SourceProvenance{Path: rel(dir), SHA256: sum}
+		source.GitCommit, source.GitDirty = gitState(dir)
+		prov.Sources = append(prov.Sources, source)
+	}
+
+	// paths are recorded relative to where k3p was run, so they do not leak the layout of the
+	// build machine and do not change between checkouts
+	buildOpts := opts.DeepCopy()
+	buildOpts.EULAFile = rel(buildOpts.EULAFile)
+	buildOpts.ConfigFile = rel(buildOpts.ConfigFile)
+	buildOpts.ImageFile = rel(buildOpts.ImageFile)
+	buildOpts.Output = rel(buildOpts.Output)
+	buildOpts.BasePackage = rel(buildOpts.BasePackage)
+	buildOpts.FromDir = rel(buildOpts.FromDir)
+	for i, dir := range buildOpts.ManifestDirs {
+		buildOpts.ManifestDirs[i] = rel(dir)
+	}
+	if buildOpts.Encrypt != nil {
+		for i, recipient := range buildOpts.Encrypt.Recipients {
+			buildOpts.Encrypt.Recipients[i] = rel(recipient)
+		}
+	}
+	prov.BuildOptions = buildOpts
+	return prov, nil
+}
+
+// recordSubjects adds the digest of every artifact in the package to its provenance. It is called
+// once every artifact is written.
+func (b *builder) recordSubjects() error {
+	meta := b.writer.GetMeta()
+	if meta.Provenance == nil {
+		return nil
+	}
+	digests := meta.GetManifest().Digests
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	prov := meta.Provenance.DeepCopy()
+	prov.Subjects = make([]types.ProvenanceSubject, 0, len(names))
+	for _, name := range names {
+		prov.Subjects = append(prov.Subjects, types.ProvenanceSubject{Name: name, SHA256: digests[name].SHA256})
+	}
+	return b.writer.PutMeta(&types.PackageMeta{Provenance: prov})
+}
+
+// relativePath returns the given path relative to dir if it is inside of it, and unchanged otherwise.
+func relativePath(dir, p string) string {
+	if p == "" || !filepath.IsAbs(p) {
+		return p
+	}
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return p
+	}
+	return filepath.ToSlash(rel)
+}
+
+// hashDir returns a hex encoded sha256sum over the path and contents of every file in the
+// directory, in the order they are walked. Directories that are excluded from the build, and
+// the metadata of git repositories, are skipped like they are when parsing manifests.
+func hashDir(dir string, excludes []string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		if info.IsDir() {
+			if file != dir && (info.Name() == ".git" || isExcluded(info.Name(), excludes)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00link\x00%s\n", rel, target)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fh := sha256.New()
+		if _, err := io.Copy(fh, f); err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%x\n", rel, fh.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func isExcluded(name string, excludes []string) bool {
+	for _, ex := range excludes {
+		if strings.TrimSuffix(ex, string(os.PathSeparator)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// gitState returns the commit checked out in the git repository containing dir, and whether
+// it has uncommitted changes. An empty commit is returned when git is not installed or the
+// directory is not in a repository.
+func gitState(dir string) (commit string, dirty bool) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", false
+	}
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		log.Debugf("Not recording a git commit for %q: %s\n", dir, err.Error())
+		return "", false
+	}
+	commit = string(bytes.TrimSpace(out))
+	status, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if err != nil {
+		log.Warningf("Could not determine if %q has uncommitted changes: %s\n", dir, err.Error())
+		return commit, false
+	}
+	return commit, len(bytes.TrimSpace(status)) > 0
+}
+
+// pipelineURL returns the URL of the CI pipeline run k3p is running in, if it can be detected
+// from the environment of a well known CI system.
+func pipelineURL() string {
+	if server, repo, run := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID"); server != "" && repo != "" && run != "" {
+		return fmt.Sprintf("%s/%s/actions/runs/%s", server, repo, run)
+	}
+	for _, env := range []string{
+		"CI_PIPELINE_URL", // GitLab
+		"BUILD_URL",       // Jenkins
+		"CIRCLE_BUILD_URL",
+		"BUILDKITE_BUILD_URL",
+	} {
+		if url := os.Getenv(env); url != "" {
+			return url
+		}
+	}
+	return ""
+}
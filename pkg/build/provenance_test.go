@@ -0,0 +1,101 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/tinyzimmer/k3p/pkg/build/package/formats"
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/unpack"
+	"github.com/tinyzimmer/k3p/pkg/version"
+)
+
+func TestBuild(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Build Suite")
+}
+
+// unpackedMock writes a mock package unpacked into a new directory under parent, so it can be
+// built again without downloading anything.
+func unpackedMock(parent string) string {
+	pkg := v2.Mock()
+	defer pkg.Close()
+	Expect(pkg.PutMeta(&types.PackageMeta{Name: "app", Version: "v1.0.0", K3sVersion: "v1.19.4+k3s1", Arch: "amd64"})).To(Succeed())
+	dir := filepath.Join(parent, "unpacked")
+	Expect(unpack.Unpack(pkg, dir)).To(Succeed())
+	return dir
+}
+
+// buildFromDir builds the package unpacked in the given directory to output and loads it.
+func buildFromDir(dir, output string) types.Package {
+	builder, err := NewBuilder()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(builder.Build(&types.BuildOptions{FromDir: dir, Output: output})).To(Succeed())
+	f, err := os.Open(output)
+	Expect(err).ToNot(HaveOccurred())
+	pkg, err := formats.Load(f)
+	Expect(err).ToNot(HaveOccurred())
+	return pkg
+}
+
+var _ = Describe("Build provenance", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() { os.RemoveAll(tmpDir) })
+
+	It("Should record the builder, the sources and the digest of every artifact", func() {
+		dir := unpackedMock(tmpDir)
+		pkg := buildFromDir(dir, filepath.Join(tmpDir, "package.tar"))
+		defer pkg.Close()
+		meta := pkg.GetMeta()
+		prov := meta.Provenance
+		Expect(prov).ToNot(BeNil())
+
+		Expect(prov.K3pVersion).To(Equal(version.K3pVersion))
+		Expect(prov.BuildTime.IsZero()).To(BeFalse())
+		hostname, err := os.Hostname()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(prov.BuildHost).To(Equal(hostname))
+		Expect(prov.BuildOptions).ToNot(BeNil())
+		Expect(prov.BuildOptions.Name).To(Equal("app"))
+
+		Expect(prov.Sources).To(HaveLen(1))
+		sum, err := hashDir(dir, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(prov.Sources[0].SHA256).To(Equal(sum))
+		Expect(prov.Sources[0].Path).To(HaveSuffix("unpacked"))
+
+		digests := meta.GetManifest().Digests
+		Expect(prov.Subjects).To(HaveLen(len(digests)))
+		for _, subject := range prov.Subjects {
+			Expect(digests).To(HaveKey(subject.Name))
+			Expect(subject.SHA256).To(Equal(digests[subject.Name].SHA256), subject.Name)
+		}
+		Expect(pkg.Verify()).To(Succeed())
+	})
+
+	It("Should change the source digest when the sources change", func() {
+		dir := unpackedMock(tmpDir)
+		before, err := hashDir(dir, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "manifests", "manifest.yaml"), []byte(strings.Repeat("x", 4)), 0644)).To(Succeed())
+		after, err := hashDir(dir, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(after).ToNot(Equal(before))
+	})
+})
@@ -0,0 +1,360 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tinyzimmer/k3p/pkg/cache"
+	"github.com/tinyzimmer/k3p/pkg/codec"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+	"github.com/tinyzimmer/k3p/pkg/version"
+)
+
+// k3pReleaseURL is the URL k3p releases for linux are downloaded from, by version and architecture
+const k3pReleaseURL = "https://github.com/tinyzimmer/k3p/releases/download/%s/k3p_linux_%s"
+
+var runFilePreSeed = template.Must(template.New("").Parse(`#!/bin/sh
+#
+# A self-installing k3p package. Run it with --extract-only [DIR] to only extract the package
+# and the k3p binaries to DIR (the current directory by default).
+
+payload_sha256="{{ .Checksum }}"
+
+payload() {
+	tail -n +{{ .PayloadLine }} "${0}"
+}
+
+verify() {
+	if command -v sha256sum > /dev/null 2>&1 ; then
+		sum=$(payload | sha256sum | cut -d ' ' -f 1)
+	elif command -v shasum > /dev/null 2>&1 ; then
+		sum=$(payload | shasum -a 256 | cut -d ' ' -f 1)
+	else
+		echo "sha256sum or shasum is required to verify the contents of ${0}" >&2
+		exit 1
+	fi
+	if [ "${sum}" != "${payload_sha256}" ] ; then
+		echo "The contents of ${0} do not match their checksum, the file is corrupt or incomplete" >&2
+		exit 1
+	fi
+}
+
+verify
+
+if [ "${1}" = "--extract-only" ] ; then
+	dest="${2:-.}"
+	mkdir -p "${dest}"
+	payload | tar xzf - -C "${dest}" || exit 1
+	echo "Extracted {{ .PackageFile }} and k3p for {{ .Archs }} to ${dest}"
+	exit 0
+fi
+
+case $(uname -m) in
+	x86_64|amd64) arch=amd64 ;;
+	aarch64|arm64) arch=arm64 ;;
+	armv7l|armv6l|armhf|arm) arch=arm ;;
+	*) arch=$(uname -m) ;;
+esac
+
+cleanup() {
+	rm -rf {{ .DirName }}
+}
+
+cleanup
+trap cleanup EXIT
+
+mkdir -p {{ .DirName }}
+payload | tar xzf - -C {{ .DirName }} || exit 1
+
+k3p="./{{ .DirName }}/{{ .K3pBin }}-${arch}"
+if [ ! -f "${k3p}" ] ; then
+	echo "${0} does not include k3p for ${arch} (included: {{ .Archs }})" >&2
+	exit 1
+fi
+
+if [ -z "${1}" ] || [ "${1}" = "install" ] || [ "$(echo "${1}" | cut -c1-1)" = "-" ] ; then
+	if [ "${1}" = "install" ] ; then shift ; fi
+	cmd="${k3p} install {{ .DirName }}/{{ .PackageFile }}"
+elif [ "${1}" = "inspect" ] ; then
+	shift
+	cmd="${k3p} inspect {{ .DirName }}/{{ .PackageFile }}"
+else
+	cmd="${k3p}"
+fi
+
+${cmd} "${@}"
+
+exit $?
+
+#payload
+`))
+
+var (
+	runDirName = ".k3p-run"
+	runK3pBin  = "k3p"
+)
+
+// tmplSeed renders the script at the start of a run file. The payload follows the script and
+// must have the given checksum.
+func tmplSeed(pkgFile string, archs []string, checksum string) ([]byte, error) {
+	data := map[string]interface{}{
+		"DirName":     runDirName,
+		"K3pBin":      runK3pBin,
+		"PackageFile": pkgFile,
+		"Archs":       strings.Join(archs, ", "),
+		"Checksum":    checksum,
+		"PayloadLine": 0,
+	}
+	var out bytes.Buffer
+	if err := runFilePreSeed.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	// the payload starts on the line after the script
+	data["PayloadLine"] = bytes.Count(out.Bytes(), []byte("\n")) + 1
+	out.Reset()
+	if err := runFilePreSeed.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func makeRunFile(opts *types.BuildOptions, archive types.Archive) error {
+	if strings.HasSuffix(opts.Output, "tar") {
+		opts.Output = strings.Replace(opts.Output, ".tar", ".run", 1)
+	}
+	for arch := range opts.RunFileK3pBinaries {
+		if arch == "" && len(opts.Archs) > 1 {
+			return fmt.Errorf("The package is built for %s, the k3p binary for each architecture must be given as ARCH=PATH", strings.Join(opts.Archs, ","))
+		}
+		if arch != "" && !hasArch(opts.Archs, arch) {
+			return fmt.Errorf("A k3p binary was provided for %s, but the package is built for %s", arch, strings.Join(opts.Archs, ","))
+		}
+	}
+
+	pkgFile := "package.tar" + codec.Extension(opts.Compression)
+
+	// the payload is written to a temporary file first, so its checksum can be embedded in the
+	// script that extracts it
+	payload, err := ioutil.TempFile(util.TempDir, "")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(payload.Name())
+	defer payload.Close()
+
+	// wrap the rest of the content in gzip
+	checksum := sha256.New()
+	gzw := gzip.NewWriter(io.MultiWriter(payload, checksum))
+
+	// Create a new tar writer around the gzip writer
+	tw := tar.NewWriter(gzw)
+
+	// get the time
+	now := time.Now()
+	if opts.SourceDate != nil {
+		now = *opts.SourceDate
+	}
+
+	// Write the k3p binary for each architecture to the tar ball
+	for _, arch := range opts.Archs {
+		bin, err := runFileBinary(opts, arch)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     bin.Name,
+			Size:     bin.Size,
+			Mode:     0755,
+			Uid:      0, Gid: 0,
+			Uname: "root", Gname: "root",
+			ModTime: now, AccessTime: now, ChangeTime: now,
+		}); err != nil {
+			bin.Body.Close()
+			return err
+		}
+		if _, err := io.Copy(tw, bin.Body); err != nil {
+			bin.Body.Close()
+			return err
+		}
+		if err := bin.Body.Close(); err != nil {
+			return err
+		}
+	}
+
+	// Write the archive to the tar ball
+	rdr := archive.Reader()
+	size := archive.Size()
+	if compressed(opts) || opts.Encrypt != nil {
+		// need to compress or encrypt to a tempfile first
+		tmpFile, err := ioutil.TempFile(util.TempDir, "")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpFile.Name())
+		finalReader, err := archiveReader(opts, archive)
+		if err != nil {
+			return err
+		}
+		defer finalReader.Close()
+		if _, err := io.Copy(tmpFile, finalReader); err != nil {
+			return err
+		}
+		if err := tmpFile.Close(); err != nil {
+			return err
+		}
+		stat, err := os.Stat(tmpFile.Name())
+		if err != nil {
+			return err
+		}
+		// Overwrite the size and the reader
+		size = stat.Size()
+		rdr, err = os.Open(tmpFile.Name())
+		if err != nil {
+			return err
+		}
+	}
+	defer rdr.Close()
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     pkgFile,
+		Size:     size,
+		Mode:     0644,
+		Uid:      0, Gid: 0,
+		Uname: "root", Gname: "root",
+		ModTime: now, AccessTime: now, ChangeTime: now,
+	}); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tw, rdr); err != nil {
+		return err
+	}
+
+	// Close the tar writer
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	// Close the gzip writer
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	log.Infof("Writing k3p executable and package contents to run file %q\n", opts.Output)
+
+	runFile, err := os.OpenFile(opts.Output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer runFile.Close()
+
+	runFileSeed, err := tmplSeed(pkgFile, opts.Archs, hex.EncodeToString(checksum.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	if _, err := runFile.Write(runFileSeed); err != nil {
+		return err
+	}
+	if _, err := payload.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(runFile, payload); err != nil {
+		return err
+	}
+
+	// Close the runfile
+	return runFile.Close()
+}
+
+// runFileBinary returns the k3p binary to embed in a run file for the given architecture. It is
+// the one provided in the options, the running executable when it was built for linux and the
+// architecture, or the release of the running version from the download cache.
+func runFileBinary(opts *types.BuildOptions, arch string) (*types.Artifact, error) {
+	name := runK3pBin + "-" + arch
+	bin, ok := opts.RunFileK3pBinaries[arch]
+	if !ok {
+		bin, ok = opts.RunFileK3pBinaries[""]
+	}
+	if !ok && runtime.GOOS == "linux" && runtime.GOARCH == arch {
+		ex, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		bin, ok = ex, true
+	}
+	if ok {
+		log.Debugf("Using k3p binary %q for %q\n", bin, arch)
+		return openK3pBinary(name, bin, arch)
+	}
+
+	if version.K3pVersion == "" {
+		return nil, fmt.Errorf("This k3p binary cannot be embedded in a run file for %s, and has no version to download one for. Provide one with --runfile-k3p-binary", arch)
+	}
+	log.Infof("Fetching k3p %s for %q to embed in the run file\n", version.K3pVersion, arch)
+	rdr, err := cache.DefaultCache.Get(fmt.Sprintf(k3pReleaseURL, version.K3pVersion, arch))
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve k3p %s for %s, provide one with --runfile-k3p-binary: %s", version.K3pVersion, arch, err.Error())
+	}
+	return util.ArtifactFromReader(types.ArtifactType("misc"), name, rdr)
+}
+
+// openK3pBinary opens the k3p binary at the given path, making sure it can run on linux nodes
+// with the given architecture.
+func openK3pBinary(name, bin, arch string) (*types.Artifact, error) {
+	f, err := os.Open(bin)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExecutableArch(f, arch); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s cannot be embedded in the run file: %s", bin, err.Error())
+	}
+	stat, err := f.Stat()
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &types.Artifact{Name: name, Body: f, Size: stat.Size()}, nil
+}
+
+// elfMachines are the machines in the headers of executables for each architecture
+var elfMachines = map[string]elf.Machine{
+	"amd64": elf.EM_X86_64,
+	"arm64": elf.EM_AARCH64,
+	"arm":   elf.EM_ARM,
+}
+
+// checkExecutableArch reads the header of an executable and makes sure it was built for linux
+// and the given architecture. Only the header is checked, so compressed executables are
+// accepted.
+func checkExecutableArch(rdr io.Reader, arch string) error {
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(rdr, header); err != nil || !bytes.HasPrefix(header, []byte(elf.ELFMAG)) {
+		return errors.New("it is not a linux executable")
+	}
+	machine := elf.Machine(binary.LittleEndian.Uint16(header[18:20]))
+	if expected, ok := elfMachines[arch]; ok && machine != expected {
+		return fmt.Errorf("it was built for %s, not %s", machine, arch)
+	}
+	return nil
+}
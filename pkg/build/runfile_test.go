@@ -0,0 +1,177 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/crypt"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// fakeK3pBinary writes a file with the header of a linux executable for amd64.
+func fakeK3pBinary(path string) []byte {
+	header := make([]byte, 64)
+	copy(header, elf.ELFMAG)
+	binary.LittleEndian.PutUint16(header[18:20], uint16(elf.EM_X86_64))
+	Expect(ioutil.WriteFile(path, header, 0755)).To(Succeed())
+	return header
+}
+
+// newArchive returns an archive of the package with its own reader.
+func newArchive(pkg types.Package) types.Archive {
+	archive, err := pkg.Archive()
+	Expect(err).ToNot(HaveOccurred())
+	return archive
+}
+
+var rePayloadLine = regexp.MustCompile(`tail -n \+(\d+) `)
+var reChecksum = regexp.MustCompile(`payload_sha256="([0-9a-f]+)"`)
+
+// runFilePayload splits a run file into its script and payload, using the line the script
+// reads the payload from.
+func runFilePayload(raw []byte) (script, payload []byte) {
+	match := rePayloadLine.FindSubmatch(raw)
+	Expect(match).ToNot(BeNil())
+	line, err := strconv.Atoi(string(match[1]))
+	Expect(err).ToNot(HaveOccurred())
+	offset := 0
+	for i := 1; i < line; i++ {
+		idx := bytes.IndexByte(raw[offset:], '\n')
+		Expect(idx).ToNot(Equal(-1))
+		offset += idx + 1
+	}
+	return raw[:offset], raw[offset:]
+}
+
+// payloadFiles returns the contents of every file in the gzipped tarball.
+func payloadFiles(payload []byte) map[string][]byte {
+	gzr, err := gzip.NewReader(bytes.NewReader(payload))
+	Expect(err).ToNot(HaveOccurred())
+	files := make(map[string][]byte)
+	rdr := tar.NewReader(gzr)
+	for {
+		header, err := rdr.Next()
+		if err == io.EOF {
+			return files
+		}
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(rdr)
+		Expect(err).ToNot(HaveOccurred())
+		files[header.Name] = body
+	}
+}
+
+var _ = Describe("Run files", func() {
+	var tmpDir, k3pBin string
+	var k3pContents, archiveContents []byte
+	var pkg types.Package
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		k3pBin = filepath.Join(tmpDir, "k3p")
+		k3pContents = fakeK3pBinary(k3pBin)
+		pkg = v2.Mock()
+		archiveContents, err = ioutil.ReadAll(newArchive(pkg).Reader())
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		pkg.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	newOpts := func() *types.BuildOptions {
+		return &types.BuildOptions{
+			Output:             filepath.Join(tmpDir, "package.tar"),
+			Archs:              []string{"amd64"},
+			RunFileK3pBinaries: map[string]string{"amd64": k3pBin},
+		}
+	}
+
+	It("Should embed the package and k3p after the script with a matching checksum", func() {
+		opts := newOpts()
+		Expect(makeRunFile(opts, newArchive(pkg))).To(Succeed())
+		Expect(opts.Output).To(Equal(filepath.Join(tmpDir, "package.run")))
+		raw, err := ioutil.ReadFile(opts.Output)
+		Expect(err).ToNot(HaveOccurred())
+
+		script, payload := runFilePayload(raw)
+		Expect(string(script)).To(HaveSuffix("#payload\n"))
+		checksum := reChecksum.FindSubmatch(script)
+		Expect(checksum).ToNot(BeNil())
+		Expect(string(checksum[1])).To(Equal(fmt.Sprintf("%x", sha256.Sum256(payload))))
+
+		files := payloadFiles(payload)
+		Expect(files).To(HaveLen(2))
+		Expect(files["k3p-amd64"]).To(Equal(k3pContents))
+		Expect(bytes.Equal(files["package.tar"], archiveContents)).To(BeTrue())
+
+		// the script itself verifies the checksum before extracting anything
+		for _, tool := range []string{"sh", "tail", "tar", "sha256sum"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				Skip(fmt.Sprintf("%s is required to run the script", tool))
+			}
+		}
+		extracted := filepath.Join(tmpDir, "extracted")
+		Expect(exec.Command("sh", opts.Output, "--extract-only", extracted).Run()).To(Succeed())
+		extractedContents, err := ioutil.ReadFile(filepath.Join(extracted, "package.tar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(extractedContents, archiveContents)).To(BeTrue())
+
+		raw[len(raw)-1] ^= 0xff
+		Expect(ioutil.WriteFile(opts.Output, raw, 0755)).To(Succeed())
+		Expect(exec.Command("sh", opts.Output, "--extract-only", filepath.Join(tmpDir, "corrupt")).Run()).ToNot(Succeed())
+		Expect(filepath.Join(tmpDir, "corrupt")).ToNot(BeADirectory())
+	})
+
+	It("Should embed the encrypted package when encryption is requested", func() {
+		opts := newOpts()
+		opts.Encrypt = &types.EncryptOptions{Passphrase: "secret"}
+		Expect(makeRunFile(opts, newArchive(pkg))).To(Succeed())
+		raw, err := ioutil.ReadFile(opts.Output)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, payload := runFilePayload(raw)
+		files := payloadFiles(payload)
+		Expect(files["k3p-amd64"]).To(Equal(k3pContents))
+		encrypted := files["package.tar"]
+		Expect(bytes.Equal(encrypted, archiveContents)).To(BeFalse())
+		Expect(crypt.IsEncrypted(bufio.NewReader(bytes.NewReader(encrypted)))).To(BeTrue())
+
+		rdr, err := crypt.NewReader(bytes.NewReader(encrypted), &crypt.Identities{
+			Passphrase: func() ([]byte, error) { return []byte("secret"), nil },
+		})
+		Expect(err).ToNot(HaveOccurred())
+		decrypted, err := ioutil.ReadAll(rdr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(decrypted, archiveContents)).To(BeTrue())
+	})
+
+	It("Should refuse k3p binaries built for another architecture", func() {
+		opts := newOpts()
+		opts.Archs = []string{"arm64"}
+		opts.RunFileK3pBinaries = map[string]string{"arm64": k3pBin}
+		err := makeRunFile(opts, newArchive(pkg))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not arm64"))
+	})
+})
@@ -0,0 +1,353 @@
+package catalog
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"gopkg.in/yaml.v2"
+
+	"github.com/tinyzimmer/k3p/pkg/codec"
+	"github.com/tinyzimmer/k3p/pkg/crypt"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+// IndexFile is the name of the index at the root of a catalog.
+const IndexFile = "index.yaml"
+
+// APIVersion is the version of the index format written by this package.
+const APIVersion = "v1"
+
+// digestPrefix is the algorithm prefixed to the digests of packages in the index
+const digestPrefix = "sha256:"
+
+// Index lists the packages in a catalog.
+type Index struct {
+	// The version of the index format
+	APIVersion string `json:"apiVersion" yaml:"apiVersion"`
+	// The packages in the catalog, sorted by name and newest version first
+	Packages []*Entry `json:"packages" yaml:"packages"`
+}
+
+// Entry describes a package in a catalog.
+type Entry struct {
+	// The name of the package
+	Name string `json:"name" yaml:"name"`
+	// The version of the package
+	Version string `json:"version" yaml:"version"`
+	// The version of k3s bundled in the package
+	K3sVersion string `json:"k3sVersion" yaml:"k3sVersion"`
+	// The architectures the package was built for, comma separated
+	Arch string `json:"arch" yaml:"arch"`
+	// The description of the package, if it was built with one
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	// The digest of the package file, prefixed with its algorithm
+	Digest string `json:"digest" yaml:"digest"`
+	// The size of the package file in bytes
+	Size int64 `json:"size" yaml:"size"`
+	// The location of the package file, relative to the root of the catalog unless it is a URL
+	Path string `json:"path" yaml:"path"`
+}
+
+// Catalog is an index loaded from a directory or a static HTTP root.
+type Catalog struct {
+	*Index
+	// the directory or URL the paths of the entries are relative to
+	root string
+}
+
+// Build indexes every package file inside the given directory. When baseURL is set, the paths of
+// the entries are URLs under it, so the index can be served from a static HTTP root that mirrors
+// the directory. Files that cannot be read as packages, encrypted packages, and delta packages
+// are left out with a warning.
+func Build(dir, baseURL string) (*Index, error) {
+	index := &Index{APIVersion: APIVersion, Packages: make([]*Entry, 0)}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !IsPackageFile(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		entry, err := readEntry(file)
+		if err != nil {
+			log.Warningf("Not indexing %q: %s\n", rel, err.Error())
+			return nil
+		}
+		entry.Path = filepath.ToSlash(rel)
+		if baseURL != "" {
+			entry.Path = strings.TrimSuffix(baseURL, "/") + "/" + entry.Path
+		}
+		log.Debugf("Indexed %s@%s at %q\n", entry.Name, entry.Version, entry.Path)
+		index.Packages = append(index.Packages, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	index.sort()
+	return index, nil
+}
+
+// IsPackageFile returns true if the given file name has the extension of a package archive.
+func IsPackageFile(name string) bool {
+	for _, compression := range append([]types.Compression{types.CompressionNone}, codec.Compressions()...) {
+		if strings.HasSuffix(name, ".tar"+codec.Extension(compression)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readEntry reads the metadata of the package at the given path, computing its digest in the
+// same pass.
+func readEntry(file string) (*Entry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	buf := bufio.NewReader(io.TeeReader(f, h))
+	if crypt.IsEncrypted(buf) {
+		return nil, errors.New("encrypted packages cannot be indexed")
+	}
+	dec, err := codec.Decompress(buf)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	meta, err := readMeta(dec)
+	if err != nil {
+		return nil, err
+	}
+	if meta.IsDelta() {
+		return nil, fmt.Errorf("%s@%s is a delta package", meta.GetName(), meta.GetVersion())
+	}
+
+	// hash the rest of the file
+	if _, err := io.Copy(ioutil.Discard, buf); err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{
+		Name:        meta.GetName(),
+		Version:     meta.GetVersion(),
+		K3sVersion:  meta.GetK3sVersion(),
+		Arch:        meta.GetArch(),
+		Description: meta.GetDescription(),
+		Digest:      digestPrefix + hex.EncodeToString(h.Sum(nil)),
+		Size:        stat.Size(),
+	}, nil
+}
+
+// readMeta scans a package archive for its metadata.
+func readMeta(rdr io.Reader) (*types.PackageMeta, error) {
+	tr := tar.NewReader(rdr)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("the archive does not contain any package metadata")
+			}
+			return nil, err
+		}
+		if header.Name != types.ManifestMetaFile {
+			continue
+		}
+		var meta types.PackageMeta
+		if err := json.NewDecoder(tr).Decode(&meta); err != nil {
+			return nil, err
+		}
+		return &meta, nil
+	}
+}
+
+// WriteFile writes the index to the given path.
+func (i *Index) WriteFile(file string) error {
+	out, err := yaml.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, out, 0644)
+}
+
+// sort orders the entries by name, and newest version first.
+func (i *Index) sort() {
+	sort.SliceStable(i.Packages, func(a, b int) bool {
+		if i.Packages[a].Name != i.Packages[b].Name {
+			return i.Packages[a].Name < i.Packages[b].Name
+		}
+		return newer(i.Packages[a].Version, i.Packages[b].Version)
+	})
+}
+
+// newer returns true if version a is newer than b. Versions that are not semantic versions
+// are compared as strings.
+func newer(a, b string) bool {
+	va, errA := semver.NewVersion(a)
+	vb, errB := semver.NewVersion(b)
+	if errA != nil || errB != nil {
+		return a > b
+	}
+	return va.GreaterThan(vb)
+}
+
+// Load reads the index of the catalog at the given location. The location is a directory or
+// an http(s) URL, either of the root of the catalog or of its index file.
+func Load(location string) (*Catalog, error) {
+	var body []byte
+	var root string
+	if isURL(location) {
+		indexURL := location
+		if !strings.HasSuffix(indexURL, ".yaml") {
+			indexURL = strings.TrimSuffix(indexURL, "/") + "/" + IndexFile
+		}
+		root = indexURL[:strings.LastIndex(indexURL, "/")]
+		log.Debug("Retrieving the catalog index from", indexURL)
+		resp, err := http.Get(indexURL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("error retrieving %q: %s", indexURL, resp.Status)
+		}
+		if body, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		indexFile := location
+		if stat, err := os.Stat(location); err == nil && stat.IsDir() {
+			indexFile = filepath.Join(location, IndexFile)
+		}
+		root = filepath.Dir(indexFile)
+		var err error
+		if body, err = ioutil.ReadFile(indexFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var index Index
+	if err := yaml.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("%s is not a valid catalog index: %s", location, err.Error())
+	}
+	if index.APIVersion != APIVersion {
+		return nil, fmt.Errorf("The catalog index at %s has version %q, which is not supported by this release of k3p", location, index.APIVersion)
+	}
+	index.sort()
+	return &Catalog{Index: &index, root: root}, nil
+}
+
+// Search returns the packages whose name or description contain the given query, ignoring
+// case. Every package is returned for an empty query.
+func (c *Catalog) Search(query string) []*Entry {
+	query = strings.ToLower(query)
+	out := make([]*Entry, 0)
+	for _, entry := range c.Packages {
+		if strings.Contains(strings.ToLower(entry.Name), query) || strings.Contains(strings.ToLower(entry.Description), query) {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// ParseReference splits a reference to a package in a catalog in the format NAME[@VERSION]
+// into its name and version.
+func ParseReference(ref string) (name, version string) {
+	if i := strings.LastIndex(ref, "@"); i != -1 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// Resolve returns the entry for a reference in the format NAME[@VERSION]. The newest version
+// of the package is returned when the reference does not include one.
+func (c *Catalog) Resolve(ref string) (*Entry, error) {
+	name, version := ParseReference(ref)
+	versions := make([]string, 0)
+	for _, entry := range c.Packages {
+		if entry.Name != name {
+			continue
+		}
+		// entries are sorted newest first
+		if version == "" || entry.Version == version {
+			return entry, nil
+		}
+		versions = append(versions, entry.Version)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("There is no package named %q in the catalog", name)
+	}
+	return nil, fmt.Errorf("Version %q of %s is not in the catalog (available versions are %s)", version, name, strings.Join(versions, ","))
+}
+
+// Location returns the path or URL of the package file for the given entry.
+func (c *Catalog) Location(entry *Entry) string {
+	if isURL(entry.Path) || path.IsAbs(entry.Path) {
+		return entry.Path
+	}
+	if isURL(c.root) {
+		return c.root + "/" + entry.Path
+	}
+	return filepath.Join(c.root, filepath.FromSlash(entry.Path))
+}
+
+// Open opens the package file for the given entry. Its contents are checked against the digest
+// in the index once they are read to the end.
+func (c *Catalog) Open(entry *Entry) (io.ReadCloser, error) {
+	if !strings.HasPrefix(entry.Digest, digestPrefix) {
+		return nil, fmt.Errorf("The digest of %s@%s in the catalog is not a sha256 digest", entry.Name, entry.Version)
+	}
+	location := c.Location(entry)
+	var rdr io.ReadCloser
+	if isURL(location) {
+		log.Info("Downloading the archive from", location)
+		resp, err := http.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("error retrieving %q: %s", location, resp.Status)
+		}
+		rdr = resp.Body
+	} else {
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		rdr = f
+	}
+	return util.NewDigestReader(location, rdr, rdr, &types.ArtifactDigest{
+		SHA256: strings.TrimPrefix(entry.Digest, digestPrefix),
+		Size:   entry.Size,
+	}), nil
+}
+
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
@@ -0,0 +1,125 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestCatalog(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Catalog Suite")
+}
+
+// writePackage writes a package with the given metadata to the given path, compressed with
+// the given codec.
+func writePackage(file string, meta *types.PackageMeta, compression types.Compression) {
+	tmpDir, err := ioutil.TempDir("", "")
+	Expect(err).ToNot(HaveOccurred())
+	pkg := v2.New(tmpDir)
+	defer pkg.Close()
+	Expect(pkg.Put(&types.Artifact{Type: types.ArtifactBin, Name: "k3s", Body: ioutil.NopCloser(strings.NewReader("k3s")), Size: 3})).To(Succeed())
+	Expect(pkg.PutMeta(meta)).To(Succeed())
+	archive, err := pkg.Archive()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(os.MkdirAll(filepath.Dir(file), 0755)).To(Succeed())
+	if compression == types.CompressionNone {
+		Expect(archive.WriteTo(file)).To(Succeed())
+		return
+	}
+	Expect(archive.CompressTo(file, compression)).To(Succeed())
+}
+
+var _ = Describe("Package catalogs", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		writePackage(filepath.Join(dir, "app-v1.0.0.tar"), &types.PackageMeta{Name: "app", Version: "v1.0.0", K3sVersion: "v1.19.4+k3s1", Arch: "amd64"}, types.CompressionNone)
+		writePackage(filepath.Join(dir, "app", "app-v1.10.0.tar.gz"), &types.PackageMeta{Name: "app", Version: "v1.10.0", K3sVersion: "v1.20.0+k3s1", Arch: "amd64"}, types.CompressionGzip)
+		writePackage(filepath.Join(dir, "monitoring.tar.zst"), &types.PackageMeta{Name: "monitoring", Version: "v2.0.0", Arch: "arm64", Description: "Prometheus and Grafana"}, types.CompressionZstd)
+		writePackage(filepath.Join(dir, "app-v1.1.0-delta.tar"), &types.PackageMeta{Name: "app", Version: "v1.1.0", Base: &types.PackageBase{Name: "app", Version: "v1.0.0"}}, types.CompressionNone)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a package"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() { os.RemoveAll(dir) })
+
+	It("Should index and resolve the packages in a directory", func() {
+		index, err := Build(dir, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(index.WriteFile(filepath.Join(dir, IndexFile))).To(Succeed())
+
+		cat, err := Load(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cat.Packages).To(HaveLen(3))
+
+		var refs []string
+		for _, entry := range cat.Packages {
+			refs = append(refs, entry.Name+"@"+entry.Version)
+			Expect(entry.Digest).To(HavePrefix("sha256:"))
+		}
+		Expect(refs).To(Equal([]string{"app@v1.10.0", "app@v1.0.0", "monitoring@v2.0.0"}))
+
+		entry, err := cat.Resolve("app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entry.Version).To(Equal("v1.10.0"))
+		Expect(entry.K3sVersion).To(Equal("v1.20.0+k3s1"))
+		Expect(cat.Location(entry)).To(Equal(filepath.Join(dir, "app", "app-v1.10.0.tar.gz")))
+
+		entry, err = cat.Resolve("app@v1.0.0")
+		Expect(err).ToNot(HaveOccurred())
+		rdr, err := cat.Open(entry)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = ioutil.ReadAll(rdr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rdr.Close()).To(Succeed())
+
+		_, err = cat.Resolve("app@v3.0.0")
+		Expect(err).To(MatchError(`Version "v3.0.0" of app is not in the catalog (available versions are v1.10.0,v1.0.0)`))
+		_, err = cat.Resolve("db")
+		Expect(err).To(MatchError(`There is no package named "db" in the catalog`))
+
+		Expect(cat.Search("grafana")).To(HaveLen(1))
+		Expect(cat.Search("APP")).To(HaveLen(2))
+		Expect(cat.Search("")).To(HaveLen(3))
+	})
+
+	It("Should refuse packages that do not match their digest", func() {
+		index, err := Build(dir, "")
+		Expect(err).ToNot(HaveOccurred())
+		cat := &Catalog{Index: index, root: dir}
+		entry, err := cat.Resolve("app@v1.0.0")
+		Expect(err).ToNot(HaveOccurred())
+
+		writePackage(filepath.Join(dir, "app-v1.0.0.tar"), &types.PackageMeta{Name: "app", Version: "v1.0.1"}, types.CompressionNone)
+		rdr, err := cat.Open(entry)
+		Expect(err).ToNot(HaveOccurred())
+		defer rdr.Close()
+		_, err = ioutil.ReadAll(rdr)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should point to the packages under the base URL", func() {
+		index, err := Build(dir, "https://packages.example.com/k3p/")
+		Expect(err).ToNot(HaveOccurred())
+		cat := &Catalog{Index: index, root: "https://mirror.example.com"}
+		entry, err := cat.Resolve("monitoring")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cat.Location(entry)).To(Equal("https://packages.example.com/k3p/monitoring.tar.zst"))
+
+		entry.Path = "monitoring.tar.zst"
+		Expect(cat.Location(entry)).To(Equal("https://mirror.example.com/monitoring.tar.zst"))
+	})
+})
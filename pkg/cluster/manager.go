@@ -8,10 +8,13 @@ import (
 	"strings"
 	"time"
 
-	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/build/package/formats"
 	"github.com/tinyzimmer/k3p/pkg/cluster/kubernetes"
 	"github.com/tinyzimmer/k3p/pkg/cluster/node"
+	"github.com/tinyzimmer/k3p/pkg/hooks"
 	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/requirements"
+	"github.com/tinyzimmer/k3p/pkg/sign"
 	"github.com/tinyzimmer/k3p/pkg/types"
 	"github.com/tinyzimmer/k3p/pkg/util"
 )
@@ -136,12 +139,18 @@ func (m *manager) AddNode(newNode types.Node, opts *types.AddNodeOptions) error
 	}
 	defer f.Close()
 
-	pkg, err := v1.Load(f)
+	pkg, err := formats.Load(f)
 	if err != nil {
 		return err
 	}
 	defer pkg.Close()
 
+	if opts.Trust != nil && opts.Trust.RequireSignature {
+		if err := m.verifyInstalledSignature(pkg, opts.Trust); err != nil {
+			return err
+		}
+	}
+
 	var tokenRdr io.ReadCloser
 	switch opts.NodeRole {
 	case types.K3sRoleServer:
@@ -179,20 +188,63 @@ func (m *manager) AddNode(newNode types.Node, opts *types.AddNodeOptions) error
 		return err
 	}
 
+	// the new node is checked against the packages installed on the leader, and keeps the same
+	// record of them once it joins
+	installed, err := util.GetInstalledPackages(m.leader)
+	if err != nil {
+		return err
+	}
+	if err := requirements.Check(newNode, pkg.GetMeta(), installed); err != nil {
+		return err
+	}
+
 	if err := util.SyncPackageToNode(newNode, pkg, &installedConfig); err != nil {
 		return err
 	}
+	if len(installed) > 0 {
+		if err := util.WriteInstalledPackages(newNode, installed); err != nil {
+			return err
+		}
+	}
+
+	hookOpts := hooks.JoinOptions(installedConfig.InstallOptions, opts.NodeName, opts.NodeRole)
+	if err := hooks.Run(newNode, pkg.GetMeta(), types.HookPreJoin, hookOpts); err != nil {
+		return err
+	}
 
 	log.Infof("Joining instance as a new %s\n", opts.NodeRole)
-	execOpts, err := buildInstallOpts(pkg, &installedConfig, remoteAddr, tokenStr, opts.NodeRole)
+	execOpts, err := buildInstallOpts(pkg, &installedConfig, remoteAddr, tokenStr, opts.NodeName, opts.NodeRole)
+	if err != nil {
+		return err
+	}
+	if err := newNode.Execute(execOpts); err != nil {
+		return err
+	}
+	return hooks.Run(newNode, pkg.GetMeta(), types.HookPostJoin, hookOpts)
+}
+
+func (m *manager) verifyInstalledSignature(pkg types.Package, opts *types.TrustOptions) error {
+	log.Info("Verifying the signature of the installed package")
+	rdr, err := m.leader.GetFile(types.InstalledSignatureFile)
+	if err != nil {
+		return fmt.Errorf("Could not retrieve the package signature from the leader: %s", err.Error())
+	}
+	defer rdr.Close()
+	sig, err := sign.LoadSignature(rdr)
 	if err != nil {
 		return err
 	}
-	return newNode.Execute(execOpts)
+	keyID, err := sign.VerifyWithKeyFiles(pkg, sig, opts.TrustedKeys)
+	if err != nil {
+		return err
+	}
+	log.Infof("The installed package is signed by trusted key %s\n", keyID)
+	return nil
 }
 
-func buildInstallOpts(pkg types.Package, cfg *types.InstallConfig, remoteAddr, token string, nodeRole types.K3sRole) (*types.ExecuteOptions, error) {
+func buildInstallOpts(pkg types.Package, cfg *types.InstallConfig, remoteAddr, token, nodeName string, nodeRole types.K3sRole) (*types.ExecuteOptions, error) {
 	opts := cfg.DeepCopy().InstallOptions
+	opts.NodeName = nodeName
 	pkgConf := pkg.GetMeta().DeepCopy().Sanitize().GetPackageConfig()
 	if pkgConf != nil {
 		if err := pkgConf.ApplyVariables(opts.Variables); err != nil {
@@ -136,12 +136,48 @@ type Docker struct {
 // GetType implements the node interface.
 func (d *Docker) GetType() types.NodeType { return types.NodeDocker }
 
+// GetArch implements the node interface. Containers run with the architecture of the docker daemon.
+func (d *Docker) GetArch() (string, error) {
+	info, err := d.cli.Info(context.TODO())
+	if err != nil {
+		return "", err
+	}
+	return archFromMachine(info.Architecture)
+}
+
 // MkdirAll implements the node interface and will create a directory inside the current
 // container.
 func (d *Docker) MkdirAll(dir string) error {
+	return d.exec("mkdir", "-p", dir)
+}
+
+// Rename implements the node interface and will move a file inside the current container. Like
+// WriteFile, it only considers files rooted in /var/lib/rancher/k3s.
+func (d *Docker) Rename(path, destination string) error {
+	if !isRuntimeFile(destination) {
+		return nil
+	}
+	return d.exec("mv", "-f", path, destination)
+}
+
+// Remove implements the node interface and will remove a file inside the current container.
+func (d *Docker) Remove(path string) error {
+	if !isRuntimeFile(path) {
+		return nil
+	}
+	return d.exec("rm", "-f", path)
+}
+
+// isRuntimeFile returns true if the given path is one of the files docker nodes care about.
+func isRuntimeFile(path string) bool {
+	return strings.HasPrefix(path, types.K3sRootConfigDir) || strings.HasPrefix(path, types.K3sEtcDir)
+}
+
+// exec runs the given command as root inside the current container and waits for it to complete.
+func (d *Docker) exec(cmd ...string) error {
 	execCfg := dockertypes.ExecConfig{
 		User:   "root",
-		Cmd:    []string{"mkdir", "-p", dir},
+		Cmd:    cmd,
 		Detach: true,
 	}
 	log.Debugf("Creating exec process in container %q: %+v\n", d.containerID, execCfg)
@@ -199,7 +235,7 @@ func (d *Docker) WriteFile(rdr io.ReadCloser, destination string, mode string, s
 	defer rdr.Close()
 
 	// stupid hack to only care about actual runtime files
-	if !strings.HasPrefix(destination, types.K3sRootConfigDir) && !strings.HasPrefix(destination, types.K3sEtcDir) {
+	if !isRuntimeFile(destination) {
 		return nil
 	}
 	if err := d.MkdirAll(path.Dir(destination)); err != nil {
@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"path"
 	"strconv"
+	"strings"
 
 	"github.com/tinyzimmer/k3p/pkg/log"
 	"github.com/tinyzimmer/k3p/pkg/types"
@@ -21,6 +22,17 @@ type localNode struct{}
 
 func (l *localNode) GetType() types.NodeType { return types.NodeLocal }
 
+// GetArch returns the architecture of the local system, which is not necessarily the one k3p
+// was built for (for example under emulation, or a 32-bit build on a 64-bit system).
+func (l *localNode) GetArch() (string, error) {
+	log.Debug("Running command on local system: uname -m")
+	out, err := exec.Command("uname", "-m").Output()
+	if err != nil {
+		return "", err
+	}
+	return archFromMachine(strings.TrimSpace(string(out)))
+}
+
 func (l *localNode) MkdirAll(dir string) error {
 	log.Debugf("Ensuring local system directory %q with mode 0755\n", dir)
 	return os.MkdirAll(dir, 0755)
@@ -41,7 +53,7 @@ func (l *localNode) WriteFile(rdr io.ReadCloser, dest string, mode string, size
 	if err != nil {
 		return err
 	}
-	f, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE, os.FileMode(u))
+	f, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(u))
 	if err != nil {
 		return err
 	}
@@ -50,6 +62,19 @@ func (l *localNode) WriteFile(rdr io.ReadCloser, dest string, mode string, size
 	return err
 }
 
+func (l *localNode) Rename(f, dest string) error {
+	log.Debugf("Renaming %q to %q on local system\n", f, dest)
+	return os.Rename(f, dest)
+}
+
+func (l *localNode) Remove(f string) error {
+	log.Debugf("Removing %q from local system\n", f)
+	if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 func (l *localNode) Execute(opts *types.ExecuteOptions) error {
 	cmd := buildCmdFromExecOpts(opts)
 	log.Debug("Executing command on local system:", redactSecrets(cmd, opts.Secrets))
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -28,6 +29,8 @@ func (m *mockNode) rootedDir(f string) string {
 
 func (m *mockNode) GetType() types.NodeType { return types.NodeLocal }
 
+func (m *mockNode) GetArch() (string, error) { return runtime.GOARCH, nil }
+
 func (m *mockNode) Close() error { return os.RemoveAll(m.root) }
 
 func (m *mockNode) Execute(opts *types.ExecuteOptions) error { return nil }
@@ -45,7 +48,7 @@ func (m *mockNode) WriteFile(rdr io.ReadCloser, dest, mode string, size int64) e
 	if err != nil {
 		return err
 	}
-	f, err := os.OpenFile(m.rootedDir(dest), os.O_RDWR|os.O_CREATE, os.FileMode(u))
+	f, err := os.OpenFile(m.rootedDir(dest), os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(u))
 	if err != nil {
 		return err
 	}
@@ -54,6 +57,17 @@ func (m *mockNode) WriteFile(rdr io.ReadCloser, dest, mode string, size int64) e
 	return err
 }
 
+func (m *mockNode) Rename(f, dest string) error {
+	return os.Rename(m.rootedDir(f), m.rootedDir(dest))
+}
+
+func (m *mockNode) Remove(f string) error {
+	if err := os.Remove(m.rootedDir(f)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 func (m *mockNode) MkdirAll(path string) error { return os.MkdirAll(m.rootedDir(path), 0755) }
 
 func (m *mockNode) GetK3sAddress() (string, error) { return "", nil }
@@ -7,6 +7,7 @@ import (
 	"net"
 	"path"
 	"strconv"
+	"strings"
 
 	"github.com/bramvdbogaerde/go-scp"
 
@@ -30,6 +31,21 @@ type remoteNode struct {
 
 func (n *remoteNode) GetType() types.NodeType { return types.NodeRemote }
 
+func (n *remoteNode) GetArch() (string, error) {
+	sess, err := n.client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer sess.Close()
+	cmd := "uname -m"
+	log.Debugf("Running command on %s: %s\n", n.remoteAddr, cmd)
+	out, err := sess.Output(cmd)
+	if err != nil {
+		return "", err
+	}
+	return archFromMachine(strings.TrimSpace(string(out)))
+}
+
 func (n *remoteNode) scpClient() (*scp.Client, error) {
 	scpClient, err := scp.NewClientBySSH(n.client)
 	if err != nil {
@@ -89,12 +105,24 @@ func (n *remoteNode) WriteFile(rdr io.ReadCloser, destination string, mode strin
 }
 
 func (n *remoteNode) MkdirAll(dir string) error {
+	return n.run(fmt.Sprintf("sudo mkdir -p %s", dir))
+}
+
+func (n *remoteNode) Rename(path, destination string) error {
+	return n.run(fmt.Sprintf("sudo mv -f %q %q", path, destination))
+}
+
+func (n *remoteNode) Remove(path string) error {
+	return n.run(fmt.Sprintf("sudo rm -f %q", path))
+}
+
+// run runs the given command on the node in a new session.
+func (n *remoteNode) run(cmd string) error {
 	sess, err := n.client.NewSession()
 	if err != nil {
 		return err
 	}
 	defer sess.Close()
-	cmd := fmt.Sprintf("sudo mkdir -p %s", dir)
 	log.Debugf("Running command on %s: %s\n", n.remoteAddr, cmd)
 	return sess.Run(cmd)
 }
@@ -22,3 +22,17 @@ func buildCmdFromExecOpts(opts *types.ExecuteOptions) string {
 	cmd = cmd + "sudo -E " + opts.Command
 	return cmd
 }
+
+// archFromMachine converts a machine hardware name, as reported by uname or docker, to the
+// architecture name k3s releases are published for.
+func archFromMachine(machine string) (string, error) {
+	switch machine {
+	case "x86_64", "amd64":
+		return "amd64", nil
+	case "aarch64", "arm64":
+		return "arm64", nil
+	case "armv7l", "armv6l", "armhf", "arm":
+		return "arm", nil
+	}
+	return "", fmt.Errorf("Unsupported node architecture %q", machine)
+}
@@ -2,11 +2,14 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,13 +17,25 @@ import (
 
 	"github.com/tinyzimmer/k3p/pkg/build"
 	"github.com/tinyzimmer/k3p/pkg/cache"
+	"github.com/tinyzimmer/k3p/pkg/crypt"
 	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/sbom"
+	"github.com/tinyzimmer/k3p/pkg/split"
 	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
 )
 
 var (
-	buildPullPolicy string
-	buildOpts       *types.BuildOptions
+	buildPullPolicy   string
+	buildSplitSize    string
+	buildCompression  string
+	buildCompress     bool
+	buildEncrypt      bool
+	buildRecipients   []string
+	buildSBOM         string
+	buildReproducible bool
+	buildRunFileBins  []string
+	buildOpts         *types.BuildOptions
 )
 
 func init() {
@@ -38,27 +53,55 @@ func init() {
 
 	buildCmd.Flags().StringVarP(&buildOpts.Name, "name", "n", "", `The name to give the package, if not provided one will be generated`)
 	buildCmd.Flags().StringVarP(&buildOpts.BuildVersion, "version", "V", types.VersionLatest, "The version to tag the package")
+	buildCmd.Flags().StringVar(&buildOpts.Description, "description", "", "An optional short description of the package, shown in catalogs")
 	buildCmd.Flags().StringVar(&buildOpts.K3sVersion, "k3s-version", types.VersionLatest, "A specific k3s version to bundle with the package, overrides --channel")
 	buildCmd.Flags().StringVarP(&buildOpts.K3sChannel, "channel", "C", "stable", "The release channel to retrieve the version of k3s from")
 	buildCmd.Flags().StringArrayVarP(&buildOpts.ManifestDirs, "manifests", "m", []string{cwd}, "Directories to scan for kubernetes manifests and charts, defaults to the current directory, can be specified multiple times")
 	buildCmd.Flags().StringSliceVarP(&buildOpts.Excludes, "exclude", "e", []string{}, "Directories to exclude when reading the manifest directory")
-	buildCmd.Flags().StringVarP(&buildOpts.Arch, "arch", "a", runtime.GOARCH, "The architecture to package the distribution for. Only (amd64, arm, and arm64 are supported)")
+	buildCmd.Flags().StringSliceVarP(&buildOpts.Archs, "arch", "a", []string{runtime.GOARCH}, `The architectures to package the distribution for. Only (amd64, arm, and arm64 are supported).
+A comma separated list produces a single package that installs the matching binary and images on each node.`)
 	buildCmd.Flags().StringVarP(&buildOpts.ImageFile, "image-file", "I", "", "A file containing a list of extra images to bundle with the archive")
 	buildCmd.Flags().StringSliceVarP(&buildOpts.Images, "images", "i", []string{}, "A comma separated list of images to include with the archive")
 	buildCmd.Flags().StringVarP(&buildOpts.EULAFile, "eula", "E", "", "A file containing an End User License Agreement to display to the user upon installing the package")
 	buildCmd.Flags().StringVarP(&buildOpts.Output, "output", "o", path.Join(cwd, "package.tar"), "The file to save the distribution package to")
 	buildCmd.Flags().BoolVar(&buildOpts.ExcludeImages, "exclude-images", false, "Don't include container images with the final archive")
 	buildCmd.Flags().StringVar(&buildPullPolicy, "pull-policy", string(types.PullPolicyAlways), "The pull policy to use when bundling container images (valid options always,never,ifnotpresent [case-insensitive])")
+	buildCmd.Flags().IntVar(&buildOpts.Parallelism, "parallelism", util.DefaultParallelism, "The number of container images to pull and k3s components to download at once")
 	buildCmd.Flags().StringVarP(&buildOpts.ConfigFile, "config", "c", defaultConfig, "An optional file providing variables and other configurations to be used at installation, if a k3p.yaml in the current directory exists it will be used automatically")
 	buildCmd.Flags().BoolVarP(&cache.NoCache, "no-cache", "N", false, "Disable the use of the local cache when downloading assets")
-	buildCmd.Flags().BoolVar(&buildOpts.Compress, "compress", false, "Whether to apply zst encryption to the package, it will usually require the same k3p release to decompress.")
+	buildCmd.Flags().StringVar(&buildCompression, "compression", string(types.CompressionNone), `The codec to compress the package with (valid options none,gzip,xz,zstd,zstd-dict). zstd-dict uses
+a dictionary trained on k3s images that is built into k3p, and requires a k3p release with the same dictionary to decompress`)
+	buildCmd.Flags().BoolVar(&buildCompress, "compress", false, "Compress the package with zstd and the built-in dictionary, the same as --compression zstd-dict")
 	buildCmd.Flags().BoolVar(&buildOpts.RunFile, "run-file", false, "Whether to bundle the final archive into a self-installing run file")
+	buildCmd.Flags().StringArrayVar(&buildRunFileBins, "runfile-k3p-binary", []string{}, `A linux k3p binary to embed in the run file instead of the running one, given as ARCH=PATH
+(or just PATH for a single architecture), can be specified multiple times. Architectures without
+one use the k3p release for the architecture from the cache`)
 	buildCmd.Flags().BoolVar(&buildOpts.CreateRegistry, "build-registry", false, "Bundle container images into a private registry instead of just raw tar balls")
+	buildCmd.Flags().BoolVar(&buildEncrypt, "encrypt", false, `Encrypt the package so it can only be read with the private key of one of the --recipients,
+or with a passphrase that is prompted for (or read from $K3P_PASSPHRASE) when there are none`)
+	buildCmd.Flags().StringSliceVar(&buildRecipients, "recipients", []string{}, `Public keys (from "k3p keys generate --encryption") that can decrypt the package, can be
+specified multiple times and implies --encrypt`)
+	buildCmd.Flags().StringVar(&buildSplitSize, "split-size", "", `Split the final archive into parts of at most this size (e.g. 4G or 700MiB), written as
+<output>.001, <output>.002 and so on along with a list of their checksums`)
+	buildCmd.Flags().StringVar(&buildOpts.BasePackage, "base", "", "A previous release of the package to build a delta against, only what changed since that release is included")
+	buildCmd.Flags().StringVar(&buildSBOM, "sbom", "", `Embed a software bill of materials listing the k3s binary, images, charts and manifests in the
+package (valid options spdx,cyclonedx), defaults to spdx when given without a value`)
+	buildCmd.Flags().Lookup("sbom").NoOptDefVal = string(types.SBOMFormatSPDX)
+	buildCmd.Flags().StringVar(&buildOpts.FromDir, "from-dir", "", `Pack a directory produced by "k3p unpack" instead of downloading k3s and scanning for manifests.
+The name, version, and configuration of the unpacked package are kept unless they are given`)
+	buildCmd.Flags().BoolVar(&buildReproducible, "reproducible", false, `Build a package that is byte for byte identical for identical inputs. Entries are owned by root
+and dated from $SOURCE_DATE_EPOCH (or the Unix epoch when unset), artifacts are sorted, and --name is required`)
 
 	buildCmd.MarkFlagDirname("exclude")
 	buildCmd.MarkFlagDirname("manifests")
+	buildCmd.MarkFlagDirname("from-dir")
 	buildCmd.MarkFlagFilename("config", "json", "yaml", "yml")
+	buildCmd.MarkFlagFilename("base", "tar", "gz", "xz", "zst")
+	buildCmd.MarkFlagFilename("recipients", "pub", "pem")
+	buildCmd.MarkFlagFilename("runfile-k3p-binary")
 	buildCmd.RegisterFlagCompletionFunc("pull-policy", completeStringOpts([]string{string(types.PullPolicyAlways), string(types.PullPolicyIfNotPresent), string(types.PullPolicyNever)}))
+	buildCmd.RegisterFlagCompletionFunc("compression", completeStringOpts(compressionOpts()))
+	buildCmd.RegisterFlagCompletionFunc("sbom", completeStringOpts(sbomFormatOpts()))
 	buildCmd.RegisterFlagCompletionFunc("arch", completeStringOpts([]string{"amd64", "arm64", "arm"}))
 	buildCmd.RegisterFlagCompletionFunc("channel", completeChannels)
 
@@ -68,7 +111,44 @@ func init() {
 var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "Build a k3s distribution package",
+	Long: `
+The build command bundles k3s, the manifests and charts in the given directories, and the images
+they use into a package that can be installed with "k3p install".
+
+Besides the configuration bundled with the package, the configuration file (k3p.yaml in the
+current directory by default) can declare how the package is built in a "build" section, so
+builds can be reproduced from a checked-in file. The section accepts the same options as the
+flags below, and flags given on the command line override it. Relative paths are resolved
+against the directory of the configuration file, and the section is not bundled with the package.
+
+Example
+
+	build:
+	  name: my-app
+	  version: v1.0.0
+	  k3sVersion: v1.19.4+k3s1
+	  archs: [amd64, arm64]
+	  manifests: [deploy]
+	  images: [registry:2]
+	  parallelism: 8
+	  compression: zstd
+	  output: dist/my-app.tar
+
+	$> k3p build
+	$> k3p build -V v1.0.1
+`,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
+		fromSpec, err := applyBuildSpec(cmd, buildOpts.ConfigFile)
+		if err != nil {
+			return err
+		}
+
+		if buildOpts.FromDir != "" {
+			if err := setFromDir(cmd, buildOpts, fromSpec); err != nil {
+				return err
+			}
+		}
+
 		// validate pull policy first
 		switch types.PullPolicy(strings.ToLower(buildPullPolicy)) {
 		case types.PullPolicyAlways:
@@ -80,6 +160,83 @@ var buildCmd = &cobra.Command{
 		default:
 			return fmt.Errorf("%s is not a valid pull policy", buildPullPolicy)
 		}
+
+		if buildOpts.Parallelism < 1 {
+			return fmt.Errorf("The --parallelism flag must be at least 1, got %d", buildOpts.Parallelism)
+		}
+
+		if buildEncrypt || len(buildRecipients) > 0 {
+			// fail early on keys that cannot be used, rather than after building the package
+			if _, err := crypt.LoadPublicKeys(buildRecipients); err != nil {
+				return err
+			}
+			buildOpts.Encrypt = &types.EncryptOptions{Recipients: buildRecipients}
+			if len(buildRecipients) == 0 {
+				passphrase, err := readPassphrase("Enter a passphrase for the package: ", true)
+				if err != nil {
+					return err
+				}
+				buildOpts.Encrypt.Passphrase = string(passphrase)
+			}
+		}
+
+		if buildSplitSize != "" {
+			if buildOpts.RunFile {
+				return errors.New("The --split-size flag cannot be used with --run-file")
+			}
+			size, err := split.ParseSize(buildSplitSize)
+			if err != nil {
+				return err
+			}
+			buildOpts.SplitSize = size
+		}
+
+		if len(buildRunFileBins) > 0 {
+			if err := setRunFileBinaries(buildOpts, buildRunFileBins); err != nil {
+				return err
+			}
+		}
+
+		if buildSBOM != "" {
+			format, err := sbom.ParseFormat(buildSBOM)
+			if err != nil {
+				return err
+			}
+			buildOpts.SBOM = format
+		}
+
+		if buildReproducible {
+			if err := setReproducible(buildOpts); err != nil {
+				return err
+			}
+		}
+
+		compression, err := getCompression(cmd, buildCompression, buildCompress)
+		if err != nil {
+			return err
+		}
+		buildOpts.Compression = compression
+
+		seen := make(map[string]struct{})
+		for _, arch := range buildOpts.Archs {
+			switch arch {
+			case "amd64", "arm64", "arm":
+			default:
+				return fmt.Errorf("%q is not a supported architecture", arch)
+			}
+			if _, ok := seen[arch]; ok {
+				return fmt.Errorf("The %q architecture was provided more than once", arch)
+			}
+			seen[arch] = struct{}{}
+		}
+		if len(buildOpts.Archs) > 1 {
+			if buildOpts.CreateRegistry {
+				return errors.New("The --build-registry flag cannot be used when building for multiple architectures")
+			}
+			if !buildOpts.ExcludeImages && buildOpts.PullPolicy != types.PullPolicyAlways {
+				return errors.New("Images must be pulled for every architecture when building for multiple architectures, --pull-policy must be always")
+			}
+		}
 		return nil
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -91,6 +248,161 @@ var buildCmd = &cobra.Command{
 	},
 }
 
+// applyBuildSpec sets the options whose flags were not given on the command line from the build
+// section of the configuration file, if it has one. The options are set directly instead of
+// through the flags, so the flags only report being changed when given on the command line. The
+// names of the flags that were set from the spec are returned.
+func applyBuildSpec(cmd *cobra.Command, configFile string) (map[string]bool, error) {
+	fromSpec := make(map[string]bool)
+	if configFile == "" {
+		return fromSpec, nil
+	}
+	spec, err := types.BuildSpecFromFile(configFile)
+	if err != nil || spec == nil {
+		return fromSpec, err
+	}
+	log.Debugf("Reading build options from %q\n", configFile)
+
+	runFileBins := make([]string, 0, len(spec.RunFileK3pBinaries))
+	for arch, bin := range spec.RunFileK3pBinaries {
+		runFileBins = append(runFileBins, arch+"="+bin)
+	}
+	sort.Strings(runFileBins)
+
+	options := []struct {
+		flag  string
+		isSet bool
+		apply func()
+	}{
+		{"name", spec.Name != "", func() { buildOpts.Name = spec.Name }},
+		{"version", spec.Version != "", func() { buildOpts.BuildVersion = spec.Version }},
+		{"description", spec.Description != "", func() { buildOpts.Description = spec.Description }},
+		{"k3s-version", spec.K3sVersion != "", func() { buildOpts.K3sVersion = spec.K3sVersion }},
+		{"channel", spec.Channel != "", func() { buildOpts.K3sChannel = spec.Channel }},
+		{"arch", len(spec.Archs) > 0, func() { buildOpts.Archs = spec.Archs }},
+		{"manifests", len(spec.Manifests) > 0, func() { buildOpts.ManifestDirs = spec.Manifests }},
+		{"exclude", len(spec.Excludes) > 0, func() { buildOpts.Excludes = spec.Excludes }},
+		{"images", len(spec.Images) > 0, func() { buildOpts.Images = spec.Images }},
+		{"image-file", spec.ImageFile != "", func() { buildOpts.ImageFile = spec.ImageFile }},
+		{"exclude-images", spec.ExcludeImages, func() { buildOpts.ExcludeImages = true }},
+		{"pull-policy", spec.PullPolicy != "", func() { buildPullPolicy = spec.PullPolicy }},
+		{"parallelism", spec.Parallelism != 0, func() { buildOpts.Parallelism = spec.Parallelism }},
+		{"build-registry", spec.BuildRegistry, func() { buildOpts.CreateRegistry = true }},
+		{"eula", spec.EULA != "", func() { buildOpts.EULAFile = spec.EULA }},
+		{"no-cache", spec.NoCache, func() { cache.NoCache = true }},
+		{"output", spec.Output != "", func() { buildOpts.Output = spec.Output }},
+		{"compression", spec.Compression != "", func() { buildCompression = spec.Compression }},
+		{"run-file", spec.RunFile, func() { buildOpts.RunFile = true }},
+		{"runfile-k3p-binary", len(runFileBins) > 0, func() { buildRunFileBins = runFileBins }},
+		{"encrypt", spec.Encrypt, func() { buildEncrypt = true }},
+		{"recipients", len(spec.Recipients) > 0, func() { buildRecipients = spec.Recipients }},
+		{"split-size", spec.SplitSize != "", func() { buildSplitSize = spec.SplitSize }},
+		{"base", spec.Base != "", func() { buildOpts.BasePackage = spec.Base }},
+		{"sbom", spec.SBOM != "", func() { buildSBOM = spec.SBOM }},
+		{"from-dir", spec.FromDir != "", func() { buildOpts.FromDir = spec.FromDir }},
+		{"reproducible", spec.Reproducible, func() { buildReproducible = true }},
+	}
+	for _, opt := range options {
+		if !opt.isSet || cmd.Flags().Changed(opt.flag) {
+			continue
+		}
+		opt.apply()
+		fromSpec[opt.flag] = true
+	}
+	return fromSpec, nil
+}
+
+// setRunFileBinaries parses the k3p binaries to embed in a run file, given as ARCH=PATH or just a
+// PATH when the package is built for a single architecture.
+func setRunFileBinaries(opts *types.BuildOptions, values []string) error {
+	if !opts.RunFile {
+		return errors.New("The --runfile-k3p-binary flag can only be used with --run-file")
+	}
+	opts.RunFileK3pBinaries = make(map[string]string)
+	for _, value := range values {
+		var arch, bin string
+		if parts := strings.SplitN(value, "=", 2); len(parts) == 2 {
+			arch, bin = parts[0], parts[1]
+		} else if len(opts.Archs) > 1 {
+			return fmt.Errorf("The package is built for %s, the k3p binary %q must be given as ARCH=PATH", strings.Join(opts.Archs, ","), value)
+		} else {
+			// packages built with --from-dir only know their architecture once they are read
+			arch, bin = "", value
+			if len(opts.Archs) == 1 {
+				arch = opts.Archs[0]
+			}
+		}
+		if _, ok := opts.RunFileK3pBinaries[arch]; ok {
+			return fmt.Errorf("More than one k3p binary was provided for %q", arch)
+		}
+		if _, err := os.Stat(bin); err != nil {
+			return err
+		}
+		opts.RunFileK3pBinaries[arch] = bin
+	}
+	return nil
+}
+
+// sourceDateEpochEnv is the environment variable holding the time to date reproducible builds
+// with, as defined by https://reproducible-builds.org/specs/source-date-epoch/
+const sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// setReproducible configures the options for a reproducible build, making sure nothing that is
+// different on every build was asked for.
+func setReproducible(opts *types.BuildOptions) error {
+	if opts.Name == "" && opts.FromDir == "" {
+		return errors.New("A name must be given with --name for reproducible builds")
+	}
+	if opts.CreateRegistry {
+		return errors.New("The --build-registry flag cannot be used for reproducible builds, the registry uses newly generated keys")
+	}
+	if opts.Encrypt != nil {
+		log.Warning("Encryption uses random keys, only the decrypted package will be reproducible")
+	}
+	sourceDate := time.Unix(0, 0)
+	if epoch := os.Getenv(sourceDateEpochEnv); epoch != "" {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("$%s must be a number of seconds since the Unix epoch: %s", sourceDateEpochEnv, err.Error())
+		}
+		sourceDate = time.Unix(secs, 0)
+	}
+	opts.SourceDate = &sourceDate
+	return nil
+}
+
+// fromDirIgnoredFlags are the flags that choose what goes into a package, which cannot be used
+// when the contents come from an unpacked package.
+var fromDirIgnoredFlags = []string{
+	"manifests", "exclude", "arch", "k3s-version", "channel", "images", "image-file",
+	"eula", "exclude-images", "pull-policy", "build-registry",
+}
+
+// setFromDir configures the options for packing an unpacked package, clearing the defaults that
+// only apply when the contents are gathered by the build. Options from the build section of the
+// configuration that do not apply are ignored, so the same file can be used for both kinds of build.
+func setFromDir(cmd *cobra.Command, opts *types.BuildOptions, fromSpec map[string]bool) error {
+	for _, flag := range fromDirIgnoredFlags {
+		if cmd.Flags().Changed(flag) {
+			return fmt.Errorf("The --%s flag cannot be used with --from-dir, edit the unpacked package instead", flag)
+		}
+		if fromSpec[flag] {
+			log.Debugf("Ignoring %s from the build section of the configuration when packing %q\n", flag, opts.FromDir)
+		}
+	}
+	if _, err := os.Stat(path.Join(opts.FromDir, types.ManifestMetaFile)); err != nil {
+		return fmt.Errorf("%q does not look like an unpacked package: %s", opts.FromDir, err.Error())
+	}
+	opts.ManifestDirs, opts.Archs, opts.K3sVersion = nil, nil, ""
+	if !cmd.Flags().Changed("version") && !fromSpec["version"] {
+		opts.BuildVersion = ""
+	}
+	if !cmd.Flags().Changed("config") {
+		opts.ConfigFile = ""
+	}
+	return nil
+}
+
 type channelResponse struct {
 	Data []channel `json:"data"`
 }
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/pflag"
+
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+var _ = Describe("Build options from the configuration", func() {
+	var tmpDir, configFile string
+	var defaults types.BuildOptions
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		configFile = filepath.Join(tmpDir, "k3p.yaml")
+		defaults = *buildOpts
+	})
+
+	AfterEach(func() {
+		*buildOpts = defaults
+		buildPullPolicy, buildCompression = string(types.PullPolicyAlways), string(types.CompressionNone)
+		buildCmd.Flags().VisitAll(func(flag *pflag.Flag) { flag.Changed = false })
+		os.RemoveAll(tmpDir)
+	})
+
+	writeConfig := func(config string) {
+		Expect(ioutil.WriteFile(configFile, []byte(config), 0644)).To(Succeed())
+	}
+
+	preRun := func(args ...string) error {
+		Expect(buildCmd.Flags().Parse(append([]string{"--config", configFile}, args...))).To(Succeed())
+		return buildCmd.PreRunE(buildCmd, nil)
+	}
+
+	It("Should use the values from the build section", func() {
+		writeConfig(`
+variables:
+- name: hostname
+build:
+  name: app
+  version: v1.0.0
+  archs: [arm64, amd64]
+  manifests: [deploy]
+  parallelism: 3
+  compression: gzip
+  output: dist/app.tar
+`)
+		Expect(preRun()).To(Succeed())
+		Expect(buildOpts.Name).To(Equal("app"))
+		Expect(buildOpts.BuildVersion).To(Equal("v1.0.0"))
+		Expect(buildOpts.Archs).To(Equal([]string{"arm64", "amd64"}))
+		Expect(buildOpts.ManifestDirs).To(Equal([]string{filepath.Join(tmpDir, "deploy")}))
+		Expect(buildOpts.Parallelism).To(Equal(3))
+		Expect(buildOpts.Compression).To(Equal(types.CompressionGzip))
+		Expect(buildOpts.Output).To(Equal(filepath.Join(tmpDir, "dist", "app.tar")))
+		// the flags only report what was given on the command line
+		for _, flag := range []string{"name", "version", "arch", "manifests", "parallelism", "output"} {
+			Expect(buildCmd.Flags().Changed(flag)).To(BeFalse(), flag)
+		}
+	})
+
+	It("Should let flags on the command line override the build section", func() {
+		writeConfig("build:\n  name: app\n  version: v1.0.0\n  parallelism: 3\n")
+		Expect(preRun("--name", "other", "--parallelism", "5")).To(Succeed())
+		Expect(buildOpts.Name).To(Equal("other"))
+		Expect(buildOpts.Parallelism).To(Equal(5))
+		Expect(buildOpts.BuildVersion).To(Equal("v1.0.0"))
+	})
+
+	It("Should reject unknown keys in the build section", func() {
+		writeConfig("build:\n  name: app\n  archz: [amd64]\n")
+		err := preRun()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("The build section of " + configFile + " is not valid"))
+		Expect(err.Error()).To(ContainSubstring("archz"))
+	})
+
+	It("Should ignore options that do not apply to unpacked packages", func() {
+		unpacked := filepath.Join(tmpDir, "unpacked")
+		Expect(os.MkdirAll(unpacked, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(unpacked, types.ManifestMetaFile), []byte("{}"), 0644)).To(Succeed())
+		writeConfig("build:\n  version: v1.0.1\n  archs: [arm64]\n  manifests: [deploy]\n  k3sVersion: v1.19.4+k3s1\n")
+
+		Expect(preRun("--from-dir", unpacked)).To(Succeed())
+		Expect(buildOpts.FromDir).To(Equal(unpacked))
+		Expect(buildOpts.BuildVersion).To(Equal("v1.0.1"))
+		Expect(buildOpts.Archs).To(BeNil())
+		Expect(buildOpts.ManifestDirs).To(BeNil())
+		Expect(buildOpts.K3sVersion).To(BeEmpty())
+		Expect(buildOpts.ConfigFile).To(Equal(configFile))
+	})
+
+	It("Should still refuse those options on the command line with --from-dir", func() {
+		unpacked := filepath.Join(tmpDir, "unpacked")
+		Expect(os.MkdirAll(unpacked, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(unpacked, types.ManifestMetaFile), []byte("{}"), 0644)).To(Succeed())
+		writeConfig("build:\n  fromDir: unpacked\n")
+
+		err := preRun("--channel", "latest")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("The --channel flag cannot be used with --from-dir"))
+	})
+})
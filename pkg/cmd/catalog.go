@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/k3p/pkg/catalog"
+	"github.com/tinyzimmer/k3p/pkg/log"
+)
+
+var (
+	catalogLocation string
+	catalogURL      string
+	catalogIndexOut string
+	catalogOutput   string
+)
+
+func init() {
+	catalogIndexCmd.Flags().StringVar(&catalogURL, "url", "", `The URL the directory is served from, when the catalog is used from a static HTTP root that
+does not mirror the location of the index`)
+	catalogIndexCmd.Flags().StringVarP(&catalogIndexOut, "output", "o", "", "The file to write the index to, defaults to index.yaml inside the directory")
+
+	for _, cmd := range []*cobra.Command{catalogListCmd, catalogSearchCmd} {
+		cmd.Flags().StringVarP(&catalogLocation, "catalog", "c", ".", "The directory or URL of the catalog, or of its index")
+		cmd.Flags().StringVarP(&catalogOutput, "output", "o", "", "Print the packages as a structured document instead (valid options json,yaml)")
+		cmd.RegisterFlagCompletionFunc("output", completeStringOpts([]string{"json", "yaml"}))
+	}
+
+	catalogCmd.AddCommand(catalogIndexCmd)
+	catalogCmd.AddCommand(catalogListCmd)
+	catalogCmd.AddCommand(catalogSearchCmd)
+	rootCmd.AddCommand(catalogCmd)
+}
+
+var catalogCmd = &cobra.Command{
+	Use:   "catalog",
+	Short: "Index and search catalogs of packages",
+	Long: `
+Catalogs make it possible to find packages on a file share or a static web server by name
+and version instead of by their file names.
+
+A catalog is a directory of packages with an index.yaml at its root, listing the name, version,
+k3s version, architecture, description, and digest of every package inside it. The index is
+written with "k3p catalog index", and catalogs can be queried with "k3p catalog list" and
+"k3p catalog search". Packages are installed from a catalog by passing it to "k3p install"
+along with the name and optional version of the package.
+
+Example
+
+	$> k3p catalog index /mnt/packages
+	$> k3p catalog search monitoring --catalog /mnt/packages
+	$> k3p install monitoring@v2.0.0 --catalog https://packages.example.com
+`,
+}
+
+var catalogIndexCmd = &cobra.Command{
+	Use:   "index DIR",
+	Short: "Index the packages inside a directory",
+	Long: `
+Scans the given directory for packages and writes an index of them to its root. Encrypted
+packages and delta packages are not indexed.
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		index, err := catalog.Build(args[0], catalogURL)
+		if err != nil {
+			return err
+		}
+		out := catalogIndexOut
+		if out == "" {
+			out = filepath.Join(args[0], catalog.IndexFile)
+		}
+		log.Infof("Writing the index of %d packages to %q\n", len(index.Packages), out)
+		return index.WriteFile(out)
+	},
+}
+
+var catalogListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the packages in a catalog",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return printCatalog("")
+	},
+}
+
+var catalogSearchCmd = &cobra.Command{
+	Use:   "search QUERY",
+	Short: "Search a catalog for packages by their name or description",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return printCatalog(args[0])
+	},
+}
+
+// printCatalog prints the packages in the catalog from --catalog matching the query.
+func printCatalog(query string) error {
+	switch catalogOutput {
+	case "":
+	case "json", "yaml":
+		// keep the document the only thing written to stdout
+		log.LogWriter = os.Stderr
+	default:
+		return fmt.Errorf("%q is not a valid output format (valid options json,yaml)", catalogOutput)
+	}
+
+	cat, err := catalog.Load(catalogLocation)
+	if err != nil {
+		return err
+	}
+	entries := cat.Search(query)
+
+	if catalogOutput != "" {
+		return printDocument(os.Stdout, entries, catalogOutput)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVERSION\tK3S VERSION\tARCH\tSIZE\tDESCRIPTION")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Name, entry.Version, entry.K3sVersion, entry.Arch, byteCountSI(entry.Size), entry.Description)
+	}
+	return w.Flush()
+}
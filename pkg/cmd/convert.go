@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/k3p/pkg/build/package/formats"
+	"github.com/tinyzimmer/k3p/pkg/codec"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+var (
+	convertTo          string
+	convertOutput      string
+	convertCompress    bool
+	convertCompression string
+)
+
+func init() {
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	convertCmd.Flags().StringVar(&convertTo, "to", formats.Latest().Version, "The package format to convert to (valid options "+strings.Join(formats.Versions(), ",")+")")
+	convertCmd.Flags().StringVarP(&convertOutput, "output", "o", path.Join(cwd, "package.tar"), "The file to save the converted package to")
+	convertCmd.Flags().StringVar(&convertCompression, "compression", string(types.CompressionNone), "The codec to compress the converted package with (valid options none,gzip,xz,zstd,zstd-dict)")
+	convertCmd.Flags().BoolVar(&convertCompress, "compress", false, "Compress the converted package with zstd and the built-in dictionary, the same as --compression zstd-dict")
+
+	convertCmd.RegisterFlagCompletionFunc("to", completeStringOpts(formats.Versions()))
+	convertCmd.RegisterFlagCompletionFunc("compression", completeStringOpts(compressionOpts()))
+
+	rootCmd.AddCommand(convertCmd)
+}
+
+var convertCmd = &cobra.Command{
+	Use:   "convert PACKAGE",
+	Short: "Convert a package to a newer package format",
+	Long: `
+The convert command rewrites a package built by an older release of k3p in a newer package
+format, so it can be used with features that require it (like streamed installs). The
+contents and metadata of the package are kept as they are.
+
+Packages that are signed must be signed again after they are converted, since the archive
+changes. Delta packages cannot be converted.
+
+Example
+
+	$> k3p convert old-package.tar --to v2 -o package.tar
+`,
+	Args: cobra.ExactArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"tar"}, cobra.ShellCompDirectiveFilterFileExt
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := formats.Get(convertTo)
+		if err != nil {
+			return err
+		}
+		compression, err := getCompression(cmd, convertCompression, convertCompress)
+		if err != nil {
+			return err
+		}
+
+		pkg, err := getInspectPackage(args[0])
+		if err != nil {
+			return err
+		}
+		defer pkg.Close()
+		meta := pkg.GetMeta()
+
+		tmpDir, err := util.GetTempDir()
+		if err != nil {
+			return err
+		}
+		log.Infof("Converting %q to the %s package format\n", args[0], format.Version)
+		out, err := formats.Convert(pkg, format, tmpDir)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		log.Info("Finalizing archive")
+		archive, err := out.Archive()
+		if err != nil {
+			return err
+		}
+		if compression != types.CompressionNone {
+			compName := convertOutput + codec.Extension(compression)
+			log.Infof("Writing version %q of %q to %q (%s)\n", meta.GetVersion(), meta.GetName(), compName, compression)
+			return archive.CompressTo(compName, compression)
+		}
+		log.Infof("Writing version %q of %q to %q\n", meta.GetVersion(), meta.GetName(), convertOutput)
+		return archive.WriteTo(convertOutput)
+	},
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/k3p/pkg/diff"
+	"github.com/tinyzimmer/k3p/pkg/log"
+)
+
+var diffOutput string
+
+func init() {
+	diffCmd.Flags().StringVarP(&diffOutput, "output", "o", "", "Print the differences as a structured document instead (valid options json,yaml)")
+
+	diffCmd.RegisterFlagCompletionFunc("output", completeStringOpts([]string{"json", "yaml"}))
+
+	rootCmd.AddCommand(diffCmd)
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff FROM TO",
+	Short: "Compare two packages",
+	Long: `
+The diff command reports what changed between two packages.
+
+Differences in the k3s version and architecture are shown, along with the artifacts that
+were added, removed, or changed (by their digests), and the container images that were
+added or removed across all the image bundles. Unified diffs are shown for the manifests
+that changed, and for the variables and helm values in the package configurations.
+
+Example
+
+	$> k3p diff app-v1.tar app-v2.tar
+	$> k3p diff app-v1.tar registry.example.com/app:v2 -o json
+`,
+	Args: cobra.ExactArgs(2),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"tar"}, cobra.ShellCompDirectiveFilterFileExt
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		switch diffOutput {
+		case "":
+		case "json", "yaml":
+			// keep the document the only thing written to stdout
+			log.LogWriter = os.Stderr
+		default:
+			return fmt.Errorf("%q is not a valid output format (valid options json,yaml)", diffOutput)
+		}
+
+		from, err := getInspectPackage(args[0])
+		if err != nil {
+			return err
+		}
+		defer from.Close()
+		to, err := getInspectPackage(args[1])
+		if err != nil {
+			return err
+		}
+		defer to.Close()
+
+		res, err := diff.Packages(from, to)
+		if err != nil {
+			return err
+		}
+
+		if diffOutput != "" {
+			return printDocument(os.Stdout, res, diffOutput)
+		}
+
+		fmt.Println()
+		fmt.Println("FROM:", res.From.Name, res.From.Version)
+		fmt.Println("TO:  ", res.To.Name, res.To.Version)
+
+		if res.IsEmpty() {
+			fmt.Println()
+			fmt.Println("The packages have the same contents")
+			fmt.Println()
+			return nil
+		}
+
+		if res.K3sVersion != nil || res.Arch != nil {
+			fmt.Println()
+		}
+		if res.K3sVersion != nil {
+			fmt.Println("K3S VERSION:", res.K3sVersion.From, "->", res.K3sVersion.To)
+		}
+		if res.Arch != nil {
+			fmt.Println("ARCH:       ", res.Arch.From, "->", res.Arch.To)
+		}
+
+		if len(res.Artifacts) > 0 {
+			fmt.Println()
+			fmt.Println("ARTIFACTS:")
+			for _, change := range res.Artifacts {
+				name := fmt.Sprintf("%s/%s", change.Type, change.Name)
+				switch change.Change {
+				case diff.ChangeAdded:
+					fmt.Println("   +", name, "\t", byteCountSI(change.ToSize))
+				case diff.ChangeRemoved:
+					fmt.Println("   -", name, "\t", byteCountSI(change.FromSize))
+				default:
+					fmt.Println("   ~", name, "\t", byteCountSI(change.FromSize), "->", byteCountSI(change.ToSize))
+				}
+			}
+		}
+
+		if len(res.AddedImages) > 0 || len(res.RemovedImages) > 0 {
+			fmt.Println()
+			fmt.Println("IMAGES:")
+			for _, img := range res.AddedImages {
+				fmt.Println("   +", img)
+			}
+			for _, img := range res.RemovedImages {
+				fmt.Println("   -", img)
+			}
+		}
+
+		if len(res.Variables) > 0 {
+			fmt.Println()
+			fmt.Println("VARIABLES:")
+			for _, change := range res.Variables {
+				switch change.Change {
+				case diff.ChangeAdded:
+					fmt.Println("   +", change.Name, defaultString(change.ToDefault))
+				case diff.ChangeRemoved:
+					fmt.Println("   -", change.Name, defaultString(change.FromDefault))
+				default:
+					fmt.Println("   ~", change.Name, defaultString(change.FromDefault), "->", defaultString(change.ToDefault))
+				}
+			}
+		}
+
+		if len(res.Manifests) > 0 {
+			fmt.Println()
+			fmt.Println("MANIFESTS:")
+			for _, fileDiff := range res.Manifests {
+				printFileDiff(fileDiff)
+			}
+		}
+
+		if len(res.HelmValues) > 0 {
+			fmt.Println()
+			fmt.Println("HELM VALUES:")
+			for _, fileDiff := range res.HelmValues {
+				printFileDiff(fileDiff)
+			}
+		}
+
+		fmt.Println()
+		return nil
+	},
+}
+
+func defaultString(def string) string {
+	if def == "" {
+		return "(required)"
+	}
+	return fmt.Sprintf("(default %q)", def)
+}
+
+func printFileDiff(fileDiff diff.FileDiff) {
+	fmt.Println()
+	scanner := bufio.NewScanner(strings.NewReader(fileDiff.Diff))
+	for scanner.Scan() {
+		fmt.Println("    ", scanner.Text())
+	}
+}
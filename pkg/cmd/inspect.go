@@ -1,35 +1,47 @@
 package cmd
 
 import (
-	"archive/tar"
 	"bufio"
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
 
 	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/images"
 	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/oci"
+	"github.com/tinyzimmer/k3p/pkg/sbom"
 	"github.com/tinyzimmer/k3p/pkg/types"
 )
 
 var inspectDetails bool
 var inspectManifest string
 var inspectConfig string
+var inspectSBOM string
+var inspectOutput string
 
 func init() {
 	inspectCmd.Flags().BoolVarP(&inspectDetails, "details", "D", false, "Show additional details on package content")
 	inspectCmd.Flags().StringVarP(&inspectManifest, "manifest", "m", "", "Dump the contents of the specified manifest")
 	inspectCmd.Flags().StringVarP(&inspectConfig, "config", "c", "", "Dump the contents of the specified config file")
+	inspectCmd.Flags().StringVar(&inspectSBOM, "sbom", "", `Print a software bill of materials for the package (valid options spdx,cyclonedx), the one
+embedded at build time is used when present, defaults to spdx when given without a value`)
+	inspectCmd.Flags().Lookup("sbom").NoOptDefVal = string(types.SBOMFormatSPDX)
+	inspectCmd.Flags().StringVarP(&inspectOutput, "output", "o", "", `Print the package as a structured document instead (valid options json,yaml), including the
+images in every image bundle`)
 
 	inspectCmd.RegisterFlagCompletionFunc("manifest", completeManifests)
 	inspectCmd.RegisterFlagCompletionFunc("config", completeConfigs)
+	inspectCmd.RegisterFlagCompletionFunc("sbom", completeStringOpts(sbomFormatOpts()))
+	inspectCmd.RegisterFlagCompletionFunc("output", completeStringOpts([]string{"json", "yaml"}))
 
 	rootCmd.AddCommand(inspectCmd)
 }
@@ -57,22 +69,10 @@ func completeConfigs(cmd *cobra.Command, args []string, toComplete string) ([]st
 }
 
 func getInspectPackage(path string) (types.Package, error) {
-	var pkgReader io.ReadCloser
-	var err error
-
-	pkgReader, err = os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-
-	if strings.HasSuffix(path, ".zst") {
-		pkgReader, err = v1.Decompress(pkgReader)
-		if err != nil {
-			return nil, err
-		}
+	if oci.IsReference(path) {
+		return getRegistryPackage(path)
 	}
-
-	return v1.Load(pkgReader)
+	return loadPackageFile(path)
 }
 
 var inspectCmd = &cobra.Command{
@@ -83,6 +83,15 @@ var inspectCmd = &cobra.Command{
 		return []string{"tar"}, cobra.ShellCompDirectiveFilterFileExt
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
+		switch inspectOutput {
+		case "":
+		case "json", "yaml":
+			// keep the document the only thing written to stdout
+			log.LogWriter = os.Stderr
+		default:
+			return fmt.Errorf("%q is not a valid output format (valid options json,yaml)", inspectOutput)
+		}
+
 		pkg, err := getInspectPackage(args[0])
 		if err != nil {
 			return err
@@ -91,6 +100,33 @@ var inspectCmd = &cobra.Command{
 
 		meta := pkg.GetMeta()
 
+		if inspectOutput != "" {
+			doc, err := newInspectDocument(pkg)
+			if err != nil {
+				return err
+			}
+			return printDocument(os.Stdout, doc, inspectOutput)
+		}
+
+		if inspectSBOM != "" {
+			format, err := sbom.ParseFormat(inspectSBOM)
+			if err != nil {
+				return err
+			}
+			body, err := sbom.Find(pkg, format)
+			if err != nil {
+				return err
+			}
+			if body == nil {
+				log.Debugf("No %s SBOM is embedded in the package, generating one\n", format)
+				if body, err = sbom.Generate(pkg, format); err != nil {
+					return err
+				}
+			}
+			fmt.Println(string(body))
+			return nil
+		}
+
 		if inspectManifest != "" {
 			artifact := &types.Artifact{
 				Type: types.ArtifactManifest,
@@ -128,9 +164,17 @@ var inspectCmd = &cobra.Command{
 		fmt.Println()
 		fmt.Println("NAME:   ", meta.Name)
 		fmt.Println("VERSION:", meta.Version)
+		if meta.Description != "" {
+			fmt.Println()
+			fmt.Println("DESCRIPTION:", meta.Description)
+		}
 		fmt.Println()
 		fmt.Println("ARCH:       ", meta.Arch)
 		fmt.Println("K3S VERSION:", meta.K3sVersion)
+		if meta.IsDelta() {
+			fmt.Println()
+			fmt.Println("DELTA OF:   ", meta.Base.Name, meta.Base.Version)
+		}
 
 		fmt.Println()
 		fmt.Println("CONTENTS:")
@@ -139,30 +183,30 @@ var inspectCmd = &cobra.Command{
 		fmt.Println("  BINARIES")
 		for _, bin := range meta.Manifest.Bins {
 			artifact := &types.Artifact{Type: types.ArtifactBin, Name: bin}
-			if err := pkg.Get(artifact); err != nil {
+			if err := getInspectArtifact(pkg, meta, artifact); err != nil {
 				return err
 			}
-			fmt.Println("    ", artifact.Name, "\t", byteCountSI(artifact.Size))
+			fmt.Println("    ", artifact.Name, "\t", inspectSize(artifact))
 		}
 
 		fmt.Println()
 		fmt.Println("  SCRIPTS")
 		for _, sc := range meta.Manifest.Scripts {
 			artifact := &types.Artifact{Type: types.ArtifactScript, Name: sc}
-			if err := pkg.Get(artifact); err != nil {
+			if err := getInspectArtifact(pkg, meta, artifact); err != nil {
 				return err
 			}
-			fmt.Println("    ", artifact.Name, "\t", byteCountSI(artifact.Size))
+			fmt.Println("    ", artifact.Name, "\t", inspectSize(artifact))
 		}
 
 		fmt.Println()
 		fmt.Println("  CONFIGS")
 		for _, e := range meta.Manifest.Etc {
 			artifact := &types.Artifact{Type: types.ArtifactEtc, Name: e}
-			if err := pkg.Get(artifact); err != nil {
+			if err := getInspectArtifact(pkg, meta, artifact); err != nil {
 				return err
 			}
-			fmt.Println("    ", artifact.Name, "\t", byteCountSI(artifact.Size))
+			fmt.Println("    ", artifact.Name, "\t", inspectSize(artifact))
 		}
 
 		fmt.Println()
@@ -172,13 +216,13 @@ var inspectCmd = &cobra.Command{
 		}
 		for i, img := range meta.Manifest.Images {
 			artifact := &types.Artifact{Type: types.ArtifactImages, Name: img}
-			if err := pkg.Get(artifact); err != nil {
+			if err := getInspectArtifact(pkg, meta, artifact); err != nil {
 				return err
 			}
-			fmt.Println("    ", artifact.Name, "\t", byteCountSI(artifact.Size))
-			if inspectDetails {
+			fmt.Println("    ", artifact.Name, "\t", inspectSize(artifact))
+			if inspectDetails && artifact.Body != nil {
 				fmt.Println()
-				imageNames, err := imageNamesFromTar(artifact.Body)
+				imageNames, err := images.NamesFromTar(artifact.Body)
 				if err != nil {
 					fmt.Println("       - <", err.Error(), ">")
 					continue
@@ -196,20 +240,32 @@ var inspectCmd = &cobra.Command{
 		fmt.Println("  MANIFESTS")
 		for _, mani := range meta.Manifest.K8sManifests {
 			artifact := &types.Artifact{Type: types.ArtifactManifest, Name: mani}
-			if err := pkg.Get(artifact); err != nil {
+			if err := getInspectArtifact(pkg, meta, artifact); err != nil {
 				return err
 			}
-			fmt.Println("    ", artifact.Name, "\t", byteCountSI(artifact.Size))
+			fmt.Println("    ", artifact.Name, "\t", inspectSize(artifact))
 		}
 
 		fmt.Println()
 		fmt.Println("  STATIC ASSETS")
 		for _, static := range meta.Manifest.Static {
 			artifact := &types.Artifact{Type: types.ArtifactStatic, Name: static}
-			if err := pkg.Get(artifact); err != nil {
+			if err := getInspectArtifact(pkg, meta, artifact); err != nil {
 				return err
 			}
-			fmt.Println("    ", artifact.Name, "\t", byteCountSI(artifact.Size))
+			fmt.Println("    ", artifact.Name, "\t", inspectSize(artifact))
+		}
+
+		if len(meta.Manifest.SBOM) > 0 {
+			fmt.Println()
+			fmt.Println("  SBOM")
+			for _, doc := range meta.Manifest.SBOM {
+				artifact := &types.Artifact{Type: types.ArtifactSBOM, Name: doc}
+				if err := getInspectArtifact(pkg, meta, artifact); err != nil {
+					return err
+				}
+				fmt.Println("    ", artifact.Name, "\t", inspectSize(artifact))
+			}
 		}
 
 		if cfg := meta.GetPackageConfig(); cfg != nil && len(cfg.Variables) > 0 {
@@ -232,41 +288,280 @@ var inspectCmd = &cobra.Command{
 			}
 		}
 
+		if cfg := meta.GetPackageConfig(); cfg != nil && cfg.Requires != nil {
+			printRequirements(cfg.Requires)
+		}
+
+		if cfg := meta.GetPackageConfig(); cfg != nil && cfg.Hooks != nil {
+			printHooks(cfg.Hooks)
+		}
+
+		if meta.Provenance != nil {
+			if err := printProvenance(meta.Provenance); err != nil {
+				return err
+			}
+		}
+
 		fmt.Println()
 		return nil
 	},
 }
 
-type imageManifest struct {
-	RepoTags []string
-	// not interested in anything else for now
+// printRequirements prints what must be met by a node and the cluster to install the package.
+func printRequirements(reqs *types.Requirements) {
+	fmt.Println()
+	fmt.Println("REQUIREMENTS:")
+	fmt.Println()
+	if reqs.MinK3sVersion != "" || reqs.MaxK3sVersion != "" {
+		min, max := reqs.MinK3sVersion, reqs.MaxK3sVersion
+		if min == "" {
+			min = "any"
+		}
+		if max == "" {
+			max = "any"
+		}
+		fmt.Println("  K3S VERSIONS:  ", min, "to", max)
+	}
+	if len(reqs.KernelModules) > 0 {
+		fmt.Println("  KERNEL MODULES:", strings.Join(reqs.KernelModules, ", "))
+	}
+	if len(reqs.Packages) > 0 {
+		fmt.Println()
+		fmt.Println("  PACKAGES")
+		for _, pkg := range reqs.Packages {
+			if pkg.Version == "" {
+				fmt.Println("    ", pkg.Name)
+			} else {
+				fmt.Println("    ", pkg.Name, "\t", pkg.Version)
+			}
+		}
+	}
+}
+
+// printHooks prints the scripts that run on each node during an installation.
+func printHooks(hooks *types.Hooks) {
+	fmt.Println()
+	fmt.Println("HOOKS:")
+	fmt.Println()
+	for _, phase := range types.HookPhases {
+		hook := hooks.Get(phase)
+		if hook == nil {
+			continue
+		}
+		onFailure := hook.OnFailure
+		if onFailure == "" {
+			onFailure = types.HookFailurePolicyFail
+		}
+		fmt.Printf("  %-12s %s (on failure: %s)\n", phase, types.HookScriptName(phase), onFailure)
+	}
 }
 
-func imageNamesFromTar(body io.ReadCloser) ([]string, error) {
-	defer body.Close()
-	out := make([]string, 0)
-	reader := tar.NewReader(body)
-	for {
-		header, err := reader.Next()
+// printProvenance prints how the package was built, including the full build options when
+// details were requested.
+func printProvenance(prov *types.Provenance) error {
+	fmt.Println()
+	fmt.Println("PROVENANCE:")
+	fmt.Println()
+	k3p := prov.K3pVersion
+	if k3p == "" {
+		k3p = "unknown"
+	}
+	if prov.K3pCommit != "" {
+		k3p += fmt.Sprintf(" (%s)", prov.K3pCommit)
+	}
+	fmt.Println("  BUILT WITH: ", "k3p", k3p)
+	fmt.Println("  BUILD TIME: ", prov.BuildTime.Format(time.RFC3339))
+	if prov.BuildHost != "" {
+		fmt.Println("  BUILD HOST: ", prov.BuildHost)
+	}
+	if prov.BuildURL != "" {
+		fmt.Println("  PIPELINE:   ", prov.BuildURL)
+	}
+	if prov.K3sChannel != "" {
+		fmt.Println("  K3S CHANNEL:", prov.K3sChannel)
+	}
+	if len(prov.Sources) > 0 {
+		fmt.Println()
+		fmt.Println("  SOURCES")
+		for _, source := range prov.Sources {
+			fmt.Println("    ", source.Path, "\t", "sha256:"+source.SHA256)
+			if source.GitCommit != "" {
+				if source.GitDirty {
+					fmt.Println("       - git", source.GitCommit, "(uncommitted changes)")
+				} else {
+					fmt.Println("       - git", source.GitCommit)
+				}
+			}
+		}
+	}
+	if inspectDetails && prov.BuildOptions != nil {
+		out, err := json.MarshalIndent(prov.BuildOptions, "", "  ")
 		if err != nil {
-			if err == io.EOF {
-				return nil, errors.New("no manifest.json found in the tar archive")
+			return err
+		}
+		fmt.Println()
+		fmt.Println("  BUILD OPTIONS")
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			fmt.Println("    ", scanner.Text())
+		}
+	}
+	return nil
+}
+
+// inspectDocument is the structured output of the inspect command.
+type inspectDocument struct {
+	Name              string                  `json:"name"`
+	Version           string                  `json:"version"`
+	Description       string                  `json:"description,omitempty"`
+	Format            string                  `json:"format,omitempty"`
+	Arch              string                  `json:"arch,omitempty"`
+	K3sVersion        string                  `json:"k3sVersion"`
+	ImageBundleFormat types.ImageBundleFormat `json:"imageBundleFormat,omitempty"`
+	DeltaOf           *types.PackageBase      `json:"deltaOf,omitempty"`
+	Artifacts         []inspectArtifact       `json:"artifacts"`
+	Variables         []inspectVariable       `json:"variables,omitempty"`
+	Config            *types.PackageConfig    `json:"config,omitempty"`
+	RawConfig         string                  `json:"rawConfig,omitempty"`
+	Provenance        *types.Provenance       `json:"provenance,omitempty"`
+}
+
+// inspectArtifact describes an artifact in the structured output of the inspect command.
+type inspectArtifact struct {
+	Type   types.ArtifactType `json:"type"`
+	Name   string             `json:"name"`
+	Arch   string             `json:"arch,omitempty"`
+	Size   int64              `json:"size"`
+	SHA256 string             `json:"sha256,omitempty"`
+	// Set in delta packages for artifacts taken from the base package
+	FromBase bool `json:"fromBase,omitempty"`
+	// The images in an image bundle
+	Images []string `json:"images,omitempty"`
+}
+
+// inspectVariable describes a package variable in the structured output of the inspect command.
+type inspectVariable struct {
+	Name     string `json:"name"`
+	Prompt   string `json:"prompt,omitempty"`
+	Default  string `json:"default,omitempty"`
+	Required bool   `json:"required"`
+}
+
+// newInspectDocument builds the structured output of the inspect command for the package.
+func newInspectDocument(pkg types.Package) (*inspectDocument, error) {
+	meta := pkg.GetMeta()
+	manifest := meta.GetManifest()
+	doc := &inspectDocument{
+		Name:              meta.GetName(),
+		Version:           meta.GetVersion(),
+		Description:       meta.GetDescription(),
+		Format:            meta.MetaVersion,
+		Arch:              meta.Arch,
+		K3sVersion:        meta.GetK3sVersion(),
+		ImageBundleFormat: meta.ImageBundleFormat,
+		DeltaOf:           meta.Base,
+		Artifacts:         make([]inspectArtifact, 0),
+		Provenance:        meta.Provenance,
+	}
+
+	listings := []struct {
+		t     types.ArtifactType
+		names []string
+	}{
+		{types.ArtifactBin, manifest.Bins},
+		{types.ArtifactScript, manifest.Scripts},
+		{types.ArtifactEtc, manifest.Etc},
+		{types.ArtifactImages, manifest.Images},
+		{types.ArtifactManifest, manifest.K8sManifests},
+		{types.ArtifactStatic, manifest.Static},
+		{types.ArtifactSBOM, manifest.SBOM},
+	}
+	if manifest.HasEULA() {
+		listings = append([]struct {
+			t     types.ArtifactType
+			names []string
+		}{{types.ArtifactEULA, []string{types.ManifestEULAFile}}}, listings...)
+	}
+	for _, listing := range listings {
+		for _, name := range listing.names {
+			artifact := &types.Artifact{Type: listing.t, Name: name}
+			if err := getInspectArtifact(pkg, meta, artifact); err != nil {
+				return nil, err
 			}
-			return nil, err
+			out := inspectArtifact{
+				Type:     listing.t,
+				Name:     name,
+				Arch:     meta.GetArtifactArch(name),
+				Size:     artifact.Size,
+				SHA256:   manifest.Digests[v1.ArtifactPath(artifact)].SHA256,
+				FromBase: artifact.Body == nil,
+			}
+			if artifact.Body != nil && listing.t == types.ArtifactImages {
+				names, err := images.NamesFromTar(artifact.Body)
+				if err != nil {
+					log.Warningf("Could not read the images in %q: %s\n", name, err.Error())
+				}
+				out.Images = names
+			} else if artifact.Body != nil {
+				artifact.Body.Close()
+			}
+			doc.Artifacts = append(doc.Artifacts, out)
 		}
-		if header.Typeflag != tar.TypeReg || !strings.HasSuffix(header.Name, "manifest.json") {
-			continue
+	}
+
+	if cfg := meta.GetPackageConfig(); cfg != nil {
+		for _, vari := range cfg.Variables {
+			doc.Variables = append(doc.Variables, inspectVariable{
+				Name:     vari.Name,
+				Prompt:   vari.Prompt,
+				Default:  vari.Default,
+				Required: vari.Default == "",
+			})
 		}
-		manifestRaw, err := ioutil.ReadAll(reader)
-		var imgs []imageManifest
-		if err := json.Unmarshal(manifestRaw, &imgs); err != nil {
-			return nil, err
+		doc.Config = cfg.DeepCopy()
+		doc.Config.Raw = nil
+		doc.RawConfig = string(cfg.Raw)
+	}
+	return doc, nil
+}
+
+// printDocument writes the given document to the writer as json or yaml.
+func printDocument(w io.Writer, doc interface{}, format string) error {
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if format == "yaml" {
+		// converted from json so both formats use the same field names and order
+		var slice yaml.MapSlice
+		if err := yaml.Unmarshal(out, &slice); err != nil {
+			return err
 		}
-		for _, img := range imgs {
-			out = append(out, img.RepoTags...)
+		if out, err = yaml.Marshal(slice); err != nil {
+			return err
 		}
-		return out, nil
+		_, err = fmt.Fprint(w, string(out))
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+// getInspectArtifact retrieves the given artifact for display. Artifacts that a delta package
+// takes from its base are not included in the archive, so only their size is populated.
+func getInspectArtifact(pkg types.Package, meta *types.PackageMeta, artifact *types.Artifact) error {
+	if digest, ok := meta.GetManifest().Digests[v1.ArtifactPath(artifact)]; ok && digest.Base {
+		artifact.Size = digest.Size
+		return nil
+	}
+	return pkg.Get(artifact)
+}
+
+func inspectSize(artifact *types.Artifact) string {
+	if artifact.Body == nil {
+		return byteCountSI(artifact.Size) + " (from base)"
 	}
+	return byteCountSI(artifact.Size)
 }
 
 func byteCountSI(b int64) string {
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v2"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestCmd(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cmd Suite")
+}
+
+var _ = Describe("Inspect output", func() {
+	var tmpDir, pkgPath string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		pkg := v2.Mock()
+		defer pkg.Close()
+		Expect(pkg.PutMeta(&types.PackageMeta{
+			Name:       "app",
+			Version:    "v1.0.0",
+			K3sVersion: "v1.19.4+k3s1",
+			Arch:       "amd64",
+			PackageConfig: &types.PackageConfig{
+				Variables: []types.PackageVariable{
+					{Name: "hostname"},
+					{Name: "replicas", Default: "2"},
+				},
+				Raw: []byte("variables:\n- name: hostname\n- name: replicas\n  default: \"2\"\n"),
+			},
+		})).To(Succeed())
+		archive, err := pkg.Archive()
+		Expect(err).ToNot(HaveOccurred())
+		pkgPath = filepath.Join(tmpDir, "package.tar")
+		Expect(archive.WriteTo(pkgPath)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		inspectOutput = ""
+		os.RemoveAll(tmpDir)
+	})
+
+	inspect := func(format string) []byte {
+		pkg, err := getInspectPackage(pkgPath)
+		Expect(err).ToNot(HaveOccurred())
+		defer pkg.Close()
+		doc, err := newInspectDocument(pkg)
+		Expect(err).ToNot(HaveOccurred())
+		var buf bytes.Buffer
+		Expect(printDocument(&buf, doc, format)).To(Succeed())
+		return buf.Bytes()
+	}
+
+	checkDocument := func(doc map[string]interface{}) {
+		Expect(doc["name"]).To(Equal("app"))
+		Expect(doc["version"]).To(Equal("v1.0.0"))
+		Expect(doc["format"]).To(Equal(v2.MetaVersion))
+		Expect(doc["k3sVersion"]).To(Equal("v1.19.4+k3s1"))
+		Expect(doc["rawConfig"]).To(ContainSubstring("name: hostname"))
+
+		artifacts, ok := doc["artifacts"].([]interface{})
+		Expect(ok).To(BeTrue())
+		Expect(artifacts).To(HaveLen(4))
+		names := make(map[string]string)
+		for _, a := range artifacts {
+			artifact, ok := a.(map[string]interface{})
+			Expect(ok).To(BeTrue())
+			Expect(artifact["sha256"]).ToNot(BeEmpty())
+			Expect(artifact["size"]).To(BeNumerically("==", 4))
+			names[artifact["name"].(string)] = artifact["type"].(string)
+		}
+		Expect(names).To(Equal(map[string]string{
+			"k3s":                   string(types.ArtifactBin),
+			"install.sh":            string(types.ArtifactScript),
+			"k3s-airgap-images.tar": string(types.ArtifactImages),
+			"manifest.yaml":         string(types.ArtifactManifest),
+		}))
+
+		variables, ok := doc["variables"].([]interface{})
+		Expect(ok).To(BeTrue())
+		Expect(variables).To(HaveLen(2))
+		Expect(variables[0]).To(HaveKeyWithValue("name", "hostname"))
+		Expect(variables[0]).To(HaveKeyWithValue("required", true))
+		Expect(variables[1]).To(HaveKeyWithValue("default", "2"))
+		Expect(variables[1]).To(HaveKeyWithValue("required", false))
+	}
+
+	It("Should print the package as a json document", func() {
+		var doc map[string]interface{}
+		Expect(json.Unmarshal(inspect("json"), &doc)).To(Succeed())
+		checkDocument(doc)
+	})
+
+	It("Should print the same document as yaml", func() {
+		out := inspect("yaml")
+		Expect(bytes.HasPrefix(out, []byte("name: app\n"))).To(BeTrue())
+		var raw interface{}
+		Expect(yaml.Unmarshal(out, &raw)).To(Succeed())
+		// round trip through json to get the same types as the json document
+		body, err := json.Marshal(stringKeys(raw))
+		Expect(err).ToNot(HaveOccurred())
+		var doc map[string]interface{}
+		Expect(json.Unmarshal(body, &doc)).To(Succeed())
+		checkDocument(doc)
+	})
+
+	It("Should reject unknown output formats", func() {
+		inspectOutput = "xml"
+		err := inspectCmd.RunE(inspectCmd, []string{pkgPath})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`"xml" is not a valid output format`))
+	})
+})
+
+// stringKeys converts the maps decoded from yaml to maps with string keys.
+func stringKeys(in interface{}) interface{} {
+	switch v := in.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			out[key.(string)] = stringKeys(value)
+		}
+		return out
+	case []interface{}:
+		for i := range v {
+			v[i] = stringKeys(v[i])
+		}
+	}
+	return in
+}
@@ -2,10 +2,12 @@ package cmd
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -19,11 +21,18 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 	"gopkg.in/yaml.v2"
 
-	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/build/package/formats"
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/catalog"
 	"github.com/tinyzimmer/k3p/pkg/cluster"
 	"github.com/tinyzimmer/k3p/pkg/cluster/node"
+	"github.com/tinyzimmer/k3p/pkg/codec"
+	"github.com/tinyzimmer/k3p/pkg/crypt"
 	"github.com/tinyzimmer/k3p/pkg/install"
 	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/oci"
+	"github.com/tinyzimmer/k3p/pkg/sign"
+	"github.com/tinyzimmer/k3p/pkg/split"
 	"github.com/tinyzimmer/k3p/pkg/types"
 )
 
@@ -37,6 +46,10 @@ var (
 	installOpts            types.InstallOptions
 	installConnectOpts     types.NodeConnectOptions
 	installDockerOpts      types.DockerClusterOptions
+	installTrustOpts       types.TrustOptions
+	installSignature       string
+	installStream          bool
+	installCatalog         string
 )
 
 func init() {
@@ -57,15 +70,22 @@ func init() {
 	installCmd.Flags().StringArrayVar(&installValues, "set", []string{}, "Values to set to configurations in the package in the format of --set <name>=<value>")
 	installCmd.Flags().BoolVar(&installAcceptDefaults, "accept-defaults", false, "Accept the defaults for any package configurations, default behavior is to prompt for all unprovided values")
 
+	installCmd.Flags().BoolVar(&installTrustOpts.RequireSignature, "require-signature", false, "Refuse to install the package unless it is signed by one of the --trusted-keys")
+	installCmd.Flags().StringSliceVar(&installTrustOpts.TrustedKeys, "trusted-keys", []string{}, "Public keys trusted to sign packages, can be specified multiple times")
+	installCmd.Flags().StringVar(&installSignature, "signature", "", "The path or URL of the detached package signature, defaults to the package location with a .sig extension")
+
+	installCmd.Flags().BoolVar(&installStream, "stream", false, `Stream the package to the node in a single pass instead of copying it to a temporary
+directory first. Requires a package built with a newer k3p and cannot be used with --docker.`)
+
+	installCmd.Flags().StringVar(&installCatalog, "catalog", "", `The directory or URL of a catalog to find the package in, see "k3p catalog". The package
+is then given as NAME[@VERSION], and the newest version is installed when none is given.`)
+
 	installCmd.MarkFlagFilename("values", "json", "yaml", "yml")
+	installCmd.MarkFlagFilename("trusted-keys", "pub", "pem")
+	installCmd.MarkFlagFilename("signature", "sig")
 	installCmd.RegisterFlagCompletionFunc("set", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		log.Verbose = false
-		f, err := os.Open(args[0])
-		if err != nil {
-			return nil, cobra.ShellCompDirectiveError
-		}
-		defer f.Close()
-		pkg, err := v1.Load(f)
+		pkg, err := getInspectPackage(args[0])
 		if err != nil {
 			return nil, cobra.ShellCompDirectiveError
 		}
@@ -143,14 +163,21 @@ var installCmd = &cobra.Command{
 	Long: `
 The install command can be used to distribute a package built with "k3p build".
 
-The command takes a single argument (with optional flags) of the filesystem path or web URL
-where the package resides. Additional flags provide the ability to initialize clustering (HA),
+The command takes a single argument (with optional flags) of the filesystem path, web URL,
+or registry reference where the package resides. Additional flags provide the ability to initialize clustering (HA),
 join existing servers, or pass custom arguments to the k3s agent/server processes.
 
+Packages built with --split-size can be given as their first part (package.tar.001) or a
+glob matching their parts (quoted, e.g. 'package.tar.*'), and are read across the parts.
+
 Example
 
 	$> k3p install /path/on/filesystem.tar
 	$> k3p install https://example.com/package.tar
+	$> k3p install oci://registry.example.com/packages/my-app:v1.0.0
+	$> k3p install my-app@v1.0.0 --catalog https://packages.example.com
+
+Packages installed from a catalog are checked against the digest in its index.
 
 When running on the local system like above, you will need to have root privileges. You can also 
 direct the installation at a remote system over SSH via the --host flag. This will require the 
@@ -185,19 +212,50 @@ See the help below for additional information on available flags.
 			}
 		}
 
-		return nil
+		if installStream && installDocker {
+			return errors.New("The --stream flag cannot be used with --docker")
+		}
+
+		return validateTrustOptions(&installTrustOpts)
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
+		// Look up the package in the catalog if one was given
+		pkgPath, cat, entry, err := resolveInstallPackage(args[0])
+		if err != nil {
+			return err
+		}
+
+		if installStream {
+			return runStreamInstall(pkgPath, cat, entry)
+		}
+
 		// Retrieve the package from the command line
-		pkg, err := getPackage(args[0])
+		var pkg types.Package
+		if entry != nil {
+			pkg, err = getCatalogPackage(cat, entry)
+		} else {
+			pkg, err = getPackage(pkgPath)
+		}
 		if err != nil {
 			return err
 		}
 
+		// Check the package signature if required
+		sig, err := getPackageSignature(pkgPath, installSignature)
+		if err != nil {
+			return err
+		}
+		if err := enforceSignature(pkg, sig, &installTrustOpts); err != nil {
+			return err
+		}
+
 		pkgMeta := pkg.GetMeta()
 
 		// Do validations on any docker options
 		if installDocker {
+			if pkgMeta.IsDelta() {
+				return errors.New("Delta packages can only be installed over an existing release and cannot be used with --docker")
+			}
 			installDockerOpts.K3sVersion = pkgMeta.GetK3sVersion()
 			if installDockerOpts.ClusterName == "" {
 				installDockerOpts.ClusterName = pkgMeta.GetName()
@@ -211,7 +269,7 @@ See the help below for additional information on available flags.
 		}
 
 		// Get the node to run the installation against
-		target, err := getTargetNode(pkg)
+		target, err := getTargetNode(pkgMeta)
 		if err != nil {
 			return err
 		}
@@ -232,6 +290,11 @@ See the help below for additional information on available flags.
 			return err
 		}
 
+		// Keep a copy of the signature with the package so new nodes can be verified
+		if err := writeInstalledSignature(target, pkgMeta, sig); err != nil {
+			return err
+		}
+
 		// If docker, add any extra nodes and configure the load balancer
 		if installDocker {
 			if err := setupDockerCluster(target, pkg); err != nil {
@@ -251,6 +314,88 @@ See the help below for additional information on available flags.
 	},
 }
 
+// runStreamInstall installs the package at the given path while it is being read, without
+// copying it to a temporary directory first. When the package was found in a catalog, the
+// entry is used to open it instead.
+func runStreamInstall(pkgPath string, cat *catalog.Catalog, entry *catalog.Entry) error {
+	var stream types.PackageStream
+	var err error
+	if entry != nil {
+		stream, err = getCatalogPackageStream(cat, entry)
+	} else {
+		stream, err = getPackageStream(pkgPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// Check the package signature if required
+	sig, err := getPackageSignature(pkgPath, installSignature)
+	if err != nil {
+		return err
+	}
+	if err := enforceStreamSignature(stream, sig, &installTrustOpts); err != nil {
+		return err
+	}
+
+	pkgMeta := stream.GetMeta()
+
+	target, err := getTargetNode(pkgMeta)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if config := pkgMeta.GetPackageConfig(); config != nil {
+		installOpts.Variables, err = gatherConfigVariables(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := install.New().InstallStream(target, stream, &installOpts); err != nil {
+		return err
+	}
+
+	if err := writeInstalledSignature(target, pkgMeta, sig); err != nil {
+		return err
+	}
+
+	if installWriteKubeconfig != "" {
+		if err := writeKubeconfig(target); err != nil {
+			return err
+		}
+	}
+
+	logCompletion(target)
+	return nil
+}
+
+// writeInstalledSignature keeps a copy of the signature with the package that was just installed,
+// and must only be called once the installation succeeded. The signature of a delta package does
+// not apply to the package it is combined into, so it is not kept. When there is no signature for
+// the installed package, the one of the previous release is removed so it is not mistaken for it.
+func writeInstalledSignature(target types.Node, pkgMeta *types.PackageMeta, sig *types.PackageSignature) error {
+	if sig != nil && !pkgMeta.IsDelta() {
+		return writeSignature(target, sig)
+	}
+	if sig != nil {
+		log.Warning("The signature of a delta package does not apply to the combined package installed on the node, it will not be kept")
+	}
+	log.Debug("Removing any package signature of a previous release from", types.InstalledSignatureFile)
+	return target.Remove(types.InstalledSignatureFile)
+}
+
+func writeSignature(target types.Node, sig *types.PackageSignature) error {
+	out, err := sign.MarshalSignature(sig)
+	if err != nil {
+		return err
+	}
+	log.Debug("Writing the package signature to", types.InstalledSignatureFile)
+	return target.WriteFile(ioutil.NopCloser(bytes.NewReader(out)), types.InstalledSignatureFile, "0644", int64(len(out)))
+}
+
 func logCompletion(target types.Node) {
 	log.Info("The cluster has been installed")
 	if installConnectOpts.Address != "" {
@@ -318,7 +463,7 @@ func gatherConfigVariables(cfg *types.PackageConfig) (map[string]string, error)
 	return vars, nil
 }
 
-func getTargetNode(pkg types.Package) (types.Node, error) {
+func getTargetNode(pkgMeta *types.PackageMeta) (types.Node, error) {
 	if installConnectOpts.Address != "" {
 		if installConnectOpts.SSHKeyFile == "" {
 			fmt.Printf("Enter SSH Password for %s: ", installConnectOpts.SSHUser)
@@ -340,7 +485,7 @@ func getTargetNode(pkg types.Package) (types.Node, error) {
 			return nil, err
 		}
 		if target.(*node.Docker).IsK3sRunning() {
-			return nil, fmt.Errorf("Package %q is already running on the sytem", pkg.GetMeta().GetName())
+			return nil, fmt.Errorf("Package %q is already running on the sytem", pkgMeta.GetName())
 		}
 		return target, nil
 	}
@@ -400,14 +545,16 @@ func setupDockerCluster(leader types.Node, pkg types.Package) error {
 			NodeRole: types.K3sRoleServer,
 		}
 		for i := 1; i < installDockerOpts.Servers; i++ {
-			server, err := node.NewDocker(&types.DockerNodeOptions{
+			nodeOpts := &types.DockerNodeOptions{
 				ClusterOptions: &installDockerOpts,
 				NodeIndex:      i,
 				NodeRole:       types.K3sRoleServer,
-			})
+			}
+			server, err := node.NewDocker(nodeOpts)
 			if err != nil {
 				return err
 			}
+			opts.NodeName = nodeOpts.GetNodeName()
 			if err := clusterManager.AddNode(server, opts); err != nil {
 				return err
 			}
@@ -439,14 +586,16 @@ func setupDockerCluster(leader types.Node, pkg types.Package) error {
 			NodeRole: types.K3sRoleAgent,
 		}
 		for i := 0; i < installDockerOpts.Agents; i++ {
-			server, err := node.NewDocker(&types.DockerNodeOptions{
+			nodeOpts := &types.DockerNodeOptions{
 				ClusterOptions: &installDockerOpts,
 				NodeIndex:      i,
 				NodeRole:       types.K3sRoleAgent,
-			})
+			}
+			server, err := node.NewDocker(nodeOpts)
 			if err != nil {
 				return err
 			}
+			opts.NodeName = nodeOpts.GetNodeName()
 			if err := clusterManager.AddNode(server, opts); err != nil {
 				return err
 			}
@@ -466,35 +615,179 @@ func setupDockerCluster(leader types.Node, pkg types.Package) error {
 
 // yea its ugly ill fix
 func getPackage(path string) (types.Package, error) {
+	if oci.IsReference(path) {
+		return getRegistryPackage(path)
+	}
 	if strings.HasPrefix(path, "http") {
 		log.Info("Downloading the archive from", path)
 		resp, err := http.Get(path)
 		if err != nil {
 			return nil, err
 		}
-		defer resp.Body.Close()
 		log.Info("Loading the archive")
-		if strings.HasSuffix(path, ".zst") {
-			dec, err := v1.Decompress(resp.Body)
-			if err != nil {
-				return nil, err
-			}
-			return v1.Load(dec)
+		rdr, err := openPackageReader(resp.Body)
+		if err != nil {
+			return nil, err
 		}
-		return v1.Load(resp.Body)
+		return formats.Load(rdr)
 	}
 	log.Info("Loading the archive")
-	f, err := os.Open(path)
+	return loadPackageFile(path)
+}
+
+// loadPackageFile loads the package at the given local path. Plain package files are opened in
+// place, so that only the artifacts that are used are read from them. Packages that are split,
+// encrypted or compressed are read in full.
+func loadPackageFile(path string) (types.Package, error) {
+	if !split.IsSplit(path) {
+		plain, err := isPlainPackageFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if plain {
+			return formats.OpenFile(path)
+		}
+	}
+	rdr, err := openPackageFile(path)
 	if err != nil {
 		return nil, err
 	}
+	return formats.Load(rdr)
+}
+
+// isPlainPackageFile returns true if the file at the given path is neither encrypted nor compressed.
+func isPlainPackageFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
 	defer f.Close()
-	if strings.HasSuffix(path, ".zst") {
-		dec, err := v1.Decompress(f)
+	buf := bufio.NewReader(f)
+	if crypt.IsEncrypted(buf) {
+		return false, nil
+	}
+	compression, err := codec.Detect(buf)
+	if err != nil {
+		return false, err
+	}
+	return compression == types.CompressionNone, nil
+}
+
+// openPackageFile opens the package at the given local path for reading. Packages split into
+// parts are read across all of them.
+func openPackageFile(path string) (io.ReadCloser, error) {
+	var rdr io.ReadCloser
+	var err error
+	if split.IsSplit(path) {
+		rdr, err = split.Open(path)
+	} else {
+		rdr, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return openPackageReader(rdr)
+}
+
+// openPackageReader wraps the raw contents of a package, decrypting and decompressing them
+// as needed. The source is closed along with the returned reader, or immediately on error.
+func openPackageReader(rdr io.ReadCloser) (io.ReadCloser, error) {
+	rdr, err := decryptPackage(rdr)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := codec.Decompress(rdr)
+	if err != nil {
+		rdr.Close()
+		return nil, err
+	}
+	return &decompressedReader{ReadCloser: dec, src: rdr}, nil
+}
+
+// getPackageStream opens the package at the given path or URL for reading in a single pass.
+func getPackageStream(path string) (types.PackageStream, error) {
+	var rdr io.ReadCloser
+	var err error
+	log.Info("Streaming the archive from", path)
+	if oci.IsReference(path) {
+		remote, err := fetchRegistryPackage(path)
+		if err != nil {
+			return nil, err
+		}
+		return v2.Stream(remote.Reader())
+	}
+	if strings.HasPrefix(path, "http") {
+		resp, err := http.Get(path)
 		if err != nil {
 			return nil, err
 		}
-		return v1.Load(dec)
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("error retrieving %q: %s", path, resp.Status)
+		}
+		rdr, err = openPackageReader(resp.Body)
+	} else {
+		rdr, err = openPackageFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v2.Stream(rdr)
+}
+
+// resolveInstallPackage returns the location of the package given to the install command. When
+// --catalog is set, the package is looked up in the catalog and its entry is returned as well.
+func resolveInstallPackage(ref string) (string, *catalog.Catalog, *catalog.Entry, error) {
+	if installCatalog == "" {
+		return ref, nil, nil, nil
+	}
+	cat, err := catalog.Load(installCatalog)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	entry, err := cat.Resolve(ref)
+	if err != nil {
+		return "", nil, nil, err
 	}
-	return v1.Load(f)
+	log.Infof("Installing version %q of %q from the catalog\n", entry.Version, entry.Name)
+	return cat.Location(entry), cat, entry, nil
+}
+
+// getCatalogPackage loads the package for the given catalog entry, making sure it matches the
+// digest in the index.
+func getCatalogPackage(cat *catalog.Catalog, entry *catalog.Entry) (types.Package, error) {
+	rdr, err := cat.Open(entry)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Loading the archive")
+	if rdr, err = openPackageReader(rdr); err != nil {
+		return nil, err
+	}
+	return formats.Load(rdr)
+}
+
+// getCatalogPackageStream opens the package for the given catalog entry for reading in a single
+// pass. The artifacts are verified as they are read.
+func getCatalogPackageStream(cat *catalog.Catalog, entry *catalog.Entry) (types.PackageStream, error) {
+	rdr, err := cat.Open(entry)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Streaming the archive from", cat.Location(entry))
+	if rdr, err = openPackageReader(rdr); err != nil {
+		return nil, err
+	}
+	return v2.Stream(rdr)
+}
+
+// decompressedReader closes the compressed source along with the decompressor.
+type decompressedReader struct {
+	io.ReadCloser
+	src io.Closer
+}
+
+func (d *decompressedReader) Close() error {
+	d.ReadCloser.Close()
+	return d.src.Close()
 }
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/tinyzimmer/k3p/pkg/cluster/node"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+var _ = Describe("Installed package signatures", func() {
+	var target types.Node
+
+	BeforeEach(func() {
+		target = node.Mock()
+		previous := "previous release signature"
+		Expect(target.WriteFile(ioutil.NopCloser(strings.NewReader(previous)), types.InstalledSignatureFile, "0644", int64(len(previous)))).To(Succeed())
+	})
+
+	AfterEach(func() { target.Close() })
+
+	It("Should replace the signature of the previous release", func() {
+		sig := &types.PackageSignature{Algorithm: "ed25519", KeyID: "test", Name: "app", Version: "v2"}
+		Expect(writeInstalledSignature(target, &types.PackageMeta{Name: "app", Version: "v2"}, sig)).To(Succeed())
+		rdr, err := target.GetFile(types.InstalledSignatureFile)
+		Expect(err).ToNot(HaveOccurred())
+		defer rdr.Close()
+		Expect(ioutil.ReadAll(rdr)).To(ContainSubstring(`"version": "v2"`))
+	})
+
+	It("Should remove the signature of the previous release when the delta signature does not apply", func() {
+		meta := &types.PackageMeta{Name: "app", Version: "v2", Base: &types.PackageBase{Version: "v1"}}
+		Expect(writeInstalledSignature(target, meta, &types.PackageSignature{KeyID: "test"})).To(Succeed())
+		_, err := target.GetFile(types.InstalledSignatureFile)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("Should remove the signature of the previous release when the package is not signed", func() {
+		Expect(writeInstalledSignature(target, &types.PackageMeta{Name: "app", Version: "v2"}, nil)).To(Succeed())
+		_, err := target.GetFile(types.InstalledSignatureFile)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
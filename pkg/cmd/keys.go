@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/k3p/pkg/crypt"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/sign"
+)
+
+var (
+	keysOutputDir  string
+	keysName       string
+	keysEncryption bool
+)
+
+func init() {
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keysGenerateCmd.Flags().StringVarP(&keysOutputDir, "output-dir", "o", cwd, "The directory to write the generated keys to")
+	keysGenerateCmd.Flags().StringVarP(&keysName, "name", "n", "k3p", "The name to use for the key files, the private key is written to <name>.key and the public key to <name>.pub")
+
+	keysGenerateCmd.Flags().BoolVar(&keysEncryption, "encryption", false, "Generate an X25519 key pair for encrypting packages instead of a signing key pair")
+
+	keysGenerateCmd.MarkFlagDirname("output-dir")
+
+	keysCmd.AddCommand(keysGenerateCmd)
+	rootCmd.AddCommand(keysCmd)
+}
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Package signing and encryption key management commands",
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate an ed25519 key pair for signing packages, or an X25519 key pair for encrypting them",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		privPath := path.Join(keysOutputDir, fmt.Sprintf("%s.key", keysName))
+		pubPath := path.Join(keysOutputDir, fmt.Sprintf("%s.pub", keysName))
+		for _, f := range []string{privPath, pubPath} {
+			if _, err := os.Stat(f); err == nil {
+				return fmt.Errorf("%q already exists, refusing to overwrite it", f)
+			}
+		}
+		generate := sign.GenerateKeys
+		if keysEncryption {
+			generate = crypt.GenerateKeys
+		}
+		pub, priv, err := generate()
+		if err != nil {
+			return err
+		}
+		log.Infof("Writing private key to %q\n", privPath)
+		if err := ioutil.WriteFile(privPath, priv, 0600); err != nil {
+			return err
+		}
+		log.Infof("Writing public key to %q\n", pubPath)
+		return ioutil.WriteFile(pubPath, pub, 0644)
+	},
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/codec"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/merge"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+var (
+	mergeName        string
+	mergeVersion     string
+	mergeOutput      string
+	mergeCompress    bool
+	mergeCompression string
+)
+
+func init() {
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mergeCmd.Flags().StringVarP(&mergeName, "name", "n", "", "The name to give the merged package, defaults to the names of the packages joined with a dash")
+	mergeCmd.Flags().StringVarP(&mergeVersion, "version", "V", types.VersionLatest, "The version to tag the merged package")
+	mergeCmd.Flags().StringVarP(&mergeOutput, "output", "o", path.Join(cwd, "package.tar"), "The file to save the merged package to")
+	mergeCmd.Flags().StringVar(&mergeCompression, "compression", string(types.CompressionNone), "The codec to compress the merged package with (valid options none,gzip,xz,zstd,zstd-dict)")
+	mergeCmd.Flags().BoolVar(&mergeCompress, "compress", false, "Compress the merged package with zstd and the built-in dictionary, the same as --compression zstd-dict")
+
+	mergeCmd.RegisterFlagCompletionFunc("compression", completeStringOpts(compressionOpts()))
+
+	rootCmd.AddCommand(mergeCmd)
+}
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge PACKAGE PACKAGE...",
+	Short: "Merge several packages into a single package",
+	Long: `
+The merge command combines packages built with "k3p build" into a single package.
+
+The manifests, images, charts, static assets and configuration variables of every package
+are combined, and artifacts shared between them (like the k3s binary) are only included once.
+The packages must be built for the same k3s version and architecture, and any variables or
+configurations they have in common must agree. Every conflict is reported before anything
+is written.
+
+Example
+
+	$> k3p merge team-a.tar team-b.tar -o site.tar
+`,
+	Args: cobra.MinimumNArgs(2),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"tar"}, cobra.ShellCompDirectiveFilterFileExt
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		compression, err := getCompression(cmd, mergeCompression, mergeCompress)
+		if err != nil {
+			return err
+		}
+
+		pkgs := make([]types.Package, 0, len(args))
+		defer func() {
+			for _, pkg := range pkgs {
+				pkg.Close()
+			}
+		}()
+		names := make([]string, 0, len(args))
+		for _, arg := range args {
+			pkg, err := getPackage(arg)
+			if err != nil {
+				return err
+			}
+			pkgs = append(pkgs, pkg)
+			names = append(names, pkg.GetMeta().GetName())
+		}
+
+		if mergeName == "" {
+			mergeName = strings.Join(names, "-")
+		}
+		log.Infof("Merging %s into package %q\n", strings.Join(names, ", "), mergeName)
+
+		tmpDir, err := util.GetTempDir()
+		if err != nil {
+			return err
+		}
+		out := v2.New(tmpDir)
+		defer out.Close()
+
+		if err := merge.Merge(pkgs, out, &types.PackageMeta{
+			MetaVersion: v2.MetaVersion,
+			Name:        mergeName,
+			Version:     mergeVersion,
+		}); err != nil {
+			return err
+		}
+
+		log.Info("Finalizing archive")
+		archive, err := out.Archive()
+		if err != nil {
+			return err
+		}
+		if compression != types.CompressionNone {
+			compName := mergeOutput + codec.Extension(compression)
+			log.Infof("Writing version %q of %q to %q (%s)\n", mergeVersion, mergeName, compName, compression)
+			return archive.CompressTo(compName, compression)
+		}
+		log.Infof("Writing version %q of %q to %q\n", mergeVersion, mergeName, mergeOutput)
+		return archive.WriteTo(mergeOutput)
+	},
+}
@@ -23,6 +23,7 @@ var (
 	nodeConnectOpts  *types.NodeConnectOptions
 	nodeAddOpts      *types.AddNodeOptions
 	nodeRemoveOpts   *types.RemoveNodeOptions
+	nodeTrustOpts    *types.TrustOptions
 )
 
 func init() {
@@ -35,6 +36,7 @@ func init() {
 	nodeConnectOpts = &types.NodeConnectOptions{}
 	nodeAddOpts = &types.AddNodeOptions{}
 	nodeRemoveOpts = &types.RemoveNodeOptions{}
+	nodeTrustOpts = &types.TrustOptions{}
 
 	var defaultKeyArg string
 	defaultKeyPath := path.Join(currentUser.HomeDir, ".ssh", "id_rsa")
@@ -53,7 +55,11 @@ of an add, to retrieve the installation manifest.
 `)
 
 	nodesAddCmd.Flags().StringVarP(&nodeAddRole, "node-role", "r", string(types.K3sRoleAgent), "Whether to join the instance as a 'server' or 'agent'")
+	nodesAddCmd.Flags().StringVarP(&nodeAddOpts.NodeName, "node-name", "n", "", "An optional name to give the new node in the cluster")
+	nodesAddCmd.Flags().BoolVar(&nodeTrustOpts.RequireSignature, "require-signature", false, "Refuse to add the node unless the installed package is signed by one of the --trusted-keys")
+	nodesAddCmd.Flags().StringSliceVar(&nodeTrustOpts.TrustedKeys, "trusted-keys", []string{}, "Public keys trusted to sign packages, can be specified multiple times")
 	nodesAddCmd.RegisterFlagCompletionFunc("node-role", completeStringOpts([]string{"server", "agent"}))
+	nodesAddCmd.MarkFlagFilename("trusted-keys", "pub", "pem")
 
 	nodesRemoveCmd.Flags().BoolVar(&nodeRemoveOpts.Uninstall, "uninstall", false, "After the node is removed from the cluster, remote in and uninstall k3s")
 
@@ -83,8 +89,12 @@ var nodesRemoveCmd = &cobra.Command{
 }
 
 func addNode(cmd *cobra.Command, args []string) error {
+	if err := validateTrustOptions(nodeTrustOpts); err != nil {
+		return err
+	}
 	nodeAddOpts.NodeConnectOptions = nodeConnectOpts
 	nodeAddOpts.Address = args[0]
+	nodeAddOpts.Trust = nodeTrustOpts
 
 	switch types.K3sRole(nodeAddRole) {
 	case types.K3sRoleServer:
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/oci"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+var pullOutput string
+
+func init() {
+	pullCmd.Flags().StringVarP(&pullOutput, "output", "o", "", "The file to save the package to, defaults to the name of the repository and tag in the current directory")
+
+	rootCmd.AddCommand(pullCmd)
+}
+
+var pullCmd = &cobra.Command{
+	Use:   "pull REFERENCE",
+	Short: "Pull a package from an OCI registry",
+	Long: `
+The pull command downloads a package pushed with "k3p push" and writes it to a file.
+
+Every layer is verified against the digest recorded in the package metadata, and downloads
+interrupted by an error are resumed where they left off. The metadata is written exactly as
+it was pushed, so signatures of the package remain valid. When a signature was pushed with
+the package, it is written next to it with a .sig extension.
+
+Example
+
+	$> k3p pull oci://registry.example.com/packages/my-app:v1.0.0 -o my-app.tar
+`,
+	Args: cobra.ExactArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ref, err := oci.ParseReference(args[0])
+		if err != nil {
+			return err
+		}
+		remote, err := registryClient().Fetch(ref)
+		if err != nil {
+			return err
+		}
+		if pullOutput == "" {
+			name := path.Base(ref.Repository)
+			if ref.Tag != "" {
+				name += "-" + ref.Tag
+			}
+			pullOutput = name + ".tar"
+		}
+
+		log.Infof("Downloading %q to %q\n", remote.GetMeta().GetName(), pullOutput)
+		if err := writePulledPackage(remote, pullOutput); err != nil {
+			return err
+		}
+
+		sig, err := remote.Signature()
+		if err != nil {
+			return err
+		}
+		if sig != nil {
+			sigPath := pullOutput + types.SignatureFileSuffix
+			log.Infof("Writing the package signature to %q\n", sigPath)
+			if err := ioutil.WriteFile(sigPath, sig, 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// writePulledPackage writes the package to the given file, removing it if the download fails.
+func writePulledPackage(remote *oci.Remote, out string) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	rdr := remote.Reader()
+	defer rdr.Close()
+	if _, err := io.Copy(f, rdr); err != nil {
+		f.Close()
+		os.Remove(out)
+		return err
+	}
+	return f.Close()
+}
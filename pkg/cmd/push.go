@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/oci"
+	"github.com/tinyzimmer/k3p/pkg/sign"
+)
+
+var pushSignature string
+
+func init() {
+	pushCmd.Flags().StringVarP(&pushSignature, "signature", "s", "", "The path of the detached signature to push with the package, defaults to the package path with a .sig extension when it exists")
+	pushCmd.MarkFlagFilename("signature", "sig")
+
+	rootCmd.AddCommand(pushCmd)
+}
+
+var pushCmd = &cobra.Command{
+	Use:   "push PACKAGE REFERENCE",
+	Short: "Push a package to an OCI registry",
+	Long: `
+The push command uploads a package built with "k3p build" to a registry implementing the
+OCI distribution API, such as Harbor or the docker registry.
+
+The package metadata is stored as the config blob of an OCI manifest, and every artifact as a
+layer with its digest from the metadata. Layers that already exist in the repository are not
+uploaded again. When a signature is found next to the package, or given with --signature, it
+is pushed along with it and used by "k3p install" and "k3p verify".
+
+Credentials are read from $K3P_REGISTRY_USERNAME and $K3P_REGISTRY_PASSWORD, or from the
+docker configuration written by "docker login". Registries on the loopback interface, and
+all registries when --insecure-registry is set, may be reached over plain HTTP.
+
+Example
+
+	$> k3p push package.tar oci://registry.example.com/packages/my-app:v1.0.0
+`,
+	Args: cobra.ExactArgs(2),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return []string{"tar"}, cobra.ShellCompDirectiveFilterFileExt
+		}
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ref, err := oci.ParseReference(args[1])
+		if err != nil {
+			return err
+		}
+		if oci.IsReference(args[0]) {
+			return fmt.Errorf("%q is already in a registry, use \"k3p pull\" to retrieve it first", args[0])
+		}
+		sig, err := getPackageSignature(args[0], pushSignature)
+		if err != nil {
+			return err
+		}
+		var rawSig []byte
+		if sig != nil {
+			if rawSig, err = sign.MarshalSignature(sig); err != nil {
+				return err
+			}
+		}
+		pkg, err := getInspectPackage(args[0])
+		if err != nil {
+			return err
+		}
+		defer pkg.Close()
+		digest, err := registryClient().Push(pkg, rawSig, ref)
+		if err != nil {
+			return err
+		}
+		log.Infof("Pushed %q to %s (%s)\n", pkg.GetMeta().GetName(), ref, digest)
+		return nil
+	},
+}
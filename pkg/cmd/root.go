@@ -9,12 +9,16 @@ import (
 )
 
 var (
-	cacheDir string
+	cacheDir         string
+	decryptKeys      []string
+	insecureRegistry bool
 )
 
 func init() {
 	rootCmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", cache.DefaultCache.CacheDir(), "Override the default location for cached k3s assets")
 	rootCmd.PersistentFlags().StringVar(&util.TempDir, "tmp-dir", util.TempDir, "Override the default tmp directory")
+	rootCmd.PersistentFlags().StringSliceVar(&decryptKeys, "decrypt-key", []string{}, "Private keys to try when reading encrypted packages, a passphrase is prompted for (or read from $K3P_PASSPHRASE) when none can decrypt it")
+	rootCmd.PersistentFlags().BoolVar(&insecureRegistry, "insecure-registry", false, "Skip TLS verification and allow plain HTTP when pushing and pulling packages with oci:// references")
 	rootCmd.PersistentFlags().BoolVarP(&log.Verbose, "verbose", "v", false, "Enable verbose logging")
 }
 
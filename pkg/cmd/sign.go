@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/oci"
+	"github.com/tinyzimmer/k3p/pkg/sign"
+	"github.com/tinyzimmer/k3p/pkg/split"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+var (
+	signKeyFile     string
+	signOutput      string
+	verifyPubKeys   []string
+	verifySignature string
+)
+
+func init() {
+	signCmd.Flags().StringVarP(&signKeyFile, "key", "k", "", "The private key to sign the package with")
+	signCmd.Flags().StringVarP(&signOutput, "output", "o", "", "The file to write the signature to, defaults to the package path with a .sig extension")
+	signCmd.MarkFlagRequired("key")
+	signCmd.MarkFlagFilename("key", "key", "pem")
+
+	verifyCmd.Flags().StringSliceVarP(&verifyPubKeys, "pubkey", "k", []string{}, "Public keys trusted to have signed the package, can be specified multiple times")
+	verifyCmd.Flags().StringVarP(&verifySignature, "signature", "s", "", "The path to the detached signature, defaults to the package path with a .sig extension")
+	verifyCmd.MarkFlagRequired("pubkey")
+	verifyCmd.MarkFlagFilename("pubkey", "pub", "pem")
+	verifyCmd.MarkFlagFilename("signature", "sig")
+
+	rootCmd.AddCommand(signCmd)
+	rootCmd.AddCommand(verifyCmd)
+}
+
+var signCmd = &cobra.Command{
+	Use:   "sign PACKAGE",
+	Short: "Produce a detached signature for the given package",
+	Long: `
+The sign command produces a detached signature for a package built with "k3p build".
+
+The signature covers the package metadata, which includes the digests of every artifact
+inside the package. It is written next to the package with a ".sig" extension by default,
+which is where "k3p install" and "k3p verify" will look for it.
+`,
+	Args: cobra.ExactArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"tar"}, cobra.ShellCompDirectiveFilterFileExt
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := sign.LoadPrivateKey(signKeyFile)
+		if err != nil {
+			return err
+		}
+		pkg, err := getInspectPackage(args[0])
+		if err != nil {
+			return err
+		}
+		defer pkg.Close()
+		sig, err := sign.Package(pkg, key)
+		if err != nil {
+			return err
+		}
+		out, err := sign.MarshalSignature(sig)
+		if err != nil {
+			return err
+		}
+		if signOutput == "" {
+			signOutput = defaultSignaturePath(args[0])
+		}
+		log.Infof("Writing signature for %q with key %s to %q\n", sig.Name, sig.KeyID, signOutput)
+		return ioutil.WriteFile(signOutput, out, 0644)
+	},
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify PACKAGE",
+	Short: "Verify the contents and signature of the given package",
+	Args:  cobra.ExactArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"tar"}, cobra.ShellCompDirectiveFilterFileExt
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sig, err := getPackageSignature(args[0], verifySignature)
+		if err != nil {
+			return err
+		}
+		if sig == nil {
+			return fmt.Errorf("No signature found for %q", args[0])
+		}
+		pkg, err := getInspectPackage(args[0])
+		if err != nil {
+			return err
+		}
+		defer pkg.Close()
+		keyID, err := sign.VerifyWithKeyFiles(pkg, sig, verifyPubKeys)
+		if err != nil {
+			return err
+		}
+		log.Infof("The package %q is valid and signed by trusted key %s\n", pkg.GetMeta().GetName(), keyID)
+		return nil
+	},
+}
+
+// getPackageSignature retrieves the detached signature for the package at the given path or URL.
+// When sigPath is empty the signature is looked for next to the package, and nil is returned if
+// it does not exist.
+func getPackageSignature(pkgPath, sigPath string) (*types.PackageSignature, error) {
+	explicit := sigPath != ""
+	if !explicit && oci.IsReference(pkgPath) {
+		return getRegistrySignature(pkgPath)
+	}
+	if !explicit {
+		sigPath = defaultSignaturePath(pkgPath)
+	}
+	var rdr io.ReadCloser
+	if strings.HasPrefix(sigPath, "http") {
+		log.Debug("Retrieving package signature from", sigPath)
+		resp, err := http.Get(sigPath)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			if explicit {
+				return nil, fmt.Errorf("error retrieving %q: %s", sigPath, resp.Status)
+			}
+			log.Debugf("No signature found at %q\n", sigPath)
+			return nil, nil
+		}
+		rdr = resp.Body
+	} else {
+		f, err := os.Open(sigPath)
+		if err != nil {
+			if os.IsNotExist(err) && !explicit {
+				log.Debugf("No signature found at %q\n", sigPath)
+				return nil, nil
+			}
+			return nil, err
+		}
+		rdr = f
+	}
+	defer rdr.Close()
+	return sign.LoadSignature(rdr)
+}
+
+// getRegistrySignature retrieves the signature pushed along with the package at the given
+// reference, returning nil if it was pushed without one.
+func getRegistrySignature(ref string) (*types.PackageSignature, error) {
+	remote, err := fetchRegistryPackage(ref)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := remote.Signature()
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		log.Debugf("No signature was pushed with %q\n", ref)
+		return nil, nil
+	}
+	return sign.LoadSignature(bytes.NewReader(raw))
+}
+
+// defaultSignaturePath returns where the signature for the package at the given path or URL
+// is expected to be. The signature of a package split into parts sits next to its parts.
+func defaultSignaturePath(pkgPath string) string {
+	if !strings.HasPrefix(pkgPath, "http") && split.IsSplit(pkgPath) {
+		pkgPath = split.ArchiveName(pkgPath)
+	}
+	return pkgPath + types.SignatureFileSuffix
+}
+
+// enforceSignature will verify the package against the given signature if the trust options
+// require it.
+func enforceSignature(pkg types.Package, sig *types.PackageSignature, opts *types.TrustOptions) error {
+	if !opts.RequireSignature {
+		return nil
+	}
+	if sig == nil {
+		return errors.New("The package is not signed and --require-signature was provided")
+	}
+	log.Info("Verifying the package signature")
+	keyID, err := sign.VerifyWithKeyFiles(pkg, sig, opts.TrustedKeys)
+	if err != nil {
+		return err
+	}
+	log.Infof("The package is signed by trusted key %s\n", keyID)
+	return nil
+}
+
+// enforceStreamSignature is the same as enforceSignature, but for a package that is being streamed.
+func enforceStreamSignature(stream types.PackageStream, sig *types.PackageSignature, opts *types.TrustOptions) error {
+	if !opts.RequireSignature {
+		return nil
+	}
+	if sig == nil {
+		return errors.New("The package is not signed and --require-signature was provided")
+	}
+	log.Info("Verifying the package signature")
+	keys, err := sign.LoadPublicKeys(opts.TrustedKeys)
+	if err != nil {
+		return err
+	}
+	keyID, err := sign.VerifyStream(stream, sig, keys)
+	if err != nil {
+		return err
+	}
+	log.Infof("The package is signed by trusted key %s\n", keyID)
+	return nil
+}
+
+// validateTrustOptions makes sure the trust flags were used together.
+func validateTrustOptions(opts *types.TrustOptions) error {
+	if opts.RequireSignature && len(opts.TrustedKeys) == 0 {
+		return errors.New("--trusted-keys must be provided with --require-signature")
+	}
+	return nil
+}
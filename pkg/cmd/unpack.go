@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/unpack"
+)
+
+var unpackOutput string
+
+func init() {
+	unpackCmd.Flags().StringVarP(&unpackOutput, "output", "o", "", "The directory to unpack the package to, defaults to <name>-<version> in the current directory")
+
+	unpackCmd.MarkFlagDirname("output")
+
+	rootCmd.AddCommand(unpackCmd)
+}
+
+var unpackCmd = &cobra.Command{
+	Use:   "unpack PACKAGE",
+	Short: "Extract the contents of a package into a directory",
+	Long: `
+The unpack command extracts every artifact in a package into a directory that mirrors the
+layout of the archive (bin/, images/, manifests/, static/, etc/), along with its metadata in
+manifest.json.
+
+The contents can then be edited and packed into a new package with "k3p build --from-dir",
+without downloading k3s or pulling images again. Any listings in manifest.json are rebuilt
+from the files in the directory, and bills of materials are generated again.
+
+Example
+
+	$> k3p unpack package.tar -o my-package
+	$> vim my-package/manifests/deployment.yaml
+	$> k3p build --from-dir my-package -V v0.0.2 -o package.tar
+`,
+	Args: cobra.ExactArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"tar"}, cobra.ShellCompDirectiveFilterFileExt
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pkg, err := getInspectPackage(args[0])
+		if err != nil {
+			return err
+		}
+		defer pkg.Close()
+
+		out := unpackOutput
+		if out == "" {
+			cwd, err := os.Getwd()
+			if err != nil {
+				return err
+			}
+			meta := pkg.GetMeta()
+			out = path.Join(cwd, fmt.Sprintf("%s-%s", meta.GetName(), meta.GetVersion()))
+		}
+
+		log.Infof("Unpacking %q to %q\n", args[0], out)
+		return unpack.Unpack(pkg, out)
+	},
+}
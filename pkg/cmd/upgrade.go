@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/tinyzimmer/k3p/pkg/cluster/node"
+	"github.com/tinyzimmer/k3p/pkg/install"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+var (
+	upgradeConnectOpts types.NodeConnectOptions
+	upgradeTrustOpts   types.TrustOptions
+	upgradeSignature   string
+	upgradeAcceptEULA  bool
+)
+
+func init() {
+	var currentUser *user.User
+	var err error
+	if currentUser, err = user.Current(); err != nil {
+		log.Fatal(err)
+	}
+
+	var defaultKeyArg string
+	defaultKeyPath := path.Join(currentUser.HomeDir, ".ssh", "id_rsa")
+	if _, err := os.Stat(defaultKeyPath); err == nil {
+		defaultKeyArg = defaultKeyPath
+	}
+
+	upgradeCmd.Flags().StringVarP(&upgradeConnectOpts.Address, "host", "H", "", "The IP or DNS name of a remote host to perform the upgrade against")
+	upgradeCmd.Flags().StringVarP(&upgradeConnectOpts.SSHUser, "ssh-user", "u", currentUser.Username, "The username to use when authenticating against the remote host")
+	upgradeCmd.Flags().StringVarP(&upgradeConnectOpts.SSHKeyFile, "private-key", "k", defaultKeyArg, `The path to a private key to use when authenticating against the remote host,
+if not provided you will be prompted for a password`)
+	upgradeCmd.Flags().IntVarP(&upgradeConnectOpts.SSHPort, "ssh-port", "P", 22, "The port to use when connecting to the remote host over SSH")
+
+	upgradeCmd.Flags().BoolVar(&upgradeAcceptEULA, "accept-eula", false, "Automatically accept any EULA included with the package")
+	upgradeCmd.Flags().BoolVar(&upgradeTrustOpts.RequireSignature, "require-signature", false, "Refuse to upgrade to the package unless it is signed by one of the --trusted-keys")
+	upgradeCmd.Flags().StringSliceVar(&upgradeTrustOpts.TrustedKeys, "trusted-keys", []string{}, "Public keys trusted to sign packages, can be specified multiple times")
+	upgradeCmd.Flags().StringVar(&upgradeSignature, "signature", "", "The path or URL of the detached package signature, defaults to the package location with a .sig extension")
+
+	upgradeCmd.MarkFlagFilename("trusted-keys", "pub", "pem")
+	upgradeCmd.MarkFlagFilename("signature", "sig")
+
+	rootCmd.AddCommand(upgradeCmd)
+}
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade PACKAGE",
+	Short: "Upgrade an existing installation to the given package",
+	Long: `
+The upgrade command installs a new release of a package over an existing installation, reusing
+the options and configuration values that were provided when it was first installed.
+
+The package may be a complete package, or a delta package built with "k3p build --base". Delta
+packages are combined with the package that is already installed on the node.
+
+Example
+
+	$> k3p upgrade package-v2-delta.tar
+	$> k3p upgrade package-v2.tar --host 192.168.1.100 [SSH_FLAGS]
+`,
+	Args: cobra.ExactArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"tar"}, cobra.ShellCompDirectiveFilterFileExt
+	},
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return validateTrustOptions(&upgradeTrustOpts)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pkg, err := getPackage(args[0])
+		if err != nil {
+			return err
+		}
+
+		sig, err := getPackageSignature(args[0], upgradeSignature)
+		if err != nil {
+			return err
+		}
+		if err := enforceSignature(pkg, sig, &upgradeTrustOpts); err != nil {
+			return err
+		}
+
+		target, err := getUpgradeTarget()
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+
+		installedConfig, err := getInstalledConfig(target)
+		if err != nil {
+			return err
+		}
+		opts := installedConfig.InstallOptions
+		opts.AcceptEULA = upgradeAcceptEULA
+
+		pkgMeta := pkg.GetMeta()
+		if err := install.New().Install(target, pkg, opts); err != nil {
+			return err
+		}
+
+		if err := writeInstalledSignature(target, pkgMeta, sig); err != nil {
+			return err
+		}
+
+		log.Info("The upgrade has been installed")
+		return nil
+	},
+}
+
+func getUpgradeTarget() (types.Node, error) {
+	if upgradeConnectOpts.Address != "" {
+		if upgradeConnectOpts.SSHKeyFile == "" {
+			fmt.Printf("Enter SSH Password for %s: ", upgradeConnectOpts.SSHUser)
+			bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
+			if err != nil {
+				return nil, err
+			}
+			upgradeConnectOpts.SSHPassword = string(bytePassword)
+		}
+		return node.Connect(&upgradeConnectOpts)
+	}
+	// make sure we are root
+	usr, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	if usr.Uid != "0" {
+		return nil, errors.New("Local upgrade must be run as root")
+	}
+	return node.Local(), nil
+}
+
+// getInstalledConfig retrieves the configuration that was used to install the package on the node.
+func getInstalledConfig(target types.Node) (*types.InstallConfig, error) {
+	log.Debug("Loading installed package configuration")
+	rdr, err := target.GetFile(types.InstalledConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve the installed configuration, is the package installed? %s", err.Error())
+	}
+	defer rdr.Close()
+	body, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	var installedConfig types.InstallConfig
+	if err := json.Unmarshal(body, &installedConfig); err != nil {
+		return nil, err
+	}
+	if installedConfig.InstallOptions == nil {
+		installedConfig.InstallOptions = &types.InstallOptions{}
+	}
+	return &installedConfig, nil
+}
@@ -1,7 +1,33 @@
 package cmd
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/tinyzimmer/k3p/pkg/build/package/formats"
+	"github.com/tinyzimmer/k3p/pkg/codec"
+	"github.com/tinyzimmer/k3p/pkg/crypt"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/oci"
+	"github.com/tinyzimmer/k3p/pkg/sbom"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// passphraseEnv is the environment variable read for package passphrases before prompting for one
+const passphraseEnv = "K3P_PASSPHRASE"
+
+// Environment variables holding registry credentials, the docker configuration is used when unset
+const (
+	registryUsernameEnv = "K3P_REGISTRY_USERNAME"
+	registryPasswordEnv = "K3P_REGISTRY_PASSWORD"
 )
 
 func completeStringOpts(opts []string) func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
@@ -9,3 +35,126 @@ func completeStringOpts(opts []string) func(cmd *cobra.Command, args []string, t
 		return opts, cobra.ShellCompDirectiveDefault
 	}
 }
+
+func compressionOpts() []string {
+	opts := []string{string(types.CompressionNone)}
+	for _, compression := range codec.Compressions() {
+		opts = append(opts, string(compression))
+	}
+	return opts
+}
+
+func sbomFormatOpts() []string {
+	opts := make([]string, 0)
+	for _, format := range sbom.Formats() {
+		opts = append(opts, string(format))
+	}
+	return opts
+}
+
+// getCompression returns the codec chosen with the --compression flag, or with the older
+// --compress flag when it is set instead.
+func getCompression(cmd *cobra.Command, compression string, compress bool) (types.Compression, error) {
+	if compress {
+		if cmd.Flags().Changed("compression") && compression != string(types.CompressionZstdDict) {
+			return "", errors.New("The --compress flag cannot be used with a --compression other than zstd-dict")
+		}
+		return types.CompressionZstdDict, nil
+	}
+	return codec.Parse(strings.ToLower(compression))
+}
+
+// readPassphrase returns the passphrase from the environment, or prompts for it. When confirm
+// is true the passphrase must be entered twice.
+func readPassphrase(prompt string, confirm bool) ([]byte, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		log.Debugf("Using the passphrase from $%s\n", passphraseEnv)
+		return []byte(passphrase), nil
+	}
+	if !terminal.IsTerminal(int(syscall.Stdin)) {
+		return nil, fmt.Errorf("A passphrase is required, set $%s when not running interactively", passphraseEnv)
+	}
+	fmt.Print(prompt)
+	passphrase, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("The passphrase cannot be empty")
+	}
+	if confirm {
+		fmt.Print("Confirm passphrase: ")
+		again, err := terminal.ReadPassword(int(syscall.Stdin))
+		fmt.Println()
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(passphrase) {
+			return nil, errors.New("The passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// decryptPackage returns a reader over the decrypted contents of the package if it is encrypted,
+// using the keys from --decrypt-key or a passphrase. The source is closed on error.
+func decryptPackage(rdr io.ReadCloser) (io.ReadCloser, error) {
+	buf := bufio.NewReader(rdr)
+	if !crypt.IsEncrypted(buf) {
+		return &bufferedReader{Reader: buf, src: rdr}, nil
+	}
+	log.Info("Decrypting the archive")
+	keys, err := crypt.LoadPrivateKeys(decryptKeys)
+	if err != nil {
+		rdr.Close()
+		return nil, err
+	}
+	dec, err := crypt.NewReader(buf, &crypt.Identities{
+		Keys: keys,
+		Passphrase: func() ([]byte, error) {
+			return readPassphrase("Enter the passphrase for the package: ", false)
+		},
+	})
+	if err != nil {
+		rdr.Close()
+		return nil, err
+	}
+	return &bufferedReader{Reader: dec, src: rdr}, nil
+}
+
+// bufferedReader closes the source of a reader wrapping it.
+type bufferedReader struct {
+	io.Reader
+	src io.Closer
+}
+
+func (b *bufferedReader) Close() error { return b.src.Close() }
+
+// registryClient returns a client for pushing and pulling packages with oci:// references.
+func registryClient() *oci.Client {
+	return oci.NewClient(&oci.Options{
+		Username: os.Getenv(registryUsernameEnv),
+		Password: os.Getenv(registryPasswordEnv),
+		Insecure: insecureRegistry,
+	})
+}
+
+// fetchRegistryPackage retrieves the manifest and metadata of the package at the given reference.
+func fetchRegistryPackage(ref string) (*oci.Remote, error) {
+	parsed, err := oci.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	return registryClient().Fetch(parsed)
+}
+
+// getRegistryPackage downloads the package at the given reference.
+func getRegistryPackage(ref string) (types.Package, error) {
+	remote, err := fetchRegistryPackage(ref)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Downloading the package from", ref)
+	return formats.Load(remote.Reader())
+}
@@ -0,0 +1,204 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// ZstDictionaryB64 is populated at compilation and contains a pre-trained dictionary
+// for compressing k3s images.
+var ZstDictionaryB64 string
+
+var (
+	gzipMagic     = []byte{0x1f, 0x8b}
+	xzMagic       = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic     = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zstdDictMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+)
+
+// Compressions returns the codecs that packages can be compressed with.
+func Compressions() []types.Compression {
+	return []types.Compression{types.CompressionGzip, types.CompressionXZ, types.CompressionZstd, types.CompressionZstdDict}
+}
+
+// Parse returns the codec with the given name.
+func Parse(name string) (types.Compression, error) {
+	for _, compression := range append(Compressions(), types.CompressionNone) {
+		if string(compression) == name {
+			return compression, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not a valid compression codec", name)
+}
+
+// Extension returns the file extension for archives compressed with the given codec.
+func Extension(compression types.Compression) string {
+	switch compression {
+	case types.CompressionGzip:
+		return ".gz"
+	case types.CompressionXZ:
+		return ".xz"
+	case types.CompressionZstd, types.CompressionZstdDict:
+		return ".zst"
+	}
+	return ""
+}
+
+// dictionary returns the embedded zstd dictionary and its ID.
+func dictionary() ([]byte, uint32, error) {
+	dict, err := base64.StdEncoding.DecodeString(ZstDictionaryB64)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(dict) < 8 || !bytes.Equal(dict[:4], zstdDictMagic) {
+		return nil, 0, errors.New("This build of k3p does not include a zstd dictionary")
+	}
+	return dict, binary.LittleEndian.Uint32(dict[4:8]), nil
+}
+
+// Compress returns a reader over the contents of rdr compressed with the given codec. Frames
+// compressed with the zstd dictionary record its ID, so they can be recognized when they are
+// decompressed.
+func Compress(rdr io.Reader, compression types.Compression) (io.ReadCloser, error) {
+	if compression == types.CompressionNone || compression == "" {
+		return ioutil.NopCloser(rdr), nil
+	}
+	// encoders may write headers as soon as they are created, so they are only created once
+	// something is reading from the pipe
+	var newEncoder func(w io.Writer) (io.WriteCloser, error)
+	switch compression {
+	case types.CompressionGzip:
+		newEncoder = func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }
+	case types.CompressionXZ:
+		newEncoder = func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) }
+	case types.CompressionZstd:
+		newEncoder = func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }
+	case types.CompressionZstdDict:
+		dict, _, err := dictionary()
+		if err != nil {
+			return nil, err
+		}
+		newEncoder = func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w, zstd.WithEncoderDict(dict)) }
+	default:
+		return nil, fmt.Errorf("%q is not a valid compression codec", compression)
+	}
+	r, w := io.Pipe()
+	go func() {
+		enc, err := newEncoder(w)
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(enc, rdr); err != nil {
+			enc.Close()
+			w.CloseWithError(err)
+			return
+		}
+		w.CloseWithError(enc.Close())
+	}()
+	return r, nil
+}
+
+// Detect returns the codec the contents of the given reader are compressed with, from their
+// first bytes. Nothing is consumed from the reader.
+func Detect(rdr *bufio.Reader) (types.Compression, error) {
+	// enough to read the dictionary ID from a zstd frame header
+	peek, err := rdr.Peek(10)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	switch {
+	case bytes.HasPrefix(peek, gzipMagic):
+		return types.CompressionGzip, nil
+	case bytes.HasPrefix(peek, xzMagic):
+		return types.CompressionXZ, nil
+	case bytes.HasPrefix(peek, zstdMagic):
+		if zstdDictID(peek) != 0 {
+			return types.CompressionZstdDict, nil
+		}
+		return types.CompressionZstd, nil
+	}
+	return types.CompressionNone, nil
+}
+
+// zstdDictID returns the dictionary ID from the header of the zstd frame at the start of
+// peek, or 0 if the frame does not use a dictionary.
+func zstdDictID(peek []byte) uint32 {
+	if len(peek) < 5 {
+		return 0
+	}
+	descriptor := peek[4]
+	offset := 5
+	if descriptor&(1<<5) == 0 {
+		// the window descriptor is present when the frame is not a single segment
+		offset++
+	}
+	size := []int{0, 1, 2, 4}[descriptor&3]
+	if size == 0 || len(peek) < offset+size {
+		return 0
+	}
+	id := make([]byte, 4)
+	copy(id, peek[offset:offset+size])
+	return binary.LittleEndian.Uint32(id)
+}
+
+// Decompress returns a reader over the decompressed contents of rdr, detecting the codec from
+// the contents themselves. Contents that are not compressed are returned as they are.
+func Decompress(rdr io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(rdr)
+	compression, err := Detect(buf)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case types.CompressionGzip:
+		return gzip.NewReader(buf)
+	case types.CompressionXZ:
+		dec, err := xz.NewReader(buf)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(dec), nil
+	case types.CompressionZstd, types.CompressionZstdDict:
+		var opts []zstd.DOption
+		if compression == types.CompressionZstdDict {
+			peek, _ := buf.Peek(10)
+			dict, id, err := dictionary()
+			if err != nil {
+				return nil, fmt.Errorf("The package was compressed with zstd dictionary %d: %s", zstdDictID(peek), err.Error())
+			}
+			if want := zstdDictID(peek); want != id {
+				return nil, fmt.Errorf("The package was compressed with zstd dictionary %d, but this build of k3p includes dictionary %d", want, id)
+			}
+			opts = append(opts, zstd.WithDecoderDicts(dict))
+		}
+		dec, err := zstd.NewReader(buf, opts...)
+		if err != nil {
+			return nil, err
+		}
+		// zstd.Decoder does not properly implement a ReadCloser
+		return &zstdReadCloser{dec}, nil
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+type zstdReadCloser struct{ rdr *zstd.Decoder }
+
+func (z *zstdReadCloser) Read(p []byte) (int, error) { return z.rdr.Read(p) }
+
+func (z *zstdReadCloser) Close() error {
+	z.rdr.Close()
+	return nil
+}
@@ -0,0 +1,78 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestCodec(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Compression Codec Suite")
+}
+
+func compress(contents []byte, compression types.Compression) []byte {
+	rdr, err := Compress(bytes.NewReader(contents), compression)
+	Expect(err).ToNot(HaveOccurred())
+	defer rdr.Close()
+	out, err := ioutil.ReadAll(rdr)
+	Expect(err).ToNot(HaveOccurred())
+	return out
+}
+
+func decompress(contents []byte) ([]byte, error) {
+	rdr, err := Decompress(bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	return ioutil.ReadAll(rdr)
+}
+
+var _ = Describe("Compression codecs", func() {
+	contents := []byte(strings.Repeat("manifest.json and some images ", 1000))
+
+	BeforeEach(func() {
+		dict, err := ioutil.ReadFile("../../hack/zstDictionary")
+		Expect(err).ToNot(HaveOccurred())
+		ZstDictionaryB64 = base64.StdEncoding.EncodeToString(dict)
+	})
+
+	It("Should detect every codec from the contents and round trip them", func() {
+		for _, compression := range append(Compressions(), types.CompressionNone) {
+			compressed := compress(contents, compression)
+			detected, err := Detect(bufio.NewReader(bytes.NewReader(compressed)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(detected).To(Equal(compression))
+			Expect(decompress(compressed)).To(Equal(contents), string(compression))
+		}
+	})
+
+	It("Should refuse frames compressed with a different dictionary", func() {
+		compressed := compress(contents, types.CompressionZstdDict)
+		ZstDictionaryB64 = ""
+		_, err := decompress(compressed)
+		Expect(err).To(MatchError(ContainSubstring("does not include a zstd dictionary")))
+
+		_, err = Compress(bytes.NewReader(contents), types.CompressionZstdDict)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should parse codec names", func() {
+		Expect(Parse("xz")).To(Equal(types.CompressionXZ))
+		_, err := Parse("bzip2")
+		Expect(err).To(HaveOccurred())
+		Expect(Extension(types.CompressionZstdDict)).To(Equal(".zst"))
+		Expect(Extension(types.CompressionNone)).To(Equal(""))
+	})
+})
@@ -0,0 +1,331 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// magic is written at the start of every encrypted package
+const magic = "k3p-encrypted/v1\n"
+
+// chunkSize is the size of the plaintext sealed in each chunk of the payload
+const chunkSize = 64 * 1024
+
+// scryptLogN is the work factor used when wrapping the file key with a passphrase, and
+// maxScryptLogN is the highest one accepted when decrypting.
+var (
+	scryptLogN    = 18
+	maxScryptLogN = 22
+)
+
+const (
+	fileKeySize = 32
+	saltSize    = 16
+	macSize     = sha256.Size
+)
+
+// IsEncrypted returns true if the contents of the given reader are an encrypted package.
+// Nothing is consumed from the reader.
+func IsEncrypted(rdr *bufio.Reader) bool {
+	peek, err := rdr.Peek(len(magic))
+	return err == nil && string(peek) == magic
+}
+
+// EncryptReader returns a reader over the encrypted contents of the given reader. The contents
+// can be decrypted by any of the recipients, or with the passphrase when it is not empty.
+func EncryptReader(rdr io.ReadCloser, recipients []PublicKey, passphrase []byte) (io.ReadCloser, error) {
+	if len(recipients) == 0 && len(passphrase) == 0 {
+		return nil, errNoRecipients
+	}
+	r, w := io.Pipe()
+	go func() {
+		defer rdr.Close()
+		enc, err := NewWriter(w, recipients, passphrase)
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(enc, rdr); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		w.CloseWithError(enc.Close())
+	}()
+	return r, nil
+}
+
+// NewWriter returns a writer that encrypts everything written to it to the given writer.
+// The contents can be decrypted by any of the recipients, or with the passphrase when it
+// is not empty. The writer must be closed to write the final chunk of the payload.
+func NewWriter(w io.Writer, recipients []PublicKey, passphrase []byte) (io.WriteCloser, error) {
+	if len(recipients) == 0 && len(passphrase) == 0 {
+		return nil, errNoRecipients
+	}
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	header := &types.EncryptionHeader{PayloadSalt: make([]byte, saltSize)}
+	if _, err := rand.Read(header.PayloadSalt); err != nil {
+		return nil, err
+	}
+	for _, recipient := range recipients {
+		stanza, err := wrapX25519(fileKey, recipient)
+		if err != nil {
+			return nil, err
+		}
+		header.Stanzas = append(header.Stanzas, *stanza)
+	}
+	if len(passphrase) > 0 {
+		stanza, err := wrapScrypt(fileKey, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		header.Stanzas = append(header.Stanzas, *stanza)
+	}
+
+	raw, err := marshalHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(headerMAC(fileKey, raw)); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(deriveKey(fileKey, header.PayloadSalt, "k3p payload"))
+	if err != nil {
+		return nil, err
+	}
+	return &writer{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// Identities are what can be used to decrypt a package.
+type Identities struct {
+	// Private keys of recipients of the package
+	Keys []PrivateKey
+	// Called for a passphrase when the package cannot be decrypted with any of the keys,
+	// if it was encrypted with one.
+	Passphrase func() ([]byte, error)
+}
+
+// NewReader returns a reader over the decrypted contents of the encrypted package read from rdr.
+// The header is read and the file key is unwrapped before returning. The payload is authenticated
+// as it is read, and an error is returned if it was modified or truncated.
+func NewReader(rdr io.Reader, ids *Identities) (io.Reader, error) {
+	raw, header, err := readHeader(rdr)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := unwrap(header, ids)
+	if err != nil {
+		return nil, err
+	}
+	mac := make([]byte, macSize)
+	if _, err := io.ReadFull(rdr, mac); err != nil {
+		return nil, fmt.Errorf("reading the encryption header: %s", err.Error())
+	}
+	if !hmac.Equal(mac, headerMAC(fileKey, raw)) {
+		return nil, errors.New("The encryption header of the package has been modified")
+	}
+	aead, err := chacha20poly1305.New(deriveKey(fileKey, header.PayloadSalt, "k3p payload"))
+	if err != nil {
+		return nil, err
+	}
+	return &reader{rdr: bufio.NewReader(rdr), aead: aead}, nil
+}
+
+func marshalHeader(header *types.EncryptionHeader) ([]byte, error) {
+	body, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	out.WriteString(magic)
+	if err := binary.Write(&out, binary.BigEndian, uint32(len(body))); err != nil {
+		return nil, err
+	}
+	out.Write(body)
+	return out.Bytes(), nil
+}
+
+func readHeader(rdr io.Reader) ([]byte, *types.EncryptionHeader, error) {
+	prefix := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(rdr, prefix); err != nil {
+		return nil, nil, fmt.Errorf("reading the encryption header: %s", err.Error())
+	}
+	if string(prefix[:len(magic)]) != magic {
+		return nil, nil, errors.New("The package is not encrypted")
+	}
+	size := binary.BigEndian.Uint32(prefix[len(magic):])
+	if size > 1<<20 {
+		return nil, nil, fmt.Errorf("The encryption header is too large (%d bytes)", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(rdr, body); err != nil {
+		return nil, nil, fmt.Errorf("reading the encryption header: %s", err.Error())
+	}
+	var header types.EncryptionHeader
+	if err := json.Unmarshal(body, &header); err != nil {
+		return nil, nil, fmt.Errorf("reading the encryption header: %s", err.Error())
+	}
+	return append(prefix, body...), &header, nil
+}
+
+func unwrap(header *types.EncryptionHeader, ids *Identities) ([]byte, error) {
+	var hasScrypt bool
+	for _, stanza := range header.Stanzas {
+		if stanza.Type != types.EncryptionStanzaX25519 {
+			hasScrypt = hasScrypt || stanza.Type == types.EncryptionStanzaScrypt
+			continue
+		}
+		for _, key := range ids.Keys {
+			if fileKey, err := unwrapX25519(&stanza, key); err == nil {
+				return fileKey, nil
+			}
+		}
+	}
+	if !hasScrypt {
+		return nil, errors.New("The package is encrypted and none of the provided keys can decrypt it")
+	}
+	if ids.Passphrase == nil {
+		return nil, errors.New("The package is encrypted with a passphrase and none was provided")
+	}
+	passphrase, err := ids.Passphrase()
+	if err != nil {
+		return nil, err
+	}
+	for _, stanza := range header.Stanzas {
+		if stanza.Type != types.EncryptionStanzaScrypt {
+			continue
+		}
+		if fileKey, err := unwrapScrypt(&stanza, passphrase); err == nil {
+			return fileKey, nil
+		} else if err != errWrongKey {
+			return nil, err
+		}
+	}
+	return nil, errors.New("The passphrase is not valid for the package")
+}
+
+// errNoRecipients is returned when there is no one to encrypt a package for
+var errNoRecipients = errors.New("At least one recipient or a passphrase is required to encrypt a package")
+
+// errWrongKey is returned when a stanza cannot be unwrapped with the given key
+var errWrongKey = errors.New("the file key could not be unwrapped")
+
+func wrapX25519(fileKey []byte, recipient PublicKey) (*types.EncryptionStanza, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	ephemeralPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, recipient)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey := deriveKey(shared, append(append([]byte{}, ephemeralPub...), recipient...), "k3p x25519")
+	key, err := seal(wrapKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &types.EncryptionStanza{Type: types.EncryptionStanzaX25519, Ephemeral: ephemeralPub, Key: key}, nil
+}
+
+func unwrapX25519(stanza *types.EncryptionStanza, key PrivateKey) ([]byte, error) {
+	pub, err := key.Public()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(key, stanza.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey := deriveKey(shared, append(append([]byte{}, stanza.Ephemeral...), pub...), "k3p x25519")
+	return open(wrapKey, stanza.Key)
+}
+
+func wrapScrypt(fileKey, passphrase []byte) (*types.EncryptionStanza, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	log.Debugf("Deriving the encryption key from the passphrase (scrypt work factor 2^%d)\n", scryptLogN)
+	wrapKey, err := scrypt.Key(passphrase, salt, 1<<scryptLogN, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	key, err := seal(wrapKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &types.EncryptionStanza{Type: types.EncryptionStanzaScrypt, Salt: salt, LogN: scryptLogN, Key: key}, nil
+}
+
+func unwrapScrypt(stanza *types.EncryptionStanza, passphrase []byte) ([]byte, error) {
+	if stanza.LogN <= 0 || stanza.LogN > maxScryptLogN {
+		return nil, fmt.Errorf("The scrypt work factor of the package (2^%d) is not supported", stanza.LogN)
+	}
+	wrapKey, err := scrypt.Key(passphrase, stanza.Salt, 1<<stanza.LogN, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return open(wrapKey, stanza.Key)
+}
+
+// seal and open wrap the file key. Every wrapping key is only ever used once, so the nonce
+// is left empty.
+func seal(key, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), plaintext, nil), nil
+}
+
+func open(key, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), ciphertext, nil)
+	if err != nil || len(plaintext) != fileKeySize {
+		return nil, errWrongKey
+	}
+	return plaintext, nil
+}
+
+func deriveKey(secret, salt []byte, info string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		// hkdf can only fail when reading more than 255 blocks
+		panic(err)
+	}
+	return key
+}
+
+func headerMAC(fileKey, raw []byte) []byte {
+	h := hmac.New(sha256.New, deriveKey(fileKey, nil, "k3p header"))
+	h.Write(raw)
+	return h.Sum(nil)
+}
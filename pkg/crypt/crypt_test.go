@@ -0,0 +1,151 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+)
+
+func TestCrypt(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	// keep the passphrase tests fast
+	scryptLogN = 10
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Package Encryption Suite")
+}
+
+func generateKeys(dir, name string) (PublicKey, PrivateKey) {
+	pub, priv, err := GenerateKeys()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(ioutil.WriteFile(path.Join(dir, name+".key"), priv, 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(path.Join(dir, name+".pub"), pub, 0644)).To(Succeed())
+	pubKeys, err := LoadPublicKeys([]string{path.Join(dir, name+".pub")})
+	Expect(err).ToNot(HaveOccurred())
+	privKeys, err := LoadPrivateKeys([]string{path.Join(dir, name+".key")})
+	Expect(err).ToNot(HaveOccurred())
+	return pubKeys[0], privKeys[0]
+}
+
+func encrypt(plaintext []byte, recipients []PublicKey, passphrase string) []byte {
+	var out bytes.Buffer
+	w, err := NewWriter(&out, recipients, []byte(passphrase))
+	Expect(err).ToNot(HaveOccurred())
+	_, err = w.Write(plaintext)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(w.Close()).To(Succeed())
+	return out.Bytes()
+}
+
+func decrypt(ciphertext []byte, ids *Identities) ([]byte, error) {
+	rdr, err := NewReader(bytes.NewReader(ciphertext), ids)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(rdr)
+}
+
+func passphrase(p string) func() ([]byte, error) {
+	return func() ([]byte, error) { return []byte(p), nil }
+}
+
+var _ = Describe("Encrypting packages", func() {
+	var tmpDir string
+	var alicePub, bobPub PublicKey
+	var alice, bob, eve PrivateKey
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		alicePub, alice = generateKeys(tmpDir, "alice")
+		bobPub, bob = generateKeys(tmpDir, "bob")
+		_, eve = generateKeys(tmpDir, "eve")
+	})
+
+	AfterEach(func() { os.RemoveAll(tmpDir) })
+
+	It("Should round trip payloads of any size for every recipient", func() {
+		for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+			plaintext := make([]byte, size)
+			rand.Read(plaintext)
+			ciphertext := encrypt(plaintext, []PublicKey{alicePub, bobPub}, "hunter2")
+			Expect(IsEncrypted(bufio.NewReader(bytes.NewReader(ciphertext)))).To(BeTrue())
+
+			for _, ids := range []*Identities{
+				{Keys: []PrivateKey{alice}},
+				{Keys: []PrivateKey{eve, bob}},
+				{Keys: []PrivateKey{eve}, Passphrase: passphrase("hunter2")},
+			} {
+				out, err := decrypt(ciphertext, ids)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(out).To(Equal(plaintext), "payload of %d bytes", size)
+			}
+		}
+	})
+
+	It("Should encrypt the contents of a reader", func() {
+		plaintext := make([]byte, chunkSize*2+1)
+		rand.Read(plaintext)
+		rdr, err := EncryptReader(ioutil.NopCloser(bytes.NewReader(plaintext)), []PublicKey{alicePub}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ciphertext, err := ioutil.ReadAll(rdr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decrypt(ciphertext, &Identities{Keys: []PrivateKey{alice}})).To(Equal(plaintext))
+
+		_, err = EncryptReader(ioutil.NopCloser(bytes.NewReader(plaintext)), nil, nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should only ask for a passphrase when no key can decrypt the package", func() {
+		ciphertext := encrypt([]byte("payload"), []PublicKey{alicePub}, "hunter2")
+		_, err := decrypt(ciphertext, &Identities{
+			Keys:       []PrivateKey{alice},
+			Passphrase: func() ([]byte, error) { return nil, errors.New("should not be called") },
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = decrypt(ciphertext, &Identities{Passphrase: passphrase("wrong")})
+		Expect(err).To(MatchError(ContainSubstring("passphrase is not valid")))
+
+		_, err = decrypt(encrypt([]byte("payload"), []PublicKey{alicePub}, ""), &Identities{Keys: []PrivateKey{eve}})
+		Expect(err).To(MatchError(ContainSubstring("none of the provided keys")))
+	})
+
+	It("Should detect modified and truncated packages", func() {
+		plaintext := make([]byte, 2*chunkSize)
+		rand.Read(plaintext)
+		ciphertext := encrypt(plaintext, []PublicKey{alicePub}, "")
+		ids := &Identities{Keys: []PrivateKey{alice}}
+
+		modified := append([]byte{}, ciphertext...)
+		modified[len(modified)-100] ^= 1
+		_, err := decrypt(modified, ids)
+		Expect(err).To(MatchError(ContainSubstring("modified")))
+
+		// dropping the final chunk leaves a stream ending on a chunk boundary
+		_, err = decrypt(ciphertext[:len(ciphertext)-chunkSize-16], ids)
+		Expect(err).To(HaveOccurred())
+		_, err = decrypt(ciphertext[:len(ciphertext)-1], ids)
+		Expect(err).To(HaveOccurred())
+
+		// the header is authenticated as well
+		header := append([]byte{}, ciphertext...)
+		header[len(magic)+4+2] = ' '
+		_, err = decrypt(header, ids)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should not treat other contents as encrypted", func() {
+		Expect(IsEncrypted(bufio.NewReader(bytes.NewReader([]byte("package.tar contents"))))).To(BeFalse())
+	})
+})
@@ -0,0 +1,83 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	privateKeyPEMType = "X25519 PRIVATE KEY"
+	publicKeyPEMType  = "X25519 PUBLIC KEY"
+)
+
+// PublicKey is the X25519 public key of a recipient of an encrypted package.
+type PublicKey []byte
+
+// PrivateKey is the X25519 private key of a recipient of an encrypted package.
+type PrivateKey []byte
+
+// Public returns the public key for the private key.
+func (p PrivateKey) Public() (PublicKey, error) {
+	return curve25519.X25519(p, curve25519.Basepoint)
+}
+
+// GenerateKeys will generate a new X25519 key pair for encrypting packages. The keys are
+// returned PEM encoded.
+func GenerateKeys() (pubPEM, privPEM []byte, err error) {
+	priv := make(PrivateKey, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err := priv.Public()
+	if err != nil {
+		return nil, nil, err
+	}
+	pubPEM = pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: pub})
+	privPEM = pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: priv})
+	return pubPEM, privPEM, nil
+}
+
+// LoadPublicKeys will load PEM encoded X25519 public keys from the given files.
+func LoadPublicKeys(paths []string) ([]PublicKey, error) {
+	keys := make([]PublicKey, len(paths))
+	for i, path := range paths {
+		key, err := readPEMFile(path, publicKeyPEMType)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// LoadPrivateKeys will load PEM encoded X25519 private keys from the given files.
+func LoadPrivateKeys(paths []string) ([]PrivateKey, error) {
+	keys := make([]PrivateKey, len(paths))
+	for i, path := range paths {
+		key, err := readPEMFile(path, privateKeyPEMType)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+func readPEMFile(path, pemType string) ([]byte, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("%q does not contain a PEM encoded %s", path, pemType)
+	}
+	if len(block.Bytes) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("%q does not contain a valid %s", path, pemType)
+	}
+	return block.Bytes, nil
+}
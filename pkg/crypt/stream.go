@@ -0,0 +1,123 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The payload is sealed in chunks of chunkSize bytes. The nonce of each chunk is its index,
+// with the last byte set on the final chunk, so chunks cannot be reordered, dropped or
+// truncated from the end without being noticed.
+
+func chunkNonce(idx uint64, final bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], idx)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// writer seals the payload a chunk at a time. A full chunk is only written once more data
+// follows it, so the final chunk can always be marked as such on Close.
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	idx    uint64
+	closed bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to a closed encrypted writer")
+	}
+	var written int
+	for len(p) > 0 {
+		if len(w.buf) == chunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) flush(final bool) error {
+	if w.idx == 1<<64-1 {
+		return errors.New("the encrypted payload is too large")
+	}
+	sealed := w.aead.Seal(nil, chunkNonce(w.idx, final), w.buf, nil)
+	w.idx++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Close writes the final chunk of the payload. It does not close the underlying writer.
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+// reader opens the payload a chunk at a time.
+type reader struct {
+	rdr   *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	idx   uint64
+	final bool
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *reader) next() error {
+	sealed := make([]byte, chunkSize+r.aead.Overhead())
+	n, err := io.ReadFull(r.rdr, sealed)
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		r.final = true
+	case err == io.EOF:
+		return errors.New("The encrypted package is truncated")
+	case err != nil:
+		return err
+	default:
+		// a full chunk is the final one when nothing follows it
+		if _, err := r.rdr.Peek(1); err == io.EOF {
+			r.final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := r.aead.Open(sealed[:0], chunkNonce(r.idx, r.final), sealed[:n], nil)
+	if err != nil {
+		return errors.New("The encrypted package has been modified or is truncated")
+	}
+	r.idx++
+	r.buf = plain
+	return nil
+}
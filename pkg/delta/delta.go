@@ -0,0 +1,572 @@
+package delta
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+// minEntrySize is the smallest entry in an image tarball that is worth taking from the base
+// package. Anything smaller is cheaper to ship again than to reference.
+const minEntrySize = 1024
+
+// MetaDigest returns the sha256sum of the metadata of the given package as it is stored
+// in the archive. Packages combined from a delta are identified by the digest of the release
+// the delta was built from instead.
+func MetaDigest(pkg types.Package) (string, error) {
+	if meta := pkg.GetMeta(); !meta.IsDelta() && meta.ReleaseMetaDigest != "" {
+		return meta.ReleaseMetaDigest, nil
+	}
+	raw, err := util.GetRawMeta(pkg)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(raw)), nil
+}
+
+// Build writes a delta of pkg against base to out. Artifacts that are unchanged since the base
+// are left out entirely, and image tarballs are written without any entries (usually layers)
+// that can be found in the image tarballs of the base.
+func Build(pkg, base, out types.Package) error {
+	baseMeta := base.GetMeta()
+	if baseMeta.IsDelta() {
+		return errors.New("The base package is itself a delta package")
+	}
+	baseDigests := baseMeta.GetManifest().Digests
+	if len(baseDigests) == 0 {
+		return errors.New("The base package does not contain artifact digests, it must be rebuilt with a newer k3p")
+	}
+	if err := base.Verify(); err != nil {
+		return err
+	}
+	baseMetaDigest, err := MetaDigest(base)
+	if err != nil {
+		return err
+	}
+	releaseMetaDigest, err := MetaDigest(pkg)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Indexing image layers in the base package")
+	baseEntries, err := indexImageEntries(base)
+	if err != nil {
+		return err
+	}
+
+	meta := pkg.GetMeta()
+	digests := meta.GetManifest().Digests
+	// the listings of the delta include the artifacts taken from the base
+	manifest := types.NewEmptyManifest()
+	listing := &types.PackageMeta{Manifest: manifest}
+	manifest.Digests = make(map[string]types.ArtifactDigest)
+
+	for _, name := range sortedNames(digests) {
+		digest := digests[name]
+		t, _ := v1.ArtifactFromPath(name)
+		v1.AppendMeta(listing, t, name)
+
+		if baseDigest, ok := baseDigests[name]; ok && baseDigest.SHA256 == digest.SHA256 {
+			log.Infof("%s is unchanged since the base package\n", name)
+			manifest.Digests[name] = types.ArtifactDigest{SHA256: digest.SHA256, Size: digest.Size, Base: true}
+			continue
+		}
+
+		if t == types.ArtifactImages && len(baseEntries) > 0 {
+			delta, err := putImageDelta(pkg, out, name, digest, baseEntries)
+			if err != nil {
+				return err
+			}
+			if delta != nil {
+				written, err := writtenDigest(out, name)
+				if err != nil {
+					return err
+				}
+				written.Delta = delta
+				manifest.Digests[name] = written
+				continue
+			}
+		}
+
+		log.Infof("Adding %s to the delta package\n", name)
+		if err := copyArtifact(pkg, out, name); err != nil {
+			return err
+		}
+		written, err := writtenDigest(out, name)
+		if err != nil {
+			return err
+		}
+		manifest.Digests[name] = written
+	}
+
+	outMeta := meta.DeepCopy()
+	outMeta.Manifest = manifest
+	outMeta.ReleaseMetaDigest = releaseMetaDigest
+	outMeta.Base = &types.PackageBase{
+		Name:       baseMeta.GetName(),
+		Version:    baseMeta.GetVersion(),
+		MetaDigest: baseMetaDigest,
+	}
+	return out.PutMeta(outMeta)
+}
+
+// Apply combines the given delta package with its base and writes the complete package to out.
+// Every artifact is restored exactly as it was in the release the delta was built from.
+func Apply(delta, base, out types.Package) error {
+	meta := delta.GetMeta()
+	if !meta.IsDelta() {
+		return errors.New("The package is not a delta package")
+	}
+	baseMetaDigest, err := MetaDigest(base)
+	if err != nil {
+		return err
+	}
+	if baseMetaDigest != meta.Base.MetaDigest {
+		baseMeta := base.GetMeta()
+		return fmt.Errorf("The delta was built against %s %s, but the base package is %s %s",
+			meta.Base.Name, meta.Base.Version, baseMeta.GetName(), baseMeta.GetVersion())
+	}
+	if err := delta.Verify(); err != nil {
+		return err
+	}
+	if err := base.Verify(); err != nil {
+		return err
+	}
+
+	digests := meta.GetManifest().Digests
+	baseDigests := base.GetMeta().GetManifest().Digests
+	manifest := types.NewEmptyManifest()
+	listing := &types.PackageMeta{Manifest: manifest}
+	manifest.Digests = make(map[string]types.ArtifactDigest, len(digests))
+	for _, name := range sortedNames(digests) {
+		digest := digests[name]
+		t, _ := v1.ArtifactFromPath(name)
+		v1.AppendMeta(listing, t, name)
+		switch {
+		case digest.Base:
+			if baseDigest, ok := baseDigests[name]; !ok || baseDigest.SHA256 != digest.SHA256 {
+				return fmt.Errorf("%s does not match the artifact in the base package", name)
+			}
+			log.Debugf("Taking %s from the base package\n", name)
+			if err := copyArtifact(base, out, name); err != nil {
+				return err
+			}
+		case digest.Delta != nil:
+			log.Debugf("Restoring %d entries of %s from the base package\n", len(digest.Delta.BaseEntries), name)
+			if err := restoreImageTarball(delta, base, out, name, digest.Delta); err != nil {
+				return err
+			}
+		default:
+			if err := copyArtifact(delta, out, name); err != nil {
+				return err
+			}
+		}
+		written, err := writtenDigest(out, name)
+		if err != nil {
+			return err
+		}
+		manifest.Digests[name] = written
+	}
+
+	outMeta := meta.DeepCopy()
+	outMeta.Base = nil
+	outMeta.Manifest = manifest
+	return out.PutMeta(outMeta)
+}
+
+// writtenDigest returns the digest the artifact at the given path was written to the package with.
+func writtenDigest(pkg types.Package, name string) (types.ArtifactDigest, error) {
+	digest, ok := pkg.GetMeta().GetManifest().Digests[name]
+	if !ok {
+		return types.ArtifactDigest{}, fmt.Errorf("%s was not written to the package", name)
+	}
+	return digest, nil
+}
+
+func sortedNames(digests map[string]types.ArtifactDigest) []string {
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// copyArtifact copies the artifact at the given path in the archive from one package to another.
+func copyArtifact(src, dst types.Package, name string) error {
+	artifact := &types.Artifact{Name: name}
+	if err := src.Get(artifact); err != nil {
+		return err
+	}
+	t, relName := v1.ArtifactFromPath(name)
+	return dst.Put(&types.Artifact{Type: t, Name: relName, Body: artifact.Body, Size: artifact.Size})
+}
+
+// walkTarball calls fn for every entry inside the tarball artifact at the given path.
+func walkTarball(pkg types.Package, name string, fn func(*tar.Header, io.Reader) error) error {
+	artifact := &types.Artifact{Name: name}
+	if err := pkg.Get(artifact); err != nil {
+		return err
+	}
+	defer artifact.Body.Close()
+	rdr := tar.NewReader(artifact.Body)
+	for {
+		header, err := rdr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("reading %s: %s", name, err.Error())
+		}
+		if err := fn(header, rdr); err != nil {
+			return err
+		}
+	}
+}
+
+// indexImageEntries returns the entries of every image tarball in the package keyed by
+// their sha256sum.
+func indexImageEntries(pkg types.Package) (map[string]types.DeltaEntry, error) {
+	entries := make(map[string]types.DeltaEntry)
+	for _, name := range sortedNames(pkg.GetMeta().GetManifest().Digests) {
+		if t, _ := v1.ArtifactFromPath(name); t != types.ArtifactImages {
+			continue
+		}
+		err := walkTarball(pkg, name, func(header *tar.Header, rdr io.Reader) error {
+			if header.Typeflag != tar.TypeReg || header.Size < minEntrySize {
+				return nil
+			}
+			sum, err := util.CalculateSHA256Sum(rdr)
+			if err != nil {
+				return err
+			}
+			if _, ok := entries[sum]; !ok {
+				entries[sum] = types.DeltaEntry{Artifact: name, Entry: header.Name, SHA256: sum, Size: header.Size}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// putImageDelta writes the image tarball at the given path to out without the entries that can
+// be found in the base package. If none of them can be found, nothing is written and nil is
+// returned. The remaining entries are copied as they are, and the position and raw headers of the
+// missing ones are recorded, so the tarball can be restored exactly.
+func putImageDelta(pkg, out types.Package, name string, digest types.ArtifactDigest, baseEntries map[string]types.DeltaEntry) (*types.ArtifactDelta, error) {
+	delta := &types.ArtifactDelta{BaseEntries: make(map[string]types.DeltaEntry), SHA256: digest.SHA256, Size: digest.Size}
+	err := walkTarball(pkg, name, func(header *tar.Header, rdr io.Reader) error {
+		if _, ok := delta.BaseEntries[header.Name]; ok || header.Typeflag != tar.TypeReg || header.Size < minEntrySize {
+			return nil
+		}
+		sum, err := util.CalculateSHA256Sum(rdr)
+		if err != nil {
+			return err
+		}
+		if entry, ok := baseEntries[sum]; ok && entry.Size == header.Size {
+			delta.BaseEntries[header.Name] = entry
+		}
+		return nil
+	})
+	if err != nil || len(delta.BaseEntries) == 0 {
+		return nil, err
+	}
+
+	log.Infof("Adding %s to the delta package without %d entries found in the base package\n", name, len(delta.BaseEntries))
+	r, w := io.Pipe()
+	go func() {
+		// the padding of an entry is only known once the next one is read, so it is only
+		// kept when the entry itself is
+		var index int
+		var keptPrevious bool
+		err := walkRawTarball(pkg, name, func(header *tar.Header, rawHeader, prevPadding []byte, body io.Reader) error {
+			defer func() { index++ }()
+			if keptPrevious {
+				if _, err := w.Write(prevPadding); err != nil {
+					return err
+				}
+			}
+			if entry, ok := delta.BaseEntries[header.Name]; ok && entry.Header == nil {
+				entry.Index, entry.Header = index, rawHeader
+				delta.BaseEntries[header.Name] = entry
+				keptPrevious = false
+				return nil
+			}
+			keptPrevious = true
+			if _, err := w.Write(rawHeader); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, body)
+			return err
+		}, func(lastPadding, trailer []byte) error {
+			if keptPrevious {
+				if _, err := w.Write(lastPadding); err != nil {
+					return err
+				}
+			}
+			_, err := w.Write(trailer)
+			return err
+		})
+		w.CloseWithError(err)
+	}()
+	t, relName := v1.ArtifactFromPath(name)
+	artifact, err := util.ArtifactFromReader(t, relName, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := out.Put(artifact); err != nil {
+		return nil, err
+	}
+	return delta, nil
+}
+
+// restoreImageTarball writes the image tarball at the given path to out, restoring the entries
+// that were taken from the base package at their original positions. The result is verified
+// against the digest of the tarball in the release the delta was built from.
+func restoreImageTarball(delta, base, out types.Package, name string, artifactDelta *types.ArtifactDelta) error {
+	if artifactDelta.SHA256 == "" {
+		return fmt.Errorf("%s does not record how to restore it, the delta must be rebuilt with a newer k3p", name)
+	}
+	spooled, err := spoolBaseEntries(base, artifactDelta)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, body := range spooled {
+			body.Close()
+		}
+	}()
+	missing := make(map[int]string, len(artifactDelta.BaseEntries))
+	for target, entry := range artifactDelta.BaseEntries {
+		if entry.Header == nil {
+			return fmt.Errorf("%s does not record how to restore it, the delta must be rebuilt with a newer k3p", name)
+		}
+		missing[entry.Index] = target
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		var index int
+		// writeMissing writes the missing entries that come before the next entry of the delta
+		writeMissing := func() error {
+			for {
+				target, ok := missing[index]
+				if !ok {
+					return nil
+				}
+				entry := artifactDelta.BaseEntries[target]
+				body := spooled[entryKey(entry)]
+				if _, err := body.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				if _, err := w.Write(entry.Header); err != nil {
+					return err
+				}
+				if _, err := io.Copy(w, body); err != nil {
+					return err
+				}
+				if _, err := w.Write(make([]byte, blockPadding(entry.Size))); err != nil {
+					return err
+				}
+				delete(missing, index)
+				index++
+			}
+		}
+		err := walkRawTarball(delta, name, func(header *tar.Header, rawHeader, prevPadding []byte, body io.Reader) error {
+			if _, err := w.Write(prevPadding); err != nil {
+				return err
+			}
+			if err := writeMissing(); err != nil {
+				return err
+			}
+			index++
+			if _, err := w.Write(rawHeader); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, body)
+			return err
+		}, func(lastPadding, trailer []byte) error {
+			if _, err := w.Write(lastPadding); err != nil {
+				return err
+			}
+			if err := writeMissing(); err != nil {
+				return err
+			}
+			if len(missing) > 0 {
+				return fmt.Errorf("%d of the entries of %s taken from the base package could not be placed", len(missing), name)
+			}
+			_, err := w.Write(trailer)
+			return err
+		})
+		w.CloseWithError(err)
+	}()
+	t, relName := v1.ArtifactFromPath(name)
+	digest := &types.ArtifactDigest{SHA256: artifactDelta.SHA256, Size: artifactDelta.Size}
+	artifact, err := util.ArtifactFromReader(t, relName, util.NewDigestReader(name, r, r, digest))
+	if err != nil {
+		return err
+	}
+	return out.Put(artifact)
+}
+
+// entryKey identifies an entry in the tarballs of the base package.
+func entryKey(entry types.DeltaEntry) string { return path.Join(entry.Artifact, entry.Entry) }
+
+// spoolBaseEntries writes the entries of the base package that the artifact needs to temporary
+// files, keyed by their entryKey. Each artifact of the base package is only read once.
+func spoolBaseEntries(base types.Package, artifactDelta *types.ArtifactDelta) (map[string]*spooledEntry, error) {
+	wanted := make(map[string]map[string]types.DeltaEntry)
+	for _, entry := range artifactDelta.BaseEntries {
+		if wanted[entry.Artifact] == nil {
+			wanted[entry.Artifact] = make(map[string]types.DeltaEntry)
+		}
+		wanted[entry.Artifact][entry.Entry] = entry
+	}
+	baseArtifacts := make([]string, 0, len(wanted))
+	for baseArtifact := range wanted {
+		baseArtifacts = append(baseArtifacts, baseArtifact)
+	}
+	sort.Strings(baseArtifacts)
+
+	spooled := make(map[string]*spooledEntry)
+	for _, baseArtifact := range baseArtifacts {
+		err := walkTarball(base, baseArtifact, func(header *tar.Header, rdr io.Reader) error {
+			entry, ok := wanted[baseArtifact][header.Name]
+			if !ok {
+				return nil
+			}
+			body, err := readEntry(header.Name, rdr, entry)
+			if err != nil {
+				return err
+			}
+			spooled[entryKey(entry)] = body
+			delete(wanted[baseArtifact], header.Name)
+			return nil
+		})
+		if err == nil && len(wanted[baseArtifact]) > 0 {
+			err = fmt.Errorf("%d entries of %s were not found in the base package", len(wanted[baseArtifact]), baseArtifact)
+		}
+		if err != nil {
+			for _, body := range spooled {
+				body.Close()
+			}
+			return nil, err
+		}
+	}
+	return spooled, nil
+}
+
+// blockPadding returns the number of bytes that pad a tar entry of the given size to a full block.
+func blockPadding(size int64) int64 { return -size & (blockSize - 1) }
+
+// blockSize is the size of the blocks of a tar archive
+const blockSize = 512
+
+// recorder keeps a copy of what is read from a reader while recording is enabled.
+type recorder struct {
+	rdr       io.Reader
+	recording bool
+	buf       bytes.Buffer
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.rdr.Read(p)
+	if r.recording {
+		r.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// take returns what was recorded since the last call.
+func (r *recorder) take() []byte {
+	out := append([]byte(nil), r.buf.Bytes()...)
+	r.buf.Reset()
+	return out
+}
+
+// walkRawTarball calls fn for every entry inside the tarball artifact at the given path, along
+// with the exact bytes of its headers and of the padding that followed the body of the previous
+// entry. Once there are no entries left, end is called with the padding of the last entry and the
+// bytes that end the archive. Together they make up the tarball byte for byte.
+func walkRawTarball(pkg types.Package, name string, fn func(header *tar.Header, rawHeader, prevPadding []byte, body io.Reader) error, end func(lastPadding, trailer []byte) error) error {
+	artifact := &types.Artifact{Name: name}
+	if err := pkg.Get(artifact); err != nil {
+		return err
+	}
+	defer artifact.Body.Close()
+	rec := &recorder{rdr: artifact.Body}
+	rdr := tar.NewReader(rec)
+	var padding int64
+	for {
+		rec.recording = true
+		header, err := rdr.Next()
+		raw := rec.take()
+		rec.recording = false
+		if err == io.EOF {
+			rec.recording = true
+			if _, err := io.Copy(ioutil.Discard, rec); err != nil {
+				return fmt.Errorf("reading %s: %s", name, err.Error())
+			}
+			trailer := append(raw, rec.take()...)
+			return end(trailer[:padding], trailer[padding:])
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %s", name, err.Error())
+		}
+		if err := fn(header, raw[padding:], raw[:padding], rdr); err != nil {
+			return err
+		}
+		// the rest of the body must not end up in the headers of the next entry
+		if _, err := io.Copy(ioutil.Discard, rdr); err != nil {
+			return fmt.Errorf("reading %s: %s", name, err.Error())
+		}
+		padding = blockPadding(header.Size)
+	}
+}
+
+// spooledEntry is an entry from a base tarball written to a temporary file.
+type spooledEntry struct {
+	*os.File
+	tmpDir string
+}
+
+func (s *spooledEntry) Close() error {
+	defer os.RemoveAll(s.tmpDir)
+	return s.File.Close()
+}
+
+// readEntry writes the contents of an entry from a base tarball to a temporary file, verifying
+// them against what was recorded when the delta was built.
+func readEntry(name string, rdr io.Reader, entry types.DeltaEntry) (*spooledEntry, error) {
+	tmpDir, err := util.GetTempDir()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path.Join(tmpDir, "entry"))
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	spooled := &spooledEntry{File: f, tmpDir: tmpDir}
+	digest := &types.ArtifactDigest{SHA256: entry.SHA256, Size: entry.Size}
+	if _, err := io.Copy(f, util.NewDigestReader(path.Join(entry.Artifact, name), rdr, nil, digest)); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
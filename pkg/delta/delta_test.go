@@ -0,0 +1,262 @@
+package delta
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestDelta(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Delta Suite")
+}
+
+// layer returns the contents of a fake image layer large enough to be taken from a base package.
+func layer(s string) string { return strings.Repeat(s, minEntrySize) }
+
+func imageTarball(entries map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"manifest.json", "layer1/layer.tar", "layer2/layer.tar", "layer3/layer.tar"} {
+		body, ok := entries[name]
+		if !ok {
+			continue
+		}
+		Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg})).To(Succeed())
+		_, err := tw.Write([]byte(body))
+		Expect(err).ToNot(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+func tarEntries(body io.ReadCloser) map[string]string {
+	defer body.Close()
+	out := make(map[string]string)
+	rdr := tar.NewReader(body)
+	for {
+		header, err := rdr.Next()
+		if err == io.EOF {
+			return out
+		}
+		Expect(err).ToNot(HaveOccurred())
+		contents, err := ioutil.ReadAll(rdr)
+		Expect(err).ToNot(HaveOccurred())
+		out[header.Name] = string(contents)
+	}
+}
+
+// newPackage writes the given artifacts to a package and loads it back from its archive.
+func newPackage(name, version, manifest string, image []byte, extra ...*types.Artifact) types.Package {
+	tmpDir, err := ioutil.TempDir("", "")
+	Expect(err).ToNot(HaveOccurred())
+	writer := v2.New(tmpDir)
+	defer writer.Close()
+	for _, artifact := range append([]*types.Artifact{
+		{Type: types.ArtifactBin, Name: "k3s", Body: ioutil.NopCloser(strings.NewReader("k3s")), Size: 3},
+		{Type: types.ArtifactImages, Name: "app.tar", Body: ioutil.NopCloser(bytes.NewReader(image)), Size: int64(len(image))},
+		{Type: types.ArtifactManifest, Name: "app.yaml", Body: ioutil.NopCloser(strings.NewReader(manifest)), Size: int64(len(manifest))},
+	}, extra...) {
+		Expect(writer.Put(artifact)).To(Succeed())
+	}
+	Expect(writer.PutMeta(&types.PackageMeta{Name: name, Version: version})).To(Succeed())
+	return reload(writer)
+}
+
+func reload(pkg types.Package) types.Package {
+	archive, err := pkg.Archive()
+	Expect(err).ToNot(HaveOccurred())
+	loaded, err := v2.Load(ioutil.NopCloser(archive.Reader()))
+	Expect(err).ToNot(HaveOccurred())
+	return loaded
+}
+
+func newWriter() types.Package {
+	tmpDir, err := ioutil.TempDir("", "")
+	Expect(err).ToNot(HaveOccurred())
+	return v2.New(tmpDir)
+}
+
+var _ = Describe("Delta packages", func() {
+	var base, release, delta types.Package
+
+	baseImage := map[string]string{
+		"manifest.json":    "base",
+		"layer1/layer.tar": layer("a"),
+		"layer2/layer.tar": layer("b"),
+	}
+	releaseImage := map[string]string{
+		"manifest.json":    "release",
+		"layer1/layer.tar": layer("a"),
+		"layer3/layer.tar": layer("c"),
+	}
+
+	BeforeEach(func() {
+		base = newPackage("app", "v1", "v1", imageTarball(baseImage))
+		release = newPackage("app", "v2", "v2", imageTarball(releaseImage))
+		out := newWriter()
+		defer out.Close()
+		Expect(Build(release, base, out)).To(Succeed())
+		delta = reload(out)
+	})
+
+	AfterEach(func() {
+		base.Close()
+		release.Close()
+		delta.Close()
+	})
+
+	It("Should only include what changed since the base", func() {
+		meta := delta.GetMeta()
+		Expect(meta.IsDelta()).To(BeTrue())
+		Expect(meta.Base.Version).To(Equal("v1"))
+		digests := meta.GetManifest().Digests
+		Expect(digests).To(HaveLen(3))
+		Expect(digests["bin/k3s"].Base).To(BeTrue())
+		Expect(digests["manifests/app.yaml"].Base).To(BeFalse())
+		Expect(digests["images/app.tar"].Delta.BaseEntries).To(HaveKey("layer1/layer.tar"))
+
+		Expect(delta.Get(&types.Artifact{Type: types.ArtifactBin, Name: "k3s"})).ToNot(Succeed())
+		image := &types.Artifact{Type: types.ArtifactImages, Name: "app.tar"}
+		Expect(delta.Get(image)).To(Succeed())
+		Expect(tarEntries(image.Body)).ToNot(HaveKey("layer1/layer.tar"))
+	})
+
+	It("Should restore the full package from the base", func() {
+		out := newWriter()
+		defer out.Close()
+		Expect(Apply(delta, base, out)).To(Succeed())
+		combined := reload(out)
+		defer combined.Close()
+
+		meta := combined.GetMeta()
+		Expect(meta.IsDelta()).To(BeFalse())
+		Expect(meta.Version).To(Equal("v2"))
+		Expect(combined.Verify()).To(Succeed())
+
+		image := &types.Artifact{Type: types.ArtifactImages, Name: "app.tar"}
+		Expect(combined.Get(image)).To(Succeed())
+		Expect(tarEntries(image.Body)).To(Equal(releaseImage))
+		for _, artifact := range []*types.Artifact{
+			{Type: types.ArtifactBin, Name: "k3s"},
+			{Type: types.ArtifactManifest, Name: "app.yaml"},
+		} {
+			Expect(combined.Get(artifact)).To(Succeed())
+			body, err := ioutil.ReadAll(artifact.Body)
+			Expect(err).ToNot(HaveOccurred())
+			artifact.Body.Close()
+			Expect(string(body)).To(BeElementOf("k3s", "v2"))
+		}
+	})
+
+	It("Should round trip changed, unchanged and removed artifacts", func() {
+		base := newPackage("app", "v1", "v1", imageTarball(baseImage), &types.Artifact{
+			Type: types.ArtifactScript, Name: "old.sh", Body: ioutil.NopCloser(strings.NewReader("old")), Size: 3,
+		})
+		defer base.Close()
+		out := newWriter()
+		defer out.Close()
+		Expect(Build(release, base, out)).To(Succeed())
+		delta := reload(out)
+		defer delta.Close()
+
+		deltaManifest := delta.GetMeta().GetManifest()
+		Expect(deltaManifest.Bins).To(Equal([]string{"k3s"}))
+		Expect(deltaManifest.K8sManifests).To(Equal([]string{"app.yaml"}))
+		Expect(deltaManifest.Scripts).To(BeEmpty())
+		Expect(deltaManifest.Digests).ToNot(HaveKey("scripts/old.sh"))
+		Expect(deltaManifest.Digests["bin/k3s"].Base).To(BeTrue())
+		Expect(deltaManifest.Digests["manifests/app.yaml"].SHA256).To(Equal(release.GetMeta().GetManifest().Digests["manifests/app.yaml"].SHA256))
+
+		combinedOut := newWriter()
+		defer combinedOut.Close()
+		Expect(Apply(delta, base, combinedOut)).To(Succeed())
+		combined := reload(combinedOut)
+		defer combined.Close()
+		Expect(combined.Verify()).To(Succeed())
+
+		manifest := combined.GetMeta().GetManifest()
+		releaseDigests := release.GetMeta().GetManifest().Digests
+		Expect(manifest.Bins).To(Equal([]string{"k3s"}))
+		Expect(manifest.Images).To(Equal([]string{"app.tar"}))
+		Expect(manifest.K8sManifests).To(Equal([]string{"app.yaml"}))
+		Expect(manifest.Scripts).To(BeEmpty())
+		Expect(manifest.Digests).To(HaveLen(3))
+		for _, name := range []string{"bin/k3s", "manifests/app.yaml"} {
+			Expect(manifest.Digests[name].SHA256).To(Equal(releaseDigests[name].SHA256), name)
+			Expect(manifest.Digests[name].Base).To(BeFalse(), name)
+		}
+		Expect(manifest.Digests["images/app.tar"].Delta).To(BeNil())
+		image := &types.Artifact{Type: types.ArtifactImages, Name: "app.tar"}
+		Expect(combined.Get(image)).To(Succeed())
+		Expect(tarEntries(image.Body)).To(Equal(releaseImage))
+	})
+
+	It("Should restore the release exactly so deltas can be chained", func() {
+		out := newWriter()
+		defer out.Close()
+		Expect(Apply(delta, base, out)).To(Succeed())
+		combined := reload(out)
+		defer combined.Close()
+
+		releaseDigests := release.GetMeta().GetManifest().Digests
+		for name, digest := range combined.GetMeta().GetManifest().Digests {
+			Expect(digest.SHA256).To(Equal(releaseDigests[name].SHA256), name)
+		}
+		releaseMetaDigest, err := MetaDigest(release)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(MetaDigest(combined)).To(Equal(releaseMetaDigest))
+
+		nextImage := map[string]string{
+			"manifest.json":    "next",
+			"layer1/layer.tar": layer("a"),
+			"layer2/layer.tar": layer("d"),
+			"layer3/layer.tar": layer("c"),
+		}
+		next := newPackage("app", "v3", "v3", imageTarball(nextImage))
+		defer next.Close()
+		nextOut := newWriter()
+		defer nextOut.Close()
+		Expect(Build(next, release, nextOut)).To(Succeed())
+		nextDelta := reload(nextOut)
+		defer nextDelta.Close()
+		Expect(nextDelta.GetMeta().GetManifest().Digests["images/app.tar"].Delta.BaseEntries).To(HaveLen(2))
+
+		// the second delta was built against the release, but applies to the combined package
+		finalOut := newWriter()
+		defer finalOut.Close()
+		Expect(Apply(nextDelta, combined, finalOut)).To(Succeed())
+		final := reload(finalOut)
+		defer final.Close()
+		Expect(final.Verify()).To(Succeed())
+		Expect(final.GetMeta().Version).To(Equal("v3"))
+		nextDigests := next.GetMeta().GetManifest().Digests
+		for name, digest := range final.GetMeta().GetManifest().Digests {
+			Expect(digest.SHA256).To(Equal(nextDigests[name].SHA256), name)
+		}
+		image := &types.Artifact{Type: types.ArtifactImages, Name: "app.tar"}
+		Expect(final.Get(image)).To(Succeed())
+		Expect(tarEntries(image.Body)).To(Equal(nextImage))
+	})
+
+	It("Should refuse a base it was not built against", func() {
+		other := newPackage("app", "v1", "v1-modified", imageTarball(baseImage))
+		defer other.Close()
+		out := newWriter()
+		defer out.Close()
+		err := Apply(delta, other, out)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("The delta was built against app v1"))
+	})
+})
@@ -0,0 +1,412 @@
+package diff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/yaml.v2"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/images"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// ChangeType describes how something differs between two packages.
+type ChangeType string
+
+// Ways something can differ between two packages
+const (
+	ChangeAdded   ChangeType = "added"
+	ChangeRemoved ChangeType = "removed"
+	ChangeChanged ChangeType = "changed"
+)
+
+// Result contains the differences between two packages.
+type Result struct {
+	// The package that was compared from
+	From PackageRef `json:"from"`
+	// The package that was compared to
+	To PackageRef `json:"to"`
+	// Set when the packages bundle different versions of k3s
+	K3sVersion *Change `json:"k3sVersion,omitempty"`
+	// Set when the packages were built for different architectures
+	Arch *Change `json:"arch,omitempty"`
+	// Artifacts that were added, removed, or whose contents changed
+	Artifacts []ArtifactChange `json:"artifacts,omitempty"`
+	// Container images only bundled in the package compared to
+	AddedImages []string `json:"addedImages,omitempty"`
+	// Container images only bundled in the package compared from
+	RemovedImages []string `json:"removedImages,omitempty"`
+	// Unified diffs of the kubernetes manifests that changed
+	Manifests []FileDiff `json:"manifests,omitempty"`
+	// Variables that were added, removed, or whose defaults changed
+	Variables []VariableChange `json:"variables,omitempty"`
+	// Unified diffs of the helm values that changed, by chart
+	HelmValues []FileDiff `json:"helmValues,omitempty"`
+}
+
+// PackageRef identifies one of the compared packages.
+type PackageRef struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Change is a value that differs between two packages.
+type Change struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ArtifactChange is an artifact that differs between two packages. The digest and size of
+// the side the artifact is missing from are left empty.
+type ArtifactChange struct {
+	Type       types.ArtifactType `json:"type"`
+	Name       string             `json:"name"`
+	Change     ChangeType         `json:"change"`
+	FromSHA256 string             `json:"fromSHA256,omitempty"`
+	ToSHA256   string             `json:"toSHA256,omitempty"`
+	FromSize   int64              `json:"fromSize,omitempty"`
+	ToSize     int64              `json:"toSize,omitempty"`
+}
+
+// FileDiff is a unified diff of a file that changed between two packages.
+type FileDiff struct {
+	Name string `json:"name"`
+	Diff string `json:"diff"`
+}
+
+// VariableChange is a package variable that differs between two packages.
+type VariableChange struct {
+	Name        string     `json:"name"`
+	Change      ChangeType `json:"change"`
+	FromDefault string     `json:"fromDefault,omitempty"`
+	ToDefault   string     `json:"toDefault,omitempty"`
+}
+
+// IsEmpty returns true if no differences were found between the packages.
+func (r *Result) IsEmpty() bool {
+	return r.K3sVersion == nil && r.Arch == nil && len(r.Artifacts) == 0 &&
+		len(r.AddedImages) == 0 && len(r.RemovedImages) == 0 && len(r.Manifests) == 0 &&
+		len(r.Variables) == 0 && len(r.HelmValues) == 0
+}
+
+// Packages compares the contents of two packages. Artifacts are compared by their digests,
+// and the images in every image tarball are read to find the ones that were added or removed.
+// Delta packages must be combined with their base before they can be compared.
+func Packages(from, to types.Package) (*Result, error) {
+	fromMeta, toMeta := from.GetMeta(), to.GetMeta()
+	for _, meta := range []*types.PackageMeta{fromMeta, toMeta} {
+		if meta.IsDelta() {
+			return nil, fmt.Errorf("%s is a delta package and must be combined with its base before it can be compared", meta.GetName())
+		}
+	}
+
+	res := &Result{
+		From:       PackageRef{Name: fromMeta.GetName(), Version: fromMeta.GetVersion()},
+		To:         PackageRef{Name: toMeta.GetName(), Version: toMeta.GetVersion()},
+		K3sVersion: compare(fromMeta.GetK3sVersion(), toMeta.GetK3sVersion()),
+		Arch:       compare(fromMeta.GetArch(), toMeta.GetArch()),
+	}
+
+	fromArtifacts, err := listArtifacts(from)
+	if err != nil {
+		return nil, err
+	}
+	toArtifacts, err := listArtifacts(to)
+	if err != nil {
+		return nil, err
+	}
+
+	fromImages, toImages := make(map[string]struct{}), make(map[string]struct{})
+	for _, key := range unionKeys(fromArtifacts, toArtifacts) {
+		a, inFrom := fromArtifacts[key]
+		b, inTo := toArtifacts[key]
+		switch {
+		case !inTo:
+			res.Artifacts = append(res.Artifacts, ArtifactChange{Type: a.t, Name: a.name, Change: ChangeRemoved, FromSHA256: a.sha256, FromSize: a.size})
+		case !inFrom:
+			res.Artifacts = append(res.Artifacts, ArtifactChange{Type: b.t, Name: b.name, Change: ChangeAdded, ToSHA256: b.sha256, ToSize: b.size})
+		case a.sha256 != b.sha256:
+			res.Artifacts = append(res.Artifacts, ArtifactChange{
+				Type: a.t, Name: a.name, Change: ChangeChanged,
+				FromSHA256: a.sha256, ToSHA256: b.sha256, FromSize: a.size, ToSize: b.size,
+			})
+		}
+
+		t, _ := v1.ArtifactFromPath(key)
+		switch {
+		case t == types.ArtifactImages && inFrom && inTo && a.sha256 == b.sha256:
+			// image tarballs that did not change only need to be read once
+			if err := readImages(to, b, fromImages, toImages); err != nil {
+				return nil, err
+			}
+		case t == types.ArtifactImages:
+			if inFrom {
+				if err := readImages(from, a, fromImages); err != nil {
+					return nil, err
+				}
+			}
+			if inTo {
+				if err := readImages(to, b, toImages); err != nil {
+					return nil, err
+				}
+			}
+		case t == types.ArtifactManifest && inFrom && inTo && a.sha256 != b.sha256:
+			fileDiff, err := diffArtifacts(from, to, fromMeta, toMeta, a, b)
+			if err != nil {
+				return nil, err
+			}
+			if fileDiff != nil {
+				res.Manifests = append(res.Manifests, *fileDiff)
+			}
+		}
+	}
+	res.AddedImages = difference(toImages, fromImages)
+	res.RemovedImages = difference(fromImages, toImages)
+
+	res.Variables = diffVariables(fromMeta.GetPackageConfig(), toMeta.GetPackageConfig())
+	res.HelmValues, err = diffHelmValues(fromMeta, toMeta)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func compare(from, to string) *Change {
+	if from == to {
+		return nil
+	}
+	return &Change{From: from, To: to}
+}
+
+// artifact is an artifact listed in the manifest of a package.
+type artifact struct {
+	t      types.ArtifactType
+	name   string
+	sha256 string
+	size   int64
+}
+
+// listArtifacts returns every artifact in the package keyed by its path inside the archive.
+// Packages that were built before digests were recorded have their artifacts hashed instead.
+func listArtifacts(pkg types.Package) (map[string]*artifact, error) {
+	manifest := pkg.GetMeta().GetManifest()
+	listings := []struct {
+		t     types.ArtifactType
+		names []string
+	}{
+		{types.ArtifactBin, manifest.Bins},
+		{types.ArtifactScript, manifest.Scripts},
+		{types.ArtifactImages, manifest.Images},
+		{types.ArtifactManifest, manifest.K8sManifests},
+		{types.ArtifactStatic, manifest.Static},
+		{types.ArtifactEtc, manifest.Etc},
+		{types.ArtifactSBOM, manifest.SBOM},
+	}
+	if manifest.HasEULA() {
+		listings = append(listings, struct {
+			t     types.ArtifactType
+			names []string
+		}{types.ArtifactEULA, []string{types.ManifestEULAFile}})
+	}
+	out := make(map[string]*artifact)
+	for _, listing := range listings {
+		for _, name := range listing.names {
+			a := &artifact{t: listing.t, name: name}
+			key := v1.ArtifactPath(&types.Artifact{Type: listing.t, Name: name})
+			if digest, ok := manifest.Digests[key]; ok {
+				a.sha256, a.size = digest.SHA256, digest.Size
+			} else {
+				log.Debugf("No digest is recorded for %q, computing one\n", key)
+				var err error
+				if a.sha256, a.size, err = hashArtifact(pkg, listing.t, name); err != nil {
+					return nil, err
+				}
+			}
+			out[key] = a
+		}
+	}
+	return out, nil
+}
+
+func hashArtifact(pkg types.Package, t types.ArtifactType, name string) (string, int64, error) {
+	a := &types.Artifact{Type: t, Name: name}
+	if err := pkg.Get(a); err != nil {
+		return "", 0, err
+	}
+	defer a.Body.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, a.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// readImages adds the names of the images in the given image tarball to every set.
+func readImages(pkg types.Package, a *artifact, sets ...map[string]struct{}) error {
+	out := &types.Artifact{Type: a.t, Name: a.name}
+	if err := pkg.Get(out); err != nil {
+		return err
+	}
+	// image tarballs can be large, so they are streamed rather than read into memory
+	names, err := images.NamesFromTar(out.Body)
+	if err != nil {
+		log.Warningf("Could not read the images in %q: %s\n", a.name, err.Error())
+		return nil
+	}
+	for _, name := range names {
+		for _, set := range sets {
+			set[name] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// getBody reads the full contents of an artifact. It is only meant for manifests, image tarballs
+// should be streamed.
+func getBody(pkg types.Package, a *artifact) ([]byte, error) {
+	out := &types.Artifact{Type: a.t, Name: a.name}
+	if err := pkg.Get(out); err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+// diffArtifacts returns a unified diff of an artifact in both packages, or nil if either of
+// them is not text.
+func diffArtifacts(from, to types.Package, fromMeta, toMeta *types.PackageMeta, a, b *artifact) (*FileDiff, error) {
+	fromBody, err := getBody(from, a)
+	if err != nil {
+		return nil, err
+	}
+	toBody, err := getBody(to, b)
+	if err != nil {
+		return nil, err
+	}
+	if isBinary(fromBody) || isBinary(toBody) {
+		return nil, nil
+	}
+	return unified(a.name, fromMeta, toMeta, fromBody, toBody)
+}
+
+// diffVariables compares the variables declared by two package configurations by name.
+func diffVariables(from, to *types.PackageConfig) []VariableChange {
+	fromVars, toVars := variables(from), variables(to)
+	var out []VariableChange
+	for _, name := range unionKeys(fromVars, toVars) {
+		a, inFrom := fromVars[name]
+		b, inTo := toVars[name]
+		switch {
+		case !inTo:
+			out = append(out, VariableChange{Name: name, Change: ChangeRemoved, FromDefault: a.Default})
+		case !inFrom:
+			out = append(out, VariableChange{Name: name, Change: ChangeAdded, ToDefault: b.Default})
+		case a.Default != b.Default:
+			out = append(out, VariableChange{Name: name, Change: ChangeChanged, FromDefault: a.Default, ToDefault: b.Default})
+		}
+	}
+	return out
+}
+
+func variables(cfg *types.PackageConfig) map[string]types.PackageVariable {
+	out := make(map[string]types.PackageVariable)
+	if cfg == nil {
+		return out
+	}
+	for _, v := range cfg.Variables {
+		out[v.Name] = v
+	}
+	return out
+}
+
+// diffHelmValues returns unified diffs of the helm values for every chart that changed
+// between two packages.
+func diffHelmValues(fromMeta, toMeta *types.PackageMeta) ([]FileDiff, error) {
+	fromValues, toValues := helmValues(fromMeta.GetPackageConfig()), helmValues(toMeta.GetPackageConfig())
+	var out []FileDiff
+	for _, chart := range unionKeys(fromValues, toValues) {
+		fromBody, err := marshalValues(fromValues[chart])
+		if err != nil {
+			return nil, err
+		}
+		toBody, err := marshalValues(toValues[chart])
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(fromBody, toBody) {
+			continue
+		}
+		fileDiff, err := unified(chart, fromMeta, toMeta, fromBody, toBody)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *fileDiff)
+	}
+	return out, nil
+}
+
+func helmValues(cfg *types.PackageConfig) map[string]interface{} {
+	if cfg == nil || cfg.HelmValues == nil {
+		return map[string]interface{}{}
+	}
+	return cfg.HelmValues
+}
+
+func marshalValues(values interface{}) ([]byte, error) {
+	if values == nil {
+		return nil, nil
+	}
+	return yaml.Marshal(values)
+}
+
+// unified returns a unified diff of the two versions of a file. The files are labeled with the
+// versions of the packages they came from.
+func unified(name string, fromMeta, toMeta *types.PackageMeta, fromBody, toBody []byte) (*FileDiff, error) {
+	out, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(fromBody)),
+		B:        difflib.SplitLines(string(toBody)),
+		FromFile: fmt.Sprintf("%s/%s", fromMeta.GetVersion(), name),
+		ToFile:   fmt.Sprintf("%s/%s", toMeta.GetVersion(), name),
+		Context:  3,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &FileDiff{Name: name, Diff: out}, nil
+}
+
+func isBinary(body []byte) bool { return bytes.IndexByte(body, 0) != -1 }
+
+// unionKeys returns the sorted keys present in any of the given maps, which must be keyed by
+// strings.
+func unionKeys(maps ...interface{}) []string {
+	seen := make(map[string]struct{})
+	for _, m := range maps {
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			seen[k.String()] = struct{}{}
+		}
+	}
+	return difference(seen, nil)
+}
+
+// difference returns the sorted keys of a that are not in b.
+func difference(a, b map[string]struct{}) []string {
+	out := make([]string, 0)
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
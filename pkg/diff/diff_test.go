@@ -0,0 +1,148 @@
+package diff
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestDiff(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Diff Suite")
+}
+
+// imageTarball returns a tarball like the ones produced by docker save for the given images.
+func imageTarball(images ...string) string {
+	manifest, err := json.Marshal([]map[string][]string{{"RepoTags": images}})
+	Expect(err).ToNot(HaveOccurred())
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	Expect(tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest)), Typeflag: tar.TypeReg})).To(Succeed())
+	_, err = tw.Write(manifest)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(tw.Close()).To(Succeed())
+	return buf.String()
+}
+
+func newPackage(version, k3sVersion, config string, files map[string]string) types.Package {
+	tmpDir, err := ioutil.TempDir("", "")
+	Expect(err).ToNot(HaveOccurred())
+	pkg := v2.New(tmpDir)
+	for tarPath, body := range files {
+		spl := strings.SplitN(tarPath, "/", 2)
+		typ := map[string]types.ArtifactType{"bin": types.ArtifactBin, "images": types.ArtifactImages, "manifests": types.ArtifactManifest}[spl[0]]
+		Expect(pkg.Put(&types.Artifact{Type: typ, Name: spl[1], Body: ioutil.NopCloser(strings.NewReader(body)), Size: int64(len(body))})).To(Succeed())
+	}
+	meta := &types.PackageMeta{Name: "app", Version: version, K3sVersion: k3sVersion, Arch: "amd64"}
+	if config != "" {
+		meta.PackageConfig, err = types.PackageConfigFromReader(strings.NewReader(config))
+		Expect(err).ToNot(HaveOccurred())
+	}
+	Expect(pkg.PutMeta(meta)).To(Succeed())
+	return pkg
+}
+
+const configV1 = `
+variables:
+  - name: domain
+    default: example.com
+  - name: replicas
+    default: "1"
+helmValues:
+  app:
+    replicas: 1
+`
+
+const configV2 = `
+variables:
+  - name: domain
+    default: example.org
+  - name: storage-class
+helmValues:
+  app:
+    replicas: 2
+`
+
+var _ = Describe("Comparing packages", func() {
+	var v1, v2 types.Package
+
+	BeforeEach(func() {
+		v1 = newPackage("v1", "v1.19.4+k3s1", configV1, map[string]string{
+			"bin/k3s":                    "k3s",
+			"images/manifest-images.tar": imageTarball("app:v1", "redis:6"),
+			"manifests/app.yaml":         "kind: Deployment\nimage: app:v1\nreplicas: 1\n",
+			"manifests/old.yaml":         "kind: ConfigMap\n",
+		})
+		v2 = newPackage("v2", "v1.20.0+k3s1", configV2, map[string]string{
+			"bin/k3s":                    "k3s",
+			"images/manifest-images.tar": imageTarball("app:v2", "redis:6"),
+			"manifests/app.yaml":         "kind: Deployment\nimage: app:v2\nreplicas: 1\n",
+			"manifests/new.yaml":         "kind: Secret\n",
+		})
+	})
+
+	AfterEach(func() {
+		v1.Close()
+		v2.Close()
+	})
+
+	It("Should report what changed between the packages", func() {
+		res, err := Packages(v1, v2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IsEmpty()).To(BeFalse())
+		Expect(res.K3sVersion).To(Equal(&Change{From: "v1.19.4+k3s1", To: "v1.20.0+k3s1"}))
+		Expect(res.Arch).To(BeNil())
+
+		changes := make(map[string]ChangeType)
+		for _, change := range res.Artifacts {
+			changes[string(change.Type)+"/"+change.Name] = change.Change
+		}
+		Expect(changes).To(Equal(map[string]ChangeType{
+			"images/manifest-images.tar": ChangeChanged,
+			"manifest/app.yaml":          ChangeChanged,
+			"manifest/new.yaml":          ChangeAdded,
+			"manifest/old.yaml":          ChangeRemoved,
+		}))
+
+		Expect(res.AddedImages).To(Equal([]string{"app:v2"}))
+		Expect(res.RemovedImages).To(Equal([]string{"app:v1"}))
+
+		Expect(res.Manifests).To(HaveLen(1))
+		Expect(res.Manifests[0].Name).To(Equal("app.yaml"))
+		Expect(res.Manifests[0].Diff).To(ContainSubstring("--- v1/app.yaml\n+++ v2/app.yaml\n"))
+		Expect(res.Manifests[0].Diff).To(ContainSubstring("-image: app:v1\n+image: app:v2\n"))
+
+		Expect(res.Variables).To(Equal([]VariableChange{
+			{Name: "domain", Change: ChangeChanged, FromDefault: "example.com", ToDefault: "example.org"},
+			{Name: "replicas", Change: ChangeRemoved, FromDefault: "1"},
+			{Name: "storage-class", Change: ChangeAdded},
+		}))
+
+		Expect(res.HelmValues).To(HaveLen(1))
+		Expect(res.HelmValues[0].Name).To(Equal("app"))
+		Expect(res.HelmValues[0].Diff).To(ContainSubstring("-replicas: 1\n+replicas: 2\n"))
+	})
+
+	It("Should find no differences between the same package", func() {
+		res, err := Packages(v1, v1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.IsEmpty()).To(BeTrue())
+	})
+
+	It("Should refuse to compare delta packages", func() {
+		Expect(v2.PutMeta(&types.PackageMeta{Base: &types.PackageBase{Name: "app", Version: "v1"}})).To(Succeed())
+		_, err := Packages(v1, v2)
+		Expect(err).To(MatchError("app is a delta package and must be combined with its base before it can be compared"))
+	})
+})
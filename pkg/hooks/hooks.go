@@ -0,0 +1,79 @@
+package hooks
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// Phases returns the phases to run before and after k3s is installed with the given options.
+// Installations that join an existing server run the join hooks.
+func Phases(opts *types.InstallOptions) (pre, post types.HookPhase) {
+	if opts.ServerURL != "" {
+		return types.HookPreJoin, types.HookPostJoin
+	}
+	return types.HookPreInstall, types.HookPostInstall
+}
+
+// JoinOptions returns the options join hooks run with on a node joining the cluster. They are
+// derived from the options the leader was installed with, but describe the new node.
+func JoinOptions(installed *types.InstallOptions, nodeName string, role types.K3sRole) *types.InstallOptions {
+	opts := installed.DeepCopy()
+	opts.NodeName = nodeName
+	opts.K3sRole = role
+	return opts
+}
+
+// Run runs the hook for the given phase declared by the package with the given metadata on the
+// node, if there is one. The hook script must already be installed to the node. The package
+// variables and details about the node are passed to the script in its environment.
+func Run(target types.Node, meta *types.PackageMeta, phase types.HookPhase, opts *types.InstallOptions) error {
+	cfg := meta.GetPackageConfig()
+	if cfg == nil {
+		return nil
+	}
+	hook := cfg.Hooks.Get(phase)
+	if hook == nil {
+		return nil
+	}
+	log.Infof("Running the %s hook\n", phase)
+	err := target.Execute(&types.ExecuteOptions{
+		Env:     Env(meta, phase, opts),
+		Command: fmt.Sprintf("sh %q", path.Join(types.K3sScriptsDir, types.HookScriptName(phase))),
+	})
+	if err == nil {
+		return nil
+	}
+	if hook.OnFailure == types.HookFailurePolicyIgnore {
+		log.Warningf("The %s hook failed, continuing the installation: %s\n", phase, err.Error())
+		return nil
+	}
+	return fmt.Errorf("The %s hook failed: %s", phase, err.Error())
+}
+
+// Env returns the environment hook scripts run with. Each package variable is available as
+// K3P_VAR_<NAME>, with its name upper-cased and any characters that are not valid in environment
+// variables replaced with underscores.
+func Env(meta *types.PackageMeta, phase types.HookPhase, opts *types.InstallOptions) map[string]string {
+	role := opts.K3sRole
+	if role == "" {
+		role = types.K3sRoleServer
+	}
+	env := map[string]string{
+		"K3P_HOOK":            string(phase),
+		"K3P_PACKAGE_NAME":    meta.GetName(),
+		"K3P_PACKAGE_VERSION": meta.GetVersion(),
+		"K3P_NODE_ROLE":       string(role),
+		"K3P_NODE_NAME":       opts.NodeName,
+	}
+	for name, value := range opts.Variables {
+		env["K3P_VAR_"+reInvalidEnvChars.ReplaceAllString(strings.ToUpper(name), "_")] = value
+	}
+	return env
+}
+
+var reInvalidEnvChars = regexp.MustCompile(`[^A-Z0-9_]`)
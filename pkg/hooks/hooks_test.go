@@ -0,0 +1,94 @@
+package hooks
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/tinyzimmer/k3p/pkg/cluster/node"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestHooks(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Hooks Suite")
+}
+
+// recordingNode records the commands executed on it, failing them when err is set.
+type recordingNode struct {
+	types.Node
+	executed []*types.ExecuteOptions
+	err      error
+}
+
+func (r *recordingNode) Execute(opts *types.ExecuteOptions) error {
+	r.executed = append(r.executed, opts)
+	return r.err
+}
+
+func metaWith(hooks *types.Hooks) *types.PackageMeta {
+	return &types.PackageMeta{Name: "app", Version: "v1.0.0", PackageConfig: &types.PackageConfig{Hooks: hooks}}
+}
+
+var _ = Describe("Hooks", func() {
+	var target *recordingNode
+
+	BeforeEach(func() { target = &recordingNode{Node: node.Mock()} })
+
+	AfterEach(func() { target.Close() })
+
+	It("Should run the installed script with the package variables", func() {
+		meta := metaWith(&types.Hooks{PreInstall: &types.Hook{Script: "hooks/pre.sh"}})
+		opts := &types.InstallOptions{NodeName: "node-1", Variables: map[string]string{"data-disk": "/dev/sdb"}}
+		Expect(Run(target, meta, types.HookPreInstall, opts)).To(Succeed())
+		Expect(Run(target, meta, types.HookPostInstall, opts)).To(Succeed())
+
+		Expect(target.executed).To(HaveLen(1))
+		Expect(target.executed[0].Command).To(Equal(`sh "/usr/local/bin/k3p-scripts/hook-preInstall.sh"`))
+		Expect(target.executed[0].Env).To(Equal(map[string]string{
+			"K3P_HOOK":            "preInstall",
+			"K3P_PACKAGE_NAME":    "app",
+			"K3P_PACKAGE_VERSION": "v1.0.0",
+			"K3P_NODE_ROLE":       "server",
+			"K3P_NODE_NAME":       "node-1",
+			"K3P_VAR_DATA_DISK":   "/dev/sdb",
+		}))
+	})
+
+	It("Should apply the failure policy of the hook", func() {
+		target.err = errors.New("exit status 1")
+		meta := metaWith(&types.Hooks{
+			PreJoin:  &types.Hook{Script: "pre.sh"},
+			PostJoin: &types.Hook{Script: "post.sh", OnFailure: types.HookFailurePolicyIgnore},
+		})
+		opts := &types.InstallOptions{K3sRole: types.K3sRoleAgent}
+		Expect(Run(target, meta, types.HookPreJoin, opts)).To(MatchError("The preJoin hook failed: exit status 1"))
+		Expect(Run(target, meta, types.HookPostJoin, opts)).To(Succeed())
+		Expect(target.executed[1].Env).To(HaveKeyWithValue("K3P_NODE_ROLE", "agent"))
+	})
+
+	It("Should run the join hooks for installations joining a server", func() {
+		pre, post := Phases(&types.InstallOptions{ServerURL: "https://10.0.0.1:6443"})
+		Expect([]types.HookPhase{pre, post}).To(Equal([]types.HookPhase{types.HookPreJoin, types.HookPostJoin}))
+		pre, post = Phases(&types.InstallOptions{})
+		Expect([]types.HookPhase{pre, post}).To(Equal([]types.HookPhase{types.HookPreInstall, types.HookPostInstall}))
+	})
+
+	It("Should describe the joining node rather than the leader to join hooks", func() {
+		meta := metaWith(&types.Hooks{PreJoin: &types.Hook{Script: "pre.sh"}})
+		leader := &types.InstallOptions{NodeName: "leader", Variables: map[string]string{"data-disk": "/dev/sdb"}}
+		Expect(Run(target, meta, types.HookPreJoin, JoinOptions(leader, "node-2", types.K3sRoleAgent))).To(Succeed())
+		Expect(Run(target, meta, types.HookPreJoin, JoinOptions(leader, "", types.K3sRoleServer))).To(Succeed())
+
+		Expect(target.executed).To(HaveLen(2))
+		Expect(target.executed[0].Env).To(HaveKeyWithValue("K3P_NODE_NAME", "node-2"))
+		Expect(target.executed[0].Env).To(HaveKeyWithValue("K3P_NODE_ROLE", "agent"))
+		Expect(target.executed[0].Env).To(HaveKeyWithValue("K3P_VAR_DATA_DISK", "/dev/sdb"))
+		Expect(target.executed[1].Env).To(HaveKeyWithValue("K3P_NODE_NAME", ""))
+		Expect(leader.NodeName).To(Equal("leader"))
+	})
+})
@@ -40,10 +40,8 @@ func (d *dockerImageDownloader) BuildRegistry(opts *types.BuildRegistryOptions)
 
 	// Ensure all needed images are present
 	userImages := sanitizeImageNameSlice(opts.Images)
-	for _, img := range append(requiredRegistryImages, userImages...) {
-		if err := ensureImagePulled(cli, img, opts.Arch, opts.PullPolicy); err != nil {
-			return nil, err
-		}
+	if err := ensureImagesPulled(cli, append(requiredRegistryImages, userImages...), opts.Arch, opts.PullPolicy, opts.Parallelism); err != nil {
+		return nil, err
 	}
 
 	log.Info("Starting local private image registry")
@@ -0,0 +1,47 @@
+package images
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+type imageManifest struct {
+	RepoTags []string
+	// not interested in anything else for now
+}
+
+// NamesFromTar returns the names of the images in a tarball produced by docker save. The
+// body is closed when it returns.
+func NamesFromTar(body io.ReadCloser) ([]string, error) {
+	defer body.Close()
+	out := make([]string, 0)
+	reader := tar.NewReader(body)
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("no manifest.json found in the tar archive")
+			}
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || !strings.HasSuffix(header.Name, "manifest.json") {
+			continue
+		}
+		manifestRaw, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		var imgs []imageManifest
+		if err := json.Unmarshal(manifestRaw, &imgs); err != nil {
+			return nil, err
+		}
+		for _, img := range imgs {
+			out = append(out, img.RepoTags...)
+		}
+		return out, nil
+	}
+}
@@ -8,18 +8,16 @@ import (
 	"github.com/tinyzimmer/k3p/pkg/types"
 )
 
-func (d *dockerImageDownloader) SaveImages(images []string, arch string, pullPolicy types.PullPolicy) (io.ReadCloser, error) {
+func (d *dockerImageDownloader) SaveImages(opts *types.SaveImagesOptions) (io.ReadCloser, error) {
 	cli, err := getDockerClient()
 	if err != nil {
 		return nil, err
 	}
 	defer cli.Close()
 
-	images = sanitizeImageNameSlice(images)
-	for _, image := range images {
-		if err := ensureImagePulled(cli, image, arch, pullPolicy); err != nil {
-			return nil, err
-		}
+	images := sanitizeImageNameSlice(opts.Images)
+	if err := ensureImagesPulled(cli, images, opts.Arch, opts.PullPolicy, opts.Parallelism); err != nil {
+		return nil, err
 	}
 
 	log.Debug("Saving images:", images)
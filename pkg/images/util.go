@@ -17,6 +17,7 @@ import (
 
 	"github.com/tinyzimmer/k3p/pkg/log"
 	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
 )
 
 func getDockerClient() (*client.Client, error) {
@@ -50,6 +51,20 @@ func sanitizeImageName(image string) string {
 	return strings.TrimSpace(image)
 }
 
+// ensureImagesPulled ensures the given images are present according to the pull policy, pulling
+// at most parallelism of them at once.
+func ensureImagesPulled(cli *client.Client, images []string, arch string, pullPolicy types.PullPolicy, parallelism int) error {
+	tasks := make([]util.Task, len(images))
+	for i, image := range images {
+		image := image
+		tasks[i] = util.Task{
+			Name: fmt.Sprintf("pulling %s", image),
+			Run:  func() error { return ensureImagePulled(cli, image, arch, pullPolicy) },
+		}
+	}
+	return util.RunTasks(parallelism, tasks)
+}
+
 func ensureImagePulled(cli *client.Client, image, arch string, pullPolicy types.PullPolicy) error {
 	switch pullPolicy {
 	case types.PullPolicyNever:
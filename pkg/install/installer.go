@@ -13,8 +13,13 @@ import (
 	"strings"
 	"time"
 
+	"github.com/tinyzimmer/k3p/pkg/build/package/formats"
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/delta"
+	"github.com/tinyzimmer/k3p/pkg/hooks"
 	"github.com/tinyzimmer/k3p/pkg/images/registry"
 	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/requirements"
 	"github.com/tinyzimmer/k3p/pkg/types"
 	"github.com/tinyzimmer/k3p/pkg/util"
 )
@@ -27,6 +32,25 @@ type installer struct{}
 func (i *installer) Install(target types.Node, pkg types.Package, opts *types.InstallOptions) error {
 	defer pkg.Close()
 
+	// Make sure the package is intact before anything is written to the node
+	if err := pkg.Verify(); err != nil {
+		return err
+	}
+
+	// Delta packages are combined with the release already installed on the node
+	if pkg.GetMeta().IsDelta() {
+		combined, err := combineWithInstalled(target, pkg)
+		if err != nil {
+			return err
+		}
+		defer combined.Close()
+		pkg = combined
+	}
+
+	if err := checkRequirements(target, pkg.GetMeta()); err != nil {
+		return err
+	}
+
 	log.Info("Copying the archive to the rancher installation directory")
 
 	archive, err := pkg.Archive()
@@ -54,11 +78,176 @@ func (i *installer) Install(target types.Node, pkg types.Package, opts *types.In
 		}
 	}
 
-	cfg := pkg.GetMeta().DeepCopy().GetPackageConfig()
+	execOpts, err := prepareNode(target, meta, opts)
+	if err != nil {
+		return err
+	}
+
+	installedConfig := &types.InstallConfig{InstallOptions: opts}
+	log.Debugf("Built installation config %+v\n", installedConfig)
+
+	// unpack the manifest onto the node
+	if err := util.SyncPackageToNode(target, pkg, installedConfig); err != nil {
+		return err
+	}
+
+	return runInstallScript(target, meta, execOpts, opts)
+}
+
+func (i *installer) InstallStream(target types.Node, stream types.PackageStream, opts *types.InstallOptions) error {
+	defer stream.Close()
+
+	meta := stream.GetMeta()
+	if meta.IsDelta() {
+		return errors.New("Delta packages cannot be streamed, they must be combined with the installed package first")
+	}
+	archiveSize := meta.GetManifest().ArchiveSize
+	if archiveSize == 0 {
+		return errors.New("The package does not record its archive size and cannot be streamed")
+	}
+	if err := checkRequirements(target, meta); err != nil {
+		return err
+	}
+
+	// Copy the raw archive to the rancher installation directory while the artifacts are
+	// extracted from it. It is written next to the installed package and only replaces it once
+	// every artifact was verified, so a failed installation leaves the previous one intact.
+	log.Info("Streaming the archive to the rancher installation directory")
+	tmpPackage := util.StagingPath(types.InstalledPackageFile)
+	if err := streamArchiveToNode(target, stream, meta, opts, tmpPackage, archiveSize); err != nil {
+		if rerr := target.Remove(tmpPackage); rerr != nil {
+			log.Warningf("Could not remove %q from the node: %s\n", tmpPackage, rerr.Error())
+		}
+		return err
+	}
+	if err := target.Rename(tmpPackage, types.InstalledPackageFile); err != nil {
+		return err
+	}
+
+	execOpts, err := prepareNode(target, meta, opts)
+	if err != nil {
+		return err
+	}
+
+	installedConfig := &types.InstallConfig{InstallOptions: opts}
+	log.Debugf("Built installation config %+v\n", installedConfig)
+	if err := util.WriteInstallConfig(target, installedConfig); err != nil {
+		return err
+	}
+
+	return runInstallScript(target, meta, execOpts, opts)
+}
+
+// streamArchiveToNode writes the raw archive to the given path on the node while the artifacts in
+// the stream are installed.
+func streamArchiveToNode(target types.Node, stream types.PackageStream, meta *types.PackageMeta, opts *types.InstallOptions, dest string, size int64) error {
+	pr, pw := io.Pipe()
+	archiveErr := make(chan error, 1)
+	go func() {
+		err := target.WriteFile(pr, dest, "0644", size)
+		// unblock the stream if the node stopped reading early
+		pr.CloseWithError(io.ErrClosedPipe)
+		archiveErr <- err
+	}()
+	if err := stream.Tee(pw); err != nil {
+		pw.CloseWithError(err)
+		<-archiveErr
+		return err
+	}
+	if err := syncStreamToNode(target, stream, meta, opts); err != nil {
+		pw.CloseWithError(err)
+		<-archiveErr
+		return err
+	}
+	pw.Close()
+	return <-archiveErr
+}
+
+// checkRequirements makes sure the node and the packages already installed on it meet the
+// requirements of the package, before anything is written to the node.
+func checkRequirements(target types.Node, meta *types.PackageMeta) error {
+	installed, err := util.GetInstalledPackages(target)
+	if err != nil {
+		return err
+	}
+	return requirements.Check(target, meta, installed)
+}
+
+// combineWithInstalled applies the given delta package to the package installed on the node
+// and returns the complete package.
+func combineWithInstalled(target types.Node, pkg types.Package) (types.Package, error) {
+	meta := pkg.GetMeta()
+	log.Infof("Combining delta package with the installed release of %s %s\n", meta.Base.Name, meta.Base.Version)
+	rdr, err := target.GetFile(types.InstalledPackageFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve the installed package from the node: %s", err.Error())
+	}
+	base, err := formats.Load(rdr)
+	if err != nil {
+		return nil, err
+	}
+	defer base.Close()
+	tmpDir, err := util.GetTempDir()
+	if err != nil {
+		return nil, err
+	}
+	combined := v2.New(tmpDir)
+	if err := delta.Apply(pkg, base, combined); err != nil {
+		combined.Close()
+		return nil, err
+	}
+	return combined, nil
+}
+
+// syncStreamToNode writes every artifact in the stream to the node as it is read.
+func syncStreamToNode(target types.Node, stream types.PackageStream, meta *types.PackageMeta, opts *types.InstallOptions) error {
+	nodeArch, err := util.GetNodeArch(target, meta)
+	if err != nil {
+		return err
+	}
+	// the EULA must be accepted before anything is installed
+	eulaAccepted := opts.AcceptEULA || !meta.GetManifest().HasEULA()
+	for {
+		artifact, err := stream.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if artifact.Type == types.ArtifactEULA {
+			if err := promptEULA(artifact, opts.AcceptEULA); err != nil {
+				return err
+			}
+			eulaAccepted = true
+			continue
+		}
+		if !eulaAccepted {
+			return errors.New("The package EULA is not at the start of the archive, it must be accepted with --accept-eula to stream the package")
+		}
+		if !util.IsNodeArtifact(artifact.Type) || !util.IsArtifactForArch(meta, artifact.Name, nodeArch) {
+			// still read it through so it is verified
+			log.Debugf("Skipping %q, it is not installed to this node\n", artifact.Name)
+			if _, err := io.Copy(ioutil.Discard, artifact.Body); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Infof("Installing %s %q\n", artifact.Type, artifact.Name)
+		if err := util.WriteArtifactToNode(target, meta, artifact, opts.Variables); err != nil {
+			return err
+		}
+	}
+}
+
+// prepareNode writes any files to the node that are generated at installation time, and returns
+// the options for running the installation script.
+func prepareNode(target types.Node, meta *types.PackageMeta, opts *types.InstallOptions) (*types.ExecuteOptions, error) {
+	cfg := meta.DeepCopy().GetPackageConfig()
 	log.Debugf("Package configuration: %+v\n", cfg)
 	if cfg != nil {
 		if err := cfg.ApplyVariables(opts.Variables); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	execOpts := opts.ToExecOpts(cfg)
@@ -68,11 +257,9 @@ func (i *installer) Install(target types.Node, pkg types.Package, opts *types.In
 		execOpts.Env["INSTALL_K3S_EXEC"] = execOpts.Env["INSTALL_K3S_EXEC"] + " --cluster-init"
 		// Check if we need to generate an HA token
 		if opts.NodeToken == "" {
-			log.Info("Generating a node token for additional control-plane instances")
-			token := util.GenerateToken(128)
-			log.Debugf("Writing the contents of the server token to %s\n", types.ServerTokenFile)
-			if err := target.WriteFile(ioutil.NopCloser(strings.NewReader(token)), types.ServerTokenFile, "0600", 128); err != nil {
-				return err
+			token, err := getServerToken(target)
+			if err != nil {
+				return nil, err
 			}
 			execOpts.Env["K3S_TOKEN"] = token
 			execOpts.Secrets = append(execOpts.Secrets, token)
@@ -82,24 +269,55 @@ func (i *installer) Install(target types.Node, pkg types.Package, opts *types.In
 	if meta.ImageBundleFormat == types.ImageBundleRegistry {
 		log.Info("Package was generated with private registry")
 		if err := setupPrivateRegistry(target, meta, opts); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	installedConfig := &types.InstallConfig{InstallOptions: opts}
-	log.Debugf("Built installation config %+v\n", installedConfig)
+	return execOpts, nil
+}
 
-	// unpack the manifest onto the node
-	if err := util.SyncPackageToNode(target, pkg, installedConfig); err != nil {
-		return err
+// getServerToken returns the server token already on the node, so upgrades keep the existing
+// control-plane token. If there is none, a new one is generated and written to the node.
+func getServerToken(target types.Node) (string, error) {
+	if rdr, err := target.GetFile(types.ServerTokenFile); err == nil {
+		defer rdr.Close()
+		body, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			return "", err
+		}
+		if token := strings.TrimSpace(string(body)); token != "" {
+			log.Info("Using the existing node token for additional control-plane instances")
+			return token, nil
+		}
+	}
+	log.Info("Generating a node token for additional control-plane instances")
+	token := util.GenerateToken(128)
+	log.Debugf("Writing the contents of the server token to %s\n", types.ServerTokenFile)
+	if err := target.WriteFile(ioutil.NopCloser(strings.NewReader(token)), types.ServerTokenFile, "0600", 128); err != nil {
+		return "", err
 	}
+	return token, nil
+}
 
+// runInstallScript runs the k3s installation script on the node between the hooks of the package,
+// and records the package as installed once it succeeds.
+func runInstallScript(target types.Node, meta *types.PackageMeta, execOpts *types.ExecuteOptions, opts *types.InstallOptions) error {
+	pre, post := hooks.Phases(opts)
+	if err := hooks.Run(target, meta, pre, opts); err != nil {
+		return err
+	}
 	// Install K3s
 	if target.GetType() != types.NodeDocker {
 		// let's not lie to the user when we are doing docker installs
 		log.Info("Running k3s installation script")
 	}
-	return target.Execute(execOpts)
+	if err := target.Execute(execOpts); err != nil {
+		return err
+	}
+	if err := hooks.Run(target, meta, post, opts); err != nil {
+		return err
+	}
+	return util.RecordInstalledPackage(target, meta)
 }
 
 func promptEULA(eula *types.Artifact, autoAccept bool) error {
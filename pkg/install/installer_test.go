@@ -1,15 +1,22 @@
 package install
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
 	"github.com/tinyzimmer/k3p/pkg/cluster/node"
 	"github.com/tinyzimmer/k3p/pkg/log"
 	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
 )
 
 func TestUtils(t *testing.T) {
@@ -28,7 +35,7 @@ var _ = Describe("Installer", func() {
 	defer target.Close()
 
 	JustBeforeEach(func() {
-		err = New().Install(target, v1.Mock(), &opts)
+		err = New().Install(target, v2.Mock(), &opts)
 	})
 
 	Context("With no error conditions present", func() {
@@ -37,5 +44,169 @@ var _ = Describe("Installer", func() {
 		})
 	})
 
+	Context("When streaming the package", func() {
+		It("Should install the package and a copy of the archive", func() {
+			pkg := v2.Mock()
+			defer pkg.Close()
+			// builds include checksums that are not installed to nodes
+			Expect(pkg.Put(&types.Artifact{
+				Type: types.ArtifactType("misc"),
+				Name: "k3s-sha256sums.txt",
+				Body: ioutil.NopCloser(strings.NewReader("test")),
+				Size: 4,
+			})).To(Succeed())
+			archive, err := pkg.Archive()
+			Expect(err).ToNot(HaveOccurred())
+			stream, err := v2.Stream(archive.Reader())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(New().InstallStream(target, stream, &opts)).To(Succeed())
+
+			installed, err := target.GetFile(types.InstalledPackageFile)
+			Expect(err).ToNot(HaveOccurred())
+			defer installed.Close()
+			loaded, err := v2.Load(installed)
+			Expect(err).ToNot(HaveOccurred())
+			loaded.Close()
+		})
+	})
+
+	Context("When streaming a package with a modified artifact", func() {
+		It("Should not write the artifact to its destination or replace the installed package", func() {
+			target := node.Mock()
+			defer target.Close()
+			pkg := v2.Mock()
+			defer pkg.Close()
+			archive, err := pkg.Archive()
+			Expect(err).ToNot(HaveOccurred())
+			raw, err := ioutil.ReadAll(archive.Reader())
+			Expect(err).ToNot(HaveOccurred())
+			digest := pkg.GetMeta().GetManifest().Digests["manifests/manifest.yaml"]
+			copy(raw[digest.Offset:], "evil")
+
+			// the release that was installed before
+			previous := "previous release"
+			Expect(target.WriteFile(ioutil.NopCloser(strings.NewReader(previous)), types.InstalledPackageFile, "0644", int64(len(previous)))).To(Succeed())
+
+			stream, err := v2.Stream(ioutil.NopCloser(bytes.NewReader(raw)))
+			Expect(err).ToNot(HaveOccurred())
+			err = New().InstallStream(target, stream, &opts)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("sha256 mismatch in manifests/manifest.yaml"))
+			for _, name := range []string{path.Join(types.K3sManifestsDir, "manifest.yaml"), util.StagingPath(path.Join(types.K3sManifestsDir, "manifest.yaml")), util.StagingPath(types.InstalledPackageFile)} {
+				_, err := target.GetFile(name)
+				Expect(os.IsNotExist(err)).To(BeTrue(), name)
+			}
+			installed, err := target.GetFile(types.InstalledPackageFile)
+			Expect(err).ToNot(HaveOccurred())
+			defer installed.Close()
+			Expect(ioutil.ReadAll(installed)).To(Equal([]byte(previous)))
+		})
+	})
+
+	Context("When the package is built for multiple architectures", func() {
+		It("Should only install the artifacts for the node architecture", func() {
+			other := "arm64"
+			if runtime.GOARCH == other {
+				other = "amd64"
+			}
+			tmpDir, err := ioutil.TempDir("", "")
+			Expect(err).ToNot(HaveOccurred())
+			pkg := v2.New(tmpDir)
+			for _, arch := range []string{runtime.GOARCH, other} {
+				for _, t := range []types.ArtifactType{types.ArtifactBin, types.ArtifactImages} {
+					Expect(pkg.Put(&types.Artifact{
+						Type: t,
+						Name: path.Join(arch, "k3s"),
+						Body: ioutil.NopCloser(strings.NewReader(arch)),
+						Size: int64(len(arch)),
+					})).To(Succeed())
+				}
+			}
+			Expect(pkg.PutMeta(&types.PackageMeta{Arch: runtime.GOARCH + "," + other})).To(Succeed())
+
+			Expect(New().Install(target, pkg, &opts)).To(Succeed())
+			for _, dir := range []string{types.K3sBinDir, types.K3sImagesDir} {
+				rdr, err := target.GetFile(path.Join(dir, "k3s"))
+				Expect(err).ToNot(HaveOccurred())
+				body, err := ioutil.ReadAll(rdr)
+				rdr.Close()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal(runtime.GOARCH))
+			}
+		})
+
+		It("Should refuse nodes of other architectures", func() {
+			pkg := v2.Mock()
+			Expect(pkg.PutMeta(&types.PackageMeta{Arch: "mips"})).To(Succeed())
+			err := New().Install(target, pkg, &opts)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("The package was built for \"mips\""))
+		})
+	})
+
+	Context("When the package requires other packages", func() {
+		It("Should only install it once they are recorded on the node", func() {
+			target := node.Mock()
+			defer target.Close()
+			newApp := func() types.Package {
+				pkg := v2.Mock()
+				Expect(pkg.PutMeta(&types.PackageMeta{Name: "app", Version: "v1.0.0", PackageConfig: &types.PackageConfig{
+					Requires: &types.Requirements{Packages: []types.PackageRequirement{{Name: "platform", Version: ">= 1.2.0"}}},
+				}})).To(Succeed())
+				return pkg
+			}
+
+			err := New().Install(target, newApp(), &opts)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`package "platform" (>= 1.2.0) must be installed first`))
+
+			platform := v2.Mock()
+			Expect(platform.PutMeta(&types.PackageMeta{Name: "platform", Version: "v1.2.0"})).To(Succeed())
+			Expect(New().Install(target, platform, &opts)).To(Succeed())
+			Expect(New().Install(target, newApp(), &opts)).To(Succeed())
+
+			installed, err := util.GetInstalledPackages(target)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(installed).To(HaveLen(2))
+			Expect(installed[0].Name).To(Equal("app"))
+			Expect(installed[1].Name).To(Equal("platform"))
+			Expect(installed[1].Version).To(Equal("v1.2.0"))
+		})
+	})
+
+	Context("When the package declares files", func() {
+		It("Should install them as declared", func() {
+			target := node.Mock()
+			defer target.Close()
+			pkg := v2.Mock()
+			defer pkg.Close()
+			for _, artifact := range []*types.Artifact{
+				{Type: types.ArtifactEtc, Name: "config.yaml", Body: ioutil.NopCloser(strings.NewReader("node-name: {{ .Vars.name }}")), Size: 27},
+				{Type: types.ArtifactStatic, Name: "99-k3s.conf", Body: ioutil.NopCloser(strings.NewReader("vm.max_map_count={{ .Vars.name }}")), Size: 33},
+			} {
+				Expect(pkg.Put(artifact)).To(Succeed())
+			}
+			Expect(pkg.PutMeta(&types.PackageMeta{Name: "app", PackageConfig: &types.PackageConfig{
+				Files: []types.PackageFile{
+					{Path: "config.yaml", Type: types.ArtifactEtc, Template: true, Mode: "600"},
+					{Path: "sysctl.conf", Name: "99-k3s.conf", Type: types.ArtifactStatic, Destination: "/etc/sysctl.d/99-k3s.conf"},
+				},
+			}})).To(Succeed())
+
+			Expect(New().Install(target, pkg, &types.InstallOptions{Variables: map[string]string{"name": "test"}})).To(Succeed())
+			for file, contents := range map[string]string{
+				path.Join(types.K3sEtcDir, "config.yaml"): "node-name: test",
+				"/etc/sysctl.d/99-k3s.conf":               "vm.max_map_count={{ .Vars.name }}",
+			} {
+				rdr, err := target.GetFile(file)
+				Expect(err).ToNot(HaveOccurred())
+				body, err := ioutil.ReadAll(rdr)
+				rdr.Close()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal(contents))
+			}
+		})
+	})
+
 	// TODO: More tests
 })
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -70,20 +71,21 @@ func (l *logger) getTime() string {
 	return fmt.Sprintf(noticeColor, time.Now().Local().Format(timeFormat))
 }
 
-func (l *logger) seedLine() {
-	fmt.Fprint(LogWriter, l.getTime(), "  ", l.getPrefix(), "\t")
+// writeMux serializes writes so lines logged from multiple goroutines are not interleaved
+var writeMux sync.Mutex
+
+func (l *logger) writeLine(line string) {
+	writeMux.Lock()
+	defer writeMux.Unlock()
+	fmt.Fprint(LogWriter, l.getTime(), "  ", l.getPrefix(), "\t", fmt.Sprintf(boldColor, line))
 }
 
 func (l *logger) Println(args ...interface{}) {
-	l.seedLine()
-	line := fmt.Sprintln(args...)
-	fmt.Fprintf(LogWriter, boldColor, line)
+	l.writeLine(fmt.Sprintln(args...))
 }
 
 func (l *logger) Printf(fstr string, args ...interface{}) {
-	l.seedLine()
-	line := fmt.Sprintf(fstr, args...)
-	fmt.Fprintf(LogWriter, boldColor, line)
+	l.writeLine(fmt.Sprintf(fstr, args...))
 }
 
 // Info is the equivalent of a log.Println on the info logger.
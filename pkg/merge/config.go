@@ -0,0 +1,367 @@
+package merge
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"gopkg.in/yaml.v2"
+
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// mergeConfigs combines the package configurations of the given packages. Variables with the
+// same name must have the same default, any server, agent or helm configuration set by more
+// than one package must have the same value, files bundled by more than one package must be
+// installed the same way, and only one package can declare the hook for each phase.
+func mergeConfigs(metas []*types.PackageMeta) (*types.PackageConfig, []string) {
+	var merged *types.PackageConfig
+	var conflicts []string
+	// who set each variable or configuration first, for reporting conflicts
+	owners := make(map[string]*types.PackageMeta)
+	raws := make([][]byte, 0)
+
+	for _, meta := range metas {
+		cfg := meta.GetPackageConfig()
+		if cfg == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &types.PackageConfig{
+				ServerConfig: make(map[string]interface{}),
+				AgentConfig:  make(map[string]interface{}),
+				HelmValues:   make(map[string]interface{}),
+			}
+		}
+		if len(cfg.Raw) > 0 {
+			// requirements, files and hooks are merged from the parsed configuration instead
+			raw := cfg.Raw
+			for _, key := range []string{"requires", "files", "hooks"} {
+				raw = types.WithoutRootBlock(raw, key)
+			}
+			raws = append(raws, raw)
+		}
+
+	Variables:
+		for _, vari := range cfg.Variables {
+			for i, existing := range merged.Variables {
+				if existing.Name != vari.Name {
+					continue
+				}
+				if existing.Default != vari.Default {
+					conflicts = append(conflicts, fmt.Sprintf("variable %s: %s defaults to %q, %s defaults to %q",
+						vari.Name, owners["variables."+vari.Name].GetName(), existing.Default, meta.GetName(), vari.Default))
+				} else if existing.Prompt == "" {
+					merged.Variables[i].Prompt = vari.Prompt
+				}
+				continue Variables
+			}
+			owners["variables."+vari.Name] = meta
+			merged.Variables = append(merged.Variables, vari)
+		}
+
+	Files:
+		for _, file := range cfg.Files {
+			name := file.GetName(meta.IsMultiArch())
+			owner := fmt.Sprintf("files.%s.%s", file.Type, name)
+			for _, existing := range merged.Files {
+				if existing.Type != file.Type || existing.GetName(meta.IsMultiArch()) != name {
+					continue
+				}
+				if existing.Mode != file.Mode || existing.Template != file.Template || existing.Destination != file.Destination {
+					conflicts = append(conflicts, fmt.Sprintf("files: %s and %s install the %s file %q differently",
+						owners[owner].GetName(), meta.GetName(), file.Type, name))
+				}
+				continue Files
+			}
+			owners[owner] = meta
+			merged.Files = append(merged.Files, file)
+		}
+
+		for _, phase := range types.HookPhases {
+			hook := cfg.Hooks.Get(phase)
+			if hook == nil {
+				continue
+			}
+			owner := "hooks." + string(phase)
+			if existing := merged.Hooks.Get(phase); existing != nil {
+				if *existing != *hook {
+					conflicts = append(conflicts, fmt.Sprintf("%s: %s and %s both declare the hook",
+						owner, owners[owner].GetName(), meta.GetName()))
+				}
+				continue
+			}
+			owners[owner] = meta
+			if merged.Hooks == nil {
+				merged.Hooks = &types.Hooks{}
+			}
+			copied := *hook
+			merged.Hooks.Set(phase, &copied)
+		}
+
+		for _, section := range []struct {
+			name     string
+			from, to map[string]interface{}
+		}{
+			{"serverConfig", cfg.ServerConfig, merged.ServerConfig},
+			{"agentConfig", cfg.AgentConfig, merged.AgentConfig},
+			{"helmValues", cfg.HelmValues, merged.HelmValues},
+		} {
+			for key, value := range section.from {
+				owner := section.name + "." + key
+				if existing, ok := section.to[key]; ok {
+					if !reflect.DeepEqual(existing, value) {
+						conflicts = append(conflicts, fmt.Sprintf("%s: %s and %s set different values",
+							owner, owners[owner].GetName(), meta.GetName()))
+					}
+					continue
+				}
+				owners[owner] = meta
+				section.to[key] = value
+			}
+		}
+	}
+
+	if merged == nil {
+		return nil, nil
+	}
+	var reqConflicts []string
+	merged.Requires, reqConflicts = mergeRequirements(metas)
+	conflicts = append(conflicts, reqConflicts...)
+	if len(conflicts) > 0 {
+		return merged, conflicts
+	}
+	raw, err := mergeRaw(raws, merged.Variables)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	merged.Raw = raw
+	return merged, nil
+}
+
+// mergeRequirements combines the requirements of the given packages. The narrowest k3s version
+// range is kept, and requirements on packages that are part of the merge are met by the merged
+// package itself, so they are dropped.
+func mergeRequirements(metas []*types.PackageMeta) (*types.Requirements, []string) {
+	var merged *types.Requirements
+	var conflicts []string
+	for _, meta := range metas {
+		cfg := meta.GetPackageConfig()
+		if cfg == nil || cfg.Requires == nil {
+			continue
+		}
+		reqs := cfg.Requires
+		if err := reqs.Validate(); err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("requires: %s: %s", meta.GetName(), err.Error()))
+			continue
+		}
+		if merged == nil {
+			merged = &types.Requirements{}
+		}
+		if reqs.MinK3sVersion != "" && (merged.MinK3sVersion == "" ||
+			semver.MustParse(reqs.MinK3sVersion).GreaterThan(semver.MustParse(merged.MinK3sVersion))) {
+			merged.MinK3sVersion = reqs.MinK3sVersion
+		}
+		if reqs.MaxK3sVersion != "" && (merged.MaxK3sVersion == "" ||
+			semver.MustParse(reqs.MaxK3sVersion).LessThan(semver.MustParse(merged.MaxK3sVersion))) {
+			merged.MaxK3sVersion = reqs.MaxK3sVersion
+		}
+
+	Modules:
+		for _, module := range reqs.KernelModules {
+			for _, existing := range merged.KernelModules {
+				if existing == module {
+					continue Modules
+				}
+			}
+			merged.KernelModules = append(merged.KernelModules, module)
+		}
+
+	Packages:
+		for _, req := range reqs.Packages {
+			for _, other := range metas {
+				if other.GetName() != req.Name {
+					continue
+				}
+				if !versionInRange(other.GetVersion(), req.Version) {
+					conflicts = append(conflicts, fmt.Sprintf("requires: %s needs %s %s, but version %s is being merged",
+						meta.GetName(), req.Name, req.Version, other.GetVersion()))
+				}
+				continue Packages
+			}
+			for _, existing := range merged.Packages {
+				if existing == req {
+					continue Packages
+				}
+			}
+			merged.Packages = append(merged.Packages, req)
+		}
+	}
+	return merged, conflicts
+}
+
+// versionInRange returns true if the version is in the given semantic version range, or the
+// range is empty.
+func versionInRange(version, versionRange string) bool {
+	if versionRange == "" {
+		return true
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return false
+	}
+	constraint, err := semver.NewConstraint(versionRange)
+	return err == nil && constraint.Check(v)
+}
+
+// reTopLevelKey matches the start of a root-level yaml block
+var reTopLevelKey = regexp.MustCompile(`^([^\s#-][^:]*):(.*)$`)
+
+// rawEntry is a single entry of a root-level block in a raw configuration, such as a key of
+// the server configuration, along with everything nested under it.
+type rawEntry struct {
+	key   string
+	lines []string
+}
+
+// mergeRaw combines the raw, untemplated configurations of several packages, so the result can
+// still be rendered with the variables provided at installation. The entries of each root-level
+// block are combined under a single key, and entries set by more than one package are only kept
+// once. Since their values were already checked for conflicts, entries that still differ in the
+// raw configurations (for example a template in one package and a literal in another) are an
+// error. The variables block is replaced with the given variables, which were already merged by
+// name. Comments and templates that are not inside a block are kept at the top.
+func mergeRaw(raws [][]byte, variables []types.PackageVariable) ([]byte, error) {
+	if len(raws) == 1 {
+		return raws[0], nil
+	}
+	var preamble, keys []string
+	blocks := make(map[string][][]string)
+	for _, raw := range raws {
+		var key string
+		scanner := bufio.NewScanner(bytes.NewReader(raw))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if match := reTopLevelKey.FindStringSubmatch(line); match != nil {
+				key = match[1]
+				if strings.TrimSpace(match[2]) != "" {
+					return nil, fmt.Errorf("the raw configuration for %s cannot be merged, it must be written as a block", key)
+				}
+				if _, ok := blocks[key]; !ok {
+					keys = append(keys, key)
+				}
+				blocks[key] = append(blocks[key], []string{})
+				continue
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if key == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "{{") {
+				// comments and templates outside of any block apply to the whole document
+				preamble = append(preamble, line)
+				continue
+			}
+			block := blocks[key]
+			block[len(block)-1] = append(block[len(block)-1], line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var out bytes.Buffer
+	for _, line := range preamble {
+		fmt.Fprintln(&out, line)
+	}
+	for _, key := range keys {
+		if key == "variables" && len(variables) > 0 {
+			rawVars, err := yaml.Marshal(map[string][]types.PackageVariable{"variables": variables})
+			if err != nil {
+				return nil, err
+			}
+			out.Write(rawVars)
+			continue
+		}
+		fmt.Fprintf(&out, "%s:\n", key)
+		seen := make(map[string]*rawEntry)
+		for _, lines := range blocks[key] {
+			for _, entry := range splitEntries(lines) {
+				if entry.key != "" {
+					if existing, ok := seen[entry.key]; ok {
+						if !sameRawValue(existing, entry) {
+							return nil, fmt.Errorf("%s.%s: the raw configurations of the packages set different values", key, entry.key)
+						}
+						continue
+					}
+					seen[entry.key] = entry
+				}
+				for _, line := range entry.lines {
+					fmt.Fprintf(&out, "  %s\n", line)
+				}
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// splitEntries splits the lines of a root-level block into its entries. Each block is reindented,
+// since packages may not use the same indentation. Comments at the indentation of the block are
+// kept with the entry before them.
+func splitEntries(lines []string) []*rawEntry {
+	indent := blockIndent(lines)
+	var entries []*rawEntry
+	for _, line := range lines {
+		line = strings.TrimPrefix(line, indent)
+		trimmed := strings.TrimLeft(line, " \t")
+		isComment := strings.HasPrefix(trimmed, "#")
+		if len(entries) == 0 || (trimmed == line && !isComment) {
+			entry := &rawEntry{}
+			if !isComment {
+				entry.key = entryKey(line)
+			}
+			entries = append(entries, entry)
+		}
+		entry := entries[len(entries)-1]
+		entry.lines = append(entry.lines, line)
+	}
+	return entries
+}
+
+// entryKey returns the key of the entry starting with the given line. List items are keyed by
+// the whole line.
+func entryKey(line string) string {
+	if strings.HasPrefix(line, "-") {
+		return line
+	}
+	if idx := strings.Index(line, ":"); idx > 0 {
+		return line[:idx]
+	}
+	return line
+}
+
+// sameRawValue returns true if the given entries are identical, or parse to the same value.
+func sameRawValue(a, b *rawEntry) bool {
+	rawA, rawB := strings.Join(a.lines, "\n"), strings.Join(b.lines, "\n")
+	if rawA == rawB {
+		return true
+	}
+	var valueA, valueB interface{}
+	if yaml.Unmarshal([]byte(rawA), &valueA) != nil || yaml.Unmarshal([]byte(rawB), &valueB) != nil {
+		return false
+	}
+	return reflect.DeepEqual(valueA, valueB)
+}
+
+func blockIndent(lines []string) string {
+	for _, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return ""
+}
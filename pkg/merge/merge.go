@@ -0,0 +1,245 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/sbom"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// ConflictError is returned when the packages being merged cannot be combined. It lists every
+// conflict that was found, so they can all be addressed at once.
+type ConflictError struct {
+	Conflicts []string
+}
+
+func (c *ConflictError) Error() string {
+	return fmt.Sprintf("The packages cannot be merged:\n  - %s", strings.Join(c.Conflicts, "\n  - "))
+}
+
+// source is an artifact to copy from one of the packages into the merged package.
+type source struct {
+	pkg  types.Package
+	meta *types.PackageMeta
+	// the path of the artifact in the source package
+	path string
+	// the path of the artifact in the merged package
+	target string
+	digest types.ArtifactDigest
+}
+
+// Merge combines the given packages into out. The name and version of the merged package are
+// taken from meta, everything else is combined from the packages. Nothing is written if the
+// packages conflict with each other.
+func Merge(pkgs []types.Package, out types.Package, meta *types.PackageMeta) error {
+	if len(pkgs) < 2 {
+		return errors.New("At least two packages are required for a merge")
+	}
+
+	metas := make([]*types.PackageMeta, len(pkgs))
+	for i, pkg := range pkgs {
+		metas[i] = pkg.GetMeta()
+		if len(metas[i].GetManifest().Digests) == 0 {
+			return fmt.Errorf("%s does not contain artifact digests, it must be rebuilt with a newer k3p", metas[i].GetName())
+		}
+	}
+
+	var conflicts []string
+	conflicts = append(conflicts, checkMeta(metas)...)
+
+	cfg, cfgConflicts := mergeConfigs(metas)
+	conflicts = append(conflicts, cfgConflicts...)
+
+	sources, eulas, artifactConflicts := planArtifacts(pkgs, metas)
+	conflicts = append(conflicts, artifactConflicts...)
+
+	if len(conflicts) > 0 {
+		return &ConflictError{Conflicts: conflicts}
+	}
+
+	// The EULA is written first so it can be reviewed before anything else is installed
+	// when the package is streamed.
+	if len(eulas) > 0 {
+		if err := putEULA(out, eulas); err != nil {
+			return err
+		}
+	}
+	for _, src := range sources {
+		log.Infof("Adding %s from %s\n", src.target, src.meta.GetName())
+		if err := copyArtifact(src, out); err != nil {
+			return err
+		}
+	}
+
+	outMeta := meta.DeepCopy()
+	outMeta.K3sVersion = metas[0].GetK3sVersion()
+	outMeta.Arch = metas[0].GetArch()
+	outMeta.ImageBundleFormat = metas[0].ImageBundleFormat
+	outMeta.PackageConfig = cfg
+	outMeta.Manifest = nil
+	if err := out.PutMeta(outMeta); err != nil {
+		return err
+	}
+
+	// The bills of materials of the packages no longer describe the merged package, so new ones
+	// are generated in the same formats.
+	for _, format := range sbomFormats(metas) {
+		log.Infof("Generating a software bill of materials for the merged package (%s)\n", format)
+		raw, err := sbom.Generate(out, format)
+		if err != nil {
+			return err
+		}
+		if err := out.Put(&types.Artifact{
+			Type: types.ArtifactSBOM,
+			Name: sbom.FileName(format),
+			Body: ioutil.NopCloser(bytes.NewReader(raw)),
+			Size: int64(len(raw)),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sbomFormats returns the formats of the bills of materials embedded in any of the packages.
+func sbomFormats(metas []*types.PackageMeta) []types.SBOMFormat {
+	var formats []types.SBOMFormat
+	for _, format := range sbom.Formats() {
+		if hasSBOM(metas, sbom.FileName(format)) {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+func hasSBOM(metas []*types.PackageMeta, name string) bool {
+	for _, meta := range metas {
+		for _, doc := range meta.GetManifest().SBOM {
+			if doc == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkMeta makes sure the packages agree on everything that applies to the cluster as a whole.
+func checkMeta(metas []*types.PackageMeta) []string {
+	var conflicts []string
+	compare := func(field string, value func(*types.PackageMeta) string) {
+		for _, meta := range metas[1:] {
+			if value(meta) != value(metas[0]) {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %s has %q, %s has %q",
+					field, metas[0].GetName(), value(metas[0]), meta.GetName(), value(meta)))
+			}
+		}
+	}
+	compare("k3sVersion", func(m *types.PackageMeta) string { return m.GetK3sVersion() })
+	compare("arch", func(m *types.PackageMeta) string { return m.GetArch() })
+	compare("imageBundleFormat", func(m *types.PackageMeta) string { return string(m.ImageBundleFormat) })
+	for _, meta := range metas {
+		if meta.IsDelta() {
+			conflicts = append(conflicts, fmt.Sprintf("%s is a delta package and must be combined with its base first", meta.GetName()))
+		}
+		if meta.ImageBundleFormat == types.ImageBundleRegistry {
+			conflicts = append(conflicts, fmt.Sprintf("%s bundles a private registry, which is tied to its package name and cannot be merged", meta.GetName()))
+		}
+	}
+	return conflicts
+}
+
+// planArtifacts decides where every artifact of every package goes in the merged package.
+// Identical artifacts are only included once, and image tarballs that share a name are renamed
+// after their package. The EULAs of all the packages are returned separately, and their bills of
+// materials are left out.
+func planArtifacts(pkgs []types.Package, metas []*types.PackageMeta) (sources []*source, eulas []*source, conflicts []string) {
+	targets := make(map[string]*source)
+	for i, pkg := range pkgs {
+		digests := metas[i].GetManifest().Digests
+		names := make([]string, 0, len(digests))
+		for name := range digests {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			src := &source{pkg: pkg, meta: metas[i], path: name, target: name, digest: digests[name]}
+			t, relName := v1.ArtifactFromPath(name)
+			if t == types.ArtifactEULA {
+				eulas = append(eulas, src)
+				continue
+			}
+			if t == types.ArtifactSBOM {
+				continue
+			}
+			existing, ok := targets[name]
+			if ok && existing.digest.SHA256 == src.digest.SHA256 {
+				continue
+			}
+			if ok && t == types.ArtifactImages {
+				src.target = path.Join(path.Dir(name), fmt.Sprintf("%s-%s", metas[i].GetName(), relName))
+				existing, ok = targets[src.target]
+			}
+			if ok {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %s and %s contain different files at this path",
+					name, existing.meta.GetName(), metas[i].GetName()))
+				continue
+			}
+			targets[src.target] = src
+			sources = append(sources, src)
+		}
+	}
+	return
+}
+
+// putEULA writes the EULAs of the merged packages as a single EULA. If they are all the same,
+// it is written as is.
+func putEULA(out types.Package, eulas []*source) error {
+	unique := make([]*source, 0, len(eulas))
+	seen := make(map[string]struct{})
+	for _, eula := range eulas {
+		if _, ok := seen[eula.digest.SHA256]; !ok {
+			seen[eula.digest.SHA256] = struct{}{}
+			unique = append(unique, eula)
+		}
+	}
+	if len(unique) == 1 {
+		return copyArtifact(unique[0], out)
+	}
+	var buf bytes.Buffer
+	for _, eula := range unique {
+		artifact := &types.Artifact{Name: eula.path}
+		if err := eula.pkg.Get(artifact); err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(artifact.Body)
+		artifact.Body.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "==== %s %s ====\n\n%s\n\n", eula.meta.GetName(), eula.meta.GetVersion(), bytes.TrimSpace(body))
+	}
+	return out.Put(&types.Artifact{
+		Type: types.ArtifactEULA,
+		Name: types.ManifestEULAFile,
+		Body: ioutil.NopCloser(&buf),
+		Size: int64(buf.Len()),
+	})
+}
+
+func copyArtifact(src *source, out types.Package) error {
+	artifact := &types.Artifact{Name: src.path}
+	if err := src.pkg.Get(artifact); err != nil {
+		return err
+	}
+	t, relName := v1.ArtifactFromPath(src.target)
+	return out.Put(&types.Artifact{Type: t, Name: relName, Body: artifact.Body, Size: artifact.Size})
+}
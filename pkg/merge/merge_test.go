@@ -0,0 +1,231 @@
+package merge
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/sbom"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestMerge(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Merge Suite")
+}
+
+func newPackage(name, k3sVersion, config string, files map[string]string) types.Package {
+	tmpDir, err := ioutil.TempDir("", "")
+	Expect(err).ToNot(HaveOccurred())
+	pkg := v2.New(tmpDir)
+	for _, tarPath := range []string{"bin/k3s", "images/manifest-images.tar", "manifests/app.yaml", "manifests/shared.yaml"} {
+		body, ok := files[tarPath]
+		if !ok {
+			continue
+		}
+		spl := strings.SplitN(tarPath, "/", 2)
+		typ := map[string]types.ArtifactType{"bin": types.ArtifactBin, "images": types.ArtifactImages, "manifests": types.ArtifactManifest}[spl[0]]
+		Expect(pkg.Put(&types.Artifact{Type: typ, Name: spl[1], Body: ioutil.NopCloser(strings.NewReader(body)), Size: int64(len(body))})).To(Succeed())
+	}
+	meta := &types.PackageMeta{Name: name, Version: "v1", K3sVersion: k3sVersion, Arch: "amd64"}
+	if config != "" {
+		meta.PackageConfig, err = types.PackageConfigFromReader(strings.NewReader(config))
+		Expect(err).ToNot(HaveOccurred())
+	}
+	Expect(pkg.PutMeta(meta)).To(Succeed())
+	return pkg
+}
+
+func merged(pkgs ...types.Package) (types.Package, error) {
+	tmpDir, err := ioutil.TempDir("", "")
+	Expect(err).ToNot(HaveOccurred())
+	out := v2.New(tmpDir)
+	return out, Merge(pkgs, out, &types.PackageMeta{Name: "site", Version: "v1"})
+}
+
+const configA = `
+variables:
+  - name: domain
+    default: example.com
+  - name: replicas
+    default: "1"
+
+serverConfig:
+  node-label: "team-a={{ .Vars.domain }}"
+`
+
+const configB = `
+variables:
+    - name: domain
+      default: example.com
+      prompt: The domain to serve on
+serverConfig:
+    disable: traefik
+`
+
+var _ = Describe("Merging packages", func() {
+	It("Should combine the contents of every package", func() {
+		a := newPackage("a", "v1.19.4+k3s1", configA, map[string]string{
+			"bin/k3s": "k3s", "images/manifest-images.tar": "a-images", "manifests/app.yaml": "a", "manifests/shared.yaml": "shared",
+		})
+		defer a.Close()
+		b := newPackage("b", "v1.19.4+k3s1", configB, map[string]string{
+			"bin/k3s": "k3s", "images/manifest-images.tar": "b-images", "manifests/shared.yaml": "shared",
+		})
+		defer b.Close()
+
+		out, err := merged(a, b)
+		Expect(err).ToNot(HaveOccurred())
+		defer out.Close()
+
+		meta := out.GetMeta()
+		Expect(meta.K3sVersion).To(Equal("v1.19.4+k3s1"))
+		Expect(meta.Manifest.Bins).To(ConsistOf("k3s"))
+		Expect(meta.Manifest.Images).To(ConsistOf("manifest-images.tar", "b-manifest-images.tar"))
+		Expect(meta.Manifest.K8sManifests).To(ConsistOf("app.yaml", "shared.yaml"))
+
+		cfg := meta.GetPackageConfig()
+		Expect(cfg.Variables).To(HaveLen(2))
+		Expect(cfg.Variables[0].Prompt).To(Equal("The domain to serve on"))
+		Expect(cfg.ApplyVariables(map[string]string{"domain": "site.local", "replicas": "3"})).To(Succeed())
+		Expect(cfg.ServerConfig).To(HaveKeyWithValue("node-label", "team-a=site.local"))
+		Expect(cfg.ServerConfig).To(HaveKeyWithValue("disable", "traefik"))
+	})
+
+	It("Should generate a new SBOM for the merged package", func() {
+		a := newPackage("a", "v1.19.4+k3s1", "", map[string]string{"bin/k3s": "k3s", "manifests/app.yaml": "a"})
+		defer a.Close()
+		raw, err := sbom.Generate(a, types.SBOMFormatCycloneDX)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a.Put(&types.Artifact{Type: types.ArtifactSBOM, Name: sbom.FileName(types.SBOMFormatCycloneDX), Body: ioutil.NopCloser(bytes.NewReader(raw)), Size: int64(len(raw))})).To(Succeed())
+		b := newPackage("b", "v1.19.4+k3s1", "", map[string]string{"bin/k3s": "k3s", "manifests/shared.yaml": "b"})
+		defer b.Close()
+
+		out, err := merged(a, b)
+		Expect(err).ToNot(HaveOccurred())
+		defer out.Close()
+
+		Expect(out.GetMeta().GetManifest().SBOM).To(ConsistOf(sbom.FileName(types.SBOMFormatCycloneDX)))
+		doc, err := sbom.Find(out, types.SBOMFormatCycloneDX)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(doc)).To(ContainSubstring(`"name": "site"`))
+		Expect(string(doc)).To(ContainSubstring("shared.yaml"))
+	})
+
+	It("Should drop requirements on the packages being merged", func() {
+		platform := newPackage("platform", "v1.19.4+k3s1", `
+requires:
+  minK3sVersion: v1.19.0
+  kernelModules: [overlay]
+`, map[string]string{"bin/k3s": "k3s", "manifests/app.yaml": "platform"})
+		defer platform.Close()
+		app := newPackage("app", "v1.19.4+k3s1", `
+requires:
+  minK3sVersion: v1.19.2
+  kernelModules: [overlay, br_netfilter]
+  packages:
+    - name: platform
+      version: ">= 1.0.0"
+    - name: storage
+serverConfig:
+  disable: traefik
+`, map[string]string{"bin/k3s": "k3s", "manifests/shared.yaml": "app"})
+		defer app.Close()
+
+		out, err := merged(platform, app)
+		Expect(err).ToNot(HaveOccurred())
+		defer out.Close()
+
+		cfg := out.GetMeta().GetPackageConfig()
+		Expect(cfg.ApplyVariables(map[string]string{})).To(Succeed())
+		Expect(cfg.ServerConfig).To(HaveKeyWithValue("disable", "traefik"))
+		Expect(cfg.Requires).To(Equal(&types.Requirements{
+			MinK3sVersion: "v1.19.2",
+			KernelModules: []string{"overlay", "br_netfilter"},
+			Packages:      []types.PackageRequirement{{Name: "storage"}},
+		}))
+	})
+
+	It("Should only keep settings and variables set by more than one package once", func() {
+		a := newPackage("a", "v1.19.4+k3s1", configA+"  disable: traefik\n", map[string]string{"manifests/app.yaml": "a"})
+		defer a.Close()
+		b := newPackage("b", "v1.19.4+k3s1", configB, map[string]string{"manifests/shared.yaml": "b"})
+		defer b.Close()
+
+		out, err := merged(a, b)
+		Expect(err).ToNot(HaveOccurred())
+		defer out.Close()
+
+		cfg := out.GetMeta().GetPackageConfig()
+		raw := string(cfg.Raw)
+		Expect(strings.Count(raw, "disable:")).To(Equal(1))
+		Expect(strings.Count(raw, "name: domain")).To(Equal(1))
+		Expect(strings.Count(raw, "name: replicas")).To(Equal(1))
+		Expect(raw).To(ContainSubstring("prompt: The domain to serve on"))
+		Expect(cfg.ApplyVariables(map[string]string{"domain": "site.local"})).To(Succeed())
+		Expect(cfg.Variables).To(HaveLen(2))
+		Expect(cfg.ServerConfig).To(HaveKeyWithValue("disable", "traefik"))
+		Expect(cfg.ServerConfig).To(HaveKeyWithValue("node-label", "team-a=site.local"))
+	})
+
+	It("Should refuse settings that only differ in the raw configurations", func() {
+		a := newPackage("a", "v1.19.4+k3s1", configA, map[string]string{"manifests/app.yaml": "a"})
+		defer a.Close()
+		b := newPackage("b", "v1.19.4+k3s1", strings.Replace(configA, "{{ .Vars.domain }}", "example.com", 1), map[string]string{"manifests/shared.yaml": "b"})
+		defer b.Close()
+
+		out, err := merged(a, b)
+		defer out.Close()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("serverConfig.node-label"))
+	})
+
+	It("Should keep comments and templates outside of the blocks", func() {
+		a := newPackage("a", "v1.19.4+k3s1", `
+variables:
+  - name: domain
+    default: example.com
+---
+{{/* the label is rendered at installation */}}
+serverConfig:
+  node-label: "{{ .Vars.domain }}"
+`, map[string]string{"manifests/app.yaml": "a"})
+		defer a.Close()
+		b := newPackage("b", "v1.19.4+k3s1", "# settings for b\n"+configB, map[string]string{"manifests/shared.yaml": "b"})
+		defer b.Close()
+
+		out, err := merged(a, b)
+		Expect(err).ToNot(HaveOccurred())
+		defer out.Close()
+
+		cfg := out.GetMeta().GetPackageConfig()
+		Expect(string(cfg.Raw)).To(HavePrefix("{{/* the label is rendered at installation */}}\n# settings for b\n"))
+		Expect(cfg.ApplyVariables(map[string]string{"domain": "site.local"})).To(Succeed())
+		Expect(cfg.ServerConfig).To(HaveKeyWithValue("node-label", "site.local"))
+		Expect(cfg.ServerConfig).To(HaveKeyWithValue("disable", "traefik"))
+	})
+
+	It("Should report every conflict", func() {
+		a := newPackage("a", "v1.19.4+k3s1", configA, map[string]string{"manifests/shared.yaml": "a"})
+		defer a.Close()
+		b := newPackage("b", "v1.20.0+k3s1", strings.Replace(configB, "example.com", "example.org", 1), map[string]string{"manifests/shared.yaml": "b"})
+		defer b.Close()
+
+		out, err := merged(a, b)
+		defer out.Close()
+		Expect(err).To(HaveOccurred())
+		conflicts := err.(*ConflictError).Conflicts
+		Expect(conflicts).To(HaveLen(3))
+		Expect(conflicts[0]).To(ContainSubstring("k3sVersion"))
+		Expect(conflicts[1]).To(ContainSubstring("variable domain"))
+		Expect(conflicts[2]).To(ContainSubstring("manifests/shared.yaml"))
+		Expect(out.GetMeta().GetManifest().Digests).To(BeEmpty())
+	})
+})
@@ -0,0 +1,181 @@
+package oci
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+)
+
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authorize returns the Authorization header to use for the given scope, in response to the
+// WWW-Authenticate challenge of the registry.
+func (c *Client) authorize(registry, scope, challenge string) (string, error) {
+	username, password := c.credentials(registry)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	switch strings.ToLower(parts[0]) {
+	case "basic":
+		if username == "" {
+			return "", fmt.Errorf("Registry %s requires credentials and none were found", registry)
+		}
+		return "Basic " + basicAuth(username, password), nil
+	case "bearer":
+		if len(parts) != 2 {
+			return "", fmt.Errorf("Registry %s returned an invalid challenge: %q", registry, challenge)
+		}
+		params := make(map[string]string)
+		for _, match := range challengeParamRegex.FindAllStringSubmatch(parts[1], -1) {
+			params[strings.ToLower(match[1])] = match[2]
+		}
+		token, err := c.fetchToken(registry, params, scope, username, password)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	return "", fmt.Errorf("Registry %s requested unsupported authentication: %q", registry, challenge)
+}
+
+// fetchToken retrieves a bearer token for the given scope from the token service named in
+// the challenge.
+func (c *Client) fetchToken(registry string, params map[string]string, scope, username, password string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("Registry %s returned an invalid token realm: %q", registry, params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	log.Debugf("Requesting a token for %q from %s\n", scope, realm.Host)
+	httpClient := c.client
+	if c.insecure(registry) {
+		httpClient = c.insecureHTTP
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp, "retrieving a registry token")
+	}
+	defer resp.Body.Close()
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	if token.AccessToken != "" {
+		return token.AccessToken, nil
+	}
+	return "", fmt.Errorf("The token service for %s did not return a token", registry)
+}
+
+// credentials returns the username and password to use for the registry, from the options of
+// the client or the docker configuration of the current user.
+func (c *Client) credentials(registry string) (string, string) {
+	if c.opts.Username != "" {
+		return c.opts.Username, c.opts.Password
+	}
+	return dockerCredentials(registry)
+}
+
+// dockerConfig is the subset of the docker client configuration holding registry credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore string `json:"credsStore"`
+}
+
+// dockerConfigPath returns the location of the docker client configuration.
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// dockerCredentials returns the credentials stored by `docker login` for the given registry.
+// Credential helpers are not supported.
+func dockerCredentials(registry string) (string, string) {
+	path := dockerConfigPath()
+	f, err := os.Open(path)
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+	var cfg dockerConfig
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		log.Debugf("Could not read docker configuration at %q: %s\n", path, err.Error())
+		return "", ""
+	}
+	for key, auth := range cfg.Auths {
+		if normalizeRegistry(key) != normalizeRegistry(registry) {
+			continue
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				continue
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) == 2 {
+				log.Debugf("Using credentials for %s from %q\n", registry, path)
+				return parts[0], parts[1]
+			}
+		}
+		if auth.Username != "" {
+			return auth.Username, auth.Password
+		}
+	}
+	if cfg.CredsStore != "" {
+		log.Debugf("Credential stores are not supported, %q is ignored\n", cfg.CredsStore)
+	}
+	return "", ""
+}
+
+// normalizeRegistry strips the scheme and path from keys in the docker configuration, which
+// may be either hosts or URLs.
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	registry = strings.SplitN(registry, "/", 2)[0]
+	switch registry {
+	case "docker.io", "registry-1.docker.io":
+		return "index.docker.io"
+	}
+	return registry
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
@@ -0,0 +1,169 @@
+package oci
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+)
+
+// Options configure how registries are accessed.
+type Options struct {
+	// Credentials for the registry. When empty, they are read from the docker configuration
+	// of the current user.
+	Username, Password string
+	// Skip TLS verification and fall back to plain HTTP when the registry does not serve HTTPS.
+	// This is always allowed for registries on the loopback interface.
+	Insecure bool
+}
+
+// Client pushes and pulls packages to and from registries implementing the OCI distribution API.
+type Client struct {
+	opts                 *Options
+	client, insecureHTTP *http.Client
+
+	mux sync.Mutex
+	// registries that were found to only serve plain HTTP
+	plainHTTP map[string]bool
+	// authorization headers by registry and scope
+	authorizations map[string]string
+}
+
+// NewClient returns a new registry client with the given options.
+func NewClient(opts *Options) *Client {
+	if opts == nil {
+		opts = &Options{}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &Client{
+		opts:           opts,
+		client:         http.DefaultClient,
+		insecureHTTP:   &http.Client{Transport: transport},
+		plainHTTP:      make(map[string]bool),
+		authorizations: make(map[string]string),
+	}
+}
+
+// requestFunc builds a request against the given base URL of a registry. It may be called more
+// than once for the same request, to retry it with credentials.
+type requestFunc func(baseURL string) (*http.Request, error)
+
+// insecure returns true if TLS is not required for the given registry.
+func (c *Client) insecure(registry string) bool {
+	if c.opts.Insecure {
+		return true
+	}
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (c *Client) baseURL(registry string) string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.plainHTTP[registry] {
+		return "http://" + registry
+	}
+	return "https://" + registry
+}
+
+// do sends the request built by newRequest to the registry of the given reference. When the
+// registry asks for credentials, they are negotiated for the given scope and the request is sent
+// again.
+func (c *Client) do(ref *Reference, scope string, newRequest requestFunc) (*http.Response, error) {
+	authKey := ref.Registry + " " + scope
+	send := func() (*http.Response, error) {
+		req, err := newRequest(c.baseURL(ref.Registry))
+		if err != nil {
+			return nil, err
+		}
+		c.mux.Lock()
+		auth := c.authorizations[authKey]
+		c.mux.Unlock()
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		httpClient := c.client
+		if c.insecure(ref.Registry) {
+			httpClient = c.insecureHTTP
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil && req.URL.Scheme == "https" && c.insecure(ref.Registry) && isPlainHTTPError(err) {
+			log.Debugf("Registry %s does not serve HTTPS, falling back to plain HTTP\n", ref.Registry)
+			c.mux.Lock()
+			c.plainHTTP[ref.Registry] = true
+			c.mux.Unlock()
+			req, err = newRequest(c.baseURL(ref.Registry))
+			if err != nil {
+				return nil, err
+			}
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			return httpClient.Do(req)
+		}
+		return resp, err
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	auth, err := c.authorize(ref.Registry, scope, challenge)
+	if err != nil {
+		return nil, err
+	}
+	c.mux.Lock()
+	c.authorizations[authKey] = auth
+	c.mux.Unlock()
+	return send()
+}
+
+// isPlainHTTPError returns true if the error was caused by an HTTPS request to a server only
+// serving plain HTTP.
+func isPlainHTTPError(err error) bool {
+	return strings.Contains(err.Error(), "server gave HTTP response to HTTPS client")
+}
+
+// registryError is the error body returned by registries.
+type registryError struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// responseError returns an error describing an unexpected response from the registry. The body
+// of the response is consumed and closed.
+func responseError(resp *http.Response, what string) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var regErr registryError
+	if err := json.Unmarshal(body, &regErr); err == nil && len(regErr.Errors) > 0 {
+		msgs := make([]string, len(regErr.Errors))
+		for i, e := range regErr.Errors {
+			msgs[i] = fmt.Sprintf("%s: %s", e.Code, e.Message)
+		}
+		return fmt.Errorf("error %s: %s (%s)", what, resp.Status, strings.Join(msgs, ", "))
+	}
+	return fmt.Errorf("error %s: %s", what, resp.Status)
+}
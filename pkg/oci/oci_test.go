@@ -0,0 +1,272 @@
+package oci
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digest "github.com/opencontainers/go-digest"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+func TestOCI(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	retryDelay = 0
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "OCI Registry Suite")
+}
+
+// fakeRegistry implements the parts of the distribution API used by the client, keeping
+// everything in memory.
+type fakeRegistry struct {
+	mux       sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[string][]byte
+	uploads   int
+	// when not empty, requests must carry a token obtained with these credentials
+	username, password string
+	// blobs that are cut short the next time they are downloaded
+	truncate map[digest.Digest]bool
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:     make(map[digest.Digest][]byte),
+		manifests: make(map[string][]byte),
+		truncate:  make(map[digest.Digest]bool),
+	}
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if r.URL.Path == "/token" {
+		if user, pass, ok := r.BasicAuth(); !ok || user != f.username || pass != f.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"token": "secret"}`)
+		return
+	}
+	if f.username != "" && r.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := r.URL.Path
+	switch {
+	case strings.Contains(path, "/blobs/uploads/") && r.Method == http.MethodPost:
+		w.Header().Set("Location", path+"session")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(path, "/blobs/uploads/") && r.Method == http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		dgst := digest.Digest(r.URL.Query().Get("digest"))
+		if digest.FromBytes(body) != dgst {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[dgst] = body
+		f.uploads++
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/"):
+		blob, ok := f.blobs[digest.Digest(path[strings.LastIndex(path, "/")+1:])]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		dgst := digest.FromBytes(blob)
+		var offset int
+		if rng := r.Header.Get("Range"); rng != "" {
+			offset, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)-offset))
+		if offset > 0 {
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		if f.truncate[dgst] {
+			f.truncate[dgst] = false
+			w.Write(blob[offset : offset+(len(blob)-offset)/2])
+			return
+		}
+		w.Write(blob[offset:])
+	case strings.Contains(path, "/manifests/"):
+		ref := path[strings.LastIndex(path, "/")+1:]
+		if r.Method == http.MethodPut {
+			body, _ := ioutil.ReadAll(r.Body)
+			f.manifests[ref] = body
+			f.manifests[digest.FromBytes(body).String()] = body
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		body, ok := f.manifests[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors": [{"code": "MANIFEST_UNKNOWN", "message": "manifest unknown"}]}`)
+			return
+		}
+		w.Write(body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// mockPackage returns a finalized mock package and its raw metadata.
+func mockPackage() (types.Package, []byte) {
+	pkg := v2.Mock()
+	_, err := pkg.Archive()
+	Expect(err).ToNot(HaveOccurred())
+	rawMeta, err := util.GetRawMeta(pkg)
+	Expect(err).ToNot(HaveOccurred())
+	return pkg, rawMeta
+}
+
+var _ = Describe("Package references", func() {
+	It("Should parse tags and digests", func() {
+		ref, err := ParseReference("oci://registry.example.com:5000/team/app:1.0.0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ref.Registry).To(Equal("registry.example.com:5000"))
+		Expect(ref.Repository).To(Equal("team/app"))
+		Expect(ref.Tag).To(Equal("1.0.0"))
+
+		ref, err = ParseReference("oci://localhost:5000/app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ref.String()).To(Equal("oci://localhost:5000/app:latest"))
+
+		dgst := digest.FromString("test")
+		ref, err = ParseReference("oci://localhost/app@" + dgst.String())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ref.Digest).To(Equal(dgst))
+		Expect(ref.Tag).To(BeEmpty())
+	})
+
+	It("Should refuse invalid references", func() {
+		for _, ref := range []string{"registry/app", "oci://registry", "oci://registry/App", "oci://registry/app@sha256:abc"} {
+			_, err := ParseReference(ref)
+			Expect(err).To(HaveOccurred(), ref)
+		}
+	})
+})
+
+var _ = Describe("Registry client", func() {
+	var registry *fakeRegistry
+	var server *httptest.Server
+	var ref *Reference
+
+	BeforeEach(func() {
+		registry = newFakeRegistry()
+		server = httptest.NewServer(registry)
+		var err error
+		ref, err = ParseReference(fmt.Sprintf("oci://%s/k3p/test:v1", strings.TrimPrefix(server.URL, "http://")))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() { server.Close() })
+
+	It("Should pull the package exactly as it was pushed", func() {
+		pkg, rawMeta := mockPackage()
+		defer pkg.Close()
+		client := NewClient(nil)
+		_, err := client.Push(pkg, []byte(`{"signature": "test"}`), ref)
+		Expect(err).ToNot(HaveOccurred())
+
+		remote, err := client.Fetch(ref)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.RawMeta()).To(Equal(rawMeta))
+		Expect(remote.Signature()).To(Equal([]byte(`{"signature": "test"}`)))
+
+		pulled, err := v2.Load(remote.Reader())
+		Expect(err).ToNot(HaveOccurred())
+		defer pulled.Close()
+		Expect(util.GetRawMeta(pulled)).To(Equal(rawMeta))
+
+		byDigest, err := ParseReference(fmt.Sprintf("%s%s/%s@%s", Scheme, ref.Registry, ref.Repository, remote.Digest))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.Fetch(byDigest)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Should not upload blobs that already exist", func() {
+		pkg, _ := mockPackage()
+		defer pkg.Close()
+		client := NewClient(nil)
+		_, err := client.Push(pkg, nil, ref)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(registry.uploads).ToNot(BeZero())
+		uploads := registry.uploads
+		_, err = client.Push(pkg, nil, ref)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(registry.uploads).To(Equal(uploads))
+	})
+
+	It("Should authenticate with a token", func() {
+		registry.username, registry.password = "user", "pass"
+		pkg, _ := mockPackage()
+		defer pkg.Close()
+
+		_, err := NewClient(&Options{Username: "user", Password: "wrong"}).Push(pkg, nil, ref)
+		Expect(err).To(MatchError(ContainSubstring("401")))
+
+		client := NewClient(&Options{Username: "user", Password: "pass"})
+		_, err = client.Push(pkg, nil, ref)
+		Expect(err).ToNot(HaveOccurred())
+		remote, err := client.Fetch(ref)
+		Expect(err).ToNot(HaveOccurred())
+		pulled, err := v2.Load(remote.Reader())
+		Expect(err).ToNot(HaveOccurred())
+		pulled.Close()
+	})
+
+	It("Should resume interrupted downloads", func() {
+		pkg, _ := mockPackage()
+		defer pkg.Close()
+		client := NewClient(nil)
+		_, err := client.Push(pkg, nil, ref)
+		Expect(err).ToNot(HaveOccurred())
+		for dgst := range registry.blobs {
+			registry.truncate[dgst] = true
+		}
+		remote, err := client.Fetch(ref)
+		Expect(err).ToNot(HaveOccurred())
+		pulled, err := v2.Load(remote.Reader())
+		Expect(err).ToNot(HaveOccurred())
+		pulled.Close()
+	})
+
+	It("Should fail on modified blobs", func() {
+		pkg, _ := mockPackage()
+		defer pkg.Close()
+		client := NewClient(nil)
+		_, err := client.Push(pkg, nil, ref)
+		Expect(err).ToNot(HaveOccurred())
+		k3s := digest.NewDigestFromEncoded(digest.SHA256, pkg.GetMeta().GetManifest().Digests["bin/k3s"].SHA256)
+		registry.blobs[k3s] = []byte("evil")
+		remote, err := client.Fetch(ref)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = v2.Load(remote.Reader())
+		Expect(err).To(MatchError(ContainSubstring("sha256 mismatch in bin/k3s")))
+	})
+
+	It("Should refuse images that are not packages", func() {
+		registry.manifests["v1"] = []byte(`{"schemaVersion": 2, "config": {"mediaType": "application/vnd.oci.image.config.v1+json"}}`)
+		_, err := NewClient(nil).Fetch(ref)
+		Expect(err).To(MatchError(ContainSubstring("is not a k3p package")))
+
+		ref.Tag = "missing"
+		_, err = NewClient(nil).Fetch(ref)
+		Expect(err).To(MatchError(ContainSubstring("MANIFEST_UNKNOWN")))
+	})
+})
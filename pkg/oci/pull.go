@@ -0,0 +1,239 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+// maxManifestSize is the largest manifest or metadata read from a registry
+const maxManifestSize = 4 << 20
+
+// maxRetries is the number of times a blob download is resumed after an error, waiting
+// retryDelay longer between each attempt.
+var (
+	maxRetries = 5
+	retryDelay = time.Second
+)
+
+// Remote is a package in a registry.
+type Remote struct {
+	c   *Client
+	ref *Reference
+	// The digest of the manifest of the package
+	Digest    digest.Digest
+	rawMeta   []byte
+	meta      *types.PackageMeta
+	signature *ocispec.Descriptor
+}
+
+// Fetch retrieves the manifest and metadata of the package at the given reference. The contents
+// of the package are only downloaded once read from the returned Remote.
+func (c *Client) Fetch(ref *Reference) (*Remote, error) {
+	log.Info("Retrieving the package manifest from", ref)
+	resp, err := c.do(ref, pullScope(ref), func(base string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", base, ref.Repository, ref.manifestReference()), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", ocispec.MediaTypeImageManifest)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, "retrieving "+ref.String())
+	}
+	defer resp.Body.Close()
+	rawManifest, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, err
+	}
+	remote := &Remote{c: c, ref: ref, Digest: digest.FromBytes(rawManifest)}
+	if ref.Digest != "" && ref.Digest != remote.Digest {
+		return nil, fmt.Errorf("The manifest of %s has digest %s", ref, remote.Digest)
+	}
+	var m manifest
+	if err := json.Unmarshal(rawManifest, &m); err != nil {
+		return nil, err
+	}
+	if m.Config.MediaType != ConfigMediaType {
+		return nil, fmt.Errorf("%s is not a k3p package (config media type %q)", ref, m.Config.MediaType)
+	}
+	if m.Config.Size > maxManifestSize {
+		return nil, fmt.Errorf("The metadata of %s is too large (%d bytes)", ref, m.Config.Size)
+	}
+
+	config := remote.openBlob(m.Config.MediaType, m.Config)
+	defer config.Close()
+	if remote.rawMeta, err = ioutil.ReadAll(config); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(remote.rawMeta, &remote.meta); err != nil {
+		return nil, err
+	}
+	if remote.meta.Manifest == nil {
+		return nil, fmt.Errorf("The metadata of %s does not include a manifest", ref)
+	}
+
+	// every artifact in the metadata must be a layer with the same digest
+	layers := make(map[string]ocispec.Descriptor)
+	for _, layer := range m.Layers {
+		switch layer.MediaType {
+		case ArtifactMediaType:
+			layers[layer.Annotations[ocispec.AnnotationTitle]] = layer
+		case SignatureMediaType:
+			sig := layer
+			remote.signature = &sig
+		}
+	}
+	for name, d := range remote.meta.Manifest.Digests {
+		if d.Base {
+			continue
+		}
+		layer, ok := layers[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is listed in the package metadata but is not a layer of %s", name, ref)
+		}
+		if layer.Digest.Encoded() != d.SHA256 || layer.Size != d.Size {
+			return nil, fmt.Errorf("The layer for %s does not match the package metadata", name)
+		}
+	}
+	return remote, nil
+}
+
+// GetMeta returns the metadata of the package.
+func (r *Remote) GetMeta() *types.PackageMeta { return r.meta }
+
+// RawMeta returns the metadata of the package exactly as it was pushed.
+func (r *Remote) RawMeta() []byte { return r.rawMeta }
+
+// Signature returns the signature pushed with the package, or nil if it was not signed.
+func (r *Remote) Signature() ([]byte, error) {
+	if r.signature == nil {
+		return nil, nil
+	}
+	rdr := r.openBlob(r.signature.MediaType, *r.signature)
+	defer rdr.Close()
+	return ioutil.ReadAll(rdr)
+}
+
+// Reader returns a reader over the package archive, assembled from the layers as they are
+// downloaded. Every layer is verified against its digest, and downloads interrupted by an
+// error are resumed where they left off.
+func (r *Remote) Reader() io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(v2.Assemble(pw, r.rawMeta, func(name string, d types.ArtifactDigest) (io.ReadCloser, error) {
+			log.Debugf("Downloading %s (%d bytes)\n", name, d.Size)
+			return r.openBlob(name, ocispec.Descriptor{Digest: digest.NewDigestFromEncoded(digest.SHA256, d.SHA256), Size: d.Size}), nil
+		}))
+	}()
+	return pr
+}
+
+// openBlob returns a reader over the contents of the given blob, which are verified against
+// its digest as they are read.
+func (r *Remote) openBlob(name string, desc ocispec.Descriptor) io.ReadCloser {
+	rdr := &blobReader{c: r.c, ref: r.ref, name: name, desc: desc}
+	return util.NewDigestReader(name, rdr, rdr, &types.ArtifactDigest{SHA256: desc.Digest.Encoded(), Size: desc.Size})
+}
+
+// blobReader downloads a blob, resuming with a range request when the download fails.
+type blobReader struct {
+	c      *Client
+	ref    *Reference
+	name   string
+	desc   ocispec.Descriptor
+	body   io.ReadCloser
+	offset int64
+	tries  int
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	for {
+		if b.body == nil {
+			if err := b.connect(); err != nil {
+				if !b.retry(err) {
+					return 0, err
+				}
+				continue
+			}
+		}
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if err == io.EOF && b.offset < b.desc.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		b.body.Close()
+		b.body = nil
+		if !b.retry(err) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// retry returns true if the download should be resumed after the given error.
+func (b *blobReader) retry(err error) bool {
+	if b.tries >= maxRetries {
+		return false
+	}
+	b.tries++
+	log.Warningf("Downloading %s failed at %d of %d bytes (%s), resuming\n", b.name, b.offset, b.desc.Size, err.Error())
+	time.Sleep(time.Duration(b.tries) * retryDelay)
+	return true
+}
+
+func (b *blobReader) connect() error {
+	resp, err := b.c.do(b.ref, pullScope(b.ref), func(base string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/blobs/%s", base, b.ref.Repository, b.desc.Digest), nil)
+		if err != nil {
+			return nil, err
+		}
+		if b.offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && b.offset > 0:
+	case resp.StatusCode == http.StatusOK:
+		// the registry ignored the range, skip what was already read
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, b.offset); err != nil {
+			resp.Body.Close()
+			return err
+		}
+	default:
+		return responseError(resp, "downloading "+b.name)
+	}
+	b.body = resp.Body
+	return nil
+}
+
+func (b *blobReader) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	return b.body.Close()
+}
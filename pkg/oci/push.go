@@ -0,0 +1,240 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+// Media types of the contents of a package in a registry
+const (
+	// The raw package metadata, stored as the config blob of the manifest
+	ConfigMediaType = "application/vnd.k3p.package.config.v1+json"
+	// An artifact of the package, stored as a layer and titled with its path in the archive
+	ArtifactMediaType = "application/vnd.k3p.package.artifact.v1"
+	// The signature over the package metadata, stored as a layer when the package is signed
+	SignatureMediaType = "application/vnd.k3p.package.signature.v1+json"
+)
+
+// manifest is an OCI image manifest. The media type is included, since the version of the
+// image spec in use does not declare it.
+type manifest struct {
+	MediaType string `json:"mediaType"`
+	ocispec.Manifest
+}
+
+// Push uploads the package, along with its signature if not nil, to the registry. The metadata
+// is stored as the config blob and every artifact as a layer. Blobs already in the repository
+// are not uploaded again. The digest of the manifest is returned.
+func (c *Client) Push(pkg types.Package, signature []byte, ref *Reference) (digest.Digest, error) {
+	if ref.Tag == "" {
+		return "", errors.New("Packages can only be pushed to a tag")
+	}
+	rawMeta, err := util.GetRawMeta(pkg)
+	if err != nil {
+		return "", err
+	}
+	var meta types.PackageMeta
+	if err := json.Unmarshal(rawMeta, &meta); err != nil {
+		return "", err
+	}
+	if meta.MetaVersion != v2.MetaVersion || meta.Manifest == nil || len(meta.Manifest.Digests) == 0 {
+		return "", errors.New("The package must be rebuilt with a newer k3p to be pushed to a registry")
+	}
+
+	names := make([]string, 0, len(meta.Manifest.Digests))
+	for name, d := range meta.Manifest.Digests {
+		if !d.Base {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return meta.Manifest.Digests[names[i]].Offset < meta.Manifest.Digests[names[j]].Offset
+	})
+
+	layers := make([]ocispec.Descriptor, 0, len(names)+1)
+	for _, name := range names {
+		d := meta.Manifest.Digests[name]
+		desc := ocispec.Descriptor{
+			MediaType:   ArtifactMediaType,
+			Digest:      digest.NewDigestFromEncoded(digest.SHA256, d.SHA256),
+			Size:        d.Size,
+			Annotations: map[string]string{ocispec.AnnotationTitle: name},
+		}
+		artifactName := name
+		err := c.pushBlob(ref, desc, func() (io.ReadCloser, error) {
+			t, n := v1.ArtifactFromPath(artifactName)
+			artifact := &types.Artifact{Type: t, Name: n}
+			if err := pkg.Get(artifact); err != nil {
+				return nil, err
+			}
+			return artifact.Body, nil
+		})
+		if err != nil {
+			return "", err
+		}
+		layers = append(layers, desc)
+	}
+	if signature != nil {
+		desc := ocispec.Descriptor{MediaType: SignatureMediaType, Digest: digest.FromBytes(signature), Size: int64(len(signature))}
+		if err := c.pushBlob(ref, desc, bytesOpener(signature)); err != nil {
+			return "", err
+		}
+		layers = append(layers, desc)
+	}
+	config := ocispec.Descriptor{MediaType: ConfigMediaType, Digest: digest.FromBytes(rawMeta), Size: int64(len(rawMeta))}
+	if err := c.pushBlob(ref, config, bytesOpener(rawMeta)); err != nil {
+		return "", err
+	}
+
+	m := manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Manifest: ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Config:    config,
+			Layers:    layers,
+			Annotations: map[string]string{
+				ocispec.AnnotationTitle:   meta.Name,
+				ocispec.AnnotationVersion: meta.Version,
+			},
+		},
+	}
+	rawManifest, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Pushing the manifest to %s\n", ref)
+	resp, err := c.do(ref, pushScope(ref), func(base string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/v2/%s/manifests/%s", base, ref.Repository, ref.Tag), bytes.NewReader(rawManifest))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", ocispec.MediaTypeImageManifest)
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", responseError(resp, "pushing the manifest")
+	}
+	resp.Body.Close()
+	return digest.FromBytes(rawManifest), nil
+}
+
+func bytesOpener(b []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(b)), nil }
+}
+
+// pushBlob uploads the contents returned by open to the repository, unless a blob with the
+// same digest is already there.
+func (c *Client) pushBlob(ref *Reference, desc ocispec.Descriptor, open func() (io.ReadCloser, error)) error {
+	exists, err := c.blobExists(ref, desc.Digest)
+	if err != nil {
+		return err
+	}
+	name := desc.Annotations[ocispec.AnnotationTitle]
+	if name == "" {
+		name = desc.MediaType
+	}
+	if exists {
+		log.Infof("%s (%s) already exists in %s/%s\n", name, desc.Digest, ref.Registry, ref.Repository)
+		return nil
+	}
+	log.Infof("Uploading %s (%d bytes)\n", name, desc.Size)
+	resp, err := c.do(ref, pushScope(ref), func(base string) (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v2/%s/blobs/uploads/", base, ref.Repository), nil)
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return responseError(resp, "starting an upload")
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return errors.New("The registry did not return a location to upload to")
+	}
+	resp, err = c.do(ref, pushScope(ref), func(base string) (*http.Request, error) {
+		uploadURL, err := uploadLocation(base, location)
+		if err != nil {
+			return nil, err
+		}
+		query := uploadURL.Query()
+		query.Set("digest", desc.Digest.String())
+		uploadURL.RawQuery = query.Encode()
+		body, err := open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPut, uploadURL.String(), body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		req.ContentLength = desc.Size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp, "uploading "+name)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// uploadLocation resolves the location returned when starting an upload, which may be
+// relative to the registry.
+func uploadLocation(base, location string) (*url.URL, error) {
+	baseURL, err := url.Parse(base + "/")
+	if err != nil {
+		return nil, err
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	return baseURL.ResolveReference(loc), nil
+}
+
+func (c *Client) blobExists(ref *Reference, dgst digest.Digest) (bool, error) {
+	resp, err := c.do(ref, pushScope(ref), func(base string) (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, fmt.Sprintf("%s/v2/%s/blobs/%s", base, ref.Repository, dgst), nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		resp.Body.Close()
+		return true, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return false, nil
+	}
+	return false, responseError(resp, "checking for "+dgst.String())
+}
+
+func pullScope(ref *Reference) string { return fmt.Sprintf("repository:%s:pull", ref.Repository) }
+
+func pushScope(ref *Reference) string { return fmt.Sprintf("repository:%s:pull,push", ref.Repository) }
@@ -0,0 +1,86 @@
+package oci
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Scheme is the prefix identifying package references in a registry.
+const Scheme = "oci://"
+
+// defaultTag is used when a reference includes neither a tag nor a digest
+const defaultTag = "latest"
+
+var (
+	repositoryRegex = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*)*$`)
+	tagRegex        = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+// Reference points to a package in a registry.
+type Reference struct {
+	// The host, and optionally port, of the registry
+	Registry string
+	// The repository inside the registry
+	Repository string
+	// The tag of the package, empty when it is referenced by digest
+	Tag string
+	// The digest of the package manifest, empty when it is referenced by tag
+	Digest digest.Digest
+}
+
+// IsReference returns true if the given path points to a registry.
+func IsReference(path string) bool { return strings.HasPrefix(path, Scheme) }
+
+// ParseReference parses a reference of the form oci://registry[:port]/repository[:tag|@digest].
+// When neither a tag nor a digest is given, the latest tag is used.
+func ParseReference(ref string) (*Reference, error) {
+	if !IsReference(ref) {
+		return nil, fmt.Errorf("%q is not a registry reference, it must start with %s", ref, Scheme)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(ref, Scheme), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("%q must include both a registry and a repository", ref)
+	}
+	out := &Reference{Registry: parts[0]}
+	repo := parts[1]
+	if idx := strings.Index(repo, "@"); idx != -1 {
+		dgst, err := digest.Parse(repo[idx+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%q has an invalid digest: %s", ref, err.Error())
+		}
+		out.Digest = dgst
+		repo = repo[:idx]
+	} else if idx := strings.LastIndex(repo, ":"); idx != -1 && !strings.Contains(repo[idx:], "/") {
+		out.Tag = repo[idx+1:]
+		repo = repo[:idx]
+		if !tagRegex.MatchString(out.Tag) {
+			return nil, fmt.Errorf("%q has an invalid tag", ref)
+		}
+	} else {
+		out.Tag = defaultTag
+	}
+	if !repositoryRegex.MatchString(repo) {
+		return nil, fmt.Errorf("%q has an invalid repository name, it must be lowercase", ref)
+	}
+	out.Repository = repo
+	return out, nil
+}
+
+// manifestReference returns the tag or digest the manifest is retrieved with.
+func (r *Reference) manifestReference() string {
+	if r.Digest != "" {
+		return r.Digest.String()
+	}
+	return r.Tag
+}
+
+// String returns the reference in the form it is parsed from.
+func (r *Reference) String() string {
+	if r.Digest != "" {
+		return fmt.Sprintf("%s%s/%s@%s", Scheme, r.Registry, r.Repository, r.Digest)
+	}
+	return fmt.Sprintf("%s%s/%s:%s", Scheme, r.Registry, r.Repository, r.Tag)
+}
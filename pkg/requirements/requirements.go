@@ -0,0 +1,176 @@
+package requirements
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/Masterminds/semver"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+const (
+	// loadedModulesFile lists the kernel modules loaded on a node
+	loadedModulesFile = "/proc/modules"
+	// kernelReleaseFile contains the release of the kernel running on a node
+	kernelReleaseFile = "/proc/sys/kernel/osrelease"
+	// modulesDir contains the modules available for each kernel release on a node
+	modulesDir = "/lib/modules"
+)
+
+// Check returns an error describing every requirement of the package with the given metadata that
+// is not met by the node, or by the packages recorded as installed on the cluster.
+func Check(target types.Node, meta *types.PackageMeta, installed []types.InstalledPackage) error {
+	cfg := meta.GetPackageConfig()
+	if cfg == nil || cfg.Requires == nil {
+		return nil
+	}
+	reqs := cfg.Requires
+	log.Infof("Checking the requirements of %q\n", meta.GetName())
+	if err := reqs.Validate(); err != nil {
+		return err
+	}
+
+	problems := CheckK3sVersion(reqs, meta.GetK3sVersion())
+	problems = append(problems, checkPackages(reqs.Packages, installed)...)
+	if len(reqs.KernelModules) > 0 && target.GetType() == types.NodeDocker {
+		log.Info("Skipping the kernel module requirements, docker nodes use the modules of the host")
+	} else if len(reqs.KernelModules) > 0 {
+		missing, err := missingKernelModules(target, reqs.KernelModules)
+		if err != nil {
+			return err
+		}
+		for _, module := range missing {
+			problems = append(problems, fmt.Sprintf("the %q kernel module is not loaded or available on the node", module))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s %s cannot be installed:\n  - %s", meta.GetName(), meta.GetVersion(), strings.Join(problems, "\n  - "))
+}
+
+// CheckK3sVersion returns a description of the problem if the given k3s version is outside the
+// range allowed by the requirements.
+func CheckK3sVersion(reqs *types.Requirements, k3sVersion string) []string {
+	if reqs.MinK3sVersion == "" && reqs.MaxK3sVersion == "" {
+		return nil
+	}
+	version, err := semver.NewVersion(k3sVersion)
+	if err != nil {
+		return []string{fmt.Sprintf("the k3s version %q cannot be compared to the supported range: %s", k3sVersion, err.Error())}
+	}
+	var problems []string
+	if reqs.MinK3sVersion != "" && version.LessThan(semver.MustParse(reqs.MinK3sVersion)) {
+		problems = append(problems, fmt.Sprintf("k3s %s or newer is required, but the package installs %s", reqs.MinK3sVersion, k3sVersion))
+	}
+	if reqs.MaxK3sVersion != "" && version.GreaterThan(semver.MustParse(reqs.MaxK3sVersion)) {
+		problems = append(problems, fmt.Sprintf("k3s %s or older is required, but the package installs %s", reqs.MaxK3sVersion, k3sVersion))
+	}
+	return problems
+}
+
+func checkPackages(reqs []types.PackageRequirement, installed []types.InstalledPackage) []string {
+	var problems []string
+	for _, req := range reqs {
+		var found *types.InstalledPackage
+		for i := range installed {
+			if installed[i].Name == req.Name {
+				found = &installed[i]
+				break
+			}
+		}
+		switch {
+		case found == nil && req.Version == "":
+			problems = append(problems, fmt.Sprintf("package %q must be installed first", req.Name))
+		case found == nil:
+			problems = append(problems, fmt.Sprintf("package %q (%s) must be installed first", req.Name, req.Version))
+		case req.Version != "":
+			version, err := semver.NewVersion(found.Version)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("package %q is installed at %q, which cannot be compared to the required range %q", req.Name, found.Version, req.Version))
+				continue
+			}
+			constraint, _ := semver.NewConstraint(req.Version)
+			if !constraint.Check(version) {
+				problems = append(problems, fmt.Sprintf("package %q %s is required, but %s is installed", req.Name, req.Version, found.Version))
+			}
+		}
+	}
+	return problems
+}
+
+// missingKernelModules returns the given modules that are neither loaded on the node nor available
+// to be loaded by the running kernel.
+func missingKernelModules(target types.Node, modules []string) ([]string, error) {
+	available, err := readModuleNames(target, loadedModulesFile, func(line string) string {
+		return strings.Fields(line)[0]
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the kernel modules loaded on the node: %s", err.Error())
+	}
+
+	// modules built into the kernel or installed for it can be loaded by k3s when it starts
+	if release, err := readFile(target, kernelReleaseFile); err == nil {
+		releaseDir := path.Join(modulesDir, strings.TrimSpace(release))
+		for _, index := range []string{"modules.builtin", "modules.dep"} {
+			names, err := readModuleNames(target, path.Join(releaseDir, index), func(line string) string {
+				return strings.SplitN(path.Base(strings.SplitN(line, ":", 2)[0]), ".ko", 2)[0]
+			})
+			if err != nil {
+				log.Debugf("Could not read the %s index of the node kernel: %s\n", index, err.Error())
+				continue
+			}
+			for name := range names {
+				available[name] = struct{}{}
+			}
+		}
+	} else {
+		log.Debugf("Could not read the kernel release of the node: %s\n", err.Error())
+	}
+
+	if len(available) == 0 {
+		// a node without any modules is more likely a node whose files could not be read
+		return nil, fmt.Errorf("Could not find any kernel modules on the node in %s or %s", loadedModulesFile, modulesDir)
+	}
+
+	var missing []string
+	for _, module := range modules {
+		if _, ok := available[moduleName(module)]; !ok {
+			missing = append(missing, module)
+		}
+	}
+	return missing, nil
+}
+
+// moduleName normalizes a module name, dashes and underscores are interchangeable in them.
+func moduleName(name string) string { return strings.Replace(name, "-", "_", -1) }
+
+func readModuleNames(target types.Node, file string, parseLine func(string) string) (map[string]struct{}, error) {
+	body, err := readFile(target, file)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{})
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			names[moduleName(parseLine(line))] = struct{}{}
+		}
+	}
+	return names, scanner.Err()
+}
+
+func readFile(target types.Node, file string) (string, error) {
+	rdr, err := target.GetFile(file)
+	if err != nil {
+		return "", err
+	}
+	defer rdr.Close()
+	body, err := ioutil.ReadAll(rdr)
+	return string(body), err
+}
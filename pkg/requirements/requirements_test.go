@@ -0,0 +1,81 @@
+package requirements
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/tinyzimmer/k3p/pkg/cluster/node"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestRequirements(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Requirements Suite")
+}
+
+func writeFile(target types.Node, path, contents string) {
+	Expect(target.WriteFile(ioutil.NopCloser(strings.NewReader(contents)), path, "0644", int64(len(contents)))).To(Succeed())
+}
+
+func metaWith(reqs *types.Requirements) *types.PackageMeta {
+	return &types.PackageMeta{
+		Name:          "app",
+		Version:       "v1.0.0",
+		K3sVersion:    "v1.19.4+k3s1",
+		PackageConfig: &types.PackageConfig{Requires: reqs},
+	}
+}
+
+var _ = Describe("Package requirements", func() {
+	var target types.Node
+
+	BeforeEach(func() {
+		target = node.Mock()
+		writeFile(target, loadedModulesFile, "br_netfilter 28672 0 - Live 0x0000000000000000\noverlay 118784 0 - Live 0x0000000000000000\n")
+		writeFile(target, kernelReleaseFile, "5.4.0-test\n")
+		writeFile(target, modulesDir+"/5.4.0-test/modules.builtin", "kernel/net/ipv4/ip_tables.ko\n")
+		writeFile(target, modulesDir+"/5.4.0-test/modules.dep", "kernel/net/netfilter/xt_conntrack.ko.xz: kernel/net/netfilter/nf_conntrack.ko.xz\n")
+	})
+
+	AfterEach(func() { target.Close() })
+
+	It("Should accept packages without requirements", func() {
+		Expect(Check(target, &types.PackageMeta{Name: "app"}, nil)).To(Succeed())
+	})
+
+	It("Should accept packages whose requirements are met", func() {
+		meta := metaWith(&types.Requirements{
+			MinK3sVersion: "v1.19.0",
+			MaxK3sVersion: "v1.20.0",
+			KernelModules: []string{"br-netfilter", "overlay", "ip_tables", "xt_conntrack"},
+			Packages:      []types.PackageRequirement{{Name: "platform", Version: ">= 1.2.0, < 2.0.0"}, {Name: "storage"}},
+		})
+		installed := []types.InstalledPackage{{Name: "platform", Version: "v1.4.2"}, {Name: "storage", Version: "latest"}}
+		Expect(Check(target, meta, installed)).To(Succeed())
+	})
+
+	It("Should report every requirement that is not met", func() {
+		meta := metaWith(&types.Requirements{
+			MinK3sVersion: "v1.20.0",
+			KernelModules: []string{"wireguard"},
+			Packages:      []types.PackageRequirement{{Name: "platform", Version: "^2.0.0"}, {Name: "storage"}},
+		})
+		err := Check(target, meta, []types.InstalledPackage{{Name: "platform", Version: "v1.4.2"}})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("k3s v1.20.0 or newer is required"))
+		Expect(err.Error()).To(ContainSubstring(`"wireguard" kernel module`))
+		Expect(err.Error()).To(ContainSubstring(`package "platform" ^2.0.0 is required, but v1.4.2 is installed`))
+		Expect(err.Error()).To(ContainSubstring(`package "storage" must be installed first`))
+	})
+
+	It("Should refuse invalid version ranges", func() {
+		meta := metaWith(&types.Requirements{Packages: []types.PackageRequirement{{Name: "platform", Version: "not a range"}}})
+		Expect(Check(target, meta, nil)).To(MatchError(ContainSubstring("is not valid")))
+	})
+})
@@ -0,0 +1,125 @@
+package sbom
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The subset of the CycloneDX 1.4 JSON schema used to describe packages.
+
+type cdxDocument struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTool struct {
+	Vendor  string `json:"vendor"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cdxComponent struct {
+	BOMRef     string        `json:"bom-ref,omitempty"`
+	Type       string        `json:"type"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	PURL       string        `json:"purl,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (d *document) cycloneDX() *cdxDocument {
+	// a version 4 style UUID taken from the contents, so the same package gets the same serial
+	ns := d.namespace()
+	uuid := ns[:16]
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	doc := &cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: d.created.Format(time.RFC3339),
+			Tools:     []cdxTool{{Vendor: "tinyzimmer", Name: "k3p", Version: toolVersion()}},
+			Component: cdxComponent{
+				BOMRef:  fmt.Sprintf("%s@%s", d.meta.GetName(), d.meta.GetVersion()),
+				Type:    "application",
+				Name:    d.meta.GetName(),
+				Version: d.meta.GetVersion(),
+				Properties: []cdxProperty{
+					{Name: "k3p:k3sVersion", Value: d.meta.GetK3sVersion()},
+					{Name: "k3p:arch", Value: d.meta.GetArch()},
+				},
+			},
+		},
+		Components: make([]cdxComponent, 0, len(d.components)),
+	}
+	seen := make(map[string]int)
+	for _, c := range d.components {
+		ref := fmt.Sprintf("%s:%s:%s", c.kind, c.path, c.name)
+		if n := seen[ref]; n > 0 {
+			ref = fmt.Sprintf("%s:%d", ref, n)
+		}
+		seen[ref]++
+		comp := cdxComponent{
+			BOMRef:     ref,
+			Type:       cdxType(c.kind),
+			Name:       c.name,
+			Version:    c.version,
+			Hashes:     []cdxHash{{Alg: "SHA-256", Content: c.sha256}},
+			PURL:       c.purl,
+			Properties: []cdxProperty{{Name: "k3p:kind", Value: string(c.kind)}, {Name: "k3p:path", Value: c.path}},
+		}
+		if c.sha1 != "" {
+			comp.Hashes = append(comp.Hashes, cdxHash{Alg: "SHA-1", Content: c.sha1})
+		}
+		if c.kind == kindImage {
+			comp.Properties = append(comp.Properties, cdxProperty{Name: "k3p:imageID", Value: "sha256:" + c.sha256})
+		}
+		if c.arch != "" {
+			comp.Properties = append(comp.Properties, cdxProperty{Name: "k3p:arch", Value: c.arch})
+		}
+		keys := make([]string, 0, len(c.details))
+		for k := range c.details {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			comp.Properties = append(comp.Properties, cdxProperty{Name: "k3p:" + k, Value: c.details[k]})
+		}
+		doc.Components = append(doc.Components, comp)
+	}
+	return doc
+}
+
+func cdxType(kind componentKind) string {
+	switch kind {
+	case kindImage:
+		return "container"
+	case kindManifest:
+		return "file"
+	}
+	return "application"
+}
@@ -0,0 +1,360 @@
+package sbom
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"helm.sh/helm/v3/pkg/chart/loader"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/codec"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/version"
+)
+
+// Formats returns the formats a bill of materials can be produced in.
+func Formats() []types.SBOMFormat {
+	return []types.SBOMFormat{types.SBOMFormatSPDX, types.SBOMFormatCycloneDX}
+}
+
+// ParseFormat returns the format with the given name.
+func ParseFormat(name string) (types.SBOMFormat, error) {
+	for _, format := range Formats() {
+		if string(format) == strings.ToLower(name) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not a valid SBOM format", name)
+}
+
+// FileName returns the name of the artifact holding a bill of materials in the given format.
+func FileName(format types.SBOMFormat) string {
+	if format == types.SBOMFormatCycloneDX {
+		return "sbom.cdx.json"
+	}
+	return "sbom.spdx.json"
+}
+
+// Find returns the bill of materials in the given format embedded in the package, or nil if
+// there is none.
+func Find(pkg types.Package, format types.SBOMFormat) ([]byte, error) {
+	name := FileName(format)
+	for _, embedded := range pkg.GetMeta().GetManifest().SBOM {
+		if embedded != name {
+			continue
+		}
+		artifact := &types.Artifact{Type: types.ArtifactSBOM, Name: name}
+		if err := pkg.Get(artifact); err != nil {
+			return nil, err
+		}
+		defer artifact.Body.Close()
+		return ioutil.ReadAll(artifact.Body)
+	}
+	return nil, nil
+}
+
+// Generate produces a bill of materials in the given format for the contents of the package. It
+// lists the k3s binaries, every container image with its ID, every helm chart with its version,
+// and every raw manifest, along with their digests. Artifacts that a delta package takes from its
+// base cannot be read, and the images and charts inside them are left out.
+func Generate(pkg types.Package, format types.SBOMFormat) ([]byte, error) {
+	return GenerateAt(pkg, format, time.Now())
+}
+
+// GenerateAt is like Generate, but records the given time as the creation time of the document
+// instead of the current one. Every other field is derived from the package, so the same package
+// and time always produce the same document.
+func GenerateAt(pkg types.Package, format types.SBOMFormat, created time.Time) ([]byte, error) {
+	meta := pkg.GetMeta()
+	components, err := collect(pkg, meta)
+	if err != nil {
+		return nil, err
+	}
+	doc := &document{meta: meta, components: components, created: created.UTC().Truncate(time.Second)}
+	var out interface{}
+	switch format {
+	case types.SBOMFormatSPDX:
+		out = doc.spdx()
+	case types.SBOMFormatCycloneDX:
+		out = doc.cycloneDX()
+	default:
+		return nil, fmt.Errorf("%q is not a valid SBOM format", format)
+	}
+	return json.MarshalIndent(out, "", "  ")
+}
+
+// componentKind is the kind of a component listed in a bill of materials.
+type componentKind string
+
+const (
+	kindBinary   componentKind = "binary"
+	kindImage    componentKind = "image"
+	kindChart    componentKind = "helm-chart"
+	kindManifest componentKind = "manifest"
+)
+
+// component is something listed in a bill of materials.
+type component struct {
+	kind    componentKind
+	name    string
+	version string
+	// the hex encoded sha256sum, for images this is the image ID
+	sha256 string
+	// the hex encoded sha1sum, only populated for manifests
+	sha1 string
+	// the path of the artifact in the package the component was found in
+	path string
+	// the architecture of binaries and images in packages built for multiple architectures
+	arch string
+	purl string
+	// extra details included as properties or comments
+	details map[string]string
+}
+
+// document holds everything that goes in a bill of materials, independent of the format.
+type document struct {
+	meta       *types.PackageMeta
+	components []*component
+	created    time.Time
+}
+
+// toolVersion returns the version of k3p recorded as the tool producing the document.
+func toolVersion() string {
+	if version.K3pVersion == "" {
+		return "unknown"
+	}
+	return version.K3pVersion
+}
+
+// namespace returns a value identifying the contents of the document, derived from the digests
+// of the components, for use in identifiers that must be unique to the document.
+func (d *document) namespace() [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", d.meta.GetName(), d.meta.GetVersion())
+	for _, c := range d.components {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00", c.kind, c.path, c.sha256)
+	}
+	var out [sha256.Size]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+func collect(pkg types.Package, meta *types.PackageMeta) ([]*component, error) {
+	digests := meta.GetManifest().Digests
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	multiArch := strings.Contains(meta.GetArch(), ",")
+	components := make([]*component, 0)
+	for _, name := range names {
+		digest := digests[name]
+		t, relName := v1.ArtifactFromPath(name)
+		var arch string
+		if multiArch && path.Dir(relName) != "." {
+			arch = path.Dir(relName)
+		}
+		switch t {
+		case types.ArtifactBin:
+			c := &component{kind: kindBinary, name: path.Base(relName), sha256: digest.SHA256, path: name, arch: arch}
+			if c.name == "k3s" {
+				c.version = meta.GetK3sVersion()
+				c.purl = fmt.Sprintf("pkg:github/k3s-io/k3s@%s", c.version)
+			}
+			components = append(components, c)
+		case types.ArtifactImages:
+			if !readable(name, digest) {
+				continue
+			}
+			images, err := readImages(pkg, t, relName)
+			if err != nil {
+				return nil, fmt.Errorf("reading the images in %s: %s", name, err.Error())
+			}
+			for _, img := range images {
+				img.path, img.arch = name, arch
+			}
+			components = append(components, images...)
+		case types.ArtifactStatic:
+			if !strings.HasSuffix(relName, ".tgz") || !readable(name, digest) {
+				continue
+			}
+			chart, err := readChart(pkg, relName)
+			if err != nil {
+				log.Debugf("%s is not a helm chart: %s\n", name, err.Error())
+				continue
+			}
+			chart.sha256, chart.path = digest.SHA256, name
+			components = append(components, chart)
+		case types.ArtifactManifest:
+			c := &component{kind: kindManifest, name: relName, sha256: digest.SHA256, path: name}
+			if digest.Base {
+				log.Warningf("%s is taken from the base package, it is listed without a SHA1 checksum\n", name)
+			} else if err := manifestSHA1(pkg, c); err != nil {
+				return nil, err
+			}
+			components = append(components, c)
+		}
+	}
+	return components, nil
+}
+
+// readable returns true if the contents of the artifact are in the package, logging a warning
+// when they are not.
+func readable(name string, digest types.ArtifactDigest) bool {
+	if digest.Base || digest.Delta != nil {
+		log.Warningf("%s is taken from the base package, its contents are not listed in the SBOM\n", name)
+		return false
+	}
+	return true
+}
+
+func manifestSHA1(pkg types.Package, c *component) error {
+	artifact := &types.Artifact{Type: types.ArtifactManifest, Name: c.name}
+	if err := pkg.Get(artifact); err != nil {
+		return err
+	}
+	defer artifact.Body.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, artifact.Body); err != nil {
+		return err
+	}
+	c.sha1 = fmt.Sprintf("%x", h.Sum(nil))
+	return nil
+}
+
+func readChart(pkg types.Package, name string) (*component, error) {
+	artifact := &types.Artifact{Type: types.ArtifactStatic, Name: name}
+	if err := pkg.Get(artifact); err != nil {
+		return nil, err
+	}
+	defer artifact.Body.Close()
+	chart, err := loader.LoadArchive(artifact.Body)
+	if err != nil {
+		return nil, err
+	}
+	c := &component{kind: kindChart, name: chart.Name(), version: chart.Metadata.Version, details: map[string]string{}}
+	if chart.Metadata.AppVersion != "" {
+		c.details["appVersion"] = chart.Metadata.AppVersion
+	}
+	return c, nil
+}
+
+// imageManifest is an entry in the manifest.json of an image tarball produced by docker save.
+type imageManifest struct {
+	Config   string
+	RepoTags []string
+}
+
+// readImages lists the images in a tarball produced by docker save. The ID of every image is
+// the digest of its config.
+func readImages(pkg types.Package, t types.ArtifactType, name string) ([]*component, error) {
+	artifact := &types.Artifact{Type: t, Name: name}
+	if err := pkg.Get(artifact); err != nil {
+		return nil, err
+	}
+	defer artifact.Body.Close()
+	rdr, err := codec.Decompress(artifact.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+
+	var manifests []imageManifest
+	configs := make(map[string]string)
+	tarReader := tar.NewReader(rdr)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || !strings.HasSuffix(header.Name, ".json") {
+			continue
+		}
+		if header.Name == "manifest.json" {
+			if err := json.NewDecoder(tarReader).Decode(&manifests); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tarReader); err != nil {
+			return nil, err
+		}
+		configs[header.Name] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	if manifests == nil {
+		return nil, fmt.Errorf("no manifest.json found in %s", name)
+	}
+
+	out := make([]*component, 0)
+	for _, m := range manifests {
+		id, ok := configs[m.Config]
+		if !ok && strings.HasPrefix(m.Config, "blobs/sha256/") {
+			// image layouts name the config after its digest
+			id, ok = path.Base(m.Config), true
+		}
+		if !ok {
+			return nil, fmt.Errorf("the config of an image in %s was not found", name)
+		}
+		if len(m.RepoTags) == 0 {
+			out = append(out, &component{kind: kindImage, name: "sha256:" + id, sha256: id, details: map[string]string{}})
+			continue
+		}
+		for _, repoTag := range m.RepoTags {
+			repo, tag := splitRepoTag(repoTag)
+			out = append(out, &component{
+				kind:    kindImage,
+				name:    repo,
+				version: tag,
+				sha256:  id,
+				purl:    imagePURL(repo, id),
+				details: map[string]string{},
+			})
+		}
+	}
+	return out, nil
+}
+
+// splitRepoTag splits an image name into the repository and the tag.
+func splitRepoTag(repoTag string) (string, string) {
+	idx := strings.LastIndex(repoTag, ":")
+	if idx == -1 || strings.Contains(repoTag[idx:], "/") {
+		return repoTag, "latest"
+	}
+	return repoTag[:idx], repoTag[idx+1:]
+}
+
+// imagePURL returns the package URL of a docker image with the given ID.
+func imagePURL(repo, id string) string {
+	parts := strings.SplitN(repo, "/", 2)
+	registry := ""
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry, repo = parts[0], parts[1]
+	}
+	if registry == "docker.io" {
+		registry = ""
+	}
+	if registry == "" && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	purl := fmt.Sprintf("pkg:docker/%s@sha256%%3A%s", repo, id)
+	if registry != "" {
+		purl += "?repository_url=" + registry
+	}
+	return purl
+}
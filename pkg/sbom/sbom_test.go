@@ -0,0 +1,146 @@
+package sbom
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestSBOM(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SBOM Suite")
+}
+
+const imageConfig = `{"architecture":"amd64"}`
+
+// tarball returns a tar archive of the given files, gzipped if requested.
+func tarball(files map[string]string, gz bool) []byte {
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var gw *gzip.Writer
+	if gz {
+		gw = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gw)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for name, body := range files {
+		Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg})).To(Succeed())
+		_, err := tw.Write([]byte(body))
+		Expect(err).ToNot(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	if gw != nil {
+		Expect(gw.Close()).To(Succeed())
+	}
+	return buf.Bytes()
+}
+
+func put(pkg types.Package, t types.ArtifactType, name string, body []byte) {
+	Expect(pkg.Put(&types.Artifact{Type: t, Name: name, Body: ioutil.NopCloser(bytes.NewReader(body)), Size: int64(len(body))})).To(Succeed())
+}
+
+func newPackage() types.Package {
+	tmpDir, err := ioutil.TempDir("", "")
+	Expect(err).ToNot(HaveOccurred())
+	pkg := v2.New(tmpDir)
+	put(pkg, types.ArtifactBin, "k3s", []byte("k3s"))
+	put(pkg, types.ArtifactImages, "manifest-images.tar", tarball(map[string]string{
+		"manifest.json": `[{"Config":"abc.json","RepoTags":["nginx:1.19","registry.example.com/team/app:v1"]}]`,
+		"abc.json":      imageConfig,
+	}, false))
+	put(pkg, types.ArtifactStatic, "charts/app-0.1.0.tgz", tarball(map[string]string{
+		"app/Chart.yaml": "apiVersion: v2\nname: app\nversion: 0.1.0\nappVersion: 1.2.3\n",
+	}, true))
+	put(pkg, types.ArtifactManifest, "app.yaml", []byte("kind: ConfigMap"))
+	Expect(pkg.PutMeta(&types.PackageMeta{Name: "test", Version: "v1", K3sVersion: "v1.19.4+k3s1", Arch: "amd64"})).To(Succeed())
+	return pkg
+}
+
+var _ = Describe("Generating SBOMs", func() {
+	var pkg types.Package
+	imageID := fmt.Sprintf("%x", sha256.Sum256([]byte(imageConfig)))
+
+	BeforeEach(func() { pkg = newPackage() })
+	AfterEach(func() { pkg.Close() })
+
+	It("Should list every component in SPDX documents", func() {
+		raw, err := Generate(pkg, types.SBOMFormatSPDX)
+		Expect(err).ToNot(HaveOccurred())
+		var doc spdxDocument
+		Expect(json.Unmarshal(raw, &doc)).To(Succeed())
+		Expect(doc.SPDXVersion).To(Equal("SPDX-2.2"))
+
+		versions := make(map[string]string)
+		for _, p := range doc.Packages {
+			versions[p.Name] = p.VersionInfo
+		}
+		Expect(versions).To(Equal(map[string]string{
+			"test":                          "v1",
+			"k3s":                           "v1.19.4+k3s1",
+			"nginx":                         "1.19",
+			"registry.example.com/team/app": "v1",
+			"app":                           "0.1.0",
+		}))
+		for _, p := range doc.Packages {
+			if p.Name == "nginx" {
+				Expect(p.Checksums[0].ChecksumValue).To(Equal(imageID))
+				Expect(p.ExternalRefs[0].ReferenceLocator).To(Equal("pkg:docker/library/nginx@sha256%3A" + imageID))
+			}
+		}
+		Expect(doc.Files).To(HaveLen(1))
+		Expect(doc.Files[0].FileName).To(Equal("./manifests/app.yaml"))
+		Expect(doc.Files[0].Checksums).To(HaveLen(2))
+		Expect(doc.Relationships).To(HaveLen(6))
+	})
+
+	It("Should list every component in CycloneDX documents", func() {
+		raw, err := Generate(pkg, types.SBOMFormatCycloneDX)
+		Expect(err).ToNot(HaveOccurred())
+		var doc cdxDocument
+		Expect(json.Unmarshal(raw, &doc)).To(Succeed())
+		Expect(doc.SerialNumber).To(MatchRegexp(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+
+		byType := make(map[string][]string)
+		for _, c := range doc.Components {
+			byType[c.Type] = append(byType[c.Type], c.Name)
+		}
+		Expect(byType["container"]).To(ConsistOf("nginx", "registry.example.com/team/app"))
+		Expect(byType["application"]).To(ConsistOf("k3s", "app"))
+		Expect(byType["file"]).To(ConsistOf("app.yaml"))
+		for _, c := range doc.Components {
+			if c.Name == "registry.example.com/team/app" {
+				Expect(c.PURL).To(Equal("pkg:docker/team/app@sha256%3A" + imageID + "?repository_url=registry.example.com"))
+			}
+			if c.Name == "app" {
+				Expect(c.Properties).To(ContainElement(cdxProperty{Name: "k3p:appVersion", Value: "1.2.3"}))
+			}
+		}
+	})
+
+	It("Should find documents embedded in the package", func() {
+		raw, err := Find(pkg, types.SBOMFormatSPDX)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(raw).To(BeNil())
+
+		raw, err = Generate(pkg, types.SBOMFormatSPDX)
+		Expect(err).ToNot(HaveOccurred())
+		put(pkg, types.ArtifactSBOM, FileName(types.SBOMFormatSPDX), raw)
+		found, err := Find(pkg, types.SBOMFormatSPDX)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(Equal(raw))
+	})
+})
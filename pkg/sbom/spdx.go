@@ -0,0 +1,167 @@
+package sbom
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The subset of the SPDX 2.2 JSON schema used to describe packages.
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files,omitempty"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+	Comment          string            `json:"comment,omitempty"`
+}
+
+type spdxFile struct {
+	SPDXID           string         `json:"SPDXID"`
+	FileName         string         `json:"fileName"`
+	Checksums        []spdxChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	CopyrightText    string         `json:"copyrightText"`
+	Comment          string         `json:"comment,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+const spdxNoAssertion = "NOASSERTION"
+
+var spdxIDRegex = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// spdxID returns an SPDX identifier built from the given parts.
+func spdxID(parts ...string) string {
+	return "SPDXRef-" + strings.Trim(spdxIDRegex.ReplaceAllString(strings.Join(parts, "-"), "-"), "-")
+}
+
+func (d *document) spdx() *spdxDocument {
+	rootID := spdxID("Package", d.meta.GetName())
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              fmt.Sprintf("%s-%s", d.meta.GetName(), d.meta.GetVersion()),
+		DocumentNamespace: fmt.Sprintf("https://github.com/tinyzimmer/k3p/spdx/%s/%s-%x", d.meta.GetName(), d.meta.GetVersion(), d.namespace()),
+		CreationInfo: spdxCreationInfo{
+			Created:  d.created.Format(time.RFC3339),
+			Creators: []string{"Tool: k3p-" + toolVersion()},
+		},
+		Packages: []spdxPackage{{
+			SPDXID:           rootID,
+			Name:             d.meta.GetName(),
+			VersionInfo:      d.meta.GetVersion(),
+			DownloadLocation: spdxNoAssertion,
+			LicenseConcluded: spdxNoAssertion,
+			LicenseDeclared:  spdxNoAssertion,
+			CopyrightText:    spdxNoAssertion,
+			Comment:          fmt.Sprintf("k3p package for k3s %s (%s)", d.meta.GetK3sVersion(), d.meta.GetArch()),
+		}},
+		Relationships: []spdxRelationship{{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: rootID}},
+	}
+
+	seen := make(map[string]int)
+	for _, c := range d.components {
+		id := spdxID(string(c.kind), c.path, c.name)
+		// images with several tags in the same tarball share everything but their names
+		if n := seen[id]; n > 0 {
+			id = fmt.Sprintf("%s-%d", id, n)
+		}
+		seen[id]++
+
+		if c.kind == kindManifest {
+			file := spdxFile{
+				SPDXID:           id,
+				FileName:         "./" + c.path,
+				Checksums:        []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: c.sha256}},
+				LicenseConcluded: spdxNoAssertion,
+				CopyrightText:    spdxNoAssertion,
+			}
+			if c.sha1 != "" {
+				file.Checksums = append([]spdxChecksum{{Algorithm: "SHA1", ChecksumValue: c.sha1}}, file.Checksums...)
+			}
+			doc.Files = append(doc.Files, file)
+			doc.Relationships = append(doc.Relationships, spdxRelationship{SPDXElementID: rootID, RelationshipType: "CONTAINS", RelatedSPDXElement: id})
+			continue
+		}
+
+		pkg := spdxPackage{
+			SPDXID:           id,
+			Name:             c.name,
+			VersionInfo:      c.version,
+			DownloadLocation: spdxNoAssertion,
+			Checksums:        []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: c.sha256}},
+			LicenseConcluded: spdxNoAssertion,
+			LicenseDeclared:  spdxNoAssertion,
+			CopyrightText:    spdxNoAssertion,
+			Comment:          spdxComment(c),
+		}
+		if c.purl != "" {
+			pkg.ExternalRefs = []spdxExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: c.purl}}
+		}
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{SPDXElementID: rootID, RelationshipType: "CONTAINS", RelatedSPDXElement: id})
+	}
+	return doc
+}
+
+// spdxComment describes where a component was found, along with any extra details.
+func spdxComment(c *component) string {
+	parts := []string{fmt.Sprintf("%s in %s", c.kind, c.path)}
+	if c.kind == kindImage {
+		parts = append(parts, "the checksum is the image ID")
+	}
+	if c.arch != "" {
+		parts = append(parts, "arch "+c.arch)
+	}
+	keys := make([]string, 0, len(c.details))
+	for k := range c.details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s %s", k, c.details[k]))
+	}
+	return strings.Join(parts, ", ")
+}
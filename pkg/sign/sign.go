@@ -0,0 +1,211 @@
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+const (
+	privateKeyPEMType = "PRIVATE KEY"
+	publicKeyPEMType  = "PUBLIC KEY"
+)
+
+// GenerateKeys will generate a new ed25519 key pair for signing packages. The keys are
+// returned PEM encoded in PKIX (public) and PKCS #8 (private) form.
+func GenerateKeys() (pubPEM, privPEM []byte, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubPEM = pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: pubDER})
+	privPEM = pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: privDER})
+	return pubPEM, privPEM, nil
+}
+
+// LoadPrivateKey will load a PEM encoded ed25519 private key from the given file.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEMFile(path, privateKeyPEMType)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%q does not contain an ed25519 private key", path)
+	}
+	return edKey, nil
+}
+
+// LoadPublicKey will load a PEM encoded ed25519 public key from the given file.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEMFile(path, publicKeyPEMType)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%q does not contain an ed25519 public key", path)
+	}
+	return edKey, nil
+}
+
+// LoadPublicKeys is a convenience method for loading multiple public keys.
+func LoadPublicKeys(paths []string) ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, len(paths))
+	for i, path := range paths {
+		key, err := LoadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+func readPEMFile(path, pemType string) ([]byte, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("%q does not contain a PEM encoded %s", path, pemType)
+	}
+	return block.Bytes, nil
+}
+
+// KeyID returns a short identifier for the given public key.
+func KeyID(pub ed25519.PublicKey) string {
+	return fmt.Sprintf("%x", sha256.Sum256(pub))[:16]
+}
+
+// Package will produce a detached signature for the given package. The package must
+// contain artifact digests in its metadata, since the signature is only computed over
+// the metadata itself.
+func Package(pkg types.Package, key ed25519.PrivateKey) (*types.PackageSignature, error) {
+	meta := pkg.GetMeta()
+	if len(meta.GetManifest().Digests) == 0 {
+		return nil, errors.New("The package does not contain artifact digests and cannot be signed, it must be rebuilt with a newer k3p")
+	}
+	if err := pkg.Verify(); err != nil {
+		return nil, err
+	}
+	raw, err := util.GetRawMeta(pkg)
+	if err != nil {
+		return nil, err
+	}
+	return &types.PackageSignature{
+		Algorithm:  types.SignatureAlgorithmEd25519,
+		KeyID:      KeyID(key.Public().(ed25519.PublicKey)),
+		Name:       meta.GetName(),
+		Version:    meta.GetVersion(),
+		MetaDigest: fmt.Sprintf("%x", sha256.Sum256(raw)),
+		Signature:  ed25519.Sign(key, raw),
+	}, nil
+}
+
+// Verify will verify the given package against the signature and a list of trusted
+// public keys. The contents of the package are verified against the digests in the
+// metadata before the signature is checked. The ID of the key that produced the signature
+// is returned on success.
+func Verify(pkg types.Package, sig *types.PackageSignature, trusted []ed25519.PublicKey) (string, error) {
+	if len(pkg.GetMeta().GetManifest().Digests) == 0 {
+		return "", errors.New("The package does not contain artifact digests and its signature cannot be trusted")
+	}
+	if err := pkg.Verify(); err != nil {
+		return "", err
+	}
+	raw, err := util.GetRawMeta(pkg)
+	if err != nil {
+		return "", err
+	}
+	return verifyMeta(raw, sig, trusted)
+}
+
+// VerifyStream will verify the metadata of the given package stream against the signature
+// and a list of trusted public keys. The artifacts in the stream are verified against the
+// digests in the metadata as they are read.
+func VerifyStream(stream types.PackageStream, sig *types.PackageSignature, trusted []ed25519.PublicKey) (string, error) {
+	if len(stream.GetMeta().GetManifest().Digests) == 0 {
+		return "", errors.New("The package does not contain artifact digests and its signature cannot be trusted")
+	}
+	return verifyMeta(stream.RawMeta(), sig, trusted)
+}
+
+func verifyMeta(raw []byte, sig *types.PackageSignature, trusted []ed25519.PublicKey) (string, error) {
+	if sig == nil {
+		return "", errors.New("The package is not signed")
+	}
+	if sig.Algorithm != types.SignatureAlgorithmEd25519 {
+		return "", fmt.Errorf("Unsupported signature algorithm %q", sig.Algorithm)
+	}
+	if len(trusted) == 0 {
+		return "", errors.New("No trusted keys were provided to verify the package signature")
+	}
+	if digest := fmt.Sprintf("%x", sha256.Sum256(raw)); digest != sig.MetaDigest {
+		return "", fmt.Errorf("The signature was produced for different package metadata (%s != %s)", sig.MetaDigest, digest)
+	}
+	for _, key := range trusted {
+		if ed25519.Verify(key, raw, sig.Signature) {
+			keyID := KeyID(key)
+			log.Debugf("Package signature verified with key %s\n", keyID)
+			return keyID, nil
+		}
+	}
+	return "", fmt.Errorf("The package signature (key %s) is not valid for any of the trusted keys", sig.KeyID)
+}
+
+// VerifyWithKeyFiles is a convenience wrapper around Verify that loads the trusted keys
+// from the given files.
+func VerifyWithKeyFiles(pkg types.Package, sig *types.PackageSignature, keyFiles []string) (string, error) {
+	keys, err := LoadPublicKeys(keyFiles)
+	if err != nil {
+		return "", err
+	}
+	return Verify(pkg, sig, keys)
+}
+
+// LoadSignature will read a detached signature from the given reader.
+func LoadSignature(rdr io.Reader) (*types.PackageSignature, error) {
+	body, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	var sig types.PackageSignature
+	if err := json.Unmarshal(body, &sig); err != nil {
+		return nil, fmt.Errorf("could not decode package signature: %s", err.Error())
+	}
+	return &sig, nil
+}
+
+// MarshalSignature will serialize the given signature for writing to disk.
+func MarshalSignature(sig *types.PackageSignature) ([]byte, error) {
+	return json.MarshalIndent(sig, "", "  ")
+}
@@ -0,0 +1,120 @@
+package sign
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestSign(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Package Signing Suite")
+}
+
+func loadedMock() types.Package {
+	mock := v2.Mock()
+	defer mock.Close()
+	archive, err := mock.Archive()
+	Expect(err).ToNot(HaveOccurred())
+	pkg, err := v2.Load(archive.Reader())
+	Expect(err).ToNot(HaveOccurred())
+	return pkg
+}
+
+func generateKeys(dir, name string) (ed25519.PrivateKey, ed25519.PublicKey) {
+	pub, priv, err := GenerateKeys()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(ioutil.WriteFile(path.Join(dir, name+".key"), priv, 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(path.Join(dir, name+".pub"), pub, 0644)).To(Succeed())
+	privKey, err := LoadPrivateKey(path.Join(dir, name+".key"))
+	Expect(err).ToNot(HaveOccurred())
+	pubKey, err := LoadPublicKey(path.Join(dir, name+".pub"))
+	Expect(err).ToNot(HaveOccurred())
+	return privKey, pubKey
+}
+
+var _ = Describe("Package Signing", func() {
+	var (
+		tmpDir      string
+		pkg         types.Package
+		key         ed25519.PrivateKey
+		pub, other  ed25519.PublicKey
+		sig         *types.PackageSignature
+		err         error
+		trustedKeys []ed25519.PublicKey
+	)
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		key, pub = generateKeys(tmpDir, "trusted")
+		_, other = generateKeys(tmpDir, "other")
+		pkg = loadedMock()
+		sig, err = Package(pkg, key)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		pkg.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	JustBeforeEach(func() {
+		_, err = Verify(pkg, sig, trustedKeys)
+	})
+
+	Context("When the signing key is trusted", func() {
+		BeforeEach(func() { trustedKeys = []ed25519.PublicKey{other, pub} })
+		It("Should verify the package", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sig.KeyID).To(Equal(KeyID(pub)))
+		})
+	})
+
+	Context("When the signing key is not trusted", func() {
+		BeforeEach(func() { trustedKeys = []ed25519.PublicKey{other} })
+		It("Should refuse the package", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("When the signature was made for different metadata", func() {
+		BeforeEach(func() {
+			trustedKeys = []ed25519.PublicKey{pub}
+			sig.MetaDigest = "bad"
+		})
+		It("Should refuse the package", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("When the signature has been modified", func() {
+		BeforeEach(func() {
+			trustedKeys = []ed25519.PublicKey{pub}
+			sig.Signature[0] ^= 0xff
+		})
+		It("Should refuse the package", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("When the package is not signed", func() {
+		BeforeEach(func() {
+			trustedKeys = []ed25519.PublicKey{pub}
+			sig = nil
+		})
+		It("Should refuse the package", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,289 @@
+package split
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+	"github.com/tinyzimmer/k3p/pkg/util"
+)
+
+// rePart matches the file name of a part of a split archive
+var rePart = regexp.MustCompile(`^(.+)\.(\d{3,})$`)
+
+// reSize matches a human readable size like 4G or 700MiB
+var reSize = regexp.MustCompile(`^(\d+)\s*([KMGT]?)(I?)B?$`)
+
+// ParseSize parses a human readable size. Units are decimal (4G is 4,000,000,000 bytes) unless
+// written as binary units (4Gi or 4GiB).
+func ParseSize(size string) (int64, error) {
+	match := reSize.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(size)))
+	if match == nil {
+		return 0, fmt.Errorf("%q is not a valid size", size)
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	base := int64(1000)
+	if match[3] != "" {
+		base = 1024
+	}
+	for _, unit := range "KMGT" {
+		if match[2] == "" {
+			break
+		}
+		n *= base
+		if match[2] == string(unit) {
+			break
+		}
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%q is not a valid size", size)
+	}
+	return n, nil
+}
+
+// PartName returns the file name of the part with the given index (starting from 1).
+func PartName(name string, idx int) string { return fmt.Sprintf("%s.%03d", name, idx) }
+
+// partIndex returns the index in the file name of a part, or 0 if it is not named like one.
+func partIndex(name string) int {
+	match := rePart.FindStringSubmatch(name)
+	if match == nil {
+		return 0
+	}
+	idx, _ := strconv.Atoi(match[2])
+	return idx
+}
+
+// Write splits the contents of the reader into files of at most partSize bytes named after
+// output, followed by the manifest listing them. The manifest is returned.
+func Write(rdr io.Reader, output string, partSize int64) (*types.SplitManifest, error) {
+	manifest := &types.SplitManifest{Name: filepath.Base(output)}
+	for idx := 1; ; idx++ {
+		partPath := PartName(output, idx)
+		part, err := writePart(io.LimitReader(rdr, partSize), partPath)
+		if err != nil {
+			return nil, err
+		}
+		if part.Size == 0 && idx > 1 {
+			// the previous part ended exactly at the end of the archive
+			if err := os.Remove(partPath); err != nil {
+				return nil, err
+			}
+			break
+		}
+		log.Infof("Wrote %q (%d bytes)\n", partPath, part.Size)
+		manifest.Parts = append(manifest.Parts, *part)
+		manifest.Size += part.Size
+		if part.Size < partSize {
+			break
+		}
+	}
+	out, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Writing the list of parts to %q\n", output+types.SplitManifestSuffix)
+	return manifest, ioutil.WriteFile(output+types.SplitManifestSuffix, out, 0644)
+}
+
+func writePart(rdr io.Reader, partPath string) (*types.SplitPart, error) {
+	f, err := os.Create(partPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), rdr)
+	if err != nil {
+		return nil, err
+	}
+	return &types.SplitPart{Name: filepath.Base(partPath), SHA256: fmt.Sprintf("%x", h.Sum(nil)), Size: n}, f.Close()
+}
+
+// IsSplit returns true if the given path refers to a split archive. This is the case for the path
+// of any of its parts, its manifest, a glob matching its parts, or the name of the archive when
+// only its parts exist. An existing file named like a part is only considered one when the rest
+// of the archive is found next to it, so a package named app-1.0.100 is read as it is.
+func IsSplit(path string) bool {
+	if info, err := os.Stat(path); err == nil {
+		if !info.Mode().IsRegular() {
+			return false
+		}
+		if strings.HasSuffix(path, types.SplitManifestSuffix) {
+			return true
+		}
+		match := rePart.FindStringSubmatch(path)
+		return match != nil && hasParts(match[1])
+	}
+	if isGlob(path) || rePart.MatchString(path) || strings.HasSuffix(path, types.SplitManifestSuffix) {
+		return true
+	}
+	return hasParts(path)
+}
+
+// hasParts returns true if the manifest or the first part of the split archive with the given
+// name exists.
+func hasParts(name string) bool {
+	for _, path := range []string{name + types.SplitManifestSuffix, PartName(name, 1)} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ArchiveName returns the name of the archive a path to a split archive reassembles into. This is
+// where other files belonging to the archive, like its signature, are expected to be found.
+func ArchiveName(path string) string {
+	if isGlob(path) {
+		matches, _ := filepath.Glob(path)
+		for _, match := range matches {
+			if rePart.MatchString(match) || strings.HasSuffix(match, types.SplitManifestSuffix) {
+				path = match
+				break
+			}
+		}
+	}
+	if match := rePart.FindStringSubmatch(path); match != nil {
+		return match[1]
+	}
+	return strings.TrimSuffix(path, types.SplitManifestSuffix)
+}
+
+// Open returns a reader over the reassembled contents of the split archive at the given path.
+// When the manifest is present, every part is verified against it as it is read.
+func Open(path string) (io.ReadCloser, error) {
+	name := ArchiveName(path)
+	parts, err := findParts(path, name)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Reading %d parts of %q\n", len(parts), name)
+	return &partReader{parts: parts}, nil
+}
+
+// part is a file to read from as part of a split archive, and its digest if it is known.
+type part struct {
+	path   string
+	digest *types.ArtifactDigest
+}
+
+func findParts(path, name string) ([]part, error) {
+	manifestPath := name + types.SplitManifestSuffix
+	body, err := ioutil.ReadFile(manifestPath)
+	if err == nil {
+		var manifest types.SplitManifest
+		if err := json.Unmarshal(body, &manifest); err != nil {
+			return nil, fmt.Errorf("reading %q: %s", manifestPath, err.Error())
+		}
+		if len(manifest.Parts) == 0 {
+			return nil, fmt.Errorf("%q does not list any parts", manifestPath)
+		}
+		parts := make([]part, len(manifest.Parts))
+		for i, p := range manifest.Parts {
+			parts[i] = part{
+				path:   filepath.Join(filepath.Dir(manifestPath), p.Name),
+				digest: &types.ArtifactDigest{SHA256: p.SHA256, Size: p.Size},
+			}
+			if _, err := os.Stat(parts[i].path); err != nil {
+				return nil, fmt.Errorf("part %d of %d of %q is missing: %s", i+1, len(manifest.Parts), manifest.Name, err.Error())
+			}
+		}
+		return parts, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Warningf("No list of parts found at %q, the parts cannot be verified before the package is read\n", manifestPath)
+	pattern := path
+	if !isGlob(pattern) {
+		pattern = name + ".[0-9][0-9][0-9]*"
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, match := range matches {
+		if rePart.MatchString(match) {
+			found = append(found, match)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("No parts of %q were found", name)
+	}
+	// parts past .999 have longer suffixes, so they are ordered by their index rather than by name
+	sort.Slice(found, func(i, j int) bool { return partIndex(found[i]) < partIndex(found[j]) })
+	parts := make([]part, len(found))
+	for i, match := range found {
+		if match != PartName(name, i+1) {
+			return nil, fmt.Errorf("The parts of %q are not contiguous, expected %q but found %q", name, PartName(name, i+1), match)
+		}
+		parts[i] = part{path: match}
+	}
+	return parts, nil
+}
+
+func isGlob(path string) bool { return strings.ContainsAny(path, "*?[") }
+
+// partReader reads the parts of a split archive one after the other, only keeping the current
+// one open.
+type partReader struct {
+	parts   []part
+	current io.ReadCloser
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	for {
+		if p.current == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			next := p.parts[0]
+			p.parts = p.parts[1:]
+			f, err := os.Open(next.path)
+			if err != nil {
+				return 0, err
+			}
+			p.current = util.NewDigestReader(next.path, f, f, next.digest)
+		}
+		n, err := p.current.Read(b)
+		if err == io.EOF {
+			if cerr := p.current.Close(); cerr != nil {
+				return n, cerr
+			}
+			p.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (p *partReader) Close() error {
+	if p.current == nil {
+		return nil
+	}
+	err := p.current.Close()
+	p.current = nil
+	p.parts = nil
+	return err
+}
+
+// ensure the reader is a valid ReadCloser
+var _ io.ReadCloser = &partReader{}
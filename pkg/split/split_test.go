@@ -0,0 +1,130 @@
+package split
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestSplit(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Split Suite")
+}
+
+var _ = Describe("Parsing sizes", func() {
+	It("Should use decimal units unless binary units are given", func() {
+		for size, expected := range map[string]int64{
+			"512":    512,
+			"4G":     4000000000,
+			"4GB":    4000000000,
+			"700m":   700000000,
+			"700MiB": 700 * 1024 * 1024,
+			"1Ti":    1024 * 1024 * 1024 * 1024,
+		} {
+			Expect(ParseSize(size)).To(Equal(expected), size)
+		}
+	})
+
+	It("Should reject invalid sizes", func() {
+		for _, size := range []string{"", "0", "G", "4X", "-1G"} {
+			_, err := ParseSize(size)
+			Expect(err).To(HaveOccurred(), size)
+		}
+	})
+})
+
+var _ = Describe("Splitting archives", func() {
+	var tmpDir, output string
+	var contents []byte
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		output = filepath.Join(tmpDir, "package.tar")
+		contents = make([]byte, 2500)
+		rand.Read(contents)
+	})
+
+	AfterEach(func() { os.RemoveAll(tmpDir) })
+
+	readAll := func(path string) ([]byte, error) {
+		rdr, err := Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer rdr.Close()
+		return ioutil.ReadAll(rdr)
+	}
+
+	It("Should write the parts and read them back from any of their names", func() {
+		manifest, err := Write(bytes.NewReader(contents), output, 1000)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.Size).To(Equal(int64(2500)))
+		Expect(manifest.Parts).To(HaveLen(3))
+		Expect(manifest.Parts[2].Name).To(Equal("package.tar.003"))
+		Expect(manifest.Parts[2].Size).To(Equal(int64(500)))
+		Expect(output + types.SplitManifestSuffix).To(BeAnExistingFile())
+
+		for _, path := range []string{output + ".001", output + ".002", output + ".*", output + types.SplitManifestSuffix, output} {
+			Expect(IsSplit(path)).To(BeTrue(), path)
+			Expect(ArchiveName(path)).To(Equal(output), path)
+			Expect(readAll(path)).To(Equal(contents), path)
+		}
+	})
+
+	It("Should not leave an empty part when the archive divides evenly", func() {
+		manifest, err := Write(bytes.NewReader(contents), output, 500)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.Parts).To(HaveLen(5))
+		Expect(output + ".006").ToNot(BeAnExistingFile())
+	})
+
+	It("Should detect corrupted and missing parts", func() {
+		_, err := Write(bytes.NewReader(contents), output, 1000)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(ioutil.WriteFile(output+".002", make([]byte, 1000), 0644)).To(Succeed())
+		_, err = readAll(output + ".001")
+		Expect(err).To(MatchError(ContainSubstring("sha256 mismatch")))
+
+		Expect(os.Remove(output + ".002")).To(Succeed())
+		_, err = readAll(output + ".001")
+		Expect(err).To(MatchError(ContainSubstring("part 2 of 3")))
+
+		// without the manifest, gaps in the parts are still noticed
+		Expect(os.Remove(output + types.SplitManifestSuffix)).To(Succeed())
+		_, err = readAll(output + ".001")
+		Expect(err).To(MatchError(ContainSubstring("not contiguous")))
+	})
+
+	It("Should read more than 999 parts in order without the manifest", func() {
+		contents = contents[:1001]
+		_, err := Write(bytes.NewReader(contents), output, 1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output + ".1001").To(BeAnExistingFile())
+		Expect(os.Remove(output + types.SplitManifestSuffix)).To(Succeed())
+		Expect(readAll(output + ".*")).To(Equal(contents))
+	})
+
+	It("Should not treat regular files as split archives", func() {
+		Expect(ioutil.WriteFile(output, contents, 0644)).To(Succeed())
+		Expect(IsSplit(output)).To(BeFalse())
+	})
+
+	It("Should not treat regular files named like parts as split archives", func() {
+		path := filepath.Join(tmpDir, "app-1.0.100")
+		Expect(ioutil.WriteFile(path, contents, 0644)).To(Succeed())
+		Expect(IsSplit(path)).To(BeFalse())
+	})
+})
@@ -0,0 +1,175 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+// BuildSpecKey is the root-level key of the build section in a package configuration.
+const BuildSpecKey = "build"
+
+// BuildSpec declares how a package is built in the "build" section of a package configuration,
+// so builds can be reproduced from a checked-in file. Every option corresponds to a flag of the
+// build command, and flags given on the command line override it. Relative paths are resolved
+// against the directory of the configuration file. The section is not included in the
+// configuration bundled with the package.
+type BuildSpec struct {
+	// The name to give the package
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// The version to tag the package
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	// A short description of the package
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	// A specific k3s version to bundle with the package, overrides the channel
+	K3sVersion string `json:"k3sVersion,omitempty" yaml:"k3sVersion,omitempty"`
+	// The release channel to retrieve the version of k3s from
+	Channel string `json:"channel,omitempty" yaml:"channel,omitempty"`
+	// The architectures to package the distribution for
+	Archs []string `json:"archs,omitempty" yaml:"archs,omitempty"`
+	// Directories to scan for kubernetes manifests and charts
+	Manifests []string `json:"manifests,omitempty" yaml:"manifests,omitempty"`
+	// Directories to exclude when reading the manifest directories
+	Excludes []string `json:"excludes,omitempty" yaml:"excludes,omitempty"`
+	// Extra images to bundle with the package
+	Images []string `json:"images,omitempty" yaml:"images,omitempty"`
+	// A file containing a list of extra images to bundle with the package
+	ImageFile string `json:"imageFile,omitempty" yaml:"imageFile,omitempty"`
+	// Don't include container images with the package
+	ExcludeImages bool `json:"excludeImages,omitempty" yaml:"excludeImages,omitempty"`
+	// The pull policy to use when bundling container images
+	PullPolicy string `json:"pullPolicy,omitempty" yaml:"pullPolicy,omitempty"`
+	// The number of container images to pull and k3s components to download at once
+	Parallelism int `json:"parallelism,omitempty" yaml:"parallelism,omitempty"`
+	// Bundle container images into a private registry instead of tar balls
+	BuildRegistry bool `json:"buildRegistry,omitempty" yaml:"buildRegistry,omitempty"`
+	// A file containing an End User License Agreement to display when the package is installed
+	EULA string `json:"eula,omitempty" yaml:"eula,omitempty"`
+	// Disable the use of the local cache when downloading assets
+	NoCache bool `json:"noCache,omitempty" yaml:"noCache,omitempty"`
+	// The file to save the package to
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+	// The codec to compress the package with
+	Compression string `json:"compression,omitempty" yaml:"compression,omitempty"`
+	// Bundle the package into a self-installing run file
+	RunFile bool `json:"runFile,omitempty" yaml:"runFile,omitempty"`
+	// Linux k3p binaries to embed in the run file, keyed by architecture
+	RunFileK3pBinaries map[string]string `json:"runFileK3pBinaries,omitempty" yaml:"runFileK3pBinaries,omitempty"`
+	// Encrypt the package for the recipients, or with a passphrase when there are none
+	Encrypt bool `json:"encrypt,omitempty" yaml:"encrypt,omitempty"`
+	// Public keys that can decrypt the package
+	Recipients []string `json:"recipients,omitempty" yaml:"recipients,omitempty"`
+	// Split the package into parts of at most this size (e.g. 4G or 700MiB)
+	SplitSize string `json:"splitSize,omitempty" yaml:"splitSize,omitempty"`
+	// A previous release of the package to build a delta against
+	Base string `json:"base,omitempty" yaml:"base,omitempty"`
+	// Embed a software bill of materials in this format
+	SBOM string `json:"sbom,omitempty" yaml:"sbom,omitempty"`
+	// Pack a directory produced by "k3p unpack" instead of gathering the contents
+	FromDir string `json:"fromDir,omitempty" yaml:"fromDir,omitempty"`
+	// Build a package that is byte for byte identical for identical inputs
+	Reproducible bool `json:"reproducible,omitempty" yaml:"reproducible,omitempty"`
+}
+
+// BuildSpecFromFile reads the build section of the package configuration at the given path,
+// returning nil if there is none. Relative paths in the spec are resolved against the directory
+// of the file.
+func BuildSpecFromFile(path string) (*BuildSpec, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block := RootBlock(body, BuildSpecKey)
+	if block == nil {
+		return nil, nil
+	}
+	// the rest of the configuration may need to be rendered, so only the build section is read
+	var doc struct {
+		Build *BuildSpec `yaml:"build"`
+	}
+	if err := yaml.UnmarshalStrict(block, &doc); err != nil {
+		return nil, fmt.Errorf("The build section of %s is not valid: %s", path, err.Error())
+	}
+	if doc.Build == nil {
+		return nil, nil
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	doc.Build.resolvePaths(dir)
+	return doc.Build, nil
+}
+
+// resolvePaths makes the relative paths in the spec relative to the given directory.
+func (b *BuildSpec) resolvePaths(dir string) {
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	for i := range b.Manifests {
+		b.Manifests[i] = resolve(b.Manifests[i])
+	}
+	for i := range b.Recipients {
+		b.Recipients[i] = resolve(b.Recipients[i])
+	}
+	for arch, bin := range b.RunFileK3pBinaries {
+		b.RunFileK3pBinaries[arch] = resolve(bin)
+	}
+	for _, p := range []*string{&b.ImageFile, &b.EULA, &b.Output, &b.Base, &b.FromDir} {
+		*p = resolve(*p)
+	}
+}
+
+// RootBlock returns the root-level block for the given key in a raw yaml document, including
+// the line with the key, or nil if there is none.
+func RootBlock(raw []byte, key string) []byte {
+	var out bytes.Buffer
+	var inBlock bool
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := reRootKey.FindStringSubmatch(line); match != nil {
+			inBlock = match[1] == key
+		} else if line == "---" {
+			inBlock = false
+		}
+		if inBlock {
+			fmt.Fprintln(&out, line)
+		}
+	}
+	if out.Len() == 0 {
+		return nil
+	}
+	return out.Bytes()
+}
+
+// WithoutRootBlock returns the raw yaml document with the root-level block for the given key
+// removed.
+func WithoutRootBlock(raw []byte, key string) []byte {
+	var out bytes.Buffer
+	var skipping bool
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := reRootKey.FindStringSubmatch(line); match != nil {
+			skipping = match[1] == key
+		} else if line == "---" {
+			skipping = false
+		}
+		if !skipping {
+			fmt.Fprintln(&out, line)
+		}
+	}
+	return out.Bytes()
+}
+
+// reRootKey matches the start of a root-level yaml block
+var reRootKey = regexp.MustCompile(`^([^\s#-][^:]*):(.*)$`)
@@ -0,0 +1,111 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestTypes(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Types Suite")
+}
+
+const specConfig = `# comments before the sections are kept
+variables:
+- name: hostname
+build:
+  name: app
+  archs:
+  - amd64
+  - arm64
+  output: dist/app.tar
+  eula: /etc/eula.txt
+  runFileK3pBinaries:
+    arm64: bin/k3p-arm64
+serverConfig:
+  node-label: host={{ .Vars.hostname }}
+`
+
+var _ = Describe("Build specs", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() { os.RemoveAll(tmpDir) })
+
+	writeConfig := func(config string) string {
+		path := filepath.Join(tmpDir, "k3p.yaml")
+		Expect(ioutil.WriteFile(path, []byte(config), 0644)).To(Succeed())
+		return path
+	}
+
+	It("Should only return the requested root block", func() {
+		Expect(string(RootBlock([]byte(specConfig), BuildSpecKey))).To(Equal(`build:
+  name: app
+  archs:
+  - amd64
+  - arm64
+  output: dist/app.tar
+  eula: /etc/eula.txt
+  runFileK3pBinaries:
+    arm64: bin/k3p-arm64
+`))
+		Expect(RootBlock([]byte(specConfig), "agentConfig")).To(BeNil())
+		Expect(string(RootBlock([]byte("build: {}\n---\nname: app\n"), BuildSpecKey))).To(Equal("build: {}\n"))
+	})
+
+	It("Should remove only the requested root block", func() {
+		Expect(string(WithoutRootBlock([]byte(specConfig), BuildSpecKey))).To(Equal(`# comments before the sections are kept
+variables:
+- name: hostname
+serverConfig:
+  node-label: host={{ .Vars.hostname }}
+`))
+		Expect(string(WithoutRootBlock([]byte(specConfig), "agentConfig"))).To(Equal(specConfig))
+	})
+
+	It("Should read the build section with paths relative to the file", func() {
+		spec, err := BuildSpecFromFile(writeConfig(specConfig))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(spec).To(Equal(&BuildSpec{
+			Name:               "app",
+			Archs:              []string{"amd64", "arm64"},
+			Output:             filepath.Join(tmpDir, "dist", "app.tar"),
+			EULA:               "/etc/eula.txt",
+			RunFileK3pBinaries: map[string]string{"arm64": filepath.Join(tmpDir, "bin", "k3p-arm64")},
+		}))
+	})
+
+	It("Should return nothing when there is no build section", func() {
+		spec, err := BuildSpecFromFile(writeConfig(string(WithoutRootBlock([]byte(specConfig), BuildSpecKey))))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(spec).To(BeNil())
+	})
+
+	It("Should reject unknown keys in the build section", func() {
+		path := writeConfig("build:\n  name: app\n  compresion: zstd\n")
+		_, err := BuildSpecFromFile(path)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("The build section of " + path + " is not valid"))
+		Expect(err.Error()).To(ContainSubstring("compresion"))
+	})
+
+	It("Should not bundle the build section with the package configuration", func() {
+		f, err := os.Open(writeConfig(specConfig))
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		cfg, err := PackageConfigFromReader(f)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(cfg.Raw)).ToNot(ContainSubstring("build:"))
+		Expect(cfg.Variables).To(HaveLen(1))
+	})
+})
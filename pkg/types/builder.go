@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 // Builder is an interface for building application bundles to be distributed to systems.
 type Builder interface {
 	Build(*BuildOptions) error
@@ -16,41 +18,98 @@ const (
 	PullPolicyIfNotPresent PullPolicy = "ifnotpresent"
 )
 
+// Compression represents the codec used to compress a package archive
+type Compression string
+
+// Valid compression codecs
+const (
+	CompressionNone     Compression = "none"
+	CompressionGzip     Compression = "gzip"
+	CompressionXZ       Compression = "xz"
+	CompressionZstd     Compression = "zstd"
+	CompressionZstdDict Compression = "zstd-dict"
+)
+
 // BuildOptions is a struct containing options to pass to the build operation.
 type BuildOptions struct {
 	// The version of the package being built
-	BuildVersion string
+	BuildVersion string `json:"version"`
 	// The name of the package, if not provided one is generated using docker's name generator
-	Name string
+	Name string `json:"name"`
+	// An optional short description of the package
+	Description string `json:"description,omitempty"`
 	// The version of K3s to bundle with the package, overrides K3sChannel
-	K3sVersion string
+	K3sVersion string `json:"k3sVersion"`
 	// The release channel to retrieve the latest K3s version from
-	K3sChannel string
-	// The CPU architecture to target the package for
-	Arch string
+	K3sChannel string `json:"k3sChannel"`
+	// The CPU architectures to target the package for. When more than one is given, a binary and
+	// images are bundled for each of them, and nodes receive the ones matching their architecture.
+	Archs []string `json:"archs"`
 	// An optional EULA to provide with the package
-	EULAFile string
+	EULAFile string `json:"eulaFile,omitempty"`
 	// An optional config file providing variables to be used at installation
-	ConfigFile string
+	ConfigFile string `json:"configFile,omitempty"`
 	// A path to an optional file of newline delimited container images to include in the package
-	ImageFile string
+	ImageFile string `json:"imageFile,omitempty"`
 	// A list of images to include in the package
-	Images []string
+	Images []string `json:"images,omitempty"`
 	// The directory to scan for kubernetes manifests and helm charts
-	ManifestDirs []string
+	ManifestDirs []string `json:"manifestDirs,omitempty"`
+	// A directory produced by unpacking a package. When set, its contents and metadata are packed
+	// again instead of downloading k3s and scanning for manifests and images.
+	FromDir string `json:"fromDir,omitempty"`
 	// A list of directories to exclude while searching for manifests
-	Excludes []string
+	Excludes []string `json:"excludes,omitempty"`
 	// Don't bundle docker images with the archive
-	ExcludeImages bool
+	ExcludeImages bool `json:"excludeImages,omitempty"`
 	// When true, instead of creating a tarball of images that is installed to every agent, a private
 	// registry is built and the package is configured to launch and use it at installation.
-	CreateRegistry bool
+	CreateRegistry bool `json:"createRegistry,omitempty"`
 	// The pull policy to use
-	PullPolicy PullPolicy
+	PullPolicy PullPolicy `json:"pullPolicy,omitempty"`
+	// The number of container images to pull and k3s components to download at once
+	Parallelism int `json:"parallelism,omitempty"`
 	// The path to write the final archive to
-	Output string
-	// Whether to apply zst compression to the final archive
-	Compress bool
+	Output string `json:"output,omitempty"`
+	// The codec to compress the final archive with, empty or none for no compression
+	Compression Compression `json:"compression,omitempty"`
 	// Whether to write the outputs to a self-installing run file
-	RunFile bool
+	RunFile bool `json:"runFile,omitempty"`
+	// The k3p binaries to embed in a run file for each architecture, keyed by architecture. A
+	// binary with an empty key is used for the only architecture of the package. Architectures
+	// without a binary use the running executable when it was built for them, or the release
+	// for the architecture from the download cache.
+	RunFileK3pBinaries map[string]string `json:"runFileK3pBinaries,omitempty"`
+	// When set, the final archive is encrypted for the given recipients or passphrase
+	Encrypt *EncryptOptions `json:"encrypt,omitempty"`
+	// When greater than zero, the final archive is split into parts of at most this many bytes
+	SplitSize int64 `json:"splitSize,omitempty"`
+	// An optional path to a previous release of the package. When provided, only what changed
+	// since that release is included and the output is a delta package.
+	BasePackage string `json:"basePackage,omitempty"`
+	// When set, a software bill of materials in this format is embedded in the package
+	SBOM SBOMFormat `json:"sbom,omitempty"`
+	// When set, the package is built reproducibly. Every entry in the archive is owned by root and
+	// stamped with this time, artifacts are written in a fixed order, and generated documents record
+	// it as their creation time.
+	SourceDate *time.Time `json:"sourceDate,omitempty"`
+}
+
+// DeepCopy creates a copy of these BuildOptions.
+func (b *BuildOptions) DeepCopy() *BuildOptions {
+	out := *b
+	out.Archs = append([]string(nil), b.Archs...)
+	out.Images = append([]string(nil), b.Images...)
+	out.ManifestDirs = append([]string(nil), b.ManifestDirs...)
+	out.Excludes = append([]string(nil), b.Excludes...)
+	if b.Encrypt != nil {
+		encrypt := *b.Encrypt
+		encrypt.Recipients = append([]string(nil), b.Encrypt.Recipients...)
+		out.Encrypt = &encrypt
+	}
+	if b.SourceDate != nil {
+		sourceDate := *b.SourceDate
+		out.SourceDate = &sourceDate
+	}
+	return &out
 }
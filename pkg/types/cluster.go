@@ -20,6 +20,10 @@ type AddNodeOptions struct {
 	*NodeConnectOptions
 	// The role to assign the new node.
 	NodeRole K3sRole
+	// An optional name to give the new node in the cluster
+	NodeName string
+	// Options for enforcing the signature of the installed package
+	Trust *TrustOptions
 }
 
 // RemoveNodeOptions are options passed to a RemoveNode operation (not implemented).
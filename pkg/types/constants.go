@@ -9,6 +9,9 @@ const ManifestMetaFile = "manifest.json"
 // ManifestEULAFile is the name used when archiving an EULA.
 const ManifestEULAFile = "EULA.txt"
 
+// SignatureFileSuffix is the suffix appended to a package path when looking for its detached signature.
+const SignatureFileSuffix = ".sig"
+
 // ManifestUserImagesFile is the name of the tarball where detected images are stored in an archive.
 const ManifestUserImagesFile = "manifest-images.tar"
 
@@ -27,9 +30,17 @@ const AgentTokenFile = "/var/lib/rancher/k3s/server/node-token"
 // during the installation.
 const InstalledPackageFile = "/var/lib/rancher/k3s/data/k3p-package.tar"
 
+// InstalledSignatureFile is the file where the detached signature for the package is copied
+// during the installation, if one was provided.
+const InstalledSignatureFile = "/var/lib/rancher/k3s/data/k3p-package.sig"
+
 // InstalledConfigFile is the file where the variables used at installation are stored.
 const InstalledConfigFile = "/var/lib/rancher/k3s/data/k3p-config.json"
 
+// InstalledPackagesFile is the file where the name and version of every package installed on the
+// cluster is recorded, so the requirements of packages installed later can be checked.
+const InstalledPackagesFile = "/var/lib/rancher/k3s/data/k3p-packages.json"
+
 // K3sManifestsDir is the directory where manifests are installed for k3s to pre-load on boot.
 const K3sManifestsDir = "/var/lib/rancher/k3s/server/manifests"
 
@@ -102,6 +113,18 @@ const (
 	ArtifactEULA ArtifactType = "eula"
 	// ArtifactEtc is an artifact to be placed in /etc/rancher/k3s.
 	ArtifactEtc ArtifactType = "etc"
+	// ArtifactSBOM is a software bill of materials describing the contents of the package.
+	ArtifactSBOM ArtifactType = "sbom"
+)
+
+// SBOMFormat declares the format of a software bill of materials.
+type SBOMFormat string
+
+const (
+	// SBOMFormatSPDX represents an SPDX 2.2 JSON document.
+	SBOMFormatSPDX SBOMFormat = "spdx"
+	// SBOMFormatCycloneDX represents a CycloneDX 1.4 JSON document.
+	SBOMFormatCycloneDX SBOMFormat = "cyclonedx"
 )
 
 // ImageBundleFormat declares how the images were bundled in a package. Currently
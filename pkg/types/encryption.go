@@ -0,0 +1,39 @@
+package types
+
+const (
+	// EncryptionStanzaX25519 is the type of a stanza that wraps the file key for an X25519 public key.
+	EncryptionStanzaX25519 = "x25519"
+	// EncryptionStanzaScrypt is the type of a stanza that wraps the file key with a passphrase.
+	EncryptionStanzaScrypt = "scrypt"
+)
+
+// EncryptionHeader is written at the start of an encrypted package. The contents are encrypted
+// with a random file key, which is wrapped once for every recipient that can decrypt them.
+type EncryptionHeader struct {
+	// The stanzas wrapping the file key
+	Stanzas []EncryptionStanza `json:"stanzas"`
+	// A random salt used to derive the payload key from the file key
+	PayloadSalt []byte `json:"payloadSalt"`
+}
+
+// EncryptionStanza contains the file key wrapped for a single recipient.
+type EncryptionStanza struct {
+	// The type of the stanza, x25519 or scrypt
+	Type string `json:"type"`
+	// The ephemeral public key for x25519 stanzas
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+	// The salt for scrypt stanzas
+	Salt []byte `json:"salt,omitempty"`
+	// The scrypt work factor, as a power of two
+	LogN int `json:"logN,omitempty"`
+	// The wrapped file key
+	Key []byte `json:"key"`
+}
+
+// EncryptOptions are options for encrypting a package.
+type EncryptOptions struct {
+	// Paths to the public keys of the recipients that can decrypt the package
+	Recipients []string `json:"recipients,omitempty"`
+	// A passphrase that can decrypt the package, never serialized
+	Passphrase string `json:"-"`
+}
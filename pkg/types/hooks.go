@@ -0,0 +1,119 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HookPhase is a point in the installation of a package where a hook can run.
+type HookPhase string
+
+// Phases where hooks can run. Install hooks run when a package is installed to start a new
+// cluster, and join hooks when a node is added to an existing cluster.
+const (
+	HookPreInstall  HookPhase = "preInstall"
+	HookPostInstall HookPhase = "postInstall"
+	HookPreJoin     HookPhase = "preJoin"
+	HookPostJoin    HookPhase = "postJoin"
+)
+
+// HookPhases are all the phases where hooks can run, in the order they are declared.
+var HookPhases = []HookPhase{HookPreInstall, HookPostInstall, HookPreJoin, HookPostJoin}
+
+// HookFailurePolicy decides what happens to an installation when a hook fails.
+type HookFailurePolicy string
+
+const (
+	// HookFailurePolicyFail aborts the installation when the hook fails. This is the default.
+	HookFailurePolicyFail HookFailurePolicy = "fail"
+	// HookFailurePolicyIgnore logs a warning and continues the installation when the hook fails.
+	HookFailurePolicyIgnore HookFailurePolicy = "ignore"
+)
+
+// Hooks are scripts from the system building a package that run on each node before and after
+// k3s is installed. They are declared in the "hooks" section of a package configuration.
+type Hooks struct {
+	// Runs before k3s is installed on the first node of a cluster
+	PreInstall *Hook `json:"preInstall,omitempty" yaml:"preInstall,omitempty"`
+	// Runs after k3s is installed on the first node of a cluster
+	PostInstall *Hook `json:"postInstall,omitempty" yaml:"postInstall,omitempty"`
+	// Runs before k3s is installed on a node joining an existing cluster
+	PreJoin *Hook `json:"preJoin,omitempty" yaml:"preJoin,omitempty"`
+	// Runs after k3s is installed on a node joining an existing cluster
+	PostJoin *Hook `json:"postJoin,omitempty" yaml:"postJoin,omitempty"`
+}
+
+// Hook is a script that runs on nodes during an installation.
+type Hook struct {
+	// The path of the script, relative to the configuration file when it is not absolute
+	Script string `json:"script" yaml:"script"`
+	// What to do when the script fails, defaults to failing the installation
+	OnFailure HookFailurePolicy `json:"onFailure,omitempty" yaml:"onFailure,omitempty"`
+}
+
+// Get returns the hook for the given phase, or nil if there is none.
+func (h *Hooks) Get(phase HookPhase) *Hook {
+	if h == nil {
+		return nil
+	}
+	switch phase {
+	case HookPreInstall:
+		return h.PreInstall
+	case HookPostInstall:
+		return h.PostInstall
+	case HookPreJoin:
+		return h.PreJoin
+	case HookPostJoin:
+		return h.PostJoin
+	}
+	return nil
+}
+
+// Set sets the hook for the given phase.
+func (h *Hooks) Set(phase HookPhase, hook *Hook) {
+	switch phase {
+	case HookPreInstall:
+		h.PreInstall = hook
+	case HookPostInstall:
+		h.PostInstall = hook
+	case HookPreJoin:
+		h.PreJoin = hook
+	case HookPostJoin:
+		h.PostJoin = hook
+	}
+}
+
+// Validate checks that every hook declares a script and a valid failure policy.
+func (h *Hooks) Validate() error {
+	for _, phase := range HookPhases {
+		hook := h.Get(phase)
+		if hook == nil {
+			continue
+		}
+		if hook.Script == "" {
+			return errors.New("A script is required for the " + string(phase) + " hook")
+		}
+		switch hook.OnFailure {
+		case "", HookFailurePolicyFail, HookFailurePolicyIgnore:
+		default:
+			return fmt.Errorf("%q is not a valid failure policy for the %s hook (valid options fail,ignore)", hook.OnFailure, phase)
+		}
+	}
+	return nil
+}
+
+// DeepCopy creates a copy of these hooks.
+func (h *Hooks) DeepCopy() *Hooks {
+	out := &Hooks{}
+	for _, phase := range HookPhases {
+		if hook := h.Get(phase); hook != nil {
+			copied := *hook
+			out.Set(phase, &copied)
+		}
+	}
+	return out
+}
+
+// HookScriptName returns the name of the script artifact the hook for the given phase is
+// bundled as.
+func HookScriptName(phase HookPhase) string { return fmt.Sprintf("hook-%s.sh", phase) }
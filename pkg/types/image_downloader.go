@@ -7,10 +7,22 @@ import "io"
 // runtimes such as docker, containerd, podman, etc.
 type ImageDownloader interface {
 	// SaveImages will return a reader containing the contents of the exported
-	// images provided as arguments.
-	SaveImages(images []string, arch string, pullPolicy PullPolicy) (io.ReadCloser, error)
+	// images in the given options.
+	SaveImages(*SaveImagesOptions) (io.ReadCloser, error)
 	// BuildRegistry will build a container registry with the given images and return a
 	// a reader to a container image holding the backed up contents. It will be unpacked into
 	// a running registry with auto-generated TLS at installation time.
 	BuildRegistry(*BuildRegistryOptions) (io.ReadCloser, error)
 }
+
+// SaveImagesOptions are options for exporting container images to a tar archive.
+type SaveImagesOptions struct {
+	// A list of images to export
+	Images []string
+	// Architecture to pull the images for
+	Arch string
+	// Pull policy to use while exporting the images
+	PullPolicy PullPolicy
+	// The number of images to pull at once, defaults to util.DefaultParallelism
+	Parallelism int
+}
@@ -10,6 +10,9 @@ import (
 // and setting up K3s.
 type Installer interface {
 	Install(node Node, pkg Package, opts *InstallOptions) error
+	// InstallStream should install a package while it is being read, without buffering it to
+	// disk on the local system.
+	InstallStream(node Node, stream PackageStream, opts *InstallOptions) error
 }
 
 // InstallOptions are options to pass to an installation
@@ -16,6 +16,55 @@ type Manifest struct {
 	Etc []string `json:"etc,omitempty"`
 	// The End User License Agreement for the package, or an empty string if there is none
 	EULA string `json:"eula,omitempty"`
+	// Software bills of materials describing the package
+	SBOM []string `json:"sbom,omitempty"`
+	// Digests of every artifact in the package, keyed by their path inside the archive. For indexed
+	// package formats this also serves as the table of contents.
+	Digests map[string]ArtifactDigest `json:"digests,omitempty"`
+	// The total size of the package archive, only recorded by indexed package formats. This allows
+	// the archive to be copied while it is being streamed.
+	ArchiveSize int64 `json:"archiveSize,omitempty"`
+}
+
+// ArtifactDigest contains the checksum and size of an artifact inside a package.
+type ArtifactDigest struct {
+	// The hex encoded sha256sum of the artifact
+	SHA256 string `json:"sha256"`
+	// The size of the artifact in bytes
+	Size int64 `json:"size"`
+	// The offset of the artifact contents inside the archive, only recorded by indexed package formats
+	Offset int64 `json:"offset,omitempty"`
+	// Set in delta packages when the artifact is unchanged and must be taken from the base package
+	Base bool `json:"base,omitempty"`
+	// Set in delta packages when the artifact is a tarball with some of its entries removed
+	Delta *ArtifactDelta `json:"delta,omitempty"`
+}
+
+// ArtifactDelta describes the entries of a tarball artifact in a delta package that must be
+// taken from the base package when the two are combined.
+type ArtifactDelta struct {
+	// The missing entries keyed by their path inside the artifact
+	BaseEntries map[string]DeltaEntry `json:"baseEntries"`
+	// The hex encoded sha256sum of the complete tarball
+	SHA256 string `json:"sha256"`
+	// The size of the complete tarball in bytes
+	Size int64 `json:"size"`
+}
+
+// DeltaEntry points to an entry of a tarball artifact inside a base package.
+type DeltaEntry struct {
+	// The path of the artifact in the base package containing the entry
+	Artifact string `json:"artifact"`
+	// The path of the entry inside that artifact
+	Entry string `json:"entry"`
+	// The hex encoded sha256sum of the entry
+	SHA256 string `json:"sha256"`
+	// The size of the entry in bytes
+	Size int64 `json:"size"`
+	// The position of the missing entry in the complete tarball, only set for missing entries
+	Index int `json:"index,omitempty"`
+	// The raw header blocks the missing entry was stored with, only set for missing entries
+	Header []byte `json:"header,omitempty"`
 }
 
 // DeepCopy returns a copy of this Manifest.
@@ -28,6 +77,8 @@ func (m *Manifest) DeepCopy() *Manifest {
 		Static:       make([]string, len(m.Static)),
 		Etc:          make([]string, len(m.Etc)),
 		EULA:         m.EULA,
+		SBOM:         make([]string, len(m.SBOM)),
+		ArchiveSize:  m.ArchiveSize,
 	}
 	copy(out.Bins, m.Bins)
 	copy(out.Scripts, m.Scripts)
@@ -35,6 +86,22 @@ func (m *Manifest) DeepCopy() *Manifest {
 	copy(out.K8sManifests, m.K8sManifests)
 	copy(out.Static, m.Static)
 	copy(out.Etc, m.Etc)
+	copy(out.SBOM, m.SBOM)
+	if m.Digests != nil {
+		out.Digests = make(map[string]ArtifactDigest, len(m.Digests))
+		for k, v := range m.Digests {
+			if v.Delta != nil {
+				entries := make(map[string]DeltaEntry, len(v.Delta.BaseEntries))
+				for name, entry := range v.Delta.BaseEntries {
+					entries[name] = entry
+				}
+				delta := *v.Delta
+				delta.BaseEntries = entries
+				v.Delta = &delta
+			}
+			out.Digests[k] = v
+		}
+	}
 	return out
 }
 
@@ -50,5 +117,6 @@ func NewEmptyManifest() *Manifest {
 		K8sManifests: make([]string, 0),
 		Static:       make([]string, 0),
 		Etc:          make([]string, 0),
+		SBOM:         make([]string, 0),
 	}
 }
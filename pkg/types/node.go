@@ -22,6 +22,9 @@ const (
 type Node interface {
 	// GetType should be implemented by every node and return one of the types above
 	GetType() NodeType
+	// GetArch should return the CPU architecture of the node, using the names k3s releases
+	// are published for (amd64, arm64, arm).
+	GetArch() (string, error)
 	// MkdirAll should ensure the given directory on the node
 	MkdirAll(dir string) error
 	// GetFile should retrieve the given file on the node
@@ -29,6 +32,12 @@ type Node interface {
 	// WriteFile should write the contents of the given reader to destination on the node,
 	// and set its mode and size accordingly.
 	WriteFile(rdr io.ReadCloser, destination string, mode string, size int64) error
+	// Rename should move the file at the given path on the node to destination, replacing
+	// any file already there.
+	Rename(path, destination string) error
+	// Remove should remove the file at the given path on the node, it is not an error if the
+	// file does not exist.
+	Remove(path string) error
 	// Execute should execute a command on the node. This function should probably be renamed/repurposed
 	// to StartK3s or something as that is all it is used for, and will make more sense in the
 	// context of docker.
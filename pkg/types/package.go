@@ -17,6 +17,9 @@ type Package interface {
 	// GetMeta should return the metadata associated with the package. This will contain information
 	// on the full contents of the package.
 	GetMeta() *PackageMeta
+	// Verify should check the contents of the package against the artifact digests recorded
+	// in the metadata and return an error if any of them do not match.
+	Verify() error
 	// Archive should produce an Archive interface that can be used to read from the final package stream.
 	// This method should ensure any metadata and finalize the archive. Any changes made to the package after
 	// Archive is called will require another call to receive the latest changes.
@@ -25,6 +28,25 @@ type Package interface {
 	Close() error
 }
 
+// PackageStream is an interface for reading a package in a single pass, without first
+// buffering its contents to disk.
+type PackageStream interface {
+	// GetMeta should return the metadata read from the start of the stream.
+	GetMeta() *PackageMeta
+	// RawMeta should return the metadata exactly as it appeared in the stream.
+	RawMeta() []byte
+	// Next should return the next artifact in the stream, or io.EOF when there are none left.
+	// The body of the artifact is verified against the digests in the metadata as it is read,
+	// and is no longer valid after the next call to Next.
+	Next() (*Artifact, error)
+	// Tee should write the raw contents of the stream to the given writer as they are read,
+	// starting with the parts that were already consumed. It must be called before the first
+	// call to Next.
+	Tee(w io.Writer) error
+	// Close should release any resources held by the stream.
+	Close() error
+}
+
 // Archive is an interface to be implemented by packagers/extracers. It contains the final contents
 // of the archive and methods for interacting with it.
 type Archive interface {
@@ -32,12 +54,12 @@ type Archive interface {
 	Reader() io.ReadCloser
 	// WriteTo should dump the contents of the archive to the given file.
 	WriteTo(path string) error
-	// CompressTo should compress the contents of the archive to the given zst file.
-	CompressTo(path string) error
+	// CompressTo should compress the contents of the archive to the given file with the given codec.
+	CompressTo(path string, compression Compression) error
 	// CompressReader should return an io.ReadCloser who's contents are compressed
-	// with zstandard. The value returned by Size() will not accurately reflect the
+	// with the given codec. The value returned by Size() will not accurately reflect the
 	// contents of this Reader.
-	CompressReader() (io.ReadCloser, error)
+	CompressReader(compression Compression) (io.ReadCloser, error)
 	// Size should return the size of the archive.
 	Size() int64
 }
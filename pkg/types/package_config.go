@@ -8,8 +8,11 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/tinyzimmer/k3p/pkg/log"
@@ -38,6 +41,15 @@ type PackageConfig struct {
 	// HelmValues is a map of chart names to either a list of filenames containing values for that chart, or a single
 	// map of inline value declarations.
 	HelmValues map[string]interface{} `json:"helmValues,omitempty" yaml:"helmValues,omitempty"`
+	// Files are files from the system building the package that are bundled with it and installed
+	// to every node, like extra binaries or configuration files.
+	Files []PackageFile `json:"files,omitempty" yaml:"files,omitempty"`
+	// Requires declares the k3s versions, kernel modules, and other packages the package needs
+	// to be installed.
+	Requires *Requirements `json:"requires,omitempty" yaml:"requires,omitempty"`
+	// Hooks are scripts bundled with the package that run on each node before and after k3s
+	// is installed.
+	Hooks *Hooks `json:"hooks,omitempty" yaml:"hooks,omitempty"`
 	// The raw untemplated contents of the config - only populated by loaders from this package and archivers
 	Raw []byte `json:"raw,omitempty" yaml:"raw,omitempty"`
 }
@@ -55,6 +67,80 @@ type PackageVariable struct {
 	Default string `json:"default,omitempty" yaml:"default,omitempty"`
 }
 
+// PackageFile is a file declared in a package configuration that is bundled with the package.
+type PackageFile struct {
+	// The path of the file, relative to the configuration file when it is not absolute
+	Path string `json:"path" yaml:"path"`
+	// The type of artifact to bundle the file as (bin, script, static, or etc), which decides
+	// where it is installed on nodes
+	Type ArtifactType `json:"type" yaml:"type"`
+	// The name of the file in the package, and on nodes relative to the directory for its type.
+	// Defaults to the base name of the path.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// The architecture the file is built for. Only binaries and scripts can be architecture
+	// specific, and they are only bundled when the package is built for the architecture.
+	Arch string `json:"arch,omitempty" yaml:"arch,omitempty"`
+	// The octal mode to install the file with (e.g. "0644"), the default for its type when empty
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// Whether to render the file with the package variables when it is installed
+	Template bool `json:"template,omitempty" yaml:"template,omitempty"`
+	// An absolute path on nodes to install the file to, instead of the directory for its type
+	Destination string `json:"destination,omitempty" yaml:"destination,omitempty"`
+}
+
+// GetName returns the name of the file in the package, relative to the directory for its type.
+// Architecture specific files in packages built for multiple architectures are stored in a
+// directory named after their architecture.
+func (f *PackageFile) GetName(multiArch bool) string {
+	name := f.Name
+	if name == "" {
+		name = path.Base(filepath.ToSlash(f.Path))
+	}
+	if multiArch && f.Arch != "" {
+		return path.Join(f.Arch, name)
+	}
+	return name
+}
+
+// NodeMode returns the mode to install the file with in the format expected by nodes, or an
+// empty string if the default for its type should be used.
+func (f *PackageFile) NodeMode() (string, error) {
+	if f.Mode == "" {
+		return "", nil
+	}
+	mode, err := strconv.ParseUint(strings.TrimPrefix(f.Mode, "0o"), 8, 32)
+	if err != nil || mode > 0777 {
+		return "", fmt.Errorf("%q is not a valid file mode", f.Mode)
+	}
+	return fmt.Sprintf("%#o", mode), nil
+}
+
+// Validate checks that the file can be bundled with a package.
+func (f *PackageFile) Validate() error {
+	if f.Path == "" {
+		return errors.New("A path is required for every file")
+	}
+	switch f.Type {
+	case ArtifactBin, ArtifactScript:
+	case ArtifactStatic, ArtifactEtc:
+		if f.Arch != "" {
+			return fmt.Errorf("%s: only bin and script files can be architecture specific", f.Path)
+		}
+	default:
+		return fmt.Errorf("%s: %q is not a valid file type (valid options bin,script,static,etc)", f.Path, f.Type)
+	}
+	if name := f.GetName(false); path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("%s: the name %q must be a path inside the directory for its type", f.Path, name)
+	}
+	if f.Destination != "" && !path.IsAbs(f.Destination) {
+		return fmt.Errorf("%s: the destination %q must be an absolute path", f.Path, f.Destination)
+	}
+	if _, err := f.NodeMode(); err != nil {
+		return fmt.Errorf("%s: %s", f.Path, err.Error())
+	}
+	return nil
+}
+
 // PackageConfigFromFile will unmarshal a file containing a package configuration.
 func PackageConfigFromFile(path string) (*PackageConfig, error) {
 	f, err := os.Open(path)
@@ -89,6 +175,11 @@ func PackageConfigFromReaderWithVars(rdr io.Reader, vars map[string]string) (*Pa
 		return nil, err
 	}
 
+	// The build section only applies to the system building the package
+	if RootBlock(rawBody, BuildSpecKey) != nil {
+		rawBody = WithoutRootBlock(rawBody, BuildSpecKey)
+	}
+
 	// We do a multi-pass load to account for templates and variables that can be throughout the config
 
 	// Treat the entire contents as one yaml object during the first pass
@@ -291,6 +382,7 @@ func (p *PackageConfig) DeepCopy() *PackageConfig {
 		Raw:          make([]byte, len(p.Raw)),
 	}
 	copy(out.Variables, p.Variables)
+	out.Files = append([]PackageFile(nil), p.Files...)
 	copy(out.Raw, p.Raw)
 	for k, v := range p.ServerConfig {
 		out.ServerConfig[k] = v
@@ -298,6 +390,12 @@ func (p *PackageConfig) DeepCopy() *PackageConfig {
 	for k, v := range p.AgentConfig {
 		out.AgentConfig[k] = v
 	}
+	if p.Requires != nil {
+		out.Requires = p.Requires.DeepCopy()
+	}
+	if p.Hooks != nil {
+		out.Hooks = p.Hooks.DeepCopy()
+	}
 	for k, v := range p.HelmValues {
 		// This technically does not do the whole job, need to generate
 		// proper deepcopy functions
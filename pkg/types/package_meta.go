@@ -3,19 +3,23 @@ package types
 import (
 	"fmt"
 	"reflect"
+	"strings"
 )
 
 // PackageMeta represents metadata included with a package.
 type PackageMeta struct {
-	// The version of this manifest, only v1 currently
+	// The version of the package format the metadata was written with, see the formats package
 	MetaVersion string `json:"apiVersion,omitempty"`
 	// The name of the package
 	Name string `json:"name,omitempty"`
 	// The version of the package
 	Version string `json:"version,omitempty"`
+	// A short description of the package
+	Description string `json:"description,omitempty"`
 	// The K3s version inside the package
 	K3sVersion string `json:"k3sVersion,omitempty"`
-	// The architecture the package was built for
+	// The architecture the package was built for, or a comma separated list for packages built
+	// for multiple architectures
 	Arch string `json:"arch,omitempty"`
 	// The format with which images were bundles in the archive.
 	ImageBundleFormat ImageBundleFormat `json:"imageBundleFormat,omitempty"`
@@ -25,8 +29,29 @@ type PackageMeta struct {
 	PackageConfig *PackageConfig `json:"config,omitempty"`
 	// The raw, untemplated package config
 	PackageConfigRaw []byte `json:"configRaw,omitempty"`
+	// For delta packages, the package the delta was built against
+	Base *PackageBase `json:"base,omitempty"`
+	// For delta packages and the packages combined from them, the hex encoded sha256sum of the
+	// metadata of the release the delta was built from. A combined package is identified by it in
+	// place of its own metadata, so later deltas built against the release apply to it as well.
+	ReleaseMetaDigest string `json:"releaseMetaDigest,omitempty"`
+	// How and where the package was built
+	Provenance *Provenance `json:"provenance,omitempty"`
 }
 
+// PackageBase identifies the package a delta package was built against.
+type PackageBase struct {
+	// The name of the base package
+	Name string `json:"name"`
+	// The version of the base package
+	Version string `json:"version"`
+	// The hex encoded sha256sum of the metadata of the base package
+	MetaDigest string `json:"metaDigest"`
+}
+
+// IsDelta returns true if this is the metadata of a delta package.
+func (p *PackageMeta) IsDelta() bool { return p.Base != nil }
+
 // DeepCopy creates a copy of this PackageMeta instance.
 // TODO: DeepCopy functions need to be generated
 func (p *PackageMeta) DeepCopy() *PackageMeta {
@@ -34,10 +59,12 @@ func (p *PackageMeta) DeepCopy() *PackageMeta {
 		MetaVersion:       p.MetaVersion,
 		Name:              p.Name,
 		Version:           p.Version,
+		Description:       p.Description,
 		K3sVersion:        p.K3sVersion,
 		Arch:              p.Arch,
 		ImageBundleFormat: p.ImageBundleFormat,
 		PackageConfigRaw:  make([]byte, len(p.PackageConfigRaw)),
+		ReleaseMetaDigest: p.ReleaseMetaDigest,
 	}
 	copy(meta.PackageConfigRaw, p.PackageConfigRaw)
 	if p.Manifest != nil {
@@ -46,6 +73,13 @@ func (p *PackageMeta) DeepCopy() *PackageMeta {
 	if p.PackageConfig != nil {
 		meta.PackageConfig = p.PackageConfig.DeepCopy()
 	}
+	if p.Base != nil {
+		base := *p.Base
+		meta.Base = &base
+	}
+	if p.Provenance != nil {
+		meta.Provenance = p.Provenance.DeepCopy()
+	}
 	return meta
 }
 
@@ -97,12 +131,60 @@ func (p *PackageMeta) GetName() string { return p.Name }
 // GetVersion returns the version of the package.
 func (p *PackageMeta) GetVersion() string { return p.Version }
 
+// GetDescription returns the description of the package.
+func (p *PackageMeta) GetDescription() string { return p.Description }
+
 // GetK3sVersion returns the K3s version for the package.
 func (p *PackageMeta) GetK3sVersion() string { return p.K3sVersion }
 
 // GetArch returns the CPU architecture fo rthe package.
 func (p *PackageMeta) GetArch() string { return p.Arch }
 
+// GetArchs returns the architectures the package was built for.
+func (p *PackageMeta) GetArchs() []string {
+	if p.Arch == "" {
+		return nil
+	}
+	return strings.Split(p.Arch, ",")
+}
+
+// IsMultiArch returns true if the package was built for more than one architecture. The
+// architecture specific artifacts of these packages are stored in a directory named after
+// their architecture.
+func (p *PackageMeta) IsMultiArch() bool { return len(p.GetArchs()) > 1 }
+
+// GetArtifactArch returns the architecture the artifact with the given name (relative to the
+// directory for its type) was bundled for, or an empty string if it applies to every node.
+func (p *PackageMeta) GetArtifactArch(name string) string {
+	if !p.IsMultiArch() {
+		return ""
+	}
+	spl := strings.SplitN(name, "/", 2)
+	if len(spl) != 2 {
+		return ""
+	}
+	for _, arch := range p.GetArchs() {
+		if spl[0] == arch {
+			return arch
+		}
+	}
+	return ""
+}
+
+// GetPackageFile returns the file declared in the package configuration that was bundled as the
+// artifact with the given type and name, or nil if the artifact was not declared as a file.
+func (p *PackageMeta) GetPackageFile(t ArtifactType, name string) *PackageFile {
+	if p.PackageConfig == nil {
+		return nil
+	}
+	for i, file := range p.PackageConfig.Files {
+		if file.Type == t && file.GetName(p.IsMultiArch()) == name {
+			return &p.PackageConfig.Files[i]
+		}
+	}
+	return nil
+}
+
 // GetManifest returns the manifest of the package.
 func (p *PackageMeta) GetManifest() *Manifest { return p.Manifest }
 
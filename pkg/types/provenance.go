@@ -0,0 +1,58 @@
+package types
+
+import "time"
+
+// Provenance records how a package was built, so that it can be traced back to the build and
+// the sources that produced it.
+type Provenance struct {
+	// The version of k3p that built the package
+	K3pVersion string `json:"k3pVersion,omitempty"`
+	// The commit k3p was compiled from
+	K3pCommit string `json:"k3pCommit,omitempty"`
+	// The hostname of the machine that built the package, left out of reproducible builds
+	BuildHost string `json:"buildHost,omitempty"`
+	// The time the build started, or the source date of reproducible builds
+	BuildTime time.Time `json:"buildTime"`
+	// The URL of the CI pipeline run that built the package, when one was detected
+	BuildURL string `json:"buildURL,omitempty"`
+	// The release channel the k3s version was resolved from, empty if it was given explicitly
+	K3sChannel string `json:"k3sChannel,omitempty"`
+	// The directories the manifests were read from, or the unpacked package that was packed again
+	Sources []SourceProvenance `json:"sources,omitempty"`
+	// The options the package was built with, after defaults were resolved
+	BuildOptions *BuildOptions `json:"buildOptions,omitempty"`
+	// The artifacts the build produced, recorded once every artifact is written to the package
+	Subjects []ProvenanceSubject `json:"subjects,omitempty"`
+}
+
+// ProvenanceSubject identifies an artifact produced by a build.
+type ProvenanceSubject struct {
+	// The path of the artifact inside the archive
+	Name string `json:"name"`
+	// The hex encoded sha256sum of the artifact
+	SHA256 string `json:"sha256"`
+}
+
+// SourceProvenance identifies the contents of a directory that manifests were read from.
+type SourceProvenance struct {
+	// The path of the directory, relative to where k3p was run when it is inside it
+	Path string `json:"path"`
+	// A hex encoded sha256sum over the path and contents of every file in the directory, except
+	// those in excluded directories
+	SHA256 string `json:"sha256"`
+	// The commit checked out in the git repository containing the directory, if any
+	GitCommit string `json:"gitCommit,omitempty"`
+	// Whether the git repository had uncommitted changes
+	GitDirty bool `json:"gitDirty,omitempty"`
+}
+
+// DeepCopy creates a copy of this Provenance instance.
+func (p *Provenance) DeepCopy() *Provenance {
+	out := *p
+	out.Sources = append([]SourceProvenance(nil), p.Sources...)
+	out.Subjects = append([]ProvenanceSubject(nil), p.Subjects...)
+	if p.BuildOptions != nil {
+		out.BuildOptions = p.BuildOptions.DeepCopy()
+	}
+	return &out
+}
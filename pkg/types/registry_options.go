@@ -16,6 +16,8 @@ type BuildRegistryOptions struct {
 	Arch string
 	// Pull policy to use while building the registry
 	PullPolicy PullPolicy
+	// The number of images to pull at once, defaults to util.DefaultParallelism
+	Parallelism int
 }
 
 // RegistryImageName returns the name to use for the image containing the registry contents.
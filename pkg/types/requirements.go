@@ -0,0 +1,76 @@
+package types
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
+
+// Requirements are the conditions a node and the packages already installed on a cluster must
+// meet for a package to be installed. They are declared in the "requires" section of a package
+// configuration.
+type Requirements struct {
+	// The oldest k3s version the package can be installed with
+	MinK3sVersion string `json:"minK3sVersion,omitempty" yaml:"minK3sVersion,omitempty"`
+	// The newest k3s version the package can be installed with
+	MaxK3sVersion string `json:"maxK3sVersion,omitempty" yaml:"maxK3sVersion,omitempty"`
+	// Kernel modules that must be loaded or available to load on every node
+	KernelModules []string `json:"kernelModules,omitempty" yaml:"kernelModules,omitempty"`
+	// Other packages that must already be installed on the cluster
+	Packages []PackageRequirement `json:"packages,omitempty" yaml:"packages,omitempty"`
+}
+
+// PackageRequirement is another package that must be installed before a package.
+type PackageRequirement struct {
+	// The name of the package
+	Name string `json:"name" yaml:"name"`
+	// A semantic version range the installed version must be in (e.g. ">= 1.2.0, < 2.0.0"), any
+	// version is accepted when it is empty
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+}
+
+// Validate checks that every version and range in the requirements can be parsed.
+func (r *Requirements) Validate() error {
+	for field, version := range map[string]string{"minK3sVersion": r.MinK3sVersion, "maxK3sVersion": r.MaxK3sVersion} {
+		if version == "" {
+			continue
+		}
+		if _, err := semver.NewVersion(version); err != nil {
+			return fmt.Errorf("%s %q is not a valid version: %s", field, version, err.Error())
+		}
+	}
+	for _, pkg := range r.Packages {
+		if pkg.Name == "" {
+			return fmt.Errorf("A name is required for every required package")
+		}
+		if pkg.Version == "" {
+			continue
+		}
+		if _, err := semver.NewConstraint(pkg.Version); err != nil {
+			return fmt.Errorf("The version range %q for package %q is not valid: %s", pkg.Version, pkg.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// DeepCopy creates a copy of these requirements.
+func (r *Requirements) DeepCopy() *Requirements {
+	out := *r
+	out.KernelModules = append([]string(nil), r.KernelModules...)
+	out.Packages = append([]PackageRequirement(nil), r.Packages...)
+	return &out
+}
+
+// InstalledPackage is an entry in the record of packages installed on a cluster, kept on every
+// node at InstalledPackagesFile.
+type InstalledPackage struct {
+	// The name of the package
+	Name string `json:"name"`
+	// The version of the package
+	Version string `json:"version"`
+	// The k3s version bundled with the package
+	K3sVersion string `json:"k3sVersion,omitempty"`
+	// When the package was installed
+	InstalledAt time.Time `json:"installedAt"`
+}
@@ -0,0 +1,30 @@
+package types
+
+// SignatureAlgorithmEd25519 is the algorithm used for signing packages.
+const SignatureAlgorithmEd25519 = "ed25519"
+
+// PackageSignature represents a detached signature for a package. The signature is computed
+// over the raw package metadata, which includes the digests of every artifact in the package.
+type PackageSignature struct {
+	// The algorithm used to produce the signature, currently only ed25519
+	Algorithm string `json:"algorithm"`
+	// An identifier for the public key that can verify the signature
+	KeyID string `json:"keyID"`
+	// The name of the signed package
+	Name string `json:"name,omitempty"`
+	// The version of the signed package
+	Version string `json:"version,omitempty"`
+	// The sha256sum of the package metadata that was signed
+	MetaDigest string `json:"metaDigest"`
+	// The raw signature bytes
+	Signature []byte `json:"signature"`
+}
+
+// TrustOptions are options for enforcing package signatures during installations
+// and node additions.
+type TrustOptions struct {
+	// Refuse packages that are not signed by one of the trusted keys
+	RequireSignature bool
+	// Paths to public keys that are trusted to sign packages
+	TrustedKeys []string
+}
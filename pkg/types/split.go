@@ -0,0 +1,24 @@
+package types
+
+// SplitManifestSuffix is appended to the name of a split archive for the manifest listing its parts.
+const SplitManifestSuffix = ".parts.json"
+
+// SplitManifest lists the parts a package archive was split into.
+type SplitManifest struct {
+	// The name of the archive the parts reassemble into
+	Name string `json:"name"`
+	// The total size of the archive in bytes
+	Size int64 `json:"size"`
+	// The parts of the archive in order
+	Parts []SplitPart `json:"parts"`
+}
+
+// SplitPart describes a single part of a split archive.
+type SplitPart struct {
+	// The file name of the part, relative to the manifest
+	Name string `json:"name"`
+	// The hex encoded sha256sum of the part
+	SHA256 string `json:"sha256"`
+	// The size of the part in bytes
+	Size int64 `json:"size"`
+}
@@ -0,0 +1,171 @@
+package unpack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	v1 "github.com/tinyzimmer/k3p/pkg/build/package/v1"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/sbom"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// Unpack extracts every artifact in the package to the given directory, using the same layout
+// as inside the archive, along with the metadata in manifest.json. The directory must not exist
+// or be empty. Delta packages do not contain everything they install and cannot be unpacked.
+func Unpack(pkg types.Package, dir string) error {
+	meta := pkg.GetMeta()
+	if meta.IsDelta() {
+		return errors.New("Delta packages cannot be unpacked, unpack the complete release it was built from instead")
+	}
+	if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%q already exists and is not empty", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	rawMeta, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, types.ManifestMetaFile), rawMeta, 0644); err != nil {
+		return err
+	}
+
+	manifest := meta.GetManifest()
+	listings := []struct {
+		t     types.ArtifactType
+		names []string
+		mode  os.FileMode
+	}{
+		{types.ArtifactBin, manifest.Bins, 0755},
+		{types.ArtifactScript, manifest.Scripts, 0755},
+		{types.ArtifactImages, manifest.Images, 0644},
+		{types.ArtifactManifest, manifest.K8sManifests, 0644},
+		{types.ArtifactStatic, manifest.Static, 0644},
+		{types.ArtifactEtc, manifest.Etc, 0644},
+		{types.ArtifactSBOM, manifest.SBOM, 0644},
+	}
+	if manifest.HasEULA() {
+		if err := extract(pkg, &types.Artifact{Type: types.ArtifactEULA, Name: types.ManifestEULAFile}, dir, 0644); err != nil {
+			return err
+		}
+	}
+	for _, listing := range listings {
+		for _, name := range listing.names {
+			if err := extract(pkg, &types.Artifact{Type: listing.t, Name: name}, dir, listing.mode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func extract(pkg types.Package, artifact *types.Artifact, dir string, mode os.FileMode) error {
+	tarPath := v1.ArtifactPath(artifact)
+	log.Infof("Extracting %s\n", tarPath)
+	if err := pkg.Get(artifact); err != nil {
+		return err
+	}
+	defer artifact.Body.Close()
+	out := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+tarPath)))
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, artifact.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Repack writes the artifacts in a directory produced by Unpack to out, and returns the metadata
+// from its manifest.json. The listings and digests of the metadata are rebuilt from the files in
+// the directory, so artifacts may be added, removed, or changed. Bills of materials in the
+// directory describe the package before it was changed, so they are not written, and the formats
+// they were in are returned so they can be generated again.
+func Repack(dir string, out types.Package) (*types.PackageMeta, []types.SBOMFormat, error) {
+	rawMeta, err := ioutil.ReadFile(filepath.Join(dir, types.ManifestMetaFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta types.PackageMeta
+	if err := json.Unmarshal(rawMeta, &meta); err != nil {
+		return nil, nil, fmt.Errorf("%s is not valid package metadata: %s", types.ManifestMetaFile, err.Error())
+	}
+	if meta.IsDelta() {
+		return nil, nil, errors.New("The directory contains a delta package, which cannot be repacked")
+	}
+
+	// The EULA is written first so it can be reviewed before anything else is installed
+	// when the package is streamed.
+	eula := filepath.Join(dir, types.ManifestEULAFile)
+	if _, err := os.Stat(eula); err == nil {
+		if err := putFile(out, eula, types.ArtifactEULA, types.ManifestEULAFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var formats []types.SBOMFormat
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, lastErr error) error {
+		if lastErr != nil {
+			return lastErr
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == types.ManifestMetaFile || rel == types.ManifestEULAFile {
+			return nil
+		}
+		t, relName := v1.ArtifactFromPath(rel)
+		switch t {
+		case "":
+			log.Warningf("Skipping %s, it is not in a directory for any type of artifact\n", rel)
+			return nil
+		case types.ArtifactSBOM:
+			for _, format := range sbom.Formats() {
+				if relName == sbom.FileName(format) {
+					formats = append(formats, format)
+				}
+			}
+			return nil
+		}
+		log.Infof("Adding %s\n", rel)
+		return putFile(out, file, t, relName)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta.MetaVersion = ""
+	meta.Manifest = nil
+	return &meta, formats, nil
+}
+
+func putFile(out types.Package, file string, t types.ArtifactType, name string) error {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	return out.Put(&types.Artifact{Type: t, Name: name, Body: f, Size: stat.Size()})
+}
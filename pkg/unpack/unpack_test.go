@@ -0,0 +1,99 @@
+package unpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	v2 "github.com/tinyzimmer/k3p/pkg/build/package/v2"
+	"github.com/tinyzimmer/k3p/pkg/log"
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+func TestUnpack(t *testing.T) {
+	log.LogWriter = GinkgoWriter
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Unpack Suite")
+}
+
+func put(pkg types.Package, t types.ArtifactType, name, body string) {
+	Expect(pkg.Put(&types.Artifact{Type: t, Name: name, Body: ioutil.NopCloser(strings.NewReader(body)), Size: int64(len(body))})).To(Succeed())
+}
+
+func get(pkg types.Package, t types.ArtifactType, name string) string {
+	artifact := &types.Artifact{Type: t, Name: name}
+	Expect(pkg.Get(artifact)).To(Succeed())
+	defer artifact.Body.Close()
+	body, err := ioutil.ReadAll(artifact.Body)
+	Expect(err).ToNot(HaveOccurred())
+	return string(body)
+}
+
+func newDir(parent, name string) string {
+	dir := filepath.Join(parent, name)
+	Expect(os.Mkdir(dir, 0755)).To(Succeed())
+	return dir
+}
+
+var _ = Describe("Unpacking packages", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() { os.RemoveAll(tmpDir) })
+
+	It("Should pack an edited directory into a new package", func() {
+		pkg := v2.New(newDir(tmpDir, "pkg"))
+		defer pkg.Close()
+		put(pkg, types.ArtifactEULA, types.ManifestEULAFile, "eula")
+		put(pkg, types.ArtifactBin, "k3s", "k3s")
+		put(pkg, types.ArtifactManifest, "app.yaml", "app")
+		put(pkg, types.ArtifactSBOM, "sbom.cdx.json", "{}")
+		Expect(pkg.PutMeta(&types.PackageMeta{Name: "app", Version: "v1", K3sVersion: "v1.19.4+k3s1", Arch: "amd64"})).To(Succeed())
+
+		dir := filepath.Join(tmpDir, "unpacked")
+		Expect(Unpack(pkg, dir)).To(Succeed())
+		Expect(filepath.Join(dir, types.ManifestMetaFile)).To(BeARegularFile())
+		stat, err := os.Stat(filepath.Join(dir, "bin", "k3s"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0755)))
+		Expect(Unpack(pkg, dir)).ToNot(Succeed())
+
+		Expect(ioutil.WriteFile(filepath.Join(dir, "manifests", "app.yaml"), []byte("edited"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "manifests", "extra.yaml"), []byte("extra"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0644)).To(Succeed())
+
+		out := v2.New(newDir(tmpDir, "out"))
+		defer out.Close()
+		meta, formats, err := Repack(dir, out)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(formats).To(Equal([]types.SBOMFormat{types.SBOMFormatCycloneDX}))
+		Expect(meta.GetName()).To(Equal("app"))
+		Expect(meta.GetK3sVersion()).To(Equal("v1.19.4+k3s1"))
+		Expect(out.PutMeta(meta)).To(Succeed())
+
+		manifest := out.GetMeta().GetManifest()
+		Expect(manifest.HasEULA()).To(BeTrue())
+		Expect(manifest.Bins).To(ConsistOf("k3s"))
+		Expect(manifest.K8sManifests).To(ConsistOf("app.yaml", "extra.yaml"))
+		Expect(manifest.SBOM).To(BeEmpty())
+		Expect(get(out, types.ArtifactManifest, "app.yaml")).To(Equal("edited"))
+		Expect(get(out, types.ArtifactEULA, types.ManifestEULAFile)).To(Equal("eula"))
+	})
+
+	It("Should refuse to unpack delta packages", func() {
+		pkg := v2.New(newDir(tmpDir, "pkg"))
+		defer pkg.Close()
+		Expect(pkg.PutMeta(&types.PackageMeta{Name: "app", Version: "v2", Base: &types.PackageBase{Version: "v1"}})).To(Succeed())
+		Expect(Unpack(pkg, filepath.Join(tmpDir, "unpacked"))).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/tinyzimmer/k3p/pkg/types"
+)
+
+// NewDigestReader wraps the contents of an artifact and verifies them against the given
+// digest once the end of the stream is reached. If digest is nil, the contents are passed
+// through as is. The closer, if not nil, is closed along with the returned reader.
+func NewDigestReader(name string, rdr io.Reader, closer io.Closer, digest *types.ArtifactDigest) io.ReadCloser {
+	return &digestReader{name: name, rdr: rdr, closer: closer, digest: digest, hash: sha256.New()}
+}
+
+type digestReader struct {
+	name   string
+	rdr    io.Reader
+	closer io.Closer
+	digest *types.ArtifactDigest
+	hash   hash.Hash
+	read   int64
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.rdr.Read(p)
+	if d.digest == nil {
+		return n, err
+	}
+	d.hash.Write(p[:n])
+	d.read += int64(n)
+	if err == io.EOF {
+		if d.read != d.digest.Size {
+			return n, fmt.Errorf("size mismatch in %s: expected %d bytes, got %d", d.name, d.digest.Size, d.read)
+		}
+		if sum := fmt.Sprintf("%x", d.hash.Sum(nil)); sum != d.digest.SHA256 {
+			return n, fmt.Errorf("sha256 mismatch in %s: expected %s, got %s", d.name, d.digest.SHA256, sum)
+		}
+	}
+	return n, err
+}
+
+func (d *digestReader) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer.Close()
+}
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
+)
+
+// DefaultParallelism is the number of tasks run at once when no parallelism is configured.
+const DefaultParallelism = 4
+
+// Task is a unit of work that can be run alongside others with RunTasks.
+type Task struct {
+	// A description of the task, such as "pulling nginx:latest", used in progress messages
+	// and errors
+	Name string
+	// The function performing the task
+	Run func() error
+}
+
+// TaskError is the error of a single task run with RunTasks.
+type TaskError struct {
+	// The name of the task that failed
+	Name string
+	// The error returned by the task
+	Err error
+}
+
+func (t *TaskError) Error() string { return fmt.Sprintf("%s: %s", t.Name, t.Err.Error()) }
+
+// TaskErrors is returned by RunTasks when one or more tasks failed. The errors are in the
+// order the tasks were given.
+type TaskErrors []*TaskError
+
+func (t TaskErrors) Error() string {
+	if len(t) == 1 {
+		return t[0].Error()
+	}
+	msgs := make([]string, len(t))
+	for i, err := range t {
+		msgs[i] = "\t" + err.Error()
+	}
+	return fmt.Sprintf("%d tasks failed:\n%s", len(t), strings.Join(msgs, "\n"))
+}
+
+// RunTasks runs the given tasks with at most parallelism of them running at once, logging
+// the progress as each of them finishes. Every task is run even when others fail, and the
+// errors of all the tasks that failed are returned together as TaskErrors. A parallelism
+// below one uses DefaultParallelism.
+func RunTasks(parallelism int, tasks []Task) error {
+	if parallelism < 1 {
+		parallelism = DefaultParallelism
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mux  sync.Mutex
+		done int
+		sem  = make(chan struct{}, parallelism)
+		errs = make([]error, len(tasks))
+	)
+
+	for i, task := range tasks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, task Task) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := task.Run()
+			mux.Lock()
+			defer mux.Unlock()
+			done++
+			if err != nil {
+				log.Errorf("Failed %s (%d/%d): %s\n", task.Name, done, len(tasks), err.Error())
+				errs[i] = err
+				return
+			}
+			log.Infof("Finished %s (%d/%d)\n", task.Name, done, len(tasks))
+		}(i, task)
+	}
+	wg.Wait()
+
+	var out TaskErrors
+	for i, err := range errs {
+		if err != nil {
+			out = append(out, &TaskError{Name: tasks[i].Name, Err: err})
+		}
+	}
+	if len(out) > 0 {
+		return out
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -70,15 +71,39 @@ func GenerateToken(length int) string {
 	return string(b)
 }
 
+// GetRawMeta returns the metadata of the given package exactly as it is stored in the archive.
+func GetRawMeta(pkg types.Package) ([]byte, error) {
+	artifact := &types.Artifact{Name: types.ManifestMetaFile}
+	if err := pkg.Get(artifact); err != nil {
+		return nil, err
+	}
+	defer artifact.Body.Close()
+	return ioutil.ReadAll(artifact.Body)
+}
+
 // SyncPackageToNode is a convenience method for extracting the contents of a package manifest
 // to a k3s node.
 func SyncPackageToNode(target types.Node, pkg types.Package, cfg *types.InstallConfig) error {
+	// Make sure nothing is written to the node from a corrupted package
+	log.Debug("Verifying package contents before syncing to node")
+	if err := pkg.Verify(); err != nil {
+		return err
+	}
+
 	meta := pkg.GetMeta()
 
+	nodeArch, err := GetNodeArch(target, meta)
+	if err != nil {
+		return err
+	}
+
 	if len(meta.Manifest.Bins) > 0 {
 		log.Info("Installing binaries to", types.K3sBinDir)
 		for _, bin := range meta.Manifest.Bins {
-			if err := writePkgFileToNode(target, pkg, types.ArtifactBin, path.Base(bin), types.K3sBinDir, "0755", cfg.InstallOptions.Variables); err != nil {
+			if !IsArtifactForArch(meta, bin, nodeArch) {
+				continue
+			}
+			if err := writePkgFileToNode(target, pkg, meta, types.ArtifactBin, bin, cfg.InstallOptions.Variables); err != nil {
 				return err
 			}
 		}
@@ -87,7 +112,10 @@ func SyncPackageToNode(target types.Node, pkg types.Package, cfg *types.InstallC
 	if len(meta.Manifest.Scripts) > 0 {
 		log.Info("Installing scripts to", types.K3sScriptsDir)
 		for _, script := range meta.Manifest.Scripts {
-			if err := writePkgFileToNode(target, pkg, types.ArtifactScript, path.Base(script), types.K3sScriptsDir, "0755", cfg.InstallOptions.Variables); err != nil {
+			if !IsArtifactForArch(meta, script, nodeArch) {
+				continue
+			}
+			if err := writePkgFileToNode(target, pkg, meta, types.ArtifactScript, script, cfg.InstallOptions.Variables); err != nil {
 				return err
 			}
 		}
@@ -96,7 +124,10 @@ func SyncPackageToNode(target types.Node, pkg types.Package, cfg *types.InstallC
 	if len(meta.Manifest.Images) > 0 {
 		log.Info("Installing images to", types.K3sImagesDir)
 		for _, imgs := range meta.Manifest.Images {
-			if err := writePkgFileToNode(target, pkg, types.ArtifactImages, path.Base(imgs), types.K3sImagesDir, "0644", cfg.InstallOptions.Variables); err != nil {
+			if !IsArtifactForArch(meta, imgs, nodeArch) {
+				continue
+			}
+			if err := writePkgFileToNode(target, pkg, meta, types.ArtifactImages, imgs, cfg.InstallOptions.Variables); err != nil {
 				return err
 			}
 		}
@@ -105,7 +136,7 @@ func SyncPackageToNode(target types.Node, pkg types.Package, cfg *types.InstallC
 	if len(meta.Manifest.K8sManifests) > 0 {
 		log.Info("Installing manifests to", types.K3sManifestsDir)
 		for _, mani := range meta.Manifest.K8sManifests {
-			if err := writePkgFileToNode(target, pkg, types.ArtifactManifest, mani, types.K3sManifestsDir, "0644", cfg.InstallOptions.Variables); err != nil {
+			if err := writePkgFileToNode(target, pkg, meta, types.ArtifactManifest, mani, cfg.InstallOptions.Variables); err != nil {
 				return err
 			}
 		}
@@ -115,7 +146,7 @@ func SyncPackageToNode(target types.Node, pkg types.Package, cfg *types.InstallC
 		log.Info("Installing static content to", types.K3sStaticDir)
 		for _, static := range meta.Manifest.Static {
 			static = strings.TrimPrefix(static, "static/") // ugly hack, should fix to come back without the prefix
-			if err := writePkgFileToNode(target, pkg, types.ArtifactStatic, static, types.K3sStaticDir, "0644", cfg.InstallOptions.Variables); err != nil {
+			if err := writePkgFileToNode(target, pkg, meta, types.ArtifactStatic, static, cfg.InstallOptions.Variables); err != nil {
 				return err
 			}
 		}
@@ -124,36 +155,209 @@ func SyncPackageToNode(target types.Node, pkg types.Package, cfg *types.InstallC
 	if len(meta.Manifest.Etc) > 0 {
 		log.Info("Installing configuration files to", types.K3sEtcDir)
 		for _, etc := range meta.Manifest.Etc {
-			if err := writePkgFileToNode(target, pkg, types.ArtifactEtc, etc, types.K3sEtcDir, "0644", cfg.InstallOptions.Variables); err != nil {
+			if err := writePkgFileToNode(target, pkg, meta, types.ArtifactEtc, etc, cfg.InstallOptions.Variables); err != nil {
 				return err
 			}
 		}
 	}
 
+	return WriteInstallConfig(target, cfg)
+}
+
+// GetNodeArch returns the architecture of the given node, making sure the package was built
+// for it. If the package does not record its architecture, an empty string is returned.
+func GetNodeArch(target types.Node, meta *types.PackageMeta) (string, error) {
+	archs := meta.GetArchs()
+	if len(archs) == 0 {
+		return "", nil
+	}
+	nodeArch, err := target.GetArch()
+	if err != nil {
+		return "", err
+	}
+	for _, arch := range archs {
+		if arch == nodeArch {
+			if meta.IsMultiArch() {
+				log.Infof("Installing the %q artifacts for the node\n", nodeArch)
+			}
+			return nodeArch, nil
+		}
+	}
+	return "", fmt.Errorf("The package was built for %q, but the node is %q", meta.GetArch(), nodeArch)
+}
+
+// IsArtifactForArch returns true if the artifact with the given name (relative to the directory
+// for its type) should be installed to a node with the given architecture.
+func IsArtifactForArch(meta *types.PackageMeta, name, arch string) bool {
+	artifactArch := meta.GetArtifactArch(name)
+	return artifactArch == "" || artifactArch == arch
+}
+
+// WriteInstallConfig writes the configuration used for an installation to the node, so it can be
+// used for future node-add/join operations.
+func WriteInstallConfig(target types.Node, cfg *types.InstallConfig) error {
 	out, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
 		return err
 	}
-
 	rdr := ioutil.NopCloser(bytes.NewReader(out))
-	if err := target.WriteFile(rdr, types.InstalledConfigFile, "0644", int64(len(out))); err != nil {
+	return target.WriteFile(rdr, types.InstalledConfigFile, "0644", int64(len(out)))
+}
+
+// GetInstalledPackages returns the record of packages installed on the cluster kept on the node.
+// It is empty if the node has no record.
+func GetInstalledPackages(target types.Node) ([]types.InstalledPackage, error) {
+	rdr, err := target.GetFile(types.InstalledPackagesFile)
+	if err != nil {
+		log.Debugf("Could not read %s from the node, assuming no packages are installed: %s\n", types.InstalledPackagesFile, err.Error())
+		return nil, nil
+	}
+	defer rdr.Close()
+	body, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	var installed []types.InstalledPackage
+	if len(bytes.TrimSpace(body)) == 0 {
+		// remote nodes return an empty file when it does not exist
+		return nil, nil
+	}
+	if err := json.Unmarshal(body, &installed); err != nil {
+		return nil, fmt.Errorf("The record of installed packages on the node is not valid: %s", err.Error())
+	}
+	return installed, nil
+}
+
+// WriteInstalledPackages writes the record of packages installed on the cluster to the node.
+func WriteInstalledPackages(target types.Node, installed []types.InstalledPackage) error {
+	out, err := json.MarshalIndent(installed, "", "  ")
+	if err != nil {
 		return err
 	}
+	rdr := ioutil.NopCloser(bytes.NewReader(out))
+	return target.WriteFile(rdr, types.InstalledPackagesFile, "0644", int64(len(out)))
+}
 
-	return nil
+// RecordInstalledPackage adds the package with the given metadata to the record of installed
+// packages on the node, replacing any other version of it.
+func RecordInstalledPackage(target types.Node, meta *types.PackageMeta) error {
+	installed, err := GetInstalledPackages(target)
+	if err != nil {
+		return err
+	}
+	entry := types.InstalledPackage{
+		Name:        meta.GetName(),
+		Version:     meta.GetVersion(),
+		K3sVersion:  meta.GetK3sVersion(),
+		InstalledAt: time.Now().UTC().Truncate(time.Second),
+	}
+	out := []types.InstalledPackage{entry}
+	for _, pkg := range installed {
+		if pkg.Name != entry.Name {
+			out = append(out, pkg)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return WriteInstalledPackages(target, out)
 }
 
-func writePkgFileToNode(target types.Node, pkg types.Package, t types.ArtifactType, name, destDir, mode string, vars map[string]string) error {
+func writePkgFileToNode(target types.Node, pkg types.Package, meta *types.PackageMeta, t types.ArtifactType, name string, vars map[string]string) error {
 	artifact := &types.Artifact{Type: t, Name: name}
 	if err := pkg.Get(artifact); err != nil {
 		return err
 	}
-	if t == types.ArtifactManifest && len(vars) > 0 {
+	return WriteArtifactToNode(target, meta, artifact, vars)
+}
+
+// IsNodeArtifact returns true if artifacts of the given type are installed to nodes.
+func IsNodeArtifact(t types.ArtifactType) bool {
+	switch t {
+	case types.ArtifactBin, types.ArtifactScript, types.ArtifactImages,
+		types.ArtifactManifest, types.ArtifactStatic, types.ArtifactEtc:
+		return true
+	}
+	return false
+}
+
+// StagingPath returns the path next to the given destination that its contents are written to
+// before they are moved into place. The name is hidden and has no extension so k3s does not pick
+// the file up in the meantime.
+func StagingPath(dest string) string {
+	return path.Join(path.Dir(dest), fmt.Sprintf(".%s.k3p-tmp", path.Base(dest)))
+}
+
+// WriteArtifactToNode writes the given artifact to the directory it is installed to on a k3s node.
+// Kubernetes manifests are templated with the given variables. Artifacts declared in the files of
+// the package configuration are installed with the mode, destination and templating declared there.
+func WriteArtifactToNode(target types.Node, meta *types.PackageMeta, artifact *types.Artifact, vars map[string]string) error {
+	var destDir, mode string
+	switch artifact.Type {
+	case types.ArtifactBin:
+		destDir, mode = types.K3sBinDir, "0755"
+	case types.ArtifactScript:
+		destDir, mode = types.K3sScriptsDir, "0755"
+	case types.ArtifactImages:
+		destDir, mode = types.K3sImagesDir, "0644"
+	case types.ArtifactManifest:
+		destDir, mode = types.K3sManifestsDir, "0644"
+	case types.ArtifactStatic:
+		destDir, mode = types.K3sStaticDir, "0644"
+	case types.ArtifactEtc:
+		destDir, mode = types.K3sEtcDir, "0644"
+	default:
+		artifact.Body.Close()
+		return fmt.Errorf("%s artifact %q cannot be installed to a node", artifact.Type, artifact.Name)
+	}
+	template := artifact.Type == types.ArtifactManifest && len(vars) > 0
+	name := artifact.Name
+	switch artifact.Type {
+	case types.ArtifactBin, types.ArtifactScript, types.ArtifactImages:
+		// these directories are flat, architecture specific artifacts are stored in a
+		// directory named after their architecture inside the package
+		name = path.Base(name)
+	}
+	dest := path.Join(destDir, name)
+	if file := meta.GetPackageFile(artifact.Type, strings.TrimPrefix(artifact.Name, "static/")); file != nil {
+		fileMode, err := file.NodeMode()
+		if err != nil {
+			artifact.Body.Close()
+			return err
+		}
+		if fileMode != "" {
+			mode = fileMode
+		}
+		if file.Destination != "" {
+			dest = file.Destination
+		}
+		template = file.Template
+	}
+	if template {
 		if err := artifact.ApplyVariables(vars); err != nil {
 			return err
 		}
 	}
-	return target.WriteFile(artifact.Body, path.Join(destDir, artifact.Name), mode, artifact.Size)
+	defer artifact.Body.Close()
+	// The contents are only verified once they have been read to the end, so they are written
+	// next to the destination first and only moved into place once they are known to be intact.
+	tmpDest := StagingPath(dest)
+	if err := writeVerifiedFile(target, artifact, tmpDest, mode); err != nil {
+		if rerr := target.Remove(tmpDest); rerr != nil {
+			log.Warningf("Could not remove %q from the node: %s\n", tmpDest, rerr.Error())
+		}
+		return err
+	}
+	return target.Rename(tmpDest, dest)
+}
+
+// writeVerifiedFile writes the contents of the artifact to the given path on the node, and returns
+// an error if they do not match the digest in the package metadata.
+func writeVerifiedFile(target types.Node, artifact *types.Artifact, dest, mode string) error {
+	if err := target.WriteFile(ioutil.NopCloser(artifact.Body), dest, mode, artifact.Size); err != nil {
+		return err
+	}
+	// read anything the node did not, so the digest is checked at the end of the contents
+	_, err := io.Copy(ioutil.Discard, artifact.Body)
+	return err
 }
 
 type tmpReadCloser struct {
@@ -1,18 +1,24 @@
 package util
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+
+	"github.com/tinyzimmer/k3p/pkg/log"
 )
 
 func TestUtils(t *testing.T) {
+	log.LogWriter = GinkgoWriter
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Utils Suite")
 }
@@ -153,4 +159,62 @@ var _ = Describe("Utils", func() {
 		})
 	})
 
+	// RunTasks()
+	Describe("Running Tasks in Parallel", func() {
+		var (
+			tasks            []Task
+			running, maxSeen int32
+			err              error
+		)
+
+		newTask := func(name string, taskErr error) Task {
+			return Task{Name: name, Run: func() error {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					seen := atomic.LoadInt32(&maxSeen)
+					if n <= seen || atomic.CompareAndSwapInt32(&maxSeen, seen, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				return taskErr
+			}}
+		}
+
+		BeforeEach(func() { running, maxSeen = 0, 0 })
+		JustBeforeEach(func() { err = RunTasks(3, tasks) })
+
+		Context("When all the tasks succeed", func() {
+			BeforeEach(func() {
+				tasks = make([]Task, 10)
+				for i := range tasks {
+					tasks[i] = newTask("task", nil)
+				}
+			})
+			It("Should run at most the given number of tasks at once", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(maxSeen).To(BeNumerically(">", 1))
+				Expect(maxSeen).To(BeNumerically("<=", 3))
+			})
+		})
+
+		Context("When some of the tasks fail", func() {
+			BeforeEach(func() {
+				tasks = []Task{
+					newTask("pulling a", errors.New("not found")),
+					newTask("pulling b", nil),
+					newTask("pulling c", errors.New("timed out")),
+				}
+			})
+			It("Should return the errors of every failed task in order", func() {
+				Expect(err).To(HaveOccurred())
+				errs, ok := err.(TaskErrors)
+				Expect(ok).To(BeTrue())
+				Expect(errs).To(HaveLen(2))
+				Expect(err.Error()).To(Equal("2 tasks failed:\n\tpulling a: not found\n\tpulling c: timed out"))
+			})
+		})
+	})
+
 })